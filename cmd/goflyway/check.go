@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+	"github.com/coyove/goflyway/proxy"
+)
+
+// checkConfig validates the config file and flags without starting any listener,
+// every problem found is reported and the number of them is returned
+func checkConfig() int {
+	problems := 0
+	report := func(what string, err error) {
+		if err != nil {
+			problems++
+			fmt.Printf("* %-12s FAIL  %v\n", what, err)
+		} else {
+			fmt.Printf("* %-12s OK\n", what)
+		}
+	}
+
+	if *cmdConfig != "" {
+		buf, err := ioutil.ReadFile(*cmdConfig)
+		if err == nil && !proxy.IsEncryptedConfig(buf) { // encrypted ones have been decrypted by loadConfig
+
+			if strings.Contains(*cmdConfig, "shadowsocks.conf") {
+				err = json.Unmarshal(buf, &map[string]interface{}{})
+			} else {
+				_, err = config.ParseConf(string(buf))
+			}
+		}
+		report("config", err)
+	}
+
+	switch *cmdLogLevel {
+	case "dbg", "log", "warn", "err", "off", "pp":
+		report("log level", nil)
+	default:
+		report("log level", errors.New("unexpected log level: "+*cmdLogLevel))
+	}
+
+	if key, err := loadKey(*cmdKey); err != nil {
+		report("password", err)
+	} else if key == defaultKey {
+		report("password", errors.New("the default password is in use"))
+	} else {
+		report("password", nil)
+	}
+
+	if *cmdEpochs != "" {
+		_, err := proxy.NewKeyEpochs("", *cmdEpochs)
+		report("key epochs", err)
+	}
+
+	if *cmdAuth != "" && !strings.Contains(*cmdAuth, ":") {
+		report("users", errors.New("auth should be username:password"))
+	} else {
+		report("users", nil)
+	}
+
+	localaddr := *cmdLocal
+	if *cmdLocal2 != "" {
+		localaddr = *cmdLocal2
+	}
+	var err error
+	for _, addr := range strings.Split(localaddr, ",") {
+		if _, _, err = net.SplitHostPort(strings.TrimSpace(addr)); err != nil {
+			break
+		}
+	}
+	report("listen", err)
+
+	if *cmdOTLP != "" {
+		_, err := proxy.NewTracer(*cmdOTLP, "")
+		report("otlp", err)
+	}
+
+	if *cmdAuditHook != "" {
+		_, err := proxy.NewAudit("", *cmdAuditHook)
+		report("audit webhook", err)
+	}
+
+	if *cmdKCPHop != "" {
+		_, err := proxy.ParsePortHop(*cmdKCPHop, "")
+		report("kcp hop", err)
+	}
+
+	if *cmdECH != "" {
+		_, err := base64.StdEncoding.DecodeString(*cmdECH)
+		report("ech", err)
+	}
+
+	if *cmdECHKey != "" && *cmdACME == "" {
+		report("ech key", errors.New("-ech-key needs TLS by -acme"))
+	}
+
+	if *cmdUpstream != "" {
+		report("upstream", checkUpstream(*cmdUpstream))
+
+		if *cmdAltUp != "" {
+			for _, up := range strings.Split(*cmdAltUp, ",") {
+				report("upstream", checkUpstream(up))
+			}
+		}
+
+		acl, err := aclrouter.LoadACL(*cmdACL)
+		if err == nil && len(acl.OmitRules) > 0 {
+			err = fmt.Errorf("invalid rules: %v", acl.OmitRules)
+		}
+		report("acl", err)
+
+		for what, path := range map[string]string{"hosts": *cmdHosts, "dns rewrite": *cmdDNSRewrite} {
+			if path != "" {
+				_, err := proxy.LoadHosts(path)
+				report(what, err)
+			}
+		}
+
+		if *cmdMaxLine != 0 && *cmdMaxLine < 128 {
+			report("request line", errors.New("-max-request-line should be at least 128"))
+		}
+
+		if *cmdFakeIP != "" {
+			_, err := proxy.NewFakeIP(*cmdFakeIP)
+			report("fake ip", err)
+		}
+
+		for _, specs := range []string{*cmdLocalFwd, *cmdRemoteFwdC, *cmdUDPFwd} {
+			for _, spec := range strings.Split(specs, ",") {
+				if spec != "" {
+					_, _, err := proxy.ParseForward(spec)
+					report("forwarding", err)
+				}
+			}
+		}
+	} else {
+		_, err := proxy.ParseThrottlingScope(*cmdThrotBy)
+		report("throttling", err)
+
+		for _, ip := range strings.Split(*cmdBan, ",") {
+			if ip != "" && net.ParseIP(ip) == nil {
+				report("ban", errors.New("invalid IP: "+ip))
+			}
+		}
+
+		if *cmdBanV4Len < 1 || *cmdBanV4Len > 32 || *cmdBanV6Len < 1 || *cmdBanV6Len > 128 {
+			report("ban prefix", errors.New("-ban-prefix-v4 should be 1 to 32 and -ban-prefix-v6 1 to 128"))
+		}
+
+		if *cmdUsers != "" {
+			_, err := proxy.LoadUsers(*cmdUsers)
+			report("users file", err)
+		}
+
+		if *cmdNAT64 != "" {
+			_, err := proxy.ParseNAT64(*cmdNAT64)
+			report("nat64", err)
+		}
+
+		if *cmdResolvers != "" {
+			_, err := proxy.ParseResolver(*cmdResolvers)
+			report("resolver", err)
+		}
+
+		if *cmdSSHJumps != "" {
+			_, err := proxy.LoadSSHJumps(*cmdSSHJumps)
+			report("ssh jump", err)
+		}
+
+		if *cmdWireGuard != "" {
+			_, err := proxy.LoadWireGuard(*cmdWireGuard)
+			report("wireguard", err)
+		}
+
+		if *cmdShared != "" {
+			state, err := proxy.NewRedisState(*cmdShared)
+			if err == nil {
+				err = state.Ping()
+			}
+			report("shared state", err)
+		}
+
+		if *cmdClasses != "" {
+			_, err := proxy.LoadTrafficClasses(*cmdClasses)
+			report("classes", err)
+		}
+
+		if *cmdTenants != "" {
+			_, err := proxy.LoadTenants(*cmdTenants)
+			report("tenants", err)
+		}
+
+		if *cmdHotOrigin != "" {
+			_, err := aclrouter.NewHostMatcher(strings.Split(*cmdHotOrigin, ","))
+			report("hot origins", err)
+		}
+
+		if strings.HasPrefix(*cmdProxyPass, "http") {
+			_, err := url.Parse(*cmdProxyPass)
+			report("proxy pass", err)
+		} else if *cmdProxyPass != "" {
+			_, err := os.Stat(*cmdProxyPass)
+			report("proxy pass", err)
+		}
+
+		if *cmdSOCKS != "" {
+			host, _, err := net.SplitHostPort(*cmdSOCKS)
+			if ip := net.ParseIP(host); err == nil && *cmdAuth == "" && *cmdUsers == "" && (ip == nil || !ip.IsLoopback()) && host != "localhost" {
+				err = errors.New("-socks without -a or -users must listen on a loopback address")
+			}
+			report("socks", err)
+		}
+
+		if (*cmdSync == "") != (*cmdSyncPeer == "") {
+			report("sync", errors.New("-sync and -sync-peer go together"))
+		} else if *cmdSync != "" {
+			_, _, err := net.SplitHostPort(*cmdSync)
+			report("sync", err)
+		}
+
+		if *cmdAdminAPI != "" {
+			_, _, err := net.SplitHostPort(*cmdAdminAPI)
+			if err == nil && *cmdAdminTok == "" {
+				err = errors.New("-admin-api needs -admin-token")
+			}
+			report("admin api", err)
+		}
+
+		if *cmdProfDir != "" {
+			_, err := os.Stat(*cmdProfDir)
+			report("profile dir", err)
+		}
+	}
+
+	return problems
+}
+
+// checkUpstream validates the upstream URL and resolves its host
+func checkUpstream(up string) error {
+	if idx := strings.Index(up, "://"); idx > -1 {
+		switch up[:idx] {
+		case "https", "gfw", "http", "ws", "cf", "fwd", "fwds":
+		case "vless":
+			if _, _, err := proxy.ParseVLESS(up); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown scheme: " + up[:idx])
+		}
+		up = up[idx+3:]
+	}
+
+	if idx := strings.Index(up, "/"); idx > -1 {
+		up = up[:idx]
+	}
+
+	if idx := strings.Index(up, "@"); idx > -1 {
+		up = up[idx+1:]
+	}
+
+	host, _, err := net.SplitHostPort(up)
+	if err != nil {
+		return err
+	}
+
+	if net.ParseIP(host) == nil {
+		_, err = net.LookupHost(host)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// runCheck runs checkConfig with flags set and returns the problems with what is printed
+func runCheck(t *testing.T, flags map[string]string) (int, string) {
+	for name, value := range flags {
+		f := flag.Lookup(name)
+		defer f.Value.Set(f.Value.String())
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+
+	out, _ := ioutil.TempFile("", "check")
+	defer os.Remove(out.Name())
+
+	stdout := os.Stdout
+	os.Stdout = out
+	n := checkConfig()
+	os.Stdout = stdout
+
+	buf, _ := ioutil.ReadFile(out.Name())
+	out.Close()
+	return n, string(buf)
+}
+
+func TestCheckConfig(t *testing.T) {
+	if n, out := runCheck(t, map[string]string{"k": "a strong key"}); n != 0 || !strings.Contains(out, "password     OK") {
+		t.Error("the server should pass:", n, out)
+	}
+
+	if n, out := runCheck(t, nil); n != 1 || !strings.Contains(out, "password     FAIL  the default password is in use") {
+		t.Error("the default password should be reported:", n, out)
+	}
+
+	// every problem is reported, not only the first one
+	n, out := runCheck(t, map[string]string{
+		"k":     "a strong key",
+		"lv":    "verbose",
+		"ban":   "1.2.3.4,1.2.3.x",
+		"socks": "0.0.0.0:1080",
+	})
+	if n != 3 {
+		t.Error("the server should have 3 problems:", n, out)
+	}
+	for _, line := range []string{"log level    FAIL", "ban          FAIL  invalid IP: 1.2.3.x", "socks        FAIL"} {
+		if !strings.Contains(out, line) {
+			t.Error("should be reported:", line, out)
+		}
+	}
+
+	acl, _ := ioutil.TempFile("", "acl")
+	acl.Close()
+	defer os.Remove(acl.Name())
+
+	n, out = runCheck(t, map[string]string{
+		"k":   "a strong key",
+		"up":  "ftp://127.0.0.1:8100",
+		"L":   "8080:127.0.0.1:80,8080",
+		"acl": acl.Name(),
+	})
+	if n != 2 || !strings.Contains(out, "upstream     FAIL  unknown scheme: ftp") || !strings.Contains(out, "forwarding   FAIL") {
+		t.Error("the client should have 2 problems:", n, out)
+	}
+
+	if n, out := runCheck(t, map[string]string{"k": "a strong key", "up": "127.0.0.1:8100", "acl": acl.Name()}); n != 0 {
+		t.Error("the client should pass:", n, out)
+	}
+}
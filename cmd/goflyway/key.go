@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	"github.com/coyove/goflyway/proxy"
+)
+
+const (
+	defaultKey = "0123456789abcdef"
+	keyEnv     = "GOFLYWAY_KEY" // used if -k is not given, so the key won't show up in ps
+)
+
+// configFiles reads config files and keys for -c and -k, and for proxy.NewServerFromConfig and
+// proxy.NewClientFromConfig alike: encrypted configs are opened by the passphrase in the OS keychain
+// or prompted, 'keychain' keys are read from the OS keychain (see -keychain)
+var configFiles = &proxy.ConfigFiles{
+	Passphrase: func(path string) (string, error) { return configPassphrase("passphrase of " + path + ": ") },
+	Keychain:   keychainGet,
+}
+
+// loadKey resolves the key given by -k or GOFLYWAY_KEY, see proxy.ConfigFiles.Key
+func loadKey(k string) (string, error) {
+	if env := os.Getenv(keyEnv); k == defaultKey && env != "" {
+		k = env
+	}
+	return configFiles.Key(k)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/coyove/goflyway/proxy"
+)
+
+func TestLoadKey(t *testing.T) {
+	os.Unsetenv(keyEnv)
+
+	file := func(buf []byte) string {
+		f, _ := ioutil.TempFile("", "key")
+		f.Write(buf)
+		f.Close()
+		return f.Name()
+	}
+
+	binary := make([]byte, 32)
+	for i := range binary {
+		binary[i] = byte(i * 7)
+	}
+	text := []byte("0123456789abcdef0123456789abcdef") // 32 bytes but a passphrase
+
+	pass, bin, txt, empty := file([]byte("  my pass phrase \nignored\n")), file(binary), file(text), file([]byte("\n"))
+	for _, f := range []string{pass, bin, txt, empty} {
+		defer os.Remove(f)
+	}
+
+	for _, c := range []struct {
+		k, key string
+		fails  bool
+	}{
+		{"secret", "secret", false},
+		{"@" + pass, "my pass phrase", false},
+		{"@" + bin, string(binary), false},
+		{"@" + txt, string(text), false},
+		{"@" + empty, "", true},
+		{"@" + pass + ".nonexist", "", true},
+	} {
+		if key, err := loadKey(c.k); (err != nil) != c.fails || key != c.key {
+			t.Errorf("%s: %q, %v", c.k, key, err)
+		}
+	}
+
+	// the environment is read only if -k is not given
+	os.Setenv(keyEnv, "@"+pass)
+	defer os.Unsetenv(keyEnv)
+	if key, err := loadKey(defaultKey); err != nil || key != "my pass phrase" {
+		t.Error("the key should be read from "+keyEnv, key, err)
+	}
+	if key, _ := loadKey("secret"); key != "secret" {
+		t.Error("-k should win over "+keyEnv, key)
+	}
+
+	// binary keys are keys of the cipher as is
+	key, _ := loadKey("@" + bin)
+	c1, c2, other := &proxy.Cipher{}, &proxy.Cipher{}, &proxy.Cipher{}
+	c1.Init(key)
+	c2.Init(string(binary))
+	other.Init(string(text))
+
+	enc := c1.EncryptString("hello")
+	if c2.DecryptString(enc) != "hello" || other.DecryptString(enc) == "hello" {
+		t.Error("the binary key should be usable:", enc)
+	}
+}
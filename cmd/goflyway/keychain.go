@@ -0,0 +1,89 @@
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var errNoKeychain = errors.New("no keychain on this system")
+
+// keychainGet reads a secret from the macOS Keychain or the Secret Service (libsecret) on Linux,
+// stored under service "goflyway" and the account
+func keychainGet(account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keychainSvc, "-a", account, "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", keychainSvc, "account", account)
+	default:
+		return "", errNoKeychain
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", errors.New("no " + account + " in the keychain")
+	}
+	return secret, nil
+}
+
+// keychainSet stores a secret, it is passed through stdin so it won't show up in ps
+func keychainSet(account, secret string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		line, err := securityLine("add-generic-password", "-U", "-s", keychainSvc, "-a", account, "-w", secret)
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(line)
+	case "linux":
+		cmd = exec.Command("secret-tool", "store", "--label="+keychainSvc+" "+account, "service", keychainSvc, "account", account)
+		cmd.Stdin = strings.NewReader(secret)
+	default:
+		return errNoKeychain
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil && len(out) > 0 {
+		return errors.New(err.Error() + ": " + strings.TrimSpace(string(out)))
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// securityLine returns the command line of args read by "security -i", each of them double quoted
+// with backslashes escaping quotes and backslashes, so spaces and quotes in them survive its tokenizer
+func securityLine(args ...string) (string, error) {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if strings.ContainsAny(a, "\r\n\x00") {
+			return "", errors.New("the keychain can't store line breaks or NULs")
+		}
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a) + `"`
+	}
+	return strings.Join(quoted, " ") + "\n", nil
+}
+
+func keychainDelete(account string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "delete-generic-password", "-s", keychainSvc, "-a", account)
+	case "linux":
+		cmd = exec.Command("secret-tool", "clear", "service", keychainSvc, "account", account)
+	default:
+		return errNoKeychain
+	}
+	return cmd.Run()
+}
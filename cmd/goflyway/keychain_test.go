@@ -0,0 +1,58 @@
+// +build !windows
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// splitSecurityLine splits a line like the tokenizer of "security -i": quotes group words, backslashes escape the next byte
+func splitSecurityLine(line string) []string {
+	var args []string
+	var arg []byte
+	quote, in := byte(0), false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line):
+			i++
+			arg, in = append(arg, line[i]), true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote, in = c, true
+		case quote == 0 && (c == ' ' || c == '\t' || c == '\n'):
+			if in {
+				args, arg, in = append(args, string(arg)), nil, false
+			}
+		default:
+			arg, in = append(arg, c), true
+		}
+	}
+	return args
+}
+
+func TestSecurityLine(t *testing.T) {
+	line, err := securityLine("-a", "my account", "-w", "")
+	if err != nil || line != `"-a" "my account" "-w" ""`+"\n" {
+		t.Fatal(line, err)
+	}
+
+	for _, secret := range []string{"plain", "two words", `say "hi"`, `back\slash\`, "it's", "  spaces  ", "密码 ü"} {
+		args := []string{"add-generic-password", "-U", "-s", keychainSvc, "-a", "a b", "-w", secret}
+		line, err := securityLine(args...)
+		if err != nil {
+			t.Fatal(secret, err)
+		}
+
+		if got := splitSecurityLine(line); !reflect.DeepEqual(got, args) {
+			t.Errorf("%q is read as %q", secret, got)
+		}
+	}
+
+	for _, bad := range []string{"a\nb", "a\rb", "a\x00b"} {
+		if _, err := securityLine("-w", bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+var (
+	advapi32      = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead  = advapi32.NewProc("CredReadW")
+	procCredWrite = advapi32.NewProc("CredWriteW")
+	procCredDel   = advapi32.NewProc("CredDeleteW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// credential is CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func credTarget(account string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(keychainSvc + ":" + account)
+	return p
+}
+
+// keychainGet reads a generic credential named goflyway:<account> from the Windows Credential Manager
+func keychainGet(account string) (string, error) {
+	var c *credential
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(credTarget(account))), credTypeGeneric, 0, uintptr(unsafe.Pointer(&c)))
+	if r == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(c)))
+
+	blob := (*[1 << 20]byte)(unsafe.Pointer(c.CredentialBlob))[:c.CredentialBlobSize:c.CredentialBlobSize]
+	return string(blob), nil
+}
+
+func keychainSet(account, secret string) error {
+	blob := []byte(secret)
+	c := &credential{
+		Type:               credTypeGeneric,
+		TargetName:         credTarget(account),
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+	}
+	if len(blob) > 0 {
+		c.CredentialBlob = &blob[0]
+	}
+
+	if r, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(c)), 0); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func keychainDelete(account string) error {
+	if r, _, err := procCredDel.Call(uintptr(unsafe.Pointer(credTarget(account))), credTypeGeneric, 0); r == 0 {
+		return err
+	}
+	return nil
+}
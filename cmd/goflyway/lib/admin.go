@@ -0,0 +1,310 @@
+package lib
+
+import (
+	pp "github.com/coyove/goflyway/proxy"
+
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerAdminHTTPHandler serves the blacklist of the server:
+// GET lists all entries as JSON, or the banned IPs and networks with format=plain, one per line for fail2ban
+// and scripts, or format=ipset, an ipset restore script of the sets named set-v4 and set-v6 (set=goflyway).
+// POST ban=<ip> or unban=<ip> modifies them, saved at once if the blacklist is kept in a file
+func ServerAdminHTTPHandler(server *pp.ProxyUpstream) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			switch r.FormValue("format") {
+			case "plain":
+				w.Header().Add("Content-Type", "text/plain")
+				for _, addr := range server.Banned() {
+					fmt.Fprintln(w, addr)
+				}
+			case "ipset":
+				w.Header().Add("Content-Type", "text/plain")
+				writeIPSet(w, r.FormValue("set"), server.Banned())
+			default:
+				w.Header().Add("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(server.Blacklist())
+			}
+			return
+		}
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if ip := r.FormValue("ban"); net.ParseIP(ip) != nil {
+			server.Ban(ip)
+			saveBlacklist(w, server)
+			return
+		}
+
+		if ip := r.FormValue("unban"); net.ParseIP(ip) != nil {
+			server.Unban(ip)
+			saveBlacklist(w, server)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error"))
+	}
+}
+
+func saveBlacklist(w http.ResponseWriter, server *pp.ProxyUpstream) {
+	if err := server.SaveBlacklist(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// writeIPSet writes the restore script replacing the members of the sets of banned IPs,
+// used like: curl .../blacklist?format=ipset | ipset restore, with iptables rules matching the sets
+func writeIPSet(w io.Writer, set string, banned []string) {
+	if set == "" {
+		set = "goflyway"
+	}
+
+	for _, family := range []string{"inet", "inet6"} {
+		name := set + map[string]string{"inet": "-v4", "inet6": "-v6"}[family]
+		fmt.Fprintf(w, "create %s hash:net family %s -exist\n", name, family)
+		fmt.Fprintf(w, "flush %s\n", name)
+
+		for _, addr := range banned {
+			ip := net.ParseIP(strings.Split(addr, "/")[0])
+			if ip != nil && (ip.To4() != nil) == (family == "inet") {
+				fmt.Fprintf(w, "add %s %s -exist\n", name, addr)
+			}
+		}
+	}
+}
+
+// ServerMetricsHTTPHandler serves traffic per user, blacklist and DNS counters, stream and dial latency histograms,
+// watchdog samples and the clock skew in the Prometheus text format, with public set users are labelled by hashes
+func ServerMetricsHTTPHandler(server *pp.ProxyUpstream, public bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+		if public {
+			server.ExposeHashed(w)
+		} else {
+			server.Expose(w)
+		}
+		server.Cipher.IO.Lat.Expose(w)
+		server.Watchdog.Expose(w)
+
+		if skew, ok := server.ClockSkew(); ok {
+			fmt.Fprintf(w, "# HELP goflyway_clock_skew_seconds Estimated offset of the clients' clocks against the server.\n")
+			fmt.Fprintf(w, "# TYPE goflyway_clock_skew_seconds gauge\ngoflyway_clock_skew_seconds %g\n", skew.Seconds())
+		}
+	}
+}
+
+// ServerNoticeHTTPHandler broadcasts POST msg=<text> to all connected clients
+func ServerNoticeHTTPHandler(server *pp.ProxyUpstream) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg := r.FormValue("msg")
+		if r.Method != "POST" || msg == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("error"))
+			return
+		}
+
+		fmt.Fprint(w, server.Broadcast(msg))
+	}
+}
+
+// ServerDrainHTTPHandler marks the server as draining before maintenance:
+// POST [retry=<sec>] starts draining, DELETE stops it, GET tells whether it is draining
+func ServerDrainHTTPHandler(server *pp.ProxyUpstream) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			retry, _ := strconv.Atoi(r.FormValue("retry"))
+			server.Drain(time.Duration(retry) * time.Second)
+		case "DELETE":
+			server.Undrain()
+		case "GET":
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		d, draining := server.Draining()
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"draining": draining, "retry_after": int(d / time.Second)})
+	}
+}
+
+// ServerTenantHTTPHandler serves the stats of the tenant presenting its token by "Authorization: Bearer <token>",
+// a tenant can't see other tenants or the rest of the server
+func ServerTenantHTTPHandler(server *pp.ProxyUpstream) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stat, err := server.TenantStat(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("error"))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stat)
+	}
+}
+
+// ServerStatusHTTPHandler serves the state of the server as JSON
+func ServerStatusHTTPHandler(server *pp.ProxyUpstream, version string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := server.Status()
+		s.Version = version
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// ServerHealthHTTPHandler answers liveness probes, 200 as long as the process serves HTTP
+func ServerHealthHTTPHandler(server *pp.ProxyUpstream) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+}
+
+// ServerReadyHTTPHandler answers readiness probes, 503 before the server listens and while it is draining
+// or shutting down, so load balancers stop sending clients to it during rollouts
+func ServerReadyHTTPHandler(server *pp.ProxyUpstream) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !server.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// ServerAPIHandler serves the admin REST API of users and sessions to those presenting token by
+// "Authorization: Bearer <token>":
+// GET /users lists users with their traffic, POST /users auth=<username:password> [throttling=<bytes/s>
+// throttling_max=<bytes> from=<CIDR,IP...>] adds one, DELETE /users?name=<name> removes one and kills its sessions,
+// POST /users/throttling name=<name> throttling=<bytes/s> [throttling_max=<bytes>] changes it live,
+// GET /sessions [user=<name>] lists streams being bridged, DELETE /sessions?id=<id> kills one, GET /stats is /status.
+// Changes of users are not saved to the users file: added users last until the server restarts,
+// and users of the file removed come back on Reload
+func ServerAPIHandler(server *pp.ProxyUpstream, token, version string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, server.ListUsers())
+		case "POST":
+			var u pp.UserConfig
+			var err error
+			if u.Throttling, u.ThrottlingMax, err = parseThrottling(r); err == nil && r.FormValue("from") != "" {
+				u.Sources, err = pp.ParseSources(r.FormValue("from"))
+			}
+			if err == nil {
+				err = server.AddUser(r.FormValue("auth"), u)
+			}
+			apiError(w, err, http.StatusBadRequest)
+		case "DELETE":
+			if !server.RemoveUser(r.FormValue("name")) {
+				apiError(w, errors.New("no such user"), http.StatusNotFound)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/users/throttling", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		speed, max, err := parseThrottling(r)
+		if err == nil {
+			err = server.SetThrottling(r.FormValue("name"), speed, max)
+		}
+		apiError(w, err, http.StatusBadRequest)
+	})
+
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			list := []map[string]interface{}{}
+			for _, bi := range server.IO.OpenBridges() {
+				if user := r.FormValue("user"); user != "" && bi.User != user {
+					continue
+				}
+
+				// the client is the target of the bridge on the server, the destination is its source
+				dst := bi.Host
+				if dst == "" {
+					dst = bi.Source
+				}
+				list = append(list, map[string]interface{}{
+					"id": bi.ID, "user": bi.User, "source": bi.Target, "destination": dst,
+					"in": bi.In, "out": bi.Out, "age_seconds": bi.Age.Seconds(), "half_closed": bi.HalfClosed > 0,
+				})
+			}
+			writeJSON(w, list)
+		case "DELETE":
+			id, _ := strconv.ParseUint(r.FormValue("id"), 10, 64)
+			if !server.KillSession(id) {
+				apiError(w, errors.New("no such session"), http.StatusNotFound)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/stats", ServerStatusHTTPHandler(server, version))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("error"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func parseThrottling(r *http.Request) (speed, max int64, err error) {
+	for _, v := range []struct {
+		key string
+		n   *int64
+	}{{"throttling", &speed}, {"throttling_max", &max}} {
+		if s := r.FormValue(v.key); s != "" {
+			if *v.n, err = strconv.ParseInt(s, 10, 64); err != nil || *v.n < 0 {
+				return 0, 0, errors.New("invalid " + v.key + ": " + s)
+			}
+		}
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiError responds err with code, or 200 if err is nil
+func apiError(w http.ResponseWriter, err error, code int) {
+	if err != nil {
+		w.WriteHeader(code)
+		w.Write([]byte(err.Error()))
+	}
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pp "github.com/coyove/goflyway/proxy"
+)
+
+func TestServerAPIAuth(t *testing.T) {
+	c := &pp.Cipher{}
+	c.Init("12345678")
+	api := ServerAPIHandler(pp.NewServer("8101", &pp.ServerConfig{Cipher: c}), "secret", "test")
+
+	do := func(method, path, auth string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, auth := range []string{"", "secret", "Bearer wrong", "Basic secret", "bearer secret"} {
+		if w := do("GET", "/users", auth, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%q should be unauthorized, got %d", auth, w.Code)
+		}
+	}
+
+	if w := do("POST", "/users", "Bearer secret", url.Values{"auth": {"alice:pass"}}); w.Code != http.StatusOK {
+		t.Fatal("adding a user:", w.Code, w.Body.String())
+	}
+
+	if w := do("GET", "/users", "Bearer secret", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"alice"`) {
+		t.Error("listing users:", w.Code, w.Body.String())
+	}
+
+	for _, path := range []string{"/users", "/sessions", "/users/throttling"} {
+		if w := do("PUT", path, "Bearer secret", nil); w.Code != http.StatusMethodNotAllowed {
+			t.Error(path, "should not allow PUT, got", w.Code)
+		}
+	}
+}
+
+func TestServerBlacklistFormats(t *testing.T) {
+	c := &pp.Cipher{}
+	c.Init("12345678")
+	server := pp.NewServer("8101", &pp.ServerConfig{Cipher: c})
+	for _, addr := range []string{"1.2.3.4", "2001:db8::1", "10.0.0.0/24", "2001:db8:1::/64"} {
+		server.Ban(addr)
+	}
+	handler := ServerAdminHTTPHandler(server)
+
+	get := func(query string) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/blacklist?"+query, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/plain" {
+			t.Fatal(query, w.Code, w.Header())
+		}
+		return w.Body.String()
+	}
+
+	if plain := get("format=plain"); plain != "1.2.3.4\n10.0.0.0/24\n2001:db8:1::/64\n2001:db8::1\n" {
+		t.Errorf("plain:\n%s", plain)
+	}
+
+	if ipset := get("format=ipset"); ipset != `create goflyway-v4 hash:net family inet -exist
+flush goflyway-v4
+add goflyway-v4 1.2.3.4 -exist
+add goflyway-v4 10.0.0.0/24 -exist
+create goflyway-v6 hash:net family inet6 -exist
+flush goflyway-v6
+add goflyway-v6 2001:db8:1::/64 -exist
+add goflyway-v6 2001:db8::1 -exist
+` {
+		t.Errorf("ipset:\n%s", ipset)
+	}
+
+	if ipset := get("format=ipset&set=gfw"); !strings.HasPrefix(ipset, "create gfw-v4 hash:net family inet -exist\nflush gfw-v4\n") ||
+		!strings.Contains(ipset, "add gfw-v6 2001:db8::1 -exist\n") {
+		t.Errorf("ipset of the set gfw:\n%s", ipset)
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	c := &pp.Cipher{}
+	c.Init("12345678")
+	handler := ServerStatusHTTPHandler(pp.NewServer("8101", &pp.ServerConfig{Cipher: c}), "1.2.3")
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/status", nil))
+
+	var s pp.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal(w.Body.String(), err)
+	}
+	if s.Version != "1.2.3" || s.Role != "server" || s.Uptime <= 0 {
+		t.Error("unexpected status:", s)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	pp "github.com/coyove/goflyway/proxy"
 
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -54,6 +55,9 @@ var webConsoleHTML, _ = template.New("console").Parse(`<!DOCTYPE html>
         table#dns tr.traffic td            { padding: 0 }
         table#dns tr.last-tr               { visibility: hidden; }
         table#dns tr.last-tr td            { border: 0; }
+        table#notice                       { border-collapse: collapse; margin: 4px auto; width: 100%; max-width: 600px; background: #FFF8E1; }
+        table#notice td                    { border: solid 1px rgba(0,0,0,0.1); padding: 4px 8px; text-align: left; }
+        table#notice td.fit                { white-space: nowrap; width: 1px; color: #888; }
         .dropdown                          { position: relative; }
         .dropdown ul                       { padding: 0; margin: 0; list-style: none; display: none; position: absolute; right: 0; border: solid 1px #ccc; background: #f1f2f3; }
         .dropdown:hover ul                 { display: inherit; box-shadow: 0 1px 2px #ccc; }
@@ -125,7 +129,12 @@ var webConsoleHTML, _ = template.New("console").Parse(`<!DOCTYPE html>
         post(t + "=" + t, function() { location.reload(); });
     }
     </script>
-    
+
+    {{if .Notices}}<table id=notice>
+        <tr><th colspan=2>{{.I18N.Notice}}</th></tr>
+        {{range .Notices}}<tr><td class=fit>{{.Time.Format "01-02 15:04"}}</td><td>{{html .Text}}</td></tr>{{end}}
+    </table>{{end}}
+
     <table id=dns>
         <tr>
             <th class=fit colspan=2 style="position:relative;min-width:100px;height:100%;overflow:hidden;text-align:left">
@@ -190,6 +199,7 @@ var _i18n = map[string]map[string]string{
 		"OldRule":   "Old Rule",
 		"GlobalOn":  "Enable global proxy",
 		"Reset":     "Reset changed rules",
+		"Notice":    "Notices from the upstream",
 	},
 	"zh": {
 		"Title":     "goflyway 控制台",
@@ -205,6 +215,7 @@ var _i18n = map[string]map[string]string{
 		"OldRule":   "旧规则",
 		"GlobalOn":  "全局代理",
 		"Reset":     "重置规则",
+		"Notice":    "服务器通知",
 	},
 }
 
@@ -245,21 +256,36 @@ func toString(ans byte) string {
 	return []string{"Proxy", "Pass", "Block"}[ans]
 }
 
-func WebConsoleHTTPHandler(proxy *pp.ProxyClient) func(w http.ResponseWriter, r *http.Request) {
+func WebConsoleHTTPHandler(proxy *pp.ProxyClient, version string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 
+			if strings.HasPrefix(r.RequestURI, "/status") {
+				s := proxy.Status()
+				s.Version = version
+				w.Header().Add("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(s)
+				return
+			}
+
 			if strings.HasPrefix(r.RequestURI, "/traffic.svg") {
 				w.Header().Add("Content-Type", "image/svg+xml")
 				w.Write(proxy.IO.Tr.SVG(300, 50, r.FormValue("log") == "1").Bytes())
 				return
 			}
 
+			if strings.HasPrefix(r.RequestURI, "/metrics") {
+				w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+				proxy.IO.Lat.Expose(w)
+				return
+			}
+
 			payload := struct {
 				Global       bool
 				Entries      int
 				EntriesRatio int
 				DNS          string
+				Notices      []pp.Notice
 				I18N         map[string]string
 			}{}
 
@@ -291,6 +317,7 @@ func WebConsoleHTTPHandler(proxy *pp.ProxyClient) func(w http.ResponseWriter, r
 			payload.DNS = buf.String()
 			payload.Global = proxy.Policy.IsSet(pp.PolicyGlobal)
 			payload.Entries = count
+			payload.Notices = proxy.Notices()
 			payload.EntriesRatio = count * 100 / proxy.DNSCache.MaxEntries
 
 			// use lang=en to force english display
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/coyove/goflyway/cmd/goflyway/lib"
 	"github.com/coyove/goflyway/pkg/aclrouter"
@@ -17,6 +23,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 )
 
 var version = "__devel__"
@@ -26,30 +33,127 @@ var (
 	cmdDebug = flag.Bool("debug", false, "turn on debug mode")
 
 	// General flags
-	cmdConfig    = flag.String("c", "", "[SC] config file path")
+	cmdConfig    = flag.String("c", "", "[SC] config file path, or GOFLYWAY_CONFIG, options in it are overridden by GOFLYWAY_ and the key in upper case, e.g. GOFLYWAY_UPSTREAM, flags win over both")
 	cmdLogLevel  = flag.String("lv", "log", "[SC] logging level: {dbg, log, warn, err, off}")
 	cmdLogFile   = flag.String("lf", "", "[SC] log to file")
+	cmdLogRate   = flag.Int64("log-rate", 20, "[SC] print at most N messages per second from each line of code, the rest are summarized, 0 means no limit")
+	cmdLogJSON   = flag.Bool("log-json", false, "[SC] print logs as JSON lines, warnings and errors to stderr, for log collectors of containers")
 	cmdAuth      = flag.String("a", "", "[SC] proxy authentication, form: username:password (remember the colon)")
-	cmdKey       = flag.String("k", "0123456789abcdef", "[SC] password, do not use the default one")
-	cmdLocal     = flag.String("l", ":8100", "[SC] local listening address")
+	cmdKey       = flag.String("k", defaultKey, "[SC] password, do not use the default one, '@path' reads it from a file (a 32-byte binary key or a passphrase), 'keychain' from the OS keychain, or set "+keyEnv)
+	cmdKeychain  = flag.String("keychain", "", "[SC] manage secrets in the OS keychain and exit: set[:account] stores a prompted one, delete[:account] removes it, the account is 'password' (-k keychain) or 'config' (encrypted -c)")
+	cmdLocal     = flag.String("l", ":8100", "[SC] local listening address, the server may listen on several separated by commas like 0.0.0.0:8100,[::]:8100")
 	cmdCloseConn = flag.Int64("t", 20, "[SC] close connections when they go idle for at least N sec")
+	cmdDump      = flag.String("dump", "", "[SC] dump decrypted traffic metadata to a JSONL file, for debugging")
+	cmdDumpHost  = flag.String("dump-host", "", "[SC] only dump connections whose host contains this string")
+	cmdDumpSize  = flag.Int64("dump-payload", 0, "[SC] also dump the first N KB of payload in each direction")
+	cmdLeakAge   = flag.Int64("leak-age", 0, "[SC] warn about bridges which have been half closed for N sec, 0 to disable")
+	cmdDNSLane   = flag.Int64("dns-lane", 50, "[SC] prioritize up to N lookups per second over bulk streams sharing a mux carrier, 0 to disable")
+	cmdPace      = flag.Int64("pace", 0, "[SC] cap bulk streams sharing a mux carrier at a fixed N KB/s each to keep interactive ones responsive, 0 to disable")
+	cmdAccess    = flag.String("access", "", "[SC] load access rules blocking destinations in time windows, e.g. gaming sites 09:00-17:00 on weekdays, rules for some users are enforced by the server")
+	cmdEpochs    = flag.String("key-epochs", "", "[SC] rotate the key derived from the password at these cron-like times in UTC, form: min hour day month weekday, e.g. '0 4 * * 1', the client and the server must use the same schedule, the server accepts the previous epoch until the next rotation")
+	cmdSkew      = flag.Int64("clock-skew", 5, "[SC] tolerated clock skew between the client and the server in sec, time-based tokens and the replay window are widened by it, a warning is logged beyond it")
+	cmdOTLP      = flag.String("otlp", "", "[SC] export spans of tunnels, their DNS lookups, dials, handshakes and bridges, to an OpenTelemetry collector by OTLP/HTTP like localhost:4318, the server joins traces of clients tracing too")
+	cmdRunAs     = flag.String("run-as", "", "[SC] switch to this user after binding listeners as root, e.g. on :443 or :53, so the process doesn't keep running as root, a scheduled restart can't bind them again")
+	cmdTransport = flag.String("transport", "", "[SC] carry connections to the upstream by this transport instead of TCP, the server listens on both, form: name[:params] like ws:/path, registered: "+strings.Join(proxy.Transports(), ", "))
+	cmdKCP       = flag.String("kcp", "", "[SC] tune the kcp transport for long-distance lossy links and imply it, form: nodelay,interval,resend,nc like 1,20,2,1 or 'fast' for it, the server listens on TCP and UDP of -l at the same time")
+	cmdKCPHop    = flag.String("kcp-hop", "", "[SC] hop the UDP port of the kcp transport across this range on a schedule derived from the password, form: low-high/interval like 20000-20099/30s, the server listens on every port of it and clients ignore the port of -up")
+	cmdSNI       = flag.String("sni", "", "[SC] the server with -acme shares its port with the https:// site of -proxy-pass, connections presenting this SNI or ALPN are of goflyway, the client of '-transport tls' presents it as SNI and still verifies the certificate of the upstream's host")
 
 	// Server flags
 	cmdThrot     = flag.Int64("throt", 0, "[S] traffic throttling in bytes")
 	cmdThrotMax  = flag.Int64("throt-max", 1024*1024, "[S] traffic throttling token bucket max capacity")
+	cmdThrotBy   = flag.String("throt-scope", "per-conn", "[S] traffic throttling scope: {per-conn, per-user, global}")
+	cmdBan       = flag.String("ban", "", "[S] reject requests from these IPs, comma separated, reloaded with the config on SIGHUP")
+	cmdUsers     = flag.String("users", "", "[S] load users file, one 'username:password [throt [throt-max]] [from=CIDR,...]' per line, see -a")
+	cmdAuditLog  = flag.String("audit-log", "", "[S] append security events like users connecting from sources not in their from= as JSON lines to this file")
+	cmdAuditHook = flag.String("audit-webhook", "", "[S] post security events like users connecting from sources not in their from= as JSON to this URL")
 	cmdDiableUDP = flag.Bool("disable-udp", false, "[S] disable UDP relay")
 	cmdProxyPass = flag.String("proxy-pass", "", "[S] use goflyway as a reverse HTTP proxy")
+	cmdTenants   = flag.String("tenants", "", "[S] load tenants hosting their sites by name instead of -proxy-pass, each with its own throttle, byte quota, access log and admin token")
+	cmdRevSOCKS  = flag.String("reverse-socks", "", "[S] SOCKS5 listening address whose traffic exits through reverse clients, SOCKS clients log in as users and exit through their own reverse clients")
+	cmdSOCKS     = flag.String("socks", "", "[S] plain SOCKS5 listening address besides goflyway, users of -a/-users authenticate, without them it must be a loopback address, not encrypted, use it inside trusted networks only")
+	cmdSync      = flag.String("sync", "", "[S] warm standby: listening address where the peer pushes users, traffic counters and the blacklist, needs -sync-peer, pushes are encrypted and signed with the password")
+	cmdShared    = flag.String("shared-state", "", "[S] share offenders, replay IVs and -ip-rate with servers behind the same load balancer in this Redis, like redis://:password@host:6379/0")
+	cmdSyncPeer  = flag.String("sync-peer", "", "[S] warm standby: the -sync address of the other server, both servers must share the password")
+	cmdRemoteFwd = flag.Bool("remote-forward", false, "[S] allow clients to listen on loopback addresses of the server and forward connections back (see -R)")
+	cmdRemoteBnd = flag.String("remote-binds", "", "[S] with -remote-forward, addresses clients may listen on besides loopback ones, comma separated, e.g. 0.0.0.0:8080")
+	cmdNAT64     = flag.String("nat64", "", "[S] reach IPv4 sites from an IPv6-only server through a NAT64 prefix like 64:ff9b::/96, or 'auto' to discover it via DNS64")
+	cmdResolvers = flag.String("resolver", "", "[S] resolve destinations and DNS queries of clients by these DNS servers, comma separated, or a DNS-over-HTTPS URL like https://1.1.1.1/dns-query, instead of the system resolver")
+	cmdWireGuard = flag.String("wireguard", "", "[S] dial destinations through an in-process WireGuard tunnel of this wg-quick config file, so they see the exit IP of the peer, UDP relays are refused")
+	cmdSSHJumps  = flag.String("ssh-jump", "", "[S] dial destinations through SSH bastions like ssh -J, each section of this file has hosts, jump, user, key or password, and knownhosts or hostkey")
+	cmdUDPMax    = flag.Int64("udp-max-sessions", 0, "[S] relay UDP of at most N apps at the same time, each has a socket and its own NAT table, 0 means no limit")
+	cmdUDPIdle   = flag.Int64("udp-timeout", 30, "[S] expire UDP sessions and the destinations in them when idle for N sec")
+	cmdIPRate    = flag.Int64("ip-rate", 0, "[S] accept at most N new connections per second from each IP on -l and -socks, others are closed right away, streams multiplexed in a connection are not counted, 0 means no limit")
+	cmdIPBridges = flag.Int64("ip-max-streams", 0, "[S] bridge at most N streams at the same time for each IP, others are refused, 0 means no limit")
+	cmdSrvDNSTTL = flag.Int64("dns-cache-ttl", 60, "[S] cache answers of DNS lookups made for clients for N sec, failed ones for 10 sec at most, 0 to disable")
+	cmdHotOrigin = flag.String("hot-origins", "", "[S] keep more warm connections to these origins in forward mode, comma separated, e.g. api.example.com,*.example.org")
+	cmdClasses   = flag.String("classes", "", "[S] load traffic classes assigning throttles and pacing to streams by their destinations")
+	cmdWorkers   = flag.Int64("workers", 0, "[S] spread accepting among N listeners sharing the port with SO_REUSEPORT")
+	cmdMaxGo     = flag.Int64("max-goroutines", 0, "[S] shed new connections when there are more goroutines than N, 0 means no limit")
+	cmdMaxHeap   = flag.Int64("max-heap", 0, "[S] shed new connections when the heap is larger than N MB, 0 means no limit")
+	cmdMaxFDs    = flag.Int64("max-fds", 0, "[S] shed new connections when more than N fds are open, 0 means no limit")
+	cmdProfDir   = flag.String("profile-dir", "", "[S] dump goroutine and heap profiles into this directory when shedding starts")
+	cmdAdminPort = flag.Int64("admin-port", 0, "[S] blacklist, metrics, notice, status and drain admin API listening port, /blacklist?format=ipset exports bans for firewalls, 0 to disable")
+	cmdMetrics   = flag.String("metrics", "", "[S] also serve /metrics for Prometheus and /tenant for tokens of -tenants at this address, e.g. :9100, unlike the admin API it may listen on public interfaces, so users are labelled by hashes there")
+	cmdAdminAPI  = flag.String("admin-api", "", "[S] serve the admin REST API of users, sessions and stats at this address, e.g. 127.0.0.1:8102, see -admin-token, changes of users are not saved to -users")
+	cmdAdminTok  = flag.String("admin-token", "", "[S] token the admin REST API requires by 'Authorization: Bearer <token>', better set by GOFLYWAY_ADMINTOKEN")
+	cmdBlackFile = flag.String("blacklist-file", "", "[S] keep the blacklist in this file across restarts, written by bans of the admin API, on SIGTERM and by the 'blacklist' and 'restart' tasks of -schedule")
+	cmdBlackSize = flag.Int64("blacklist-size", 128, "[S] track at most N IPs sending invalid requests, the least recent are forgotten")
+	cmdBanHits   = flag.Int64("ban-threshold", 10, "[S] reject requests of an IP before decrypting them after N invalid ones")
+	cmdBanTime   = flag.Int64("ban-duration", 600, "[S] keep rejecting the IP for N sec since its last invalid request")
+	cmdBanV4Len  = flag.Int64("ban-prefix-v4", 32, "[S] track invalid requests by IPv4 networks of this prefix length, like 24")
+	cmdBanV6Len  = flag.Int64("ban-prefix-v6", 128, "[S] track invalid requests by IPv6 networks of this prefix length, like 64, scanners may rotate addresses of their /64")
+	cmdACME      = flag.String("acme", "", "[S] terminate TLS on -l with certificates of these domains obtained from Let's Encrypt, comma separated, -l should be :443, clients use '-transport tls'")
+	cmdACMEDir   = flag.String("acme-dir", "acme", "[S] keep ACME accounts and certificates in this directory, inside -chroot if any")
+	cmdECHKey    = flag.String("ech-key", "", "[S] accept Encrypted Client Hellos by the ECH key in this file, generated if it doesn't exist, outer ClientHellos present the first domain of -acme, clients use the printed config list by -ech")
+	cmdChroot    = flag.String("chroot", "", "[S] chroot into this directory after startup, files read later like -users are inside it, copy /etc/resolv.conf into it for DNS, needs root")
+	cmdSandbox   = flag.Bool("sandbox", false, "[S] forbid exec and syscalls like ptrace and mount after startup with seccomp, Linux only, scheduled restarts are impossible then")
+	cmdPreopen   = flag.Bool("preopen", true, "[SC] bind listeners before dropping privileges by -run-as, -chroot or -sandbox, turn it off if they are bound by socket activation or the binary can bind low ports by CAP_NET_BIND_SERVICE")
+	cmdReplay    = flag.Bool("anti-replay", false, "[S] reject replayed requests and those older than -clock-skew plus 10 seconds, clients before this option was added will be rejected too")
+	cmdGrace     = flag.Int64("grace", 30, "[S] on SIGTERM, refuse new tunnels and wait up to N sec for open ones to finish before exiting")
+	cmdSchedule  = flag.String("schedule", "", "[S] cron-like schedules of maintenance tasks separated by ';', form: task=min hour day month weekday, tasks: {logrotate, blacklist, reload, restart}, e.g. 'logrotate=0 4 * * *;restart=30 4 * * 1'")
 
 	// Client flags
 	cmdGlobal     = flag.Bool("g", false, "[C] global proxy")
-	cmdUpstream   = flag.String("up", "", "[C] upstream server address")
+	cmdUpstream   = flag.String("up", "", "[C] upstream server address, or vless://uuid@host:port to use a V2Ray/Xray VLESS inbound over TCP instead of a goflyway server, VMess is not supported")
+	cmdVLESSPlain = flag.Bool("vless-plaintext", false, "[C] allow VLESS upstreams reached without TLS, VLESS doesn't encrypt the traffic")
+	cmdServers    = flag.String("servers", "", "[C] load named servers with labels like region=us sharing the key of -up, and pin proxied hosts to them, e.g. *.netflix.com to a server in the US, ignored behind an HTTPS proxy frontend")
+	cmdAltUp      = flag.String("up-alt", "", "[C] alternate upstream server addresses (comma separated), tried when dialing the upstream fails")
+	cmdMaxLine    = flag.Int64("max-request-line", 0, "[C] keep request lines to the upstream within N bytes, at least 128, longer destinations go in headers once the upstream advertises collecting them, 0 means 2048")
+	cmdWSPath     = flag.String("ws-path", "", "[C] send genuine WebSocket handshakes to this path, e.g. /ws, with the destination in a header, for CDNs routing WebSocket by path, needs a ws:// or cf:// upstream")
 	cmdPartial    = flag.Bool("partial", false, "[C] partially encrypt the tunnel traffic")
-	cmdUDPonTCP   = flag.Int64("udp-tcp", 1, "[C] use N TCP connections to relay UDP")
+	cmdPartialSum = flag.Bool("partial-sum", false, "[C] with -partial, append checksums to tunnels so the unencrypted traffic corrupted on the way is detected, the upstream must support it")
+	cmdStreamBody = flag.Bool("stream-body", false, "[C] stream tunnels in chunked request and response bodies, so HTTP/2 frontends like CDNs can carry them, the upstream must support it")
+	cmdCompress   = flag.Bool("compress", false, "[C] ask the upstream to gzip uncompressed text responses in forward mode")
+	cmdUDPonTCP   = flag.Int64("udp-tcp", 1, "[C] use N TCP connections to relay UDP through upstreams too old for NAT sessions")
 	cmdWebConPort = flag.Int64("web-port", 8101, "[C] web console listening port, 0 to disable")
 	cmdDNSCache   = flag.Int64("dns-cache", 1024, "[C] DNS cache size")
+	cmdDNSTTL     = flag.Int64("dns-ttl", 0, "[C] remake cached DNS rules after N seconds, 0 to keep them until evicted")
+	cmdPrefetch   = flag.Bool("dns-prefetch", false, "[C] refresh DNS rules resolved by the upstream before they expire if they are still in use, needs -dns-ttl")
+	cmdRace       = flag.Int64("race", 0, "[C] race direct connections against the upstream which starts N ms later for hosts without explicit rules, 0 to disable")
+	cmdLearn      = flag.Bool("learn", false, "[C] learn routes for hosts without explicit rules, e.g. proxy hosts whose direct connections keep timing out, implied by -race")
+	cmdRouteCache = flag.String("route-cache", "", "[C] file to remember learned routes across restarts")
+	cmdRaceCache  = flag.String("race-cache", "", "[C] deprecated, the same as -route-cache")
+	cmdPrewarm    = flag.Int64("prewarm", 0, "[C] keep N idle connections to the upstream ready for new requests")
 	cmdMux        = flag.Int64("mux", 0, "[C] limit the total number of TCP connections, 0 means no limit")
+	cmdReverse    = flag.Int64("reverse", 0, "[C] keep N idle tunnels so the upstream can reach the network of this client")
+	cmdLocalFwd   = flag.String("L", "", "[C] local port forwarding, form: [bind:]port:host:hostport, comma separated")
+	cmdUDPFwd     = flag.String("udp-forward", "", "[C] UDP port forwarding, form: [bind:]port:host:hostport, comma separated")
+	cmdRemoteFwdC = flag.String("R", "", "[C] remote port forwarding, form: [bind:]port:host:hostport, comma separated")
+	cmdNotice     = flag.Bool("notice", false, "[C] receive notices broadcast by the upstream, shown in the log and web console")
 	cmdVPN        = flag.Bool("vpn", false, "[C] vpn mode, used on Android only")
+	cmdTunnelLAN  = flag.Bool("tunnel-lan", false, "[C] proxy private, link-local and loopback destinations instead of connecting directly")
+	cmdSniff      = flag.Bool("sniff", false, "[C] recover hostnames of SOCKS requests targeting IPs by sniffing TLS SNI and HTTP Host")
 	cmdACL        = flag.String("acl", "chinalist.txt", "[C] load ACL file")
+	cmdResolveRem = flag.Bool("resolve-remote", false, "[C] resolve domains through the upstream before checking IP rules, unless listed in [local_dns_list] of the ACL")
+	cmdHosts      = flag.String("hosts", "", "[C] load hosts file, entries override DNS and ACL rules")
+	cmdFakeIP     = flag.String("fake-ip", "", "[C] answer DNS queries relayed through the client, by SOCKS UDP or -udp-forward to port 53, with virtual IPs of this network like 198.18.0.0/15 and connect to the names behind them")
+	cmdDNSRewrite = flag.String("dns-rewrite", "", "[C] load hosts file, DNS answers relayed to apps are rewritten with entries mapped to IPs")
+	cmdSoftFail   = flag.Bool("soft-fail", false, "[C] connect directly when the upstream is unreachable, the traffic is NOT protected meanwhile")
+	cmdSoftDeny   = flag.String("soft-fail-deny", "", "[C] hosts never connected directly by -soft-fail, comma separated, e.g. *.corp.example.com,10.0.0.0/8")
+	cmdECH        = flag.String("ech", "", "[C] encrypt the TLS ClientHello of '-transport tls' by this ECH config list printed by the server, so even the SNI isn't visible on the wire, not with -fingerprint")
+	cmdTLSFinger  = flag.String("fingerprint", "", "[C] mimic the TLS ClientHello of a browser on '-transport tls' instead of Go's own, which DPI can tell apart, one of: "+strings.Join(proxy.Fingerprints(), ", "))
+	cmdECDH       = flag.Bool("ecdh", false, "[C] exchange X25519 keys with the upstream so each tunnel has its own key and past traffic stays safe if the password leaks, the upstream must support it")
 
 	// Shadowsocks compatible flags
 	cmdLocal2 = flag.String("p", "", "server listening address")
@@ -61,25 +165,173 @@ var (
 	_ = flag.Bool("fast-open", true, "placeholder")
 )
 
+var configEncrypted bool
+
+// loadConfig reads options from the command line, the environment and the config file, in this order of
+// precedence: flags given win over GOFLYWAY_* variables (see proxy.EnvConfig), which win over the file
 func loadConfig() {
 	flag.Parse()
 
-	path := *cmdConfig
+	given := map[string]string{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+	defer func() {
+		for name, value := range given {
+			flag.Set(name, value)
+		}
+	}()
+
+	if *cmdConfig == "" {
+		*cmdConfig = os.Getenv(proxy.EnvPrefix + "CONFIG")
+	}
+
+	cf := proxy.EnvConfig(readConfig(*cmdConfig), func(msg string) {
+		fmt.Println("* invalid environment:", msg)
+		os.Exit(1)
+	})
+
+	*cmdKey = cf.GetString("default", "password", *cmdKey)
+	*cmdAuth = cf.GetString("default", "auth", *cmdAuth)
+	*cmdLocal = cf.GetString("default", "listen", *cmdLocal)
+	*cmdUpstream = cf.GetString("default", "upstream", *cmdUpstream)
+	*cmdAltUp = cf.GetString("default", "upstreamalt", *cmdAltUp)
+	*cmdDiableUDP = cf.GetBool("default", "disableudp", *cmdDiableUDP)
+	*cmdUDPonTCP = cf.GetInt("default", "udptcp", *cmdUDPonTCP)
+	*cmdGlobal = cf.GetBool("default", "global", *cmdGlobal)
+	*cmdACL = cf.GetString("default", "acl", *cmdACL)
+	*cmdResolveRem = cf.GetBool("default", "resolveremote", *cmdResolveRem)
+	*cmdHosts = cf.GetString("default", "hosts", *cmdHosts)
+	*cmdDNSRewrite = cf.GetString("default", "dnsrewrite", *cmdDNSRewrite)
+	*cmdFakeIP = cf.GetString("default", "fakeip", *cmdFakeIP)
+	*cmdSoftFail = cf.GetBool("default", "softfail", *cmdSoftFail)
+	*cmdSoftDeny = cf.GetString("default", "softfaildeny", *cmdSoftDeny)
+	*cmdECDH = cf.GetBool("default", "ecdh", *cmdECDH)
+	*cmdPartial = cf.GetBool("default", "partial", *cmdPartial)
+	*cmdPartialSum = cf.GetBool("default", "partialsum", *cmdPartialSum)
+	*cmdStreamBody = cf.GetBool("default", "streambody", *cmdStreamBody)
+	*cmdVLESSPlain = cf.GetBool("default", "vlessplaintext", *cmdVLESSPlain)
+	*cmdWSPath = cf.GetString("default", "wspath", *cmdWSPath)
+	*cmdMaxLine = cf.GetInt("default", "maxrequestline", *cmdMaxLine)
+	*cmdCompress = cf.GetBool("default", "compress", *cmdCompress)
+	*cmdSniff = cf.GetBool("default", "sniff", *cmdSniff)
+	*cmdTunnelLAN = cf.GetBool("default", "tunnellan", *cmdTunnelLAN)
+	*cmdTransport = cf.GetString("default", "transport", *cmdTransport)
+	*cmdKCP = cf.GetString("default", "kcp", *cmdKCP)
+	*cmdKCPHop = cf.GetString("default", "kcphop", *cmdKCPHop)
+	*cmdTLSFinger = cf.GetString("default", "fingerprint", *cmdTLSFinger)
+	*cmdECH = cf.GetString("default", "ech", *cmdECH)
+
+	*cmdProxyPass = cf.GetString("misc", "proxypass", *cmdProxyPass)
+	*cmdWebConPort = cf.GetInt("misc", "webconport", *cmdWebConPort)
+	*cmdAdminPort = cf.GetInt("misc", "adminport", *cmdAdminPort)
+	*cmdRevSOCKS = cf.GetString("misc", "reversesocks", *cmdRevSOCKS)
+	*cmdSOCKS = cf.GetString("misc", "socks", *cmdSOCKS)
+	*cmdSync = cf.GetString("misc", "sync", *cmdSync)
+	*cmdSrvDNSTTL = cf.GetInt("misc", "dnscachettl", *cmdSrvDNSTTL)
+	*cmdUDPMax = cf.GetInt("misc", "udpmaxsessions", *cmdUDPMax)
+	*cmdUDPIdle = cf.GetInt("misc", "udptimeout", *cmdUDPIdle)
+	*cmdIPRate = cf.GetInt("misc", "iprate", *cmdIPRate)
+	*cmdIPBridges = cf.GetInt("misc", "ipmaxstreams", *cmdIPBridges)
+	*cmdResolvers = cf.GetString("misc", "resolver", *cmdResolvers)
+	*cmdSyncPeer = cf.GetString("misc", "syncpeer", *cmdSyncPeer)
+	*cmdShared = cf.GetString("misc", "sharedstate", *cmdShared)
+	*cmdReverse = cf.GetInt("misc", "reverse", *cmdReverse)
+	*cmdRemoteFwd = cf.GetBool("misc", "remoteforward", *cmdRemoteFwd)
+	*cmdNAT64 = cf.GetString("misc", "nat64", *cmdNAT64)
+	*cmdWireGuard = cf.GetString("misc", "wireguard", *cmdWireGuard)
+	*cmdSSHJumps = cf.GetString("misc", "sshjump", *cmdSSHJumps)
+	*cmdClasses = cf.GetString("misc", "classes", *cmdClasses)
+	*cmdTenants = cf.GetString("misc", "tenants", *cmdTenants)
+	*cmdHotOrigin = cf.GetString("misc", "hotorigins", *cmdHotOrigin)
+	*cmdRemoteBnd = cf.GetString("misc", "remotebinds", *cmdRemoteBnd)
+	*cmdWorkers = cf.GetInt("misc", "workers", *cmdWorkers)
+	*cmdMaxGo = cf.GetInt("misc", "maxgoroutines", *cmdMaxGo)
+	*cmdMaxHeap = cf.GetInt("misc", "maxheap", *cmdMaxHeap)
+	*cmdMaxFDs = cf.GetInt("misc", "maxfds", *cmdMaxFDs)
+	*cmdProfDir = cf.GetString("misc", "profiledir", *cmdProfDir)
+	*cmdRemoteFwdC = cf.GetString("misc", "rforward", *cmdRemoteFwdC)
+	*cmdLocalFwd = cf.GetString("misc", "lforward", *cmdLocalFwd)
+	*cmdUDPFwd = cf.GetString("misc", "uforward", *cmdUDPFwd)
+	*cmdNotice = cf.GetBool("misc", "notice", *cmdNotice)
+	*cmdDNSCache = cf.GetInt("misc", "dnscache", *cmdDNSCache)
+	*cmdDNSTTL = cf.GetInt("misc", "dnsttl", *cmdDNSTTL)
+	*cmdPrefetch = cf.GetBool("misc", "dnsprefetch", *cmdPrefetch)
+	*cmdRace = cf.GetInt("misc", "race", *cmdRace)
+	*cmdLearn = cf.GetBool("misc", "learn", *cmdLearn)
+	*cmdRouteCache = cf.GetString("misc", "routecache", *cmdRouteCache)
+	if *cmdRaceCache = cf.GetString("misc", "racecache", *cmdRaceCache); *cmdRouteCache == "" {
+		*cmdRouteCache = *cmdRaceCache
+	}
+	*cmdMux = cf.GetInt("misc", "mux", *cmdMux)
+	*cmdPrewarm = cf.GetInt("misc", "prewarm", *cmdPrewarm)
+	*cmdLogLevel = cf.GetString("misc", "loglevel", *cmdLogLevel)
+	*cmdLogFile = cf.GetString("misc", "logfile", *cmdLogFile)
+	*cmdLogRate = cf.GetInt("misc", "lograte", *cmdLogRate)
+	*cmdLogJSON = cf.GetBool("misc", "logjson", *cmdLogJSON)
+	*cmdThrot = cf.GetInt("misc", "throt", *cmdThrot)
+	*cmdThrotMax = cf.GetInt("misc", "throtmax", *cmdThrotMax)
+	*cmdThrotBy = cf.GetString("misc", "throtscope", *cmdThrotBy)
+	*cmdUsers = cf.GetString("misc", "users", *cmdUsers)
+	*cmdAuditLog = cf.GetString("misc", "auditlog", *cmdAuditLog)
+	*cmdAuditHook = cf.GetString("misc", "auditwebhook", *cmdAuditHook)
+	*cmdBan = cf.GetString("misc", "ban", *cmdBan)
+	*cmdMetrics = cf.GetString("misc", "metrics", *cmdMetrics)
+	*cmdAdminAPI = cf.GetString("misc", "adminapi", *cmdAdminAPI)
+	*cmdAdminTok = cf.GetString("misc", "admintoken", *cmdAdminTok)
+	*cmdBlackFile = cf.GetString("misc", "blacklistfile", *cmdBlackFile)
+	*cmdBlackSize = cf.GetInt("misc", "blacklistsize", *cmdBlackSize)
+	*cmdBanHits = cf.GetInt("misc", "banthreshold", *cmdBanHits)
+	*cmdBanTime = cf.GetInt("misc", "banduration", *cmdBanTime)
+	*cmdBanV4Len = cf.GetInt("misc", "banprefixv4", *cmdBanV4Len)
+	*cmdBanV6Len = cf.GetInt("misc", "banprefixv6", *cmdBanV6Len)
+	*cmdSchedule = cf.GetString("misc", "schedule", *cmdSchedule)
+	*cmdGrace = cf.GetInt("misc", "grace", *cmdGrace)
+	*cmdReplay = cf.GetBool("misc", "antireplay", *cmdReplay)
+
+	*cmdCloseConn = cf.GetInt("misc", "closeconn", *cmdCloseConn)
+	*cmdDump = cf.GetString("misc", "dump", *cmdDump)
+	*cmdDumpHost = cf.GetString("misc", "dumphost", *cmdDumpHost)
+	*cmdDumpSize = cf.GetInt("misc", "dumppayload", *cmdDumpSize)
+	*cmdLeakAge = cf.GetInt("misc", "leakage", *cmdLeakAge)
+	*cmdPace = cf.GetInt("misc", "pace", *cmdPace)
+	*cmdDNSLane = cf.GetInt("misc", "dnslane", *cmdDNSLane)
+	*cmdSkew = cf.GetInt("misc", "clockskew", *cmdSkew)
+	*cmdEpochs = cf.GetString("misc", "keyepochs", *cmdEpochs)
+	*cmdAccess = cf.GetString("misc", "access", *cmdAccess)
+	*cmdOTLP = cf.GetString("misc", "otlp", *cmdOTLP)
+	*cmdServers = cf.GetString("misc", "servers", *cmdServers)
+	*cmdRunAs = cf.GetString("misc", "runas", *cmdRunAs)
+	*cmdACME = cf.GetString("misc", "acme", *cmdACME)
+	*cmdACMEDir = cf.GetString("misc", "acmedir", *cmdACMEDir)
+	*cmdECHKey = cf.GetString("misc", "echkey", *cmdECHKey)
+	*cmdSNI = cf.GetString("misc", "sni", *cmdSNI)
+	*cmdChroot = cf.GetString("misc", "chroot", *cmdChroot)
+	*cmdSandbox = cf.GetBool("misc", "sandbox", *cmdSandbox)
+	*cmdPreopen = cf.GetBool("misc", "preopen", *cmdPreopen)
+}
+
+// readConfig parses the config file at path, nil if there is none
+func readConfig(path string) proxy.ConfigSource {
 	if path == "" {
-		return
+		return nil
 	}
 
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		fmt.Println("* can't load config file:", err)
-		return
+		return nil
+	}
+
+	configEncrypted = proxy.IsEncryptedConfig(buf)
+	if buf, err = configFiles.Decrypt(path, buf); err != nil {
+		fmt.Println("* can't decrypt config file:", err)
+		os.Exit(1)
 	}
 
 	if strings.Contains(path, "shadowsocks.conf") {
 		cmds := make(map[string]interface{})
 		if err := json.Unmarshal(buf, &cmds); err != nil {
 			fmt.Println("* can't parse config file:", err)
-			return
+			return nil
 		}
 
 		*cmdKey = cmds["password"].(string)
@@ -88,42 +340,25 @@ func loadConfig() {
 		*cmdLogLevel = "dbg"
 		*cmdVPN = true
 		*cmdGlobal = true
-		return
+		return nil
 	}
 
 	cf, err := config.ParseConf(string(buf))
 	if err != nil {
 		fmt.Println("* can't parse config file:", err)
-		return
+		return nil
 	}
-
-	*cmdKey = cf.GetString("default", "password", *cmdKey)
-	*cmdAuth = cf.GetString("default", "auth", *cmdAuth)
-	*cmdLocal = cf.GetString("default", "listen", *cmdLocal)
-	*cmdUpstream = cf.GetString("default", "upstream", *cmdUpstream)
-	*cmdDiableUDP = cf.GetBool("default", "disableudp", *cmdDiableUDP)
-	*cmdUDPonTCP = cf.GetInt("default", "udptcp", *cmdUDPonTCP)
-	*cmdGlobal = cf.GetBool("default", "global", *cmdGlobal)
-	*cmdACL = cf.GetString("default", "acl", *cmdACL)
-	*cmdPartial = cf.GetBool("default", "partial", *cmdPartial)
-
-	*cmdProxyPass = cf.GetString("misc", "proxypass", *cmdProxyPass)
-	*cmdWebConPort = cf.GetInt("misc", "webconport", *cmdWebConPort)
-	*cmdDNSCache = cf.GetInt("misc", "dnscache", *cmdDNSCache)
-	*cmdMux = cf.GetInt("misc", "mux", *cmdMux)
-	*cmdLogLevel = cf.GetString("misc", "loglevel", *cmdLogLevel)
-	*cmdLogFile = cf.GetString("misc", "logfile", *cmdLogFile)
-	*cmdThrot = cf.GetInt("misc", "throt", *cmdThrot)
-	*cmdThrotMax = cf.GetInt("misc", "throtmax", *cmdThrotMax)
-
-	*cmdCloseConn = cf.GetInt("misc", "closeconn", *cmdCloseConn)
+	return cf
 }
 
 func main() {
-	fmt.Println("goflyway (build " + version + ")")
-
 	loadConfig()
 
+	if flag.Arg(0) != "status" || flag.Arg(1) != "--json" {
+		// keep the output of status --json parsable
+		fmt.Println("goflyway (build " + version + ")")
+	}
+
 	if *cmdGenCA {
 		fmt.Println("* generating CA...")
 
@@ -145,18 +380,160 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "status" {
+		// goflyway [flags] status [--json]
+		if err := printStatus(flag.Arg(1) == "--json"); err != nil {
+			fmt.Println("*", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *cmdKeychain != "" {
+		if err := manageKeychain(*cmdKeychain); err != nil {
+			fmt.Println("* keychain:", err)
+			os.Exit(1)
+		}
+		fmt.Println("* keychain updated")
+		return
+	}
+
+	if flag.Arg(0) == "encrypt-config" {
+		// goflyway encrypt-config <in> <out>
+		if err := encryptConfigFile(flag.Arg(1), flag.Arg(2)); err != nil {
+			fmt.Println("*", err)
+			os.Exit(1)
+		}
+		fmt.Println("* encrypted config written to", flag.Arg(2))
+		return
+	}
+
+	if flag.Arg(0) == "check-config" {
+		// goflyway [flags] check-config
+		if n := checkConfig(); n > 0 {
+			fmt.Println("*", n, "problem(s) found")
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *cmdUpstream != "" {
 		fmt.Println("* launched as client")
 	} else {
 		fmt.Println("* launched as server (aka upstream)")
 	}
 
-	if *cmdKey == "0123456789abcdef" {
+	key, err := loadKey(*cmdKey)
+	if err != nil {
+		fmt.Println("* can't load key:", err)
+		return
+	}
+
+	if key == defaultKey {
 		fmt.Println("* you are using the default password, it is recommended to change it: -k=<NEW PASSWORD>")
 	}
 
 	cipher := &proxy.Cipher{Partial: *cmdPartial}
-	cipher.Init(*cmdKey)
+	cipher.Init(key)
+
+	var epochs *proxy.KeyEpochs
+	if *cmdEpochs != "" {
+		if epochs, err = proxy.NewKeyEpochs(key, *cmdEpochs); err != nil {
+			fmt.Println("*", err)
+			return
+		}
+
+		if *cmdUpstream != "" {
+			cipher.Init(epochs.Key())
+		}
+		fmt.Println("* rotate the key at", *cmdEpochs, "UTC, next at", epochs.Schedule.Next(time.Now().UTC()).Format("2006-01-02 15:04"))
+	}
+
+	cipher.IO.LeakAge = time.Duration(*cmdLeakAge) * time.Second
+
+	if *cmdPace > 0 {
+		fmt.Println("* pace bulk streams at", *cmdPace, "KB/s")
+		cipher.IO.Pacing = proxy.NewPacing(*cmdPace * 1024)
+	}
+
+	if *cmdDNSLane > 0 {
+		cipher.IO.DNSLane = proxy.NewDNSLane(int(*cmdDNSLane))
+	}
+
+	if *cmdDump != "" {
+		dump, err := proxy.NewTrafficDump(*cmdDump, *cmdDumpHost, int(*cmdDumpSize)*1024)
+		if err != nil {
+			fmt.Println("* can't open dump file:", err)
+			return
+		}
+
+		fmt.Println("* dump traffic to [", *cmdDump, "], host filter: [", *cmdDumpHost, "], payload:", *cmdDumpSize, "KB")
+		cipher.IO.Dump = dump
+	}
+
+	var access proxy.AccessRules
+	if *cmdAccess != "" {
+		var err error
+		if access, err = proxy.LoadAccessRules(*cmdAccess); err != nil {
+			fmt.Println("* failed to read access rules:", err)
+			return
+		}
+		fmt.Println("* access rules loaded,", len(access), "rules")
+	}
+
+	var tracer *proxy.Tracer
+	if *cmdOTLP != "" {
+		service := "goflyway-server"
+		if *cmdUpstream != "" {
+			service = "goflyway-client"
+		}
+
+		var err error
+		if tracer, err = proxy.NewTracer(*cmdOTLP, service); err != nil {
+			fmt.Println("*", err)
+			return
+		}
+		fmt.Println("* export spans of tunnels to [", tracer.Endpoint, "]")
+	}
+
+	spec := *cmdTransport
+	if *cmdKCP != "" {
+		if spec != "" && spec != "kcp" {
+			fmt.Println("* -kcp is for the kcp transport, not", spec)
+			return
+		}
+		spec = "kcp:" + *cmdKCP
+	}
+
+	ech, err := base64.StdEncoding.DecodeString(*cmdECH)
+	if err != nil {
+		fmt.Println("* invalid ECH config list:", err)
+		return
+	}
+
+	transport, err := proxy.NewTransport(spec, proxy.TransportOptions{SNI: *cmdSNI, Fingerprint: *cmdTLSFinger, ECH: ech})
+	if err != nil {
+		fmt.Println("*", err)
+		return
+	}
+	*cmdTransport = strings.SplitN(spec, ":", 2)[0]
+
+	if *cmdKCPHop != "" {
+		kc, ok := transport.(*proxy.KCPConfig)
+		if !ok {
+			fmt.Println("* -kcp-hop is for the kcp transport")
+			return
+		}
+
+		hop, err := proxy.ParsePortHop(*cmdKCPHop, key)
+		if err != nil {
+			fmt.Println("*", err)
+			return
+		}
+
+		transport = kc.WithHop(hop)
+		fmt.Println("* hop the UDP port of the kcp transport across", hop)
+	}
 
 	var cc *proxy.ClientConfig
 	var sc *proxy.ServerConfig
@@ -176,18 +553,159 @@ func main() {
 			fmt.Println("* ACL omit rule:", r)
 		}
 
+		if *cmdResolveRem {
+			fmt.Println("* resolve domains through the upstream before checking IP rules")
+			acl.ResolveRemote = true
+		}
+
+		var hosts proxy.Hosts
+		if *cmdHosts != "" {
+			if hosts, err = proxy.LoadHosts(*cmdHosts); err != nil {
+				fmt.Println("* failed to read hosts file:", err)
+			} else {
+				fmt.Println("* hosts file loaded,", len(hosts), "entries")
+			}
+		}
+
+		var rewrite proxy.Hosts
+		if *cmdDNSRewrite != "" {
+			if rewrite, err = proxy.LoadHosts(*cmdDNSRewrite); err != nil {
+				fmt.Println("* failed to read DNS rewrite file:", err)
+			} else {
+				fmt.Println("* DNS rewrite file loaded,", len(rewrite), "entries")
+			}
+		}
+
+		var fake *proxy.FakeIP
+		if *cmdFakeIP != "" {
+			if fake, err = proxy.NewFakeIP(*cmdFakeIP); err != nil {
+				fmt.Println("* invalid fake IP network:", err)
+				return
+			}
+			fmt.Println("* answer DNS queries with fake IPs of", fake.Net)
+		}
+
 		cc = &proxy.ClientConfig{
 			UserAuth:       *cmdAuth,
 			Upstream:       *cmdUpstream,
 			UDPRelayCoconn: int(*cmdUDPonTCP),
 			Cipher:         cipher,
+			Hosts:          hosts,
+			DNSRewrite:     rewrite,
+			FakeIP:         fake,
 			DNSCache:       lru.NewCache(int(*cmdDNSCache)),
+			DNSTTL:         time.Duration(*cmdDNSTTL) * time.Second,
+			DNSPrefetch:    *cmdPrefetch,
 			CACache:        lru.NewCache(256),
 			ACL:            acl,
 			Mux:            int(*cmdMux),
+			Prewarm:        int(*cmdPrewarm),
+			SkewTolerance:  time.Duration(*cmdSkew) * time.Second,
+			SoftFail:       *cmdSoftFail,
+			ECDH:           *cmdECDH,
+			PartialSum:     *cmdPartialSum,
+			StreamBody:     *cmdStreamBody,
+			MaxRequestLine: int(*cmdMaxLine),
+			AccessRules:    access,
+			Transport:      transport,
+			Tracer:         tracer,
 		}
 
-		if is := func(in string) bool { return strings.HasPrefix(*cmdUpstream, in) }; is("https://") {
+		if *cmdServers != "" {
+			if cc.Inventory, err = proxy.LoadInventory(*cmdServers); err != nil {
+				fmt.Println("* failed to read servers:", err)
+				return
+			}
+
+			fmt.Println("* servers loaded,", len(cc.Inventory.Servers), "servers,", len(cc.Inventory.Pins), "pins")
+			for _, p := range cc.Inventory.Pins {
+				if p.Duplicate {
+					fmt.Println("* pin", p.Name, "duplicates tunnels through", len(p.Servers), "servers")
+				}
+			}
+		}
+
+		if *cmdECDH {
+			fmt.Println("* exchange a key with the upstream for each tunnel (ECDH)")
+		}
+
+		if *cmdPartialSum && !*cmdPartial {
+			fmt.Println("* -partial-sum needs -partial")
+			return
+		} else if *cmdPartialSum {
+			fmt.Println("* append checksums to partially encrypted tunnels")
+		}
+
+		if *cmdStreamBody {
+			fmt.Println("* stream tunnels in request and response bodies")
+		}
+
+		if transport != nil {
+			fmt.Println("* dial the upstream by the", *cmdTransport, "transport")
+		}
+
+		if *cmdSoftFail {
+			fmt.Println("* soft fail: connect directly when the upstream is unreachable")
+			if *cmdSoftDeny != "" {
+				if cc.SoftFailDeny, err = aclrouter.NewHostMatcher(strings.Split(*cmdSoftDeny, ",")); err != nil {
+					fmt.Println("* invalid soft fail deny rules:", err)
+					cc.SoftFail = false
+				}
+			}
+		}
+
+		if cc.Race = time.Duration(*cmdRace) * time.Millisecond; *cmdLearn || cc.Race > 0 {
+			if cc.RouteBook, err = proxy.LoadRouteBook(*cmdRouteCache); err != nil {
+				fmt.Println("* failed to read route cache:", err)
+				cc.RouteBook, _ = proxy.LoadRouteBook("")
+			}
+		}
+
+		if *cmdAltUp != "" {
+			cc.AltUpstreams = strings.Split(*cmdAltUp, ",")
+			fmt.Println("* alternate upstreams:", cc.AltUpstreams)
+		}
+
+		if is := func(in string) bool { return strings.HasPrefix(*cmdUpstream, in) }; is("vless://") {
+			if cc.Upstream, cc.VLESS, err = proxy.ParseVLESS(*cmdUpstream); err != nil {
+				fmt.Println("* invalid VLESS upstream:", err)
+				return
+			}
+
+			fmt.Println("* use the VLESS inbound [", cc.Upstream, "] as the upstream")
+			if cc.VLESS.TLS && transport == nil {
+				opts := proxy.TransportOptions{SNI: cc.VLESS.SNI, Fingerprint: cc.VLESS.Fingerprint}
+				if cc.Transport, err = proxy.NewTransport("tls", opts); err != nil {
+					fmt.Println("*", err)
+					return
+				}
+				*cmdTransport = "tls"
+				fmt.Println("* reach the VLESS inbound by TLS as its link says")
+			} else if cc.VLESS.TLS && *cmdTransport != "tls" {
+				fmt.Println("* the VLESS link asks for TLS, not the", *cmdTransport, "transport")
+				return
+			} else if *cmdTransport != "tls" && !*cmdVLESSPlain {
+				fmt.Println("* VLESS doesn't encrypt the traffic, reach the upstream by security=tls or '-transport tls', or allow it by -vless-plaintext")
+				return
+			}
+
+			for _, f := range []struct {
+				name string
+				on   bool
+			}{
+				{"-servers", *cmdServers != ""}, {"-mux", *cmdMux > 0}, {"-ecdh", *cmdECDH}, {"-partial", *cmdPartial},
+				{"-reverse", *cmdReverse > 0}, {"-R", *cmdRemoteFwdC != ""}, {"-notice", *cmdNotice}, {"-udp-forward", *cmdUDPFwd != ""},
+				{"-stream-body", *cmdStreamBody},
+			} {
+				if f.on {
+					fmt.Println("*", f.name, "needs a goflyway upstream")
+					return
+				}
+			}
+		} else if is("vmess://") {
+			fmt.Println("* VMess upstreams are not supported, add a VLESS inbound to the server instead")
+			return
+		} else if is("https://") {
 			cc.Connect2Auth, cc.Connect2, _, cc.Upstream = parseAuthURL(*cmdUpstream)
 			fmt.Println("* use HTTPS proxy [", cc.Connect2, "] as the frontend, proxy auth: [", cc.Connect2Auth, "]")
 		} else if gfw, http, ws, cf, fwd, fwdws :=
@@ -213,6 +731,10 @@ func main() {
 			case fwdws, cf, ws:
 				cc.Policy.Set(proxy.PolicyWebSocket)
 				fmt.Println("* use WebSocket protocol to transfer data")
+				if *cmdWSPath != "" {
+					cc.WSPath = "/" + strings.TrimPrefix(*cmdWSPath, "/")
+					fmt.Println("* send WebSocket handshakes to [", cc.WSPath, "]")
+				}
 			case fwd, http:
 				cc.Policy.Set(proxy.PolicyManInTheMiddle)
 				fmt.Println("* use MITM to intercept HTTPS (HTTP proxy mode only)")
@@ -228,6 +750,21 @@ func main() {
 		if *cmdVPN {
 			cc.Policy.Set(proxy.PolicyVPN)
 		}
+
+		if *cmdSniff {
+			fmt.Println("* sniff hostnames of SOCKS requests targeting IPs")
+			cc.Policy.Set(proxy.PolicySniff)
+		}
+
+		if *cmdTunnelLAN {
+			fmt.Println("* proxy LAN destinations through the upstream")
+			cc.Policy.Set(proxy.PolicyTunnelLAN)
+		}
+
+		if *cmdCompress {
+			fmt.Println("* gzip text responses in forward mode")
+			cc.Policy.Set(proxy.PolicyCompress)
+		}
 	}
 
 	if *cmdUpstream == "" || *cmdDebug {
@@ -237,12 +774,191 @@ func main() {
 			ThrottlingMax: *cmdThrotMax,
 			ProxyPassAddr: *cmdProxyPass,
 			DisableUDP:    *cmdDiableUDP,
+			ReverseSOCKS:  *cmdRevSOCKS,
+			SOCKS:         *cmdSOCKS,
+			Sync:          *cmdSync,
+			SyncPeer:      *cmdSyncPeer,
+			RemoteForward: *cmdRemoteFwd,
+			Workers:       int(*cmdWorkers),
+			SkewTolerance: time.Duration(*cmdSkew) * time.Second,
+			DNSCacheTTL:   time.Duration(*cmdSrvDNSTTL) * time.Second,
+			AntiReplay:    *cmdReplay,
+			UsersFile:     *cmdUsers,
+			BlacklistFile: *cmdBlackFile,
+			AccessRules:   access,
+			Tracer:        tracer,
+			KeyEpochs:     epochs,
+		}
+
+		if !configEncrypted {
+			// encrypted ones can't be re-read without the passphrase
+			sc.ConfigFile = *cmdConfig
+		}
+
+		sc.UDPMaxSessions, sc.UDPTimeout = int(*cmdUDPMax), time.Duration(*cmdUDPIdle)*time.Second
+		sc.IPConnRate, sc.IPMaxBridges = int(*cmdIPRate), int(*cmdIPBridges)
+		sc.BlacklistSize, sc.BanThreshold, sc.BanDuration = int(*cmdBlackSize), int(*cmdBanHits), time.Duration(*cmdBanTime)*time.Second
+		sc.BanPrefixV4, sc.BanPrefixV6 = int(*cmdBanV4Len), int(*cmdBanV6Len)
+
+		if *cmdBan != "" {
+			sc.Bans = strings.Split(*cmdBan, ",")
+		}
+
+		scope, err := proxy.ParseThrottlingScope(*cmdThrotBy)
+		if err != nil {
+			fmt.Println("*", err)
+			return
+		}
+		sc.ThrottlingScope = scope
+
+		if *cmdAuditLog != "" || *cmdAuditHook != "" {
+			if sc.Audit, err = proxy.NewAudit(*cmdAuditLog, *cmdAuditHook); err != nil {
+				fmt.Println("* failed to open the audit:", err)
+				return
+			}
+			fmt.Println("* record security events to", strings.Trim(*cmdAuditLog+" "+*cmdAuditHook, " "))
+		}
+
+		if *cmdMaxGo > 0 || *cmdMaxHeap > 0 || *cmdMaxFDs > 0 {
+			sc.Watchdog = &proxy.Watchdog{
+				MaxGoroutines: int(*cmdMaxGo),
+				MaxHeap:       uint64(*cmdMaxHeap) << 20,
+				MaxFDs:        int(*cmdMaxFDs),
+				ProfileDir:    *cmdProfDir,
+			}
+			go sc.Watchdog.Start(5 * time.Second)
+		}
+
+		if *cmdReplay {
+			fmt.Println("* reject replayed requests, clients must be up to date")
+		}
+
+		if proxy.TransportNetwork(transport) == "tcp" {
+			fmt.Println("* the", *cmdTransport, "transport needs the TCP port of -l, the server terminates TLS on it by -acme")
+			return
+		} else if transport != nil {
+			sc.Transports = []proxy.Transport{transport}
+			fmt.Println("* also listen by the", *cmdTransport, "transport")
+		}
+
+		if *cmdACME != "" {
+			sc.TLS = proxy.NewACMEConfig(strings.Split(*cmdACME, ","), *cmdACMEDir, "")
+			fmt.Println("* terminate TLS with certificates of", *cmdACME, "from Let's Encrypt, kept in", *cmdACMEDir)
+		}
+
+		if *cmdECHKey != "" {
+			if sc.TLS == nil {
+				fmt.Println("* -ech-key needs TLS by -acme")
+				return
+			}
+
+			key, err := proxy.LoadECHKey(*cmdECHKey, strings.Split(*cmdACME, ",")[0])
+			if err != nil {
+				fmt.Println("* failed to load the ECH key:", err)
+				return
+			}
+
+			sc.TLS.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{key}
+			fmt.Println("* accept Encrypted Client Hellos, clients use -ech", base64.StdEncoding.EncodeToString(proxy.ECHConfigList(sc.TLS.EncryptedClientHelloKeys)))
+		}
+
+		if *cmdSNI != "" {
+			if sc.TLS == nil {
+				fmt.Println("* -sni needs TLS by -acme")
+				return
+			}
+
+			sc.TLSRoute = *cmdSNI
+			fmt.Println("* connections presenting", sc.TLSRoute, "are of goflyway, others are passed to", sc.ProxyPassAddr)
+		}
+
+		if *cmdRemoteBnd != "" {
+			sc.RemoteBinds = strings.Split(*cmdRemoteBnd, ",")
+		}
+
+		if *cmdHotOrigin != "" {
+			sc.HotOrigins = strings.Split(*cmdHotOrigin, ",")
+			fmt.Println("* keep warm connections to", sc.HotOrigins)
+		}
+
+		if *cmdClasses != "" {
+			if sc.Classes, err = proxy.LoadTrafficClasses(*cmdClasses); err != nil {
+				fmt.Println("* failed to read traffic classes:", err)
+				return
+			}
+			fmt.Println("* traffic classes loaded,", len(sc.Classes), "classes")
+		}
+
+		if *cmdTenants != "" {
+			if sc.Tenants, err = proxy.LoadTenants(*cmdTenants); err != nil {
+				fmt.Println("* failed to read tenants:", err)
+				return
+			}
+			fmt.Println("* tenants loaded,", len(sc.Tenants), "tenants")
+		}
+
+		if *cmdNAT64 != "" {
+			if sc.NAT64, err = proxy.ParseNAT64(*cmdNAT64); err != nil {
+				fmt.Println("* NAT64:", err)
+				return
+			}
+			fmt.Println("* reach IPv4 destinations through NAT64 prefix", sc.NAT64.Prefix.String()+"/96")
+		}
+
+		if *cmdResolvers != "" {
+			if sc.Resolver, err = proxy.ParseResolver(*cmdResolvers); err != nil {
+				fmt.Println("* resolver:", err)
+				return
+			}
+			fmt.Println("* resolve destinations by", *cmdResolvers)
+		}
+
+		if *cmdSSHJumps != "" {
+			if sc.SSHJumps, err = proxy.LoadSSHJumps(*cmdSSHJumps); err != nil {
+				fmt.Println("* SSH jump:", err)
+				return
+			}
+			fmt.Println("* SSH jump hosts loaded,", len(sc.SSHJumps), "bastions")
+		}
+
+		if *cmdShared != "" {
+			state, err := proxy.NewRedisState(*cmdShared)
+			if err == nil {
+				err = state.Ping()
+			}
+			if err != nil {
+				fmt.Println("* shared state:", err)
+				return
+			}
+			sc.State = state
+			fmt.Println("* share state with other servers in [", state.Addr, "]")
+		}
+
+		if *cmdWireGuard != "" {
+			if sc.WireGuard, err = proxy.LoadWireGuard(*cmdWireGuard); err != nil {
+				fmt.Println("* WireGuard:", err)
+				return
+			}
+			if err = sc.WireGuard.Up(); err != nil {
+				fmt.Println("* WireGuard:", err)
+				return
+			}
+			fmt.Println("* dial destinations through WireGuard", *cmdWireGuard)
+		}
+
+		if *cmdUsers != "" {
+			if sc.Users, err = proxy.LoadUsers(*cmdUsers); err != nil {
+				fmt.Println("* failed to read users file:", err)
+				return
+			}
+			fmt.Println("* users file loaded,", len(sc.Users), "users")
 		}
 
 		if *cmdAuth != "" {
-			sc.Users = map[string]proxy.UserConfig{
-				*cmdAuth: {},
+			if sc.Users == nil {
+				sc.Users = map[string]proxy.UserConfig{}
 			}
+			sc.Users[strings.Split(*cmdAuth, ":")[0]] = proxy.UserConfig{Auth: *cmdAuth}
 		}
 	}
 
@@ -252,6 +968,8 @@ func main() {
 	}
 
 	logg.SetLevel(*cmdLogLevel)
+	logg.SetRateLimit(int(*cmdLogRate))
+	logg.SetJSON(*cmdLogJSON)
 	logg.Start()
 
 	if *cmdDebug {
@@ -280,30 +998,326 @@ func main() {
 		localaddr = *cmdLocal
 	}
 
+	if *cmdUpstream != "" && flag.Arg(0) == "ping" {
+		// goflyway [flags] ping [host]
+		host := "www.example.com"
+		if flag.NArg() > 1 {
+			host = flag.Arg(1)
+		}
+
+		failed := false
+		client := proxy.NewClient("127.0.0.1:0", cc)
+		for _, r := range client.Ping(host) {
+			if r.Err != nil {
+				failed = true
+				fmt.Printf("* %-10s FAIL %5dms  %v\n", r.Step, r.Cost/time.Millisecond, r.Err)
+			} else {
+				fmt.Printf("* %-10s OK   %5dms\n", r.Step, r.Cost/time.Millisecond)
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if n, err := proxy.InheritSockets(); err != nil {
+		fmt.Println("*", err)
+		return
+	} else if n > 0 {
+		fmt.Println("*", n, "sockets passed by socket activation, listeners of their addresses use them")
+	}
+
+	if *cmdUpstream != "" {
+		// the sandbox is for the server
+		*cmdChroot, *cmdSandbox = "", false
+	}
+
+	if *cmdPreopen && (*cmdRunAs != "" || *cmdChroot != "" || *cmdSandbox) {
+		if err := preopen(localaddr, sc, transport); err != nil {
+			fmt.Println("* failed to bind listeners:", err)
+			return
+		}
+	}
+
+	var uid, gid int
+	if *cmdRunAs != "" {
+		if uid, gid, err = lookupUser(*cmdRunAs); err != nil {
+			fmt.Println("* failed to run as", *cmdRunAs+":", err)
+			return
+		}
+	}
+
+	if *cmdChroot != "" {
+		if _, err := os.Stat(filepath.Join(*cmdChroot, "etc", "resolv.conf")); err != nil {
+			fmt.Println("* no etc/resolv.conf in", *cmdChroot+", DNS will ask localhost")
+		}
+
+		if err := chroot(*cmdChroot); err != nil {
+			fmt.Println("* failed to chroot:", err)
+			return
+		}
+		fmt.Println("* chroot into", *cmdChroot)
+	}
+
+	if *cmdRunAs != "" {
+		if err := dropPrivileges(uid, gid); err != nil {
+			fmt.Println("* failed to run as", *cmdRunAs+":", err)
+			return
+		}
+		fmt.Println("* listeners bound, run as", *cmdRunAs)
+	}
+
+	if *cmdSandbox {
+		if strings.Contains(*cmdSchedule, "restart") {
+			fmt.Println("* scheduled restarts can't exec in the sandbox")
+			return
+		}
+
+		if err := sandbox(); err != nil {
+			fmt.Println("* failed to sandbox:", err)
+			return
+		}
+		fmt.Println("* sandboxed: exec and privileged syscalls are forbidden")
+	}
+
 	if *cmdUpstream != "" {
 		client := proxy.NewClient(localaddr, cc)
 
 		if *cmdWebConPort != 0 {
 			go func() {
 				addr := fmt.Sprintf("127.0.0.1:%d", *cmdWebConPort)
-				http.HandleFunc("/", lib.WebConsoleHTTPHandler(client))
+				http.HandleFunc("/", lib.WebConsoleHTTPHandler(client, version))
 				fmt.Println("* access client web console at [", addr, "]")
 				logg.F(http.ListenAndServe(addr, nil))
 			}()
 		}
 
+		if *cmdNotice {
+			client.StartNotice()
+		}
+
+		if *cmdReverse > 0 {
+			fmt.Println("* park", *cmdReverse, "reverse tunnels on the upstream")
+			client.StartReverse(int(*cmdReverse))
+		}
+
+		if epochs != nil {
+			go epochs.Start(client.UpdateKey)
+		}
+
+		for _, spec := range strings.Split(*cmdRemoteFwdC, ",") {
+			if spec == "" {
+				continue
+			}
+
+			listen, target, err := proxy.ParseForward(spec)
+			if err != nil {
+				fmt.Println("*", err)
+				return
+			}
+
+			n := int(*cmdReverse)
+			if n <= 0 {
+				n = 4
+			}
+
+			fmt.Println("* remote port forwarding [", listen, "] on the upstream to [", target, "]")
+			client.StartRemoteForward(listen, target, n)
+		}
+
+		for _, spec := range strings.Split(*cmdLocalFwd, ",") {
+			if spec == "" {
+				continue
+			}
+
+			listen, target, err := proxy.ParseForward(spec)
+			if err != nil {
+				fmt.Println("*", err)
+				return
+			}
+
+			fmt.Println("* local port forwarding [", listen, "] to [", target, "] through the upstream")
+			go func() { logg.F(client.StartLocalForward(listen, target)) }()
+		}
+
+		for _, spec := range strings.Split(*cmdUDPFwd, ",") {
+			if spec == "" {
+				continue
+			}
+
+			listen, target, err := proxy.ParseForward(spec)
+			if err != nil {
+				fmt.Println("*", err)
+				return
+			}
+
+			fmt.Println("* UDP port forwarding [", listen, "] to [", target, "] through the upstream")
+			go func() { logg.F(client.StartUDPForward(listen, target)) }()
+		}
+
 		fmt.Println("* proxy", client.Cipher.Alias, "started at [", client.Localaddr, "], upstream: [", client.Upstream, "]")
 		logg.F(client.Start())
 	} else {
 		server := proxy.NewServer(localaddr, sc)
 		fmt.Println("* upstream", server.Cipher.Alias, "started at [", server.Localaddr, "]")
+
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := server.Reload(); err != nil {
+					logg.E("reload: ", err)
+				}
+			}
+		}()
+
+		go func() {
+			term := make(chan os.Signal, 1)
+			signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+			<-term
+			go func() {
+				// a second signal, like Ctrl-C pressed again, doesn't wait for the grace period
+				<-term
+				logg.W("terminating now, open bridges are cut")
+				os.Exit(1)
+			}()
+			terminate(server, time.Duration(*cmdGrace)*time.Second)
+		}()
+
+		if epochs != nil {
+			go epochs.Start(func(string) { logg.L("key rotated, the previous epoch is accepted until the next rotation") })
+		}
+
+		if err := startSchedules(server, *cmdSchedule); err != nil {
+			fmt.Println("*", err)
+			return
+		}
+
 		if strings.HasPrefix(sc.ProxyPassAddr, "http") {
 			fmt.Println("* alternatively act as a reverse proxy:", sc.ProxyPassAddr)
 		} else if sc.ProxyPassAddr != "" {
 			fmt.Println("* alternatively act as a file server:", sc.ProxyPassAddr)
 		}
-		logg.F(server.Start())
+
+		if *cmdAdminPort != 0 {
+			go func() {
+				addr := fmt.Sprintf("127.0.0.1:%d", *cmdAdminPort)
+				http.HandleFunc("/blacklist", lib.ServerAdminHTTPHandler(server))
+				http.HandleFunc("/metrics", lib.ServerMetricsHTTPHandler(server, false))
+				http.HandleFunc("/notice", lib.ServerNoticeHTTPHandler(server))
+				http.HandleFunc("/status", lib.ServerStatusHTTPHandler(server, version))
+				http.HandleFunc("/drain", lib.ServerDrainHTTPHandler(server))
+				http.HandleFunc("/tenant", lib.ServerTenantHTTPHandler(server))
+				http.HandleFunc("/healthz", lib.ServerHealthHTTPHandler(server))
+				http.HandleFunc("/readyz", lib.ServerReadyHTTPHandler(server))
+				fmt.Println("* access server admin API at [", addr, "/blacklist ], [", addr, "/metrics ], [", addr, "/status ] and [", addr, "/drain ]")
+				logg.F(http.ListenAndServe(addr, nil))
+			}()
+		}
+
+		if *cmdMetrics != "" {
+			go func() {
+				mux := http.NewServeMux()
+				mux.HandleFunc("/metrics", lib.ServerMetricsHTTPHandler(server, true))
+				mux.HandleFunc("/tenant", lib.ServerTenantHTTPHandler(server))
+				mux.HandleFunc("/healthz", lib.ServerHealthHTTPHandler(server))
+				mux.HandleFunc("/readyz", lib.ServerReadyHTTPHandler(server))
+				fmt.Println("* access server metrics at [", *cmdMetrics, "/metrics ], probes at [", *cmdMetrics, "/healthz ] and [", *cmdMetrics, "/readyz ]")
+				logg.F(http.ListenAndServe(*cmdMetrics, mux))
+			}()
+		}
+
+		if *cmdAdminAPI != "" {
+			if *cmdAdminTok == "" {
+				fmt.Println("* the admin REST API needs -admin-token")
+				os.Exit(1)
+			}
+
+			go func() {
+				fmt.Println("* access server admin REST API at [", *cmdAdminAPI, "/users ], [", *cmdAdminAPI, "/sessions ] and [", *cmdAdminAPI, "/stats ]")
+				logg.F(http.ListenAndServe(*cmdAdminAPI, lib.ServerAPIHandler(server, *cmdAdminTok, version)))
+			}()
+		}
+
+		if sc.ReverseSOCKS != "" {
+			go func() {
+				fmt.Println("* reverse SOCKS5 started at [", sc.ReverseSOCKS, "]")
+				logg.F(server.StartReverseSOCKS())
+			}()
+		}
+
+		if sc.SOCKS != "" {
+			go func() {
+				fmt.Println("* plain SOCKS5 started at [", sc.SOCKS, "]")
+				logg.F(server.StartSOCKS())
+			}()
+		}
+
+		if sc.Sync != "" {
+			go func() {
+				fmt.Println("* sync with the warm standby", sc.SyncPeer, "at [", sc.Sync, "]")
+				if err := server.StartSync(); err != http.ErrServerClosed {
+					logg.F(err)
+				}
+			}()
+		}
+
+		if err := server.Start(); err != http.ErrServerClosed {
+			logg.F(err)
+		}
+		select {} // shut down by a scheduled restart
+	}
+}
+
+// preopen binds listeners of the client or the server before dropping privileges
+func preopen(localaddr string, sc *proxy.ServerConfig, transport proxy.Transport) error {
+	if *cmdUpstream != "" {
+		if err := proxy.Preopen("tcp", localaddr); err != nil {
+			return err
+		}
+
+		for _, spec := range strings.Split(*cmdLocalFwd, ",") {
+			if listen, _, err := proxy.ParseForward(spec); err == nil {
+				if err := proxy.Preopen("tcp", listen); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, spec := range strings.Split(*cmdUDPFwd, ",") {
+			if listen, _, err := proxy.ParseForward(spec); err == nil {
+				if err := proxy.Preopen("udp", listen); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if sc.Workers > 1 {
+		return errors.New("listeners sharing the port by -workers can't be bound in advance")
+	}
+
+	if err := proxy.Preopen("tcp", localaddr); err != nil {
+		return err
+	}
+
+	if proxy.TransportNetwork(transport) == "udp" {
+		if err := proxy.Preopen("udp", localaddr); err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range []string{sc.SOCKS, sc.ReverseSOCKS, sc.Sync} {
+		if addr != "" {
+			if err := proxy.Preopen("tcp", addr); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 func parseAuthURL(in string) (auth string, upstream string, header string, dummy string) {
@@ -0,0 +1,48 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// lookupUser returns the uid and the primary gid of the user, before chrooting away from /etc/passwd
+func lookupUser(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+	return uid, gid, nil
+}
+
+// dropPrivileges switches to the user and its primary group for good, listeners must be bound before
+func dropPrivileges(uid, gid int) error {
+	// groups first, they can't be changed without root
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// chroot confines the filesystem to dir, files opened later like the users file and the blacklist file
+// are resolved inside it, so is /etc/resolv.conf for DNS
+func chroot(dir string) error {
+	// the local time zone is loaded lazily from /etc/localtime
+	time.Now().Zone()
+
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return os.Chdir("/")
+}
@@ -0,0 +1,15 @@
+package main
+
+import "errors"
+
+func lookupUser(name string) (uid, gid int, err error) {
+	return 0, 0, errors.New("not supported on Windows")
+}
+
+func dropPrivileges(uid, gid int) error {
+	return errors.New("not supported on Windows")
+}
+
+func chroot(dir string) error {
+	return errors.New("not supported on Windows")
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const canRestart = true
+
+// execSelf replaces the process with the same executable and arguments, listeners are closed on exec
+func execSelf() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,9 @@
+package main
+
+import "errors"
+
+const canRestart = false
+
+func execSelf() error {
+	return errors.New("not supported on Windows")
+}
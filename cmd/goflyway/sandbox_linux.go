@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs        = 38
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	bpfLdWAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+
+	x32SyscallBit = 0x40000000
+)
+
+type sockFilter struct {
+	code   uint16
+	jt, jf uint8
+	k      uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// sandbox forbids exec and the syscalls a proxy never needs, like ptrace, mount and loading kernel modules,
+// in all threads and for good, they fail with EPERM
+func sandbox() error {
+	if auditArch == 0 {
+		return errors.New("not supported on " + runtime.GOARCH)
+	}
+
+	deny := seccompRetErrno | uint32(syscall.EPERM)
+	n := len(deniedSyscalls)
+	f := []sockFilter{
+		{bpfLdWAbs, 0, 0, 4}, // seccomp_data.arch
+		{bpfJeqK, 1, 0, auditArch},
+		{bpfRetK, 0, 0, deny},
+		{bpfLdWAbs, 0, 0, 0}, // seccomp_data.nr
+		{bpfJgeK, uint8(n + 1), 0, x32SyscallBit},
+	}
+
+	for i, nr := range deniedSyscalls {
+		f = append(f, sockFilter{bpfJeqK, uint8(n - i), 0, nr})
+	}
+	f = append(f, sockFilter{bpfRetK, 0, 0, seccompRetAllow}, sockFilter{bpfRetK, 0, 0, deny})
+
+	prog := sockFprog{len: uint16(len(f)), filter: &f[0]}
+
+	// no_new_privs of the calling thread is synchronized to the others along with the filter
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); e != 0 {
+		return e
+	}
+
+	if r, _, e := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog))); e != 0 {
+		return e
+	} else if r != 0 {
+		return errors.New("thread " + strconv.Itoa(int(r)) + " can't be sandboxed")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "syscall"
+
+const (
+	auditArch  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp = 317
+)
+
+// syscall doesn't define the newer ones on amd64
+var deniedSyscalls = []uint32{
+	syscall.SYS_EXECVE,
+	322, // execveat
+	syscall.SYS_PTRACE,
+	310, // process_vm_readv
+	311, // process_vm_writev
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_UNSHARE,
+	308, // setns
+	syscall.SYS_INIT_MODULE,
+	313, // finit_module
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_KEXEC_LOAD,
+	320, // kexec_file_load
+	syscall.SYS_REBOOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_PERSONALITY,
+	321, // bpf
+	323, // userfaultfd
+	syscall.SYS_PERF_EVENT_OPEN,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_KEYCTL,
+}
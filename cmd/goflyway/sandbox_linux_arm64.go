@@ -0,0 +1,37 @@
+package main
+
+import "syscall"
+
+const (
+	auditArch  = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp = syscall.SYS_SECCOMP
+)
+
+var deniedSyscalls = []uint32{
+	syscall.SYS_EXECVE,
+	syscall.SYS_EXECVEAT,
+	syscall.SYS_PTRACE,
+	syscall.SYS_PROCESS_VM_READV,
+	syscall.SYS_PROCESS_VM_WRITEV,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_SETNS,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_FINIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_KEXEC_LOAD,
+	294, // kexec_file_load
+	syscall.SYS_REBOOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_PERSONALITY,
+	syscall.SYS_BPF,
+	282, // userfaultfd
+	syscall.SYS_PERF_EVENT_OPEN,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_KEYCTL,
+}
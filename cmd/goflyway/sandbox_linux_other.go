@@ -0,0 +1,10 @@
+// +build linux,!amd64,!arm64
+
+package main
+
+const (
+	auditArch  = 0 // not supported
+	sysSeccomp = 0
+)
+
+var deniedSyscalls []uint32
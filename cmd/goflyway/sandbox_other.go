@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func sandbox() error {
+	return errors.New("only supported on Linux")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+	"github.com/coyove/goflyway/proxy"
+)
+
+// open bridges are cut after this when restarting
+const restartDeadline = 30 * time.Second
+
+// startSchedules runs the maintenance tasks of -schedule, e.g. "logrotate=0 4 * * *;restart=30 4 * * 1"
+func startSchedules(server *proxy.ProxyUpstream, spec string) error {
+	tasks := map[string]func(){
+		"logrotate": func() {
+			if err := logg.Rotate(); err != nil {
+				logg.E("rotate log: ", err)
+			}
+		},
+		"blacklist": func() {
+			if err := server.SaveBlacklist(); err != nil {
+				logg.E("save blacklist: ", err)
+			}
+		},
+		"reload": func() {
+			if err := server.Reload(); err != nil {
+				logg.E("reload: ", err)
+			}
+		},
+		"restart": func() { restart(server) },
+	}
+
+	type job struct {
+		name string
+		s    *proxy.Schedule
+	}
+
+	jobs := []job{}
+	for _, item := range strings.Split(spec, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		idx := strings.Index(item, "=")
+		if idx == -1 {
+			return fmt.Errorf("invalid schedule: %s, form: task=min hour day month weekday", item)
+		}
+
+		name := strings.TrimSpace(item[:idx])
+		if tasks[name] == nil {
+			return fmt.Errorf("unknown scheduled task: %s", name)
+		}
+
+		if name == "restart" && !canRestart {
+			return fmt.Errorf("scheduled restart is not supported on this system")
+		}
+
+		s, err := proxy.ParseSchedule(item[idx+1:])
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job{name, s})
+	}
+
+	for _, j := range jobs {
+		fmt.Println("* scheduled", j.name, "next at", j.s.Next(time.Now()).Format("2006-01-02 15:04"))
+		go j.s.Start(tasks[j.name])
+	}
+	return nil
+}
+
+// restart stops accepting, waits for open bridges up to restartDeadline, saves the blacklist
+// and replaces the process with a new one of the same arguments
+func restart(server *proxy.ProxyUpstream) {
+	logg.L("scheduled restart, ", len(server.IO.OpenBridges()), " bridges open")
+
+	ctx, cancel := context.WithTimeout(context.Background(), restartDeadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logg.W("restart: ", err)
+	}
+
+	if err := server.SaveBlacklist(); err != nil {
+		logg.E("save blacklist: ", err)
+	}
+
+	logg.F("restart: ", execSelf())
+}
+
+// terminate handles SIGTERM of container runtimes: the server drains so /readyz fails and clients move
+// to other upstreams, open bridges are waited for up to grace, then the blacklist is saved and it exits
+func terminate(server *proxy.ProxyUpstream, grace time.Duration) {
+	logg.L("terminating, ", len(server.IO.OpenBridges()), " bridges open, grace period ", grace)
+	server.Drain(grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logg.W("terminate: ", err)
+	}
+
+	if err := server.SaveBlacklist(); err != nil {
+		logg.E("save blacklist: ", err)
+	}
+	os.Exit(0)
+}
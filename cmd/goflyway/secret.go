@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/coyove/goflyway/proxy"
+)
+
+const keychainSvc = "goflyway"
+
+// configPassphrase returns the passphrase of encrypted configs, it is looked up in the OS keychain
+// (account "config", see -keychain) first, then prompted
+func configPassphrase(prompt string) (string, error) {
+	if pass, err := keychainGet("config"); err == nil {
+		return pass, nil
+	}
+	return readPassphrase(prompt)
+}
+
+// manageKeychain runs -keychain <op>[:<account>], the account is "password" by default,
+// set stores a prompted secret, delete removes it
+func manageKeychain(arg string) error {
+	op, account := arg, "password"
+	if idx := strings.Index(arg, ":"); idx > -1 {
+		op, account = arg[:idx], arg[idx+1:]
+	}
+
+	switch op {
+	case "set":
+		secret, err := readPassphrase(account + ": ")
+		if err != nil {
+			return err
+		}
+
+		if again, err := readPassphrase("again: "); err != nil {
+			return err
+		} else if again != secret || secret == "" {
+			return errors.New("secrets are empty or don't match")
+		}
+		return keychainSet(account, secret)
+	case "delete":
+		return keychainDelete(account)
+	default:
+		return errors.New("unknown keychain operation: " + op)
+	}
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase prompts on stderr and reads a line from stdin, echo is turned off if possible
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if runtime.GOOS != "windows" {
+		stty := func(arg string) {
+			cmd := exec.Command("stty", arg)
+			cmd.Stdin = os.Stdin
+			cmd.Run()
+		}
+		stty("-echo")
+		defer stty("echo")
+	}
+
+	line, err := stdin.ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// encryptConfigFile encrypts in into out with a passphrase prompted twice
+func encryptConfigFile(in, out string) error {
+	buf, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+
+	if proxy.IsEncryptedConfig(buf) {
+		return errors.New(in + " is already encrypted")
+	}
+
+	pass, err := readPassphrase("passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	if again, err := readPassphrase("again: "); err != nil {
+		return err
+	} else if again != pass || pass == "" {
+		return errors.New("passphrases are empty or don't match")
+	}
+
+	if buf, err = proxy.EncryptConfig(buf, pass); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, buf, 0600)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/coyove/goflyway/proxy"
+)
+
+// printStatus queries the web console of the local client, or the admin API of the local server,
+// and prints its status, asJSON prints the response as is for scripts and monitoring agents
+func printStatus(asJSON bool) error {
+	port := *cmdAdminPort
+	if *cmdUpstream != "" {
+		port = *cmdWebConPort
+	}
+
+	if port == 0 {
+		return fmt.Errorf("the web console (-web-port) or admin API (-admin-port) is disabled")
+	}
+
+	c := &http.Client{Timeout: 5 * time.Second}
+	resp, err := c.Get(fmt.Sprintf("http://127.0.0.1:%d/status", port))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		os.Stdout.Write(buf)
+		return nil
+	}
+
+	var s proxy.Status
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+
+	fmt.Println("* version:  ", s.Version)
+	fmt.Println("* role:     ", s.Role)
+	if s.Upstream != "" {
+		fmt.Println("* upstream: ", s.Upstream)
+	}
+	fmt.Println("* uptime:   ", time.Duration(s.Uptime)*time.Second)
+	fmt.Println("* bridges:  ", s.Bridges)
+	if s.Latency > 0 {
+		fmt.Printf("* latency:   %.0fms (min %.0fms, max %.0fms)\n", s.Latency, s.LatencyMin, s.LatencyMax)
+	}
+	fmt.Printf("* traffic:   sent %.2fMB, received %.2fMB\n", float64(s.Sent)/1024/1024, float64(s.Received)/1024/1024)
+	fmt.Printf("* skew:      %.0fs\n", s.ClockSkew)
+
+	ups := make([]string, 0, len(s.Bandwidth))
+	for up := range s.Bandwidth {
+		ups = append(ups, up)
+	}
+	sort.Strings(ups)
+	for _, up := range ups {
+		b := s.Bandwidth[up]
+		fmt.Printf("* speed:     %s up %.2fMB/s, down %.2fMB/s\n", up, b.Up/1024/1024, b.Down/1024/1024)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package aclrouter
+
+import "strings"
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloom is a bloom filter of all domains in the fast match tree, a miss on every
+// suffix of a domain means the tree can't match it, so the walk can be skipped
+type bloom struct {
+	bits []uint64
+}
+
+func newBloom(n int) *bloom {
+	m := (n*bloomBitsPerKey + 63) / 64
+	if m == 0 {
+		m = 1
+	}
+	return &bloom{bits: make([]uint64, m)}
+}
+
+func fnv64a(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (b *bloom) add(s string) {
+	h := fnv64a(s)
+	h1, h2, m := h&0xffffffff, h>>32, uint64(len(b.bits))*64
+	for i := uint64(0); i < bloomHashes; i++ {
+		x := (h1 + i*h2) % m
+		b.bits[x/64] |= 1 << (x % 64)
+	}
+}
+
+func (b *bloom) has(s string) bool {
+	h := fnv64a(s)
+	h1, h2, m := h&0xffffffff, h>>32, uint64(len(b.bits))*64
+	for i := uint64(0); i < bloomHashes; i++ {
+		x := (h1 + i*h2) % m
+		if b.bits[x/64]&(1<<(x%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSuffix checks "com", "example.com", "www.example.com" of "www.example.com"
+func (b *bloom) hasSuffix(domain string) bool {
+	for i := len(domain); i >= 0; {
+		j := strings.LastIndexByte(domain[:i], '.')
+		if b.has(domain[j+1:]) {
+			return true
+		}
+		i = j
+	}
+	return false
+}
+
+// compile builds the bloom filter from the fast match tree, it must be called after all rules are added
+func (lk *lookup) compile() {
+	domains := []string{}
+
+	var walk func(tree matchTree, suffix string)
+	walk = func(tree matchTree, suffix string) {
+		for k, v := range tree {
+			d := k
+			if suffix != "" {
+				d = k + "." + suffix
+			}
+
+			switch v.(type) {
+			case matchTree:
+				walk(v.(matchTree), d)
+			case int:
+				domains = append(domains, d)
+			}
+		}
+	}
+	walk(lk.DomainFastMatch, "")
+
+	lk.bloom = newBloom(len(domains))
+	for _, d := range domains {
+		lk.bloom.add(d)
+	}
+}
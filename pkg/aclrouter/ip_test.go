@@ -1,7 +1,10 @@
 package aclrouter
 
 import (
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -95,3 +98,194 @@ func TestIPv4ToInt(t *testing.T) {
 	test("0.1.2.3.4", false)
 	test("0.1.2.257", false)
 }
+
+func TestPrivateCheck(t *testing.T) {
+	acl := &ACL{}
+	acl.init()
+
+	for _, host := range []string{"192.168.1.1", "169.254.10.20", "[::1]", "[fe80::1%eth0]", "[fd00::1]"} {
+		if r, _, _ := acl.Check(host, true); r != RulePrivate {
+			t.Error("should be private:", host)
+		}
+	}
+
+	for _, host := range []string{"169.255.0.1", "[2001:db8::1]", "[::ffff:10.0.0.1]"} {
+		if r, _, _ := acl.Check(host, true); r == RulePrivate {
+			t.Error("should not be private:", host)
+		}
+	}
+}
+
+func TestSpecialUseDomain(t *testing.T) {
+	test := func(host string, special, blocked bool) {
+		if s, b := SpecialUseDomain(host); s != special || b != blocked {
+			t.Error("special-use check failed:", host)
+		}
+	}
+
+	test("printer.local", true, false)
+	test("nas.home.arpa.", true, false)
+	test("localhost", true, false)
+	test("router", true, false)
+	test("facebookcorewwwi.onion", true, true)
+	test("foo.invalid", true, true)
+	test("www.example.com", false, false)
+	test("local.example.com", false, false)
+	test("[::1]", false, false)
+	test("1.2.3.4", false, false)
+	test("nas.lan", false, false) // not special-use, see local_domain_list
+
+	path := filepath.Join(t.TempDir(), "acl.conf")
+	ioutil.WriteFile(path, []byte("[local_domain_list]\nLAN\ncorp.example.\n"), 0644)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, special := range map[string]bool{
+		"nas.lan":             true,
+		"lan":                 true,
+		"git.corp.example":    true,
+		"printer.local":       true,
+		"www.example":         false,
+		"planet.com":          false,
+		"www.notcorp.example": false,
+	} {
+		if s, b := acl.SpecialUseDomain(host); s != special || b {
+			t.Error("local domains check failed:", host, s, b)
+		}
+	}
+	if _, b := acl.SpecialUseDomain("foo.invalid"); !b {
+		t.Error("special-use names should still be blocked")
+	}
+
+	acl = nil
+	if s, _ := acl.SpecialUseDomain("printer.local"); !s {
+		t.Error("a nil ACL should know special-use names")
+	}
+	if s, _ := acl.SpecialUseDomain("nas.lan"); s {
+		t.Error("a nil ACL has no local domains")
+	}
+}
+
+func bigLookup(n int) *lookup {
+	lk := &lookup{}
+	lk.init()
+	for i := 0; i < n; i++ {
+		lk.tryAddACLSingleRule(`(^|\.)d` + strconv.Itoa(i) + `\.example` + strconv.Itoa(i%100) + `\.com$`)
+	}
+	lk.compile()
+	return lk
+}
+
+func TestCompiledMatch(t *testing.T) {
+	lk := bigLookup(1000)
+	lk.tryAddACLSingleRule(`^slow\.`)
+
+	test := func(m string, assert bool) {
+		if lk.Match(m) != assert {
+			t.Error("compiled lookup failed:", m)
+		}
+	}
+
+	test("d10.example10.com", true)
+	test("www.d999.example99.com", true)
+	test("d10.example11.com", false)
+	test("example10.com", false)
+	test("slow.example.org", true)
+	test("localhost", false)
+}
+
+func BenchmarkMatchHit(b *testing.B) {
+	lk := bigLookup(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lk.Match("www.d12345.example45.com")
+	}
+}
+
+func BenchmarkMatchMiss(b *testing.B) {
+	lk := bigLookup(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lk.Match("www.not-in-the-list.org")
+	}
+}
+
+func TestRulePrecedence(t *testing.T) {
+	acl := &ACL{}
+	acl.init()
+
+	acl.Gray.tryAddACLSingleRule(`*.example.com`)
+	acl.Gray.tryAddACLSingleRule(`^ads[0-9]+\.`)
+	acl.Gray.tryAddACLSingleRule(`tracker*.example.org`)
+	acl.White.tryAddACLSingleRule(`=cdn.example.com`)
+	acl.White.tryAddACLSingleRule(`shop.example.com`)
+	acl.White.tryAddACLSingleRule(`(^|\.)static\.example\.com$`)
+	acl.White.tryAddACLSingleRule(`(^|\.)ads1\.example\.net$`)
+	acl.Black.tryAddACLSingleRule(`^bad\.example\.com$`)
+	for _, lk := range []*lookup{&acl.Black, &acl.Gray, &acl.White} {
+		lk.compile()
+	}
+
+	for host, want := range map[string]byte{
+		"www.example.com":        RuleMatchedProxy, // wildcard
+		"cdn.example.com":        RuleMatchedPass,  // exact beats wildcard
+		"img.cdn.example.com":    RuleMatchedProxy, // exact doesn't cover subdomains
+		"shop.example.com":       RuleMatchedPass,  // bare domains are suffixes
+		"eu.shop.example.com":    RuleMatchedPass,
+		"a.static.example.com":   RuleMatchedPass, // longer suffix beats wildcard
+		"bad.example.com":        RuleBlock,
+		"ads12.example.net":      RuleMatchedProxy, // regex
+		"ads1.example.net":       RuleMatchedPass,  // suffix beats regex
+		"tracker-eu.example.org": RuleMatchedProxy, // glob
+	} {
+		if r, ok := acl.matchDomain(host); !ok || r != want {
+			t.Error("rule of", host, "is", r, "want", want)
+		}
+	}
+
+	for _, host := range []string{"example.com", "a.b.tracker.example.org", "xcdn.example.com.cn"} {
+		if r, ok := acl.matchDomain(host); ok {
+			t.Error(host, "should not match, got", r)
+		}
+	}
+}
+
+func TestResolveRemotely(t *testing.T) {
+	acl := &ACL{}
+	acl.init()
+	acl.Gray.tryAddACLSingleRule(`1.0.0.0/8`)
+	acl.Gray.sortLookupTable()
+	acl.RemoteResolve.tryAddACLSingleRule(`*.poisoned.com`)
+	acl.LocalResolve.tryAddACLSingleRule(`=cdn.poisoned.com`)
+
+	if acl.ResolvesRemotely("www.poisoned.com") {
+		t.Error("nothing is resolved remotely without a resolver")
+	}
+
+	acl.Resolver = func(host string) (net.IP, error) { return net.IP{1, 2, 3, 4}, nil }
+	for host, want := range map[string]bool{
+		"www.poisoned.com": true,
+		"cdn.poisoned.com": false, // exact beats wildcard
+		"www.example.com":  false,
+	} {
+		if acl.ResolvesRemotely(host) != want {
+			t.Error(host, "should be resolved remotely:", want)
+		}
+	}
+
+	if r, ip, err := acl.Check("www.poisoned.com", false); r != RuleMatchedProxy || ip != "1.2.3.4" || err != nil {
+		t.Error("IP rules should be checked against the remote answer:", r, ip, err)
+	}
+
+	acl.Resolver = func(host string) (net.IP, error) { return net.IP{10, 0, 0, 1}, nil }
+	if r, _, _ := acl.Check("www.poisoned.com", false); r != RuleMatchedProxy {
+		t.Error("private IPs behind the tunnel should be proxied:", r)
+	}
+
+	acl.ResolveRemote = true
+	if !acl.ResolvesRemotely("www.example.com") || acl.ResolvesRemotely("cdn.poisoned.com") {
+		t.Error("local_dns_list should override resolve_remote")
+	}
+}
@@ -6,6 +6,9 @@ var (
 127.0.0.0/8
 172.16.0.0 172.31.255.255
 192.168.0.0 192.168.255.255`
+
+	// LinkLocalIP is where printers and other zero-config devices live when there is no DHCP
+	LinkLocalIP = `169.254.0.0/16`
 )
 
 var (
@@ -6,6 +6,7 @@ import (
 	"net"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/coyove/goflyway/pkg/config"
 )
@@ -15,16 +16,22 @@ type matchTree map[string]interface{}
 type ipRange struct{ start, end uint32 }
 
 type lookup struct {
-	Always          bool
-	DomainFastMatch matchTree
-	DomainSlowMatch []*regexp.Regexp
-	IPv4Table       []ipRange
+	Always              bool
+	DomainExactMatch    map[string]bool // example.com
+	DomainWildcardMatch map[string]bool // *.example.com, keyed by example.com
+	DomainFastMatch     matchTree       // (^|\.)example\.com$
+	DomainSlowMatch     []*regexp.Regexp
+	IPv4Table           []ipRange
+
+	bloom *bloom
 }
 
 func (lk *lookup) init() {
 	lk.IPv4Table = make([]ipRange, 0)
 	lk.DomainSlowMatch = make([]*regexp.Regexp, 0)
 	lk.DomainFastMatch = make(matchTree)
+	lk.DomainExactMatch = make(map[string]bool)
+	lk.DomainWildcardMatch = make(map[string]bool)
 }
 
 const (
@@ -48,13 +55,26 @@ type ACL struct {
 	RemoteDNS        bool
 	Legacy           bool
 	OmitRules        []string
+
+	// domains are resolved through the tunnel before checking IP rules if they match RemoteResolve,
+	// or ResolveRemote is set and they don't match LocalResolve, the more specific rule wins if both match,
+	// Resolver is set by the client to do the remote resolving, nil disables it
+	RemoteResolve lookup
+	LocalResolve  lookup
+	ResolveRemote bool
+	Resolver      func(host string) (net.IP, error)
+
+	// LocalDomains are suffixes of names of the LAN like lan or corp, never tunneled like special-use names
+	LocalDomains []string
 }
 
 func (acl *ACL) init() {
 	acl.White.init()
 	acl.Gray.init()
 	acl.Black.init()
-	acl.PrivateIPv4Table = sortLookupTable(linesToRange(PrivateIP))
+	acl.RemoteResolve.init()
+	acl.LocalResolve.init()
+	acl.PrivateIPv4Table = sortLookupTable(linesToRange(PrivateIP + "\n" + LinkLocalIP))
 	acl.RemoteDNS = true
 	acl.OmitRules = make([]string, 0)
 }
@@ -92,6 +112,7 @@ func LoadACL(path string) (*ACL, error) {
 	acl.Gray.Always = cf.HasSection("proxy_all")
 	acl.White.Always = cf.HasSection("bypass_all")
 	acl.RemoteDNS = !cf.HasSection("local_dns")
+	acl.ResolveRemote = cf.HasSection("resolve_remote")
 
 	if acl.Gray.Always && acl.White.Always {
 		return acl.postInit(), errors.New("proxy_all and bypass_all collide")
@@ -107,12 +128,25 @@ func LoadACL(path string) (*ACL, error) {
 
 	cf.Iterate("bypass_list", adder(&acl.White))
 	acl.White.sortLookupTable()
+	acl.White.compile()
 
 	cf.Iterate("proxy_list", adder(&acl.Gray))
 	acl.Gray.sortLookupTable()
+	acl.Gray.compile()
 
 	cf.Iterate("outbound_block_list", adder(&acl.Black))
 	acl.Black.sortLookupTable()
+	acl.Black.compile()
+
+	cf.Iterate("remote_dns_list", adder(&acl.RemoteResolve))
+	acl.RemoteResolve.compile()
+
+	cf.Iterate("local_dns_list", adder(&acl.LocalResolve))
+	acl.LocalResolve.compile()
+
+	cf.Iterate("local_domain_list", func(key string) {
+		acl.LocalDomains = append(acl.LocalDomains, strings.Trim(strings.ToLower(key), "."))
+	})
 
 	// fmt.Println(IPv4ToInt("47.97.161.219"))
 	// fmt.Println(acl.White.IPv4Table)
@@ -146,6 +180,7 @@ func loadChinaList(buf []byte) (*ACL, error) {
 		}
 	}
 
+	acl.White.compile()
 	return acl, nil
 }
 
@@ -185,6 +220,92 @@ func (acl *ACL) IsPrivateIP(ip string) bool {
 	return isIPInLookupTable(ip, acl.PrivateIPv4Table)
 }
 
+// IsPrivateIPv6 checks if the given (bracketed) IPv6 is loopback, link-local or unique local
+func IsPrivateIPv6(host string) bool {
+	host = strings.Trim(host, "[]")
+	if idx := strings.Index(host, "%"); idx > -1 {
+		// strip the zone
+		host = host[:idx]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return false
+	}
+
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip[0]&0xfe == 0xfc
+}
+
+var (
+	chinaIPv4Table []ipRange
+	chinaIPv4Once  sync.Once
+)
+
+// IsChinaIP checks if the given IPv4 is in ChinaIP, there are no IPv6 ranges in it
+func IsChinaIP(ip string) bool {
+	chinaIPv4Once.Do(func() { chinaIPv4Table = sortLookupTable(linesToRange(ChinaIP)) })
+	return isIPInLookupTable(ip, chinaIPv4Table)
+}
+
+// HostMatcher matches hosts against rules written in the same forms as ACL lists
+type HostMatcher struct{ lk lookup }
+
+func NewHostMatcher(rules []string) (*HostMatcher, error) {
+	m := &HostMatcher{}
+	m.lk.init()
+	for _, r := range rules {
+		if err := m.lk.tryAddACLSingleRule(r); err != nil {
+			return nil, err
+		}
+	}
+
+	m.lk.sortLookupTable()
+	m.lk.compile()
+	return m, nil
+}
+
+// Match checks host against domain rules, IPv4 hosts are also checked against CIDR rules
+func (m *HostMatcher) Match(host string) bool {
+	if iip := IPv4ToInt(host); iip > 0 && isIPInLookupTableI(iip, m.lk.IPv4Table) {
+		return true
+	}
+	return m.lk.Match(host)
+}
+
+// matchDomain checks host against the domain rules of all lists, the most specific match wins:
+// exact names first, then the longest suffix (wildcards included), then regexes,
+// ties are broken in the order of Black, Gray and White
+func (acl *ACL) matchDomain(host string) (byte, bool) {
+	rule, best := byte(RuleUnknown), matchNone
+	for _, l := range []struct {
+		lk   *lookup
+		rule byte
+	}{
+		{&acl.Black, RuleBlock},
+		{&acl.Gray, RuleMatchedProxy},
+		{&acl.White, RuleMatchedPass},
+	} {
+		if m := l.lk.match(host); m > best {
+			rule, best = l.rule, m
+		}
+	}
+
+	return rule, best > matchNone
+}
+
+// ResolvesRemotely reports whether host should be resolved through the tunnel
+func (acl *ACL) ResolvesRemotely(host string) bool {
+	if acl.Resolver == nil {
+		return false
+	}
+
+	remote, local := acl.RemoteResolve.match(host), acl.LocalResolve.match(host)
+	if remote == matchNone && local == matchNone {
+		return acl.ResolveRemote
+	}
+	return remote > local
+}
+
 // Check returns a route rule for the given host
 func (acl *ACL) Check(host string, trustIP bool) (rule byte, strIP string, err error) {
 	var ip *net.IPAddr
@@ -200,30 +321,47 @@ func (acl *ACL) Check(host string, trustIP bool) (rule byte, strIP string, err e
 		goto IP_CHECK
 	}
 
-	if acl.Black.Match(host) {
-		return RuleBlock, host, nil
-	} else if acl.Gray.Match(host) {
-		return RuleMatchedProxy, host, nil
-	} else if acl.White.Match(host) {
-		return RuleMatchedPass, host, nil
+	if rule, ok := acl.matchDomain(host); ok {
+		return rule, host, nil
 	}
 
 	if host[0] == '[' && host[len(host)-1] == ']' {
+		if IsPrivateIPv6(host) {
+			return RulePrivate, host, nil
+		}
+
 		// Naive match: host is IPv6
 		// We assume that local don't have the ability to resolve IPv6,
 		// so return RuleIPv6 and let the caller deal with it
 		return RuleIPv6, host, nil
 	}
 
-	// Resolve at local in case host points to a private ip
-	ip, err = net.ResolveIPAddr("ip4", host)
-	if err != nil {
-		return RuleUnknown, "unknown", err
-	}
+	if acl.ResolvesRemotely(host) {
+		// local DNS may be poisoned, the answer from the tunnel is trusted
+		rip, err := acl.Resolver(host)
+		if err == nil && rip == nil {
+			err = errors.New("tunnel can't resolve " + host)
+		}
+		if err != nil {
+			return RuleUnknown, "unknown", err
+		}
+
+		ip, trustIP = &net.IPAddr{IP: rip}, true
+		if iip = NetIPv4ToInt(rip); isIPInLookupTableI(iip, acl.PrivateIPv4Table) {
+			// private on the other side of the tunnel
+			return RuleMatchedProxy, ip.String(), nil
+		}
+	} else {
+		// Resolve at local in case host points to a private ip
+		ip, err = net.ResolveIPAddr("ip4", host)
+		if err != nil {
+			return RuleUnknown, "unknown", err
+		}
 
-	iip = NetIPv4ToInt(ip.IP)
-	if isIPInLookupTableI(iip, acl.PrivateIPv4Table) {
-		return RulePrivate, ip.String(), nil
+		iip = NetIPv4ToInt(ip.IP)
+		if isIPInLookupTableI(iip, acl.PrivateIPv4Table) {
+			return RulePrivate, ip.String(), nil
+		}
 	}
 
 	strIP = ip.String()
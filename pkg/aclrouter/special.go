@@ -0,0 +1,52 @@
+package aclrouter
+
+import "strings"
+
+// special-use suffixes (RFC 6761, RFC 6762, RFC 8375, RFC 7686) which should never be tunneled,
+// true means the name can't be resolved anywhere and should be blocked. Names of LANs like .lan
+// aren't special-use, they go in local_domain_list of the ACL file, see ACL.SpecialUseDomain
+var specialUseSuffixes = map[string]bool{
+	"local":     false, // mDNS
+	"localhost": false,
+	"home.arpa": false,
+	"test":      false,
+	"invalid":   true,
+	"onion":     true,
+}
+
+// SpecialUseDomain checks whether host is a special-use name, single-label names
+// (resolved by LLMNR/NetBIOS) are also treated as special-use
+func SpecialUseDomain(host string) (special, blocked bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || host[0] == '[' {
+		return false, false
+	}
+
+	if !strings.Contains(host, ".") {
+		return true, specialUseSuffixes[host]
+	}
+
+	for suffix, blocked := range specialUseSuffixes {
+		if strings.HasSuffix(host, "."+suffix) {
+			return true, blocked
+		}
+	}
+
+	return false, false
+}
+
+// SpecialUseDomain is the package's SpecialUseDomain, names under LocalDomains are special-use too,
+// a nil ACL has no LocalDomains
+func (acl *ACL) SpecialUseDomain(host string) (special, blocked bool) {
+	if special, blocked = SpecialUseDomain(host); special || acl == nil {
+		return
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range acl.LocalDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true, false
+		}
+	}
+	return false, false
+}
@@ -10,6 +10,14 @@ import (
 
 var validDomain = regexp.MustCompile(`^[a-zA-Z0-9.\-_]+$`)
 
+// specificity of a domain match, suffix matches add the number of labels in the suffix
+const (
+	matchNone   = 0
+	matchRegex  = 1
+	matchSuffix = 2
+	matchExact  = 1 << 16
+)
+
 func linesToRange(lines string) []ipRange {
 	l := strings.Split(lines, "\n")
 	ret := make([]ipRange, 0, len(l))
@@ -72,33 +80,51 @@ func (lk *lookup) sortLookupTable() {
 	lk.IPv4Table = sortLookupTable(lk.IPv4Table)
 }
 
+// tryAddACLSingleRule adds a rule of these forms:
+//
+//	example.com           matches example.com and its subdomains
+//	(^|\.)example\.com$   same as above
+//	=example.com          matches example.com only
+//	^example\.com$        same as above
+//	*.example.com         matches subdomains of example.com
+//	ads*.example.com      '*' matches any characters except dots
+//	1.2.3.0/24            IPv4 CIDR
+//
+// anything else is treated as a regex
 func (lk *lookup) tryAddACLSingleRule(r string) error {
+	if d := strings.TrimPrefix(r, "="); d != r && validDomain.MatchString(d) {
+		lk.DomainExactMatch[strings.ToLower(d)] = true
+		return nil
+	}
+
+	if validDomain.MatchString(r) && strings.Trim(r, ".") != "" {
+		lk.addSuffix(strings.Trim(r, "."))
+		return nil
+	}
+
+	if strings.HasPrefix(r, "^") && strings.HasSuffix(r, "$") {
+		if rx := strings.Replace(r[1:len(r)-1], "\\.", ".", -1); validDomain.MatchString(rx) {
+			lk.DomainExactMatch[strings.ToLower(rx)] = true
+			return nil
+		}
+	}
+
+	if strings.Contains(r, "*") && validDomain.MatchString(strings.Replace(r, "*", "", -1)) {
+		if suffix := r[2:]; strings.HasPrefix(r, "*.") && !strings.Contains(suffix, "*") {
+			lk.DomainWildcardMatch[strings.ToLower(suffix)] = true
+			return nil
+		}
+
+		glob := strings.Replace(regexp.QuoteMeta(strings.ToLower(r)), "\\*", "[^.]*", -1)
+		lk.DomainSlowMatch = append(lk.DomainSlowMatch, regexp.MustCompile("^"+glob+"$"))
+		return nil
+	}
+
 	rx := strings.Replace(r, "\\.", ".", -1)
 	if strings.HasPrefix(rx, "(^|.)") && strings.HasSuffix(rx, "$") {
 		rx = rx[5 : len(rx)-1]
 		if validDomain.MatchString(rx) {
-			subs := strings.Split(strings.Trim(rx, "\r "), ".")
-			fast := lk.DomainFastMatch
-			for i := len(subs) - 1; i >= 0; i-- {
-				if fast[subs[i]] == nil {
-					fast[subs[i]] = make(matchTree)
-				}
-
-				if i == 0 {
-					// end
-					fast[subs[0]] = 0
-				} else {
-					it := fast[subs[i]]
-					switch it.(type) {
-					case int:
-						fast[subs[i]] = make(matchTree)
-						fast = fast[subs[i]].(matchTree)
-					case matchTree:
-						fast = it.(matchTree)
-					}
-				}
-			}
-
+			lk.addSuffix(strings.Trim(rx, "\r "))
 			return nil
 		}
 	}
@@ -119,42 +145,110 @@ func (lk *lookup) tryAddACLSingleRule(r string) error {
 	return fmt.Errorf("invalid rule: %s", r)
 }
 
-func (lk *lookup) Match(domain string) bool {
-	slowMatch := func() bool {
-		for _, r := range lk.DomainSlowMatch {
-			if r.MatchString(domain) {
-				return true
+// addSuffix adds a rule matching domain and its subdomains to the fast match tree
+func (lk *lookup) addSuffix(domain string) {
+	subs := strings.Split(strings.ToLower(domain), ".")
+	fast := lk.DomainFastMatch
+	for i := len(subs) - 1; i >= 0; i-- {
+		if fast[subs[i]] == nil {
+			fast[subs[i]] = make(matchTree)
+		}
+
+		if i == 0 {
+			// end
+			fast[subs[0]] = 0
+		} else {
+			it := fast[subs[i]]
+			switch it.(type) {
+			case int:
+				fast[subs[i]] = make(matchTree)
+				fast = fast[subs[i]].(matchTree)
+			case matchTree:
+				fast = it.(matchTree)
 			}
 		}
+	}
+}
+
+func (lk *lookup) Match(domain string) bool {
+	return lk.match(domain) > matchNone
+}
 
-		return false
+// match returns how specific the matched rule is, matchNone if there is none
+func (lk *lookup) match(domain string) int {
+	if lk.DomainExactMatch[domain] {
+		return matchExact
 	}
 
-	subs := strings.Split(domain, ".")
-	if len(subs) <= 1 {
-		return slowMatch()
+	labels := lk.matchFast(domain)
+	if w := lk.matchWildcard(domain); w > labels {
+		labels = w
 	}
 
-	top := lk.DomainFastMatch
-	if top == nil {
-		return slowMatch()
+	if labels > 0 {
+		return matchSuffix + labels
 	}
 
-	for i := len(subs) - 1; i >= 0; i-- {
-		sub := subs[i]
-		if top[sub] == nil {
-			return slowMatch()
+	for _, r := range lk.DomainSlowMatch {
+		if r.MatchString(domain) {
+			return matchRegex
 		}
+	}
 
-		switch top[sub].(type) {
+	return matchNone
+}
+
+// matchFast returns the number of labels of the suffix matched in the fast match tree, 0 if none
+func (lk *lookup) matchFast(domain string) int {
+	if lk.bloom != nil && !lk.bloom.hasSuffix(domain) {
+		return 0
+	}
+
+	top := lk.DomainFastMatch
+	if top == nil || strings.IndexByte(domain, '.') == -1 {
+		return 0
+	}
+
+	// walk labels from right to left without splitting the domain
+	for i, labels := len(domain), 1; i >= 0; labels++ {
+		j := strings.LastIndexByte(domain[:i], '.')
+		sub := domain[j+1 : i]
+		i = j
+
+		switch v := top[sub].(type) {
 		case matchTree:
-			top = top[sub].(matchTree)
+			top = v
 		case int:
-			return top[sub].(int) == 0
+			if v == 0 {
+				return labels
+			}
+			return 0
 		default:
-			return slowMatch()
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// matchWildcard returns the number of labels of the longest wildcard suffix matched, 0 if none
+func (lk *lookup) matchWildcard(domain string) int {
+	if len(lk.DomainWildcardMatch) == 0 {
+		return 0
+	}
+
+	for i := strings.IndexByte(domain, '.'); i > -1; {
+		suffix := domain[i+1:]
+		if lk.DomainWildcardMatch[suffix] {
+			return strings.Count(suffix, ".") + 1
+		}
+
+		j := strings.IndexByte(suffix, '.')
+		if j == -1 {
+			break
 		}
+		i += j + 1
 	}
 
-	return slowMatch()
+	return 0
 }
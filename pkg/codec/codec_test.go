@@ -0,0 +1,43 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeterministic(t *testing.T) {
+	c1, c2 := NewDeterministic("key", 42), NewDeterministic("key", 42)
+
+	for i := 0; i < 100; i++ {
+		k1, iv1 := c1.NewIV(DoConnect, nil, "")
+		k2, iv2 := c2.NewIV(DoConnect, nil, "")
+		if k1 != k2 || !bytes.Equal(iv1, iv2) {
+			t.Fatal("deterministic codecs diverged at round", i)
+		}
+
+		if c1.EncryptCompress("example.com:443") != c2.EncryptCompress("example.com:443") {
+			t.Fatal("deterministic codecs diverged at round", i)
+		}
+	}
+}
+
+func TestHostRoundTrip(t *testing.T) {
+	c := NewDeterministic("0123456789abcdef", 1)
+
+	for _, host := range []string{"example.com:443", "[::1]:80", "1.2.3.4:53", ""} {
+		_, iv := c.NewIV(DoConnect, nil, "")
+		if h := c.DecryptDecompress(c.EncryptCompress(host, iv...), iv...); h != host {
+			t.Error("host round trip failed:", host, h)
+		}
+	}
+}
+
+func TestDNSRoundTrip(t *testing.T) {
+	c := NewDeterministic("0123456789abcdef", 1)
+
+	k, _ := c.NewIV(DoDNS, []byte("example.com"), "user:pass")
+	o, host, auth := c.ReverseIV(k)
+	if !o.IsSet(DoDNS) || string(host) != "example.com" || string(auth) != "user:pass" {
+		t.Error("DNS round trip failed:", o, string(host), string(auth))
+	}
+}
@@ -0,0 +1,25 @@
+// +build gofuzz
+
+package codec
+
+import "bytes"
+
+var fuzzCodec = NewDeterministic("0123456789abcdef", 1)
+
+// Fuzz is the go-fuzz entry point, data is treated as an rkey header
+func Fuzz(data []byte) int {
+	o, iv, auth := fuzzCodec.ReverseIV(string(data))
+	fuzzCodec.DecryptDecompress(string(data), iv...)
+
+	if iv == nil {
+		return 0
+	}
+
+	k, _ := fuzzCodec.NewIV(o, dup(iv), string(auth))
+	o2, iv2, auth2 := fuzzCodec.ReverseIV(k)
+	if o2 != o || !bytes.Equal(iv, iv2) || (len(auth) > 0 && !bytes.Equal(auth, auth2)) {
+		panic("rkey round trip mismatch")
+	}
+
+	return 1
+}
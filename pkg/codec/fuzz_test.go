@@ -0,0 +1,42 @@
+// +build go1.18
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReverseIV(f *testing.F) {
+	c := NewDeterministic("0123456789abcdef", 1)
+	for _, o := range []byte{DoConnect, DoForward, DoConnect | DoWebSocket | DoPartial} {
+		k, _ := c.NewIV(Options(o), nil, "")
+		f.Add(k)
+	}
+	k, _ := c.NewIV(DoDNS, []byte("example.com"), "")
+	f.Add(k)
+
+	f.Fuzz(func(t *testing.T, key string) {
+		o, iv, auth := c.ReverseIV(key)
+		if iv == nil {
+			return
+		}
+
+		k, _ := c.NewIV(o, dup(iv), string(auth))
+		o2, iv2, auth2 := c.ReverseIV(k)
+		if o2 != o || !bytes.Equal(iv, iv2) || (len(auth) > 0 && !bytes.Equal(auth, auth2)) {
+			t.Errorf("round trip mismatch: %v %v %v, %v %v %v", o, iv, auth, o2, iv2, auth2)
+		}
+	})
+}
+
+func FuzzDecryptDecompress(f *testing.F) {
+	c := NewDeterministic("0123456789abcdef", 1)
+	_, iv := c.NewIV(DoConnect, nil, "")
+	f.Add(c.EncryptCompress("example.com:443", iv...), iv)
+	f.Add("", []byte{})
+
+	f.Fuzz(func(t *testing.T, str string, iv []byte) {
+		c.DecryptDecompress(str, iv...)
+	})
+}
@@ -0,0 +1,89 @@
+package logg
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// messages of each level and source line are limited to rateLimit per second (with a burst of the same size),
+// so a flood of invalid requests can't overwhelm the disk, suppressed ones are summarized later
+type limiter struct {
+	tokens     float64
+	last       int64
+	suppressed int
+	lead       string // level, file and line, e.g. W:server.go(123)
+	caller     string // file and line, e.g. server.go:123
+}
+
+var (
+	rateLimit  = 20
+	limiters   = map[string]*limiter{}
+	limitersMu sync.Mutex
+)
+
+// SetRateLimit sets how many messages each source line can print per second, 0 means unlimited
+func SetRateLimit(n int) {
+	limitersMu.Lock()
+	rateLimit = n
+	limitersMu.Unlock()
+}
+
+// allow reports whether a message of the source can be printed, if so, the number of messages
+// suppressed before it is returned and reset
+func allow(l, fn string, line int) (ok bool, suppressed int) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	if rateLimit <= 0 {
+		return true, 0
+	}
+
+	key := fmt.Sprintf("%s%s:%d", l, fn, line)
+	now := time.Now().UnixNano()
+	lm := limiters[key]
+	if lm == nil {
+		lm = &limiter{tokens: float64(rateLimit), last: now, lead: fmt.Sprintf("%s:%s(%d)", l, trunc(fn), line), caller: fmt.Sprintf("%s:%d", trunc(fn), line)}
+		limiters[key] = lm
+	}
+
+	lm.tokens += float64(now-lm.last) / 1e9 * float64(rateLimit)
+	if max := float64(rateLimit); lm.tokens > max {
+		lm.tokens = max
+	}
+	lm.last = now
+
+	if lm.tokens < 1 {
+		lm.suppressed++
+		return false, 0
+	}
+
+	lm.tokens--
+	suppressed, lm.suppressed = lm.suppressed, 0
+	return true, suppressed
+}
+
+// suppressedMessages summarizes and resets messages suppressed since the last call
+func suppressedMessages() []*msg_t {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	var ret []*msg_t
+	for _, lm := range limiters {
+		if lm.suppressed > 0 {
+			ret = append(ret, suppressedMessage(fmt.Sprintf("[%s%s%s] ", lm.lead[:1], timestamp(), lm.lead[1:]), lm.lead[:1], lm.caller, lm.suppressed))
+			lm.suppressed = 0
+		}
+	}
+	return ret
+}
+
+func suppressedMessage(lead, level, caller string, n int) *msg_t {
+	return &msg_t{
+		lead:    lead,
+		level:   level,
+		caller:  caller,
+		ts:      time.Now().UnixNano(),
+		message: fmt.Sprintf("%d similar message(s) suppressed", n),
+	}
+}
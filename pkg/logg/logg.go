@@ -2,6 +2,7 @@ package logg
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
@@ -22,10 +23,12 @@ const (
 
 var (
 	logLevel     = 0
+	logJSON      = false
 	fatalAsError = false
 	started      = false
 	logFileOnly  = false
 	logFile      *os.File
+	logFileName  string
 	logCallback  func(ts int64, msg string)
 )
 
@@ -67,10 +70,17 @@ func Redirect(dst interface{}) {
 			logFileOnly = true
 		}
 
+		logFileName = fn
 		logFile, _ = os.Create(fn)
 	}
 }
 
+// SetJSON prints messages as JSON lines like {"time":...,"level":"warn","caller":"server.go:123","msg":...},
+// warnings and errors go to stderr and others to stdout, so log collectors of containers can parse them
+func SetJSON(flag bool) {
+	logJSON = flag
+}
+
 func TreatFatalAsError(flag bool) {
 	fatalAsError = flag
 }
@@ -119,19 +129,61 @@ func tryShortenWSAError(err interface{}) (ret string) {
 type msg_t struct {
 	dst     string
 	lead    string
+	level   string
+	caller  string // file:line
 	ts      int64
 	message string
 }
 
+var jsonLevels = map[string]string{"_": "info", "W": "warn", "E": "error", "P": "print", "X": "fatal"}
+
+// text returns the line of m printed, the lead and the message, or JSON
+func (m *msg_t) text() string {
+	if !logJSON {
+		return m.lead + m.message
+	}
+
+	buf, _ := json.Marshal(map[string]interface{}{
+		"time":   time.Unix(0, m.ts).Format(time.RFC3339Nano),
+		"level":  jsonLevels[m.level],
+		"caller": m.caller,
+		"msg":    m.message,
+	})
+	return string(buf)
+}
+
+// stderr reports whether m is a warning or worse printed to stderr in JSON
+func (m *msg_t) stderr() bool {
+	return logJSON && m.level != "_" && m.level != "P"
+}
+
 var msgQueue = make(chan *msg_t)
 
+var rotateQueue = make(chan chan error)
+
 func print(l string, params ...interface{}) {
 	if !started {
 		return
 	}
 
 	_, fn, line, _ := runtime.Caller(2)
-	m := msg_t{lead: fmt.Sprintf("[%s%s:%s(%d)] ", l, timestamp(), trunc(fn), line), ts: time.Now().UnixNano()}
+	suppressed := 0
+	if l != "X" {
+		var ok bool
+		if ok, suppressed = allow(l, fn, line); !ok {
+			return
+		}
+	}
+
+	m := msg_t{
+		lead:   fmt.Sprintf("[%s%s:%s(%d)] ", l, timestamp(), trunc(fn), line),
+		level:  l,
+		caller: fmt.Sprintf("%s:%d", trunc(fn), line),
+		ts:     time.Now().UnixNano(),
+	}
+	if suppressed > 0 {
+		msgQueue <- suppressedMessage(m.lead, l, m.caller, suppressed)
+	}
 
 	for _, p := range params {
 		switch p.(type) {
@@ -166,14 +218,14 @@ func print(l string, params ...interface{}) {
 
 	if l == "X" {
 		// immediately print fatal message
-		printRaw(0, m.lead+m.message, nil)
+		printRaw(0, m.text(), nil, m.stderr())
 		return
 	}
 
 	msgQueue <- &m
 }
 
-func printRaw(ts int64, str string, buf *bytes.Buffer) {
+func printRaw(ts int64, str string, buf *bytes.Buffer, stderr bool) {
 	if logFile != nil {
 		if buf != nil {
 			buf.WriteString(str)
@@ -190,6 +242,8 @@ func printRaw(ts int64, str string, buf *bytes.Buffer) {
 
 	if logCallback != nil {
 		logCallback(ts, str)
+	} else if stderr && !logFileOnly {
+		fmt.Fprintln(os.Stderr, str)
 	} else if !logFileOnly {
 		fmt.Println(str)
 	}
@@ -199,6 +253,7 @@ func printLoop() {
 	var count, nop int
 	var lastMsg *msg_t
 	var lastTime = time.Now()
+	var lastSummary = time.Now()
 	logBuffer := &bytes.Buffer{}
 
 	print := func(m *msg_t) {
@@ -215,7 +270,10 @@ func printLoop() {
 		}
 
 		if count > 0 {
-			printRaw(lastMsg.ts, fmt.Sprintf(strings.Repeat(" ", len(lastMsg.lead))+"... %d similar message(s)", count), logBuffer)
+			similar := *lastMsg
+			similar.lead, similar.ts = strings.Repeat(" ", len(lastMsg.lead)), time.Now().UnixNano()
+			similar.message = fmt.Sprintf("... %d similar message(s)", count)
+			printRaw(lastMsg.ts, similar.text(), logBuffer, similar.stderr())
 		}
 
 		if lastMsg == nil && m == nil {
@@ -223,7 +281,7 @@ func printLoop() {
 		}
 
 		if m != nil {
-			printRaw(m.ts, m.lead+m.message, logBuffer)
+			printRaw(m.ts, m.text(), logBuffer, m.stderr())
 			lastMsg = m
 		}
 
@@ -236,6 +294,8 @@ func printLoop() {
 			select {
 			case m := <-msgQueue:
 				print(m)
+			case r := <-rotateQueue:
+				r <- rotate(logBuffer)
 			default:
 				if nop++; nop > 10 {
 					print(nil)
@@ -245,10 +305,43 @@ func printLoop() {
 			}
 		}
 
+		if time.Since(lastSummary) > 5*time.Second {
+			for _, m := range suppressedMessages() {
+				print(m)
+			}
+			lastSummary = time.Now()
+		}
+
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
+// rotate renames the log file with a timestamp suffix and starts a new one
+func rotate(buf *bytes.Buffer) error {
+	if logFile == nil {
+		return nil
+	}
+
+	logFile.Write(buf.Bytes())
+	buf.Reset()
+	logFile.Close()
+
+	err := os.Rename(logFileName, logFileName+"."+time.Now().Format("20060102-150405"))
+	logFile, _ = os.Create(logFileName)
+	return err
+}
+
+// Rotate renames the file set by Redirect with a timestamp suffix and continues logging into a new one
+func Rotate() error {
+	if !started {
+		return rotate(&bytes.Buffer{})
+	}
+
+	r := make(chan error)
+	rotateQueue <- r
+	return <-r
+}
+
 func Start() {
 	if started {
 		return
@@ -0,0 +1,46 @@
+package logg
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestText(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC).UnixNano()
+	m := &msg_t{lead: "[W0102/030405.006:a.go(7)] ", level: "W", caller: "a.go:7", ts: ts, message: `say "hi"`}
+
+	SetJSON(false)
+	if s := m.text(); s != `[W0102/030405.006:a.go(7)] say "hi"` {
+		t.Error(s)
+	}
+	if m.stderr() {
+		t.Error("plain lines are printed to stdout")
+	}
+
+	SetJSON(true)
+	defer SetJSON(false)
+
+	line := map[string]string{}
+	if err := json.Unmarshal([]byte(m.text()), &line); err != nil {
+		t.Fatal(m.text(), err)
+	}
+
+	if line["level"] != "warn" || line["caller"] != "a.go:7" || line["msg"] != `say "hi"` {
+		t.Error(line)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, line["time"]); err != nil || at.UnixNano() != ts {
+		t.Error(line["time"], err)
+	}
+
+	for level, stderr := range map[string]bool{"_": false, "P": false, "W": true, "E": true, "X": true} {
+		if m.level = level; m.stderr() != stderr {
+			t.Error(level, "should be printed to stderr:", stderr)
+		}
+
+		line := map[string]string{}
+		if json.Unmarshal([]byte(m.text()), &line); line["level"] != jsonLevels[level] {
+			t.Error(level, line["level"])
+		}
+	}
+}
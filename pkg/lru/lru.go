@@ -3,6 +3,7 @@ package lru
 import (
 	"container/list"
 	"sync"
+	"time"
 )
 
 type Cache struct {
@@ -24,9 +25,14 @@ type Cache struct {
 type Key interface{}
 
 type entry struct {
-	key   Key
-	value interface{}
-	hits  int64
+	key    Key
+	value  interface{}
+	hits   int64
+	expire int64 // unix nanoseconds, 0 means never
+}
+
+func (e *entry) expired() bool {
+	return e.expire > 0 && time.Now().UnixNano() > e.expire
 }
 
 // New creates a new Cache.
@@ -63,6 +69,16 @@ func (c *Cache) Info(callback func(Key, interface{}, int64)) {
 
 // Add adds a value to the cache.
 func (c *Cache) Add(key Key, value interface{}) {
+	c.add(key, value, 0)
+}
+
+// AddWithTTL adds a value to the cache which expires after ttl,
+// expired values are missing from Get and Peek and removed by Get
+func (c *Cache) AddWithTTL(key Key, value interface{}, ttl time.Duration) {
+	c.add(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+func (c *Cache) add(key Key, value interface{}, expire int64) {
 	c.Lock()
 	defer c.Unlock()
 
@@ -76,11 +92,12 @@ func (c *Cache) Add(key Key, value interface{}) {
 		e := ee.Value.(*entry)
 
 		e.value = value
+		e.expire = expire
 		e.hits++
 		return
 	}
 
-	ele := c.ll.PushFront(&entry{key, value, 1})
+	ele := c.ll.PushFront(&entry{key, value, 1, expire})
 	c.cache[key] = ele
 	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
 		c.removeOldest()
@@ -98,6 +115,11 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 
 	if ele, hit := c.cache[key]; hit {
 		e := ele.Value.(*entry)
+		if e.expired() {
+			c.removeElement(ele)
+			return
+		}
+
 		e.hits++
 		c.ll.MoveToFront(ele)
 		return e.value, true
@@ -106,6 +128,22 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	return
 }
 
+// Peek looks up a key's value without updating its hits or recent-ness
+func (c *Cache) Peek(key Key) (value interface{}, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.cache == nil {
+		return
+	}
+
+	if ele, hit := c.cache[key]; hit && !ele.Value.(*entry).expired() {
+		return ele.Value.(*entry).value, true
+	}
+
+	return
+}
+
 func (c *Cache) GetHits(key Key) (hits int64, ok bool) {
 	c.Lock()
 	defer c.Unlock()
@@ -0,0 +1,63 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	c := NewCache(4)
+	c.AddWithTTL("a", 1, 50*time.Millisecond)
+	c.Add("b", 2)
+
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatal("the entry should not expire before its TTL:", v, ok)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Peek("a"); ok {
+		t.Error("expired entries should be missing")
+	}
+	if c.Len() != 2 {
+		t.Error("expired entries should be kept by Peek")
+	}
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Error("expired entries should be removed by Get")
+	}
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Error("entries without TTL never expire:", v, ok)
+	}
+
+	// adding again renews the TTL, or clears it
+	c.AddWithTTL("b", 3, 50*time.Millisecond)
+	c.Add("b", 4)
+	time.Sleep(100 * time.Millisecond)
+	if v, ok := c.Get("b"); !ok || v != 4 {
+		t.Error("the TTL should be cleared by Add:", v, ok)
+	}
+
+	c.AddWithTTL("c", 5, time.Hour)
+	c.AddWithTTL("c", 6, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("c"); ok {
+		t.Error("the TTL should be replaced by AddWithTTL")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := NewCache(2)
+	evicted := []Key{}
+	c.OnEvicted = func(key Key, value interface{}) { evicted = append(evicted, key) }
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Add("c", 3)
+
+	if _, ok := c.Peek("b"); ok || len(evicted) != 1 || evicted[0] != "b" {
+		t.Error("the least recent entry should be evicted:", evicted)
+	}
+	if _, ok := c.Peek("a"); !ok {
+		t.Error("a was used recently")
+	}
+}
@@ -203,6 +203,11 @@ func charToIdx(b byte) (byte, byte, int) {
 }
 
 func Compress(str string) []byte {
+	return CompressWith(str, r)
+}
+
+// CompressWith uses rnd to decide where to insert the checksum
+func CompressWith(str string, rnd *rand.ConcurrentRand) []byte {
 	ln := len(str)
 	if ln == 0 {
 		return []byte{}
@@ -224,7 +229,7 @@ func Compress(str string) []byte {
 	ln = len(str)
 	inserted := false
 	for i := 0; i < ln; i++ {
-		if !inserted && r.Intn(ln-i) == 0 {
+		if !inserted && rnd.Intn(ln-i) == 0 {
 			b.PushByte(_HASH, 6)
 			b.PushByte(byte(crc>>8), 7)
 			b.PushByte(byte(crc), 8)
@@ -200,12 +200,17 @@ func seedrand(x int32) int32 {
 }
 
 func New(seeds ...int64) *ConcurrentRand {
-	rng := &ConcurrentRand{}
-	rng.seed = GetCounter() % _M
+	seed := GetCounter() % _M
 	for _, s := range seeds {
-		rng.seed ^= s
+		seed ^= s
 	}
 
+	return NewSeeded(seed)
+}
+
+// NewSeeded doesn't mix the counter into the seed, the same seed always generates the same sequence
+func NewSeeded(seed int64) *ConcurrentRand {
+	rng := &ConcurrentRand{seed: seed % _M}
 	if rng.seed < 0 {
 		rng.seed += _M
 	}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// AccessRule blocks destinations during a time window, e.g. gaming sites during school hours
+type AccessRule struct {
+	Name     string
+	Hosts    *acr.HostMatcher
+	From, To int             // minutes of the day in local time, the window wraps midnight if From > To
+	Days     uint64          // bits of weekdays, 0 is Sunday
+	Users    map[string]bool // only enforced by the server, empty means everyone
+}
+
+// AccessRules are sorted by name
+type AccessRules []*AccessRule
+
+// LoadAccessRules reads rules from a config file, each section is a rule:
+//
+//	[gaming]
+//	hosts=*.steampowered.com,*.epicgames.com
+//	time=09:00-17:00   # local time, 22:00-07:00 wraps midnight, empty means all day
+//	days=1-5           # 0 is Sunday, like -schedule, empty means every day
+//	users=alice,bob    # only on the server, empty means everyone
+func LoadAccessRules(path string) (AccessRules, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := config.ParseConf(string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	list := func(section, key string) []string {
+		parts := []string{}
+		for _, p := range strings.Split(cf.GetString(section, key, ""), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		return parts
+	}
+
+	ar := AccessRules{}
+	for name := range *cf {
+		if name == "default" {
+			continue
+		}
+
+		r := &AccessRule{Name: name, To: 24 * 60, Users: make(map[string]bool)}
+		hosts := list(name, "hosts")
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("%s: hosts is missing", name)
+		}
+
+		if r.Hosts, err = acr.NewHostMatcher(hosts); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if window := cf.GetString(name, "time", ""); window != "" {
+			if r.From, r.To, err = parseTimeWindow(window); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+
+		r.Days = 1<<7 - 1
+		if days := cf.GetString(name, "days", ""); days != "" {
+			if n := cf.GetInt(name, "days", -1); n > -1 {
+				days = strconv.FormatInt(n, 10)
+			}
+
+			r.Days = 0
+			for _, d := range strings.Split(days, ",") {
+				bits, err := parseScheduleRange(strings.TrimSpace(d), 0, 6)
+				if err != nil {
+					return nil, fmt.Errorf("%s: days: %v", name, err)
+				}
+				r.Days |= bits
+			}
+		}
+
+		for _, u := range list(name, "users") {
+			r.Users[u] = true
+		}
+
+		ar = append(ar, r)
+	}
+
+	sort.Slice(ar, func(i, j int) bool { return ar[i].Name < ar[j].Name })
+	return ar, nil
+}
+
+// parseTimeWindow parses hh:mm-hh:mm into minutes of the day
+func parseTimeWindow(s string) (int, int, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid time window: %s, expect hh:mm-hh:mm", s)
+	}
+
+	var m [2]int
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time window: %s, expect hh:mm-hh:mm", s)
+		}
+		m[i] = t.Hour()*60 + t.Minute()
+	}
+
+	return m[0], m[1], nil
+}
+
+// active reports whether the window of the rule covers t, a window wrapping midnight
+// belongs to the day it starts
+func (r *AccessRule) active(t time.Time) bool {
+	min, day := t.Hour()*60+t.Minute(), int(t.Weekday())
+	if r.From <= r.To {
+		return r.Days&(1<<uint(day)) > 0 && min >= r.From && min < r.To
+	}
+
+	if min >= r.From {
+		return r.Days&(1<<uint(day)) > 0
+	}
+	return min < r.To && r.Days&(1<<uint((day+6)%7)) > 0
+}
+
+// blocked returns the first rule blocking host for user at t, nil if none,
+// rules with users are skipped if user is empty, i.e. on the client
+func (ar AccessRules) blocked(user, host string, t time.Time) *AccessRule {
+	name, _ := splitHostPort(host)
+	name = strings.Trim(name, "[]")
+
+	for _, r := range ar {
+		if len(r.Users) > 0 && !r.Users[user] {
+			continue
+		}
+
+		if r.active(t) && r.Hosts.Match(name) {
+			logg.W("access rule ", r.Name, " blocked ", host, auditUser(user))
+			return r
+		}
+	}
+
+	return nil
+}
+
+func auditUser(user string) string {
+	if user == "" {
+		return ""
+	}
+	return " for user " + user
+}
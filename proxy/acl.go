@@ -3,8 +3,13 @@ package proxy
 import (
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/codec"
 	"github.com/coyove/goflyway/pkg/logg"
 )
 
@@ -12,6 +17,7 @@ const (
 	ruleProxy = iota
 	rulePass
 	ruleBlock
+	ruleRace // only returned by route, race direct against the upstream
 )
 
 type Rule struct {
@@ -19,15 +25,65 @@ type Rule struct {
 	Ans    byte
 	OldAns byte
 	R      byte
+	Remote bool  // resolved by the upstream
+	Time   int64 // when the rule was made
+	Used   int64 // when the rule was last used
+}
+
+// expired reports whether rule should be made again, rules changed by the user never expire
+func (proxy *ProxyClient) expired(rule *Rule) bool {
+	return proxy.DNSTTL > 0 && rule.Ans == rule.OldAns && time.Now().UnixNano()-rule.Time > int64(proxy.DNSTTL)
+}
+
+// route maps host through Hosts first, then decides how to connect to it
+func (proxy *ProxyClient) route(host string) (dst string, r byte, ext string) {
+	if name, ok := proxy.FakeIP.lookup(host); ok {
+		logg.D("fake IP ", host, " is ", name)
+		host = name
+	}
+
+	if rule := proxy.AccessRules.blocked("", host, time.Now()); rule != nil {
+		return host, ruleBlock, " (access-" + rule.Name + ")"
+	}
+
+	dst, mapped := proxy.Hosts.Lookup(host)
+	if r, ext = proxy.canDirectConnect(dst); mapped {
+		ext = " (hosts-" + dst + ")" + ext
+	}
+
+	if name, _ := splitHostPort(dst); r != ruleBlock && proxy.guessed(name) {
+		if learned, ok := proxy.RouteBook.get(name); ok {
+			r, ext = learned, ext+" (learned)"
+		} else if proxy.Race > 0 && !proxy.Policy.IsSet(PolicyWebSocket) {
+			r, ext = ruleRace, ext+" (race)"
+		}
+	}
+
+	return
 }
 
 func (proxy *ProxyClient) canDirectConnect(host string) (r byte, ext string) {
 	host, _ = splitHostPort(host)
 
-	if c, ok := proxy.DNSCache.Get(host); ok && c.(*Rule) != nil {
+	// local discovery names must never reach the upstream, even in global mode
+	if special, blocked := proxy.ACL.SpecialUseDomain(host); blocked {
+		return ruleBlock, " (special-use-block)"
+	} else if special {
+		return rulePass, " (special-use)"
+	}
+
+	if c, ok := proxy.DNSCache.Get(host); ok && c.(*Rule) != nil && !proxy.expired(c.(*Rule)) {
+		atomic.StoreInt64(&c.(*Rule).Used, time.Now().UnixNano())
 		return c.(*Rule).Ans, " (cache-" + c.(*Rule).IP + ")"
 	}
 
+	return proxy.makeRule(host)
+}
+
+// makeRule decides how to connect to host and caches the result
+func (proxy *ProxyClient) makeRule(host string) (r byte, ext string) {
+	// remote is true if host is resolved by the upstream, either through the tunnel first or when in doubt
+	remote := proxy.ACL.ResolvesRemotely(host)
 	rule, ipstr, err := proxy.ACL.Check(host, !proxy.ACL.RemoteDNS)
 	if err != nil {
 		logg.E(err)
@@ -39,7 +95,8 @@ func (proxy *ProxyClient) canDirectConnect(host string) (r byte, ext string) {
 			r = ruleProxy
 			ext += " (global)"
 		} else {
-			proxy.DNSCache.Add(host, &Rule{ipstr, r, r, rule})
+			now := time.Now().UnixNano()
+			proxy.DNSCache.Add(host, &Rule{IP: ipstr, Ans: r, OldAns: r, R: rule, Remote: remote, Time: now, Used: now})
 		}
 	}()
 
@@ -53,10 +110,15 @@ func (proxy *ProxyClient) canDirectConnect(host string) (r byte, ext string) {
 	case acr.RuleBlock:
 		return ruleBlock, " (match-block)"
 	case acr.RulePrivate:
+		if proxy.Policy.IsSet(PolicyTunnelLAN) {
+			return ruleProxy, " (private-ip-proxy)"
+		}
 		priv = true
 		return rulePass, " (private-ip)"
 	case acr.RulePass:
-		if !proxy.ACL.RemoteDNS {
+		if remote {
+			return rulePass, " (tunnel-dns-pass)"
+		} else if !proxy.ACL.RemoteDNS {
 			return rulePass, " (trust-local-pass)"
 		}
 		r = rulePass
@@ -66,22 +128,16 @@ func (proxy *ProxyClient) canDirectConnect(host string) (r byte, ext string) {
 
 	if proxy.Policy.IsSet(PolicyGlobal) {
 		return
+	} else if remote {
+		// the upstream has answered (or failed) already
+		return r, " (tunnel-dns-unknown)"
+	} else if proxy.VLESS != nil {
+		return r, " (vless-dns-unknown)"
 	}
 
 	// We have doubts, so query the upstream
-	dnsloc := "http://" + proxy.genHost()
-	rkey, _ := proxy.Cipher.NewIV(doDNS, []byte(host), proxy.UserAuth)
-	if proxy.URLHeader != "" {
-		dnsloc = "http://" + proxy.Upstream
-	}
-
-	req, _ := http.NewRequest("GET", dnsloc, nil)
-	req.Header.Add(proxy.rkeyHeader, rkey)
-	if proxy.URLHeader != "" {
-		req.Header.Add(proxy.URLHeader, "http://"+proxy.genHost())
-	}
-
-	resp, err := proxy.tpq.RoundTrip(req)
+	remote = true
+	ip, err := proxy.lookupRemote(host)
 	if err != nil {
 		if e, _ := err.(net.Error); e != nil && e.Timeout() {
 			// proxy.tpq.Dial = (&net.Dialer{Timeout: 2 * time.Second}).Dial
@@ -91,13 +147,11 @@ func (proxy *ProxyClient) canDirectConnect(host string) (r byte, ext string) {
 		return r, " (network-err)"
 	}
 
-	tryClose(resp.Body)
-	ip, _ := base32Decode(resp.Header.Get(dnsRespHeader), true)
-	if ip == nil || len(ip) != net.IPv4len {
+	if ip == nil {
 		return r, " (remote-err)"
 	}
 
-	ipstr = net.IP(ip).String()
+	ipstr = ip.String()
 	switch rule, _, _ = proxy.ACL.Check(ipstr, true); rule {
 	case acr.RulePass, acr.RuleMatchedPass:
 		return rulePass, " (remote-pass)"
@@ -111,3 +165,60 @@ func (proxy *ProxyClient) canDirectConnect(host string) (r byte, ext string) {
 		return ruleProxy, " (remote-unknown)"
 	}
 }
+
+// lookupRemote asks the upstream to resolve host, a nil IP without error means the upstream failed to answer
+func (proxy *ProxyClient) lookupRemote(host string) (net.IP, error) {
+	if proxy.VLESS != nil {
+		return nil, errVLESSDNS
+	}
+
+	dnsloc := "http://" + proxy.genHost()
+	rkey, _ := proxy.Cipher.NewIV(doDNS, []byte(host), proxy.UserAuth)
+	if proxy.URLHeader != "" {
+		dnsloc = "http://" + proxy.Upstream
+	}
+
+	req, _ := http.NewRequest("GET", dnsloc, nil)
+	req.Header.Add(proxy.rkeyHeader, rkey)
+	if proxy.URLHeader != "" {
+		req.Header.Add(proxy.URLHeader, "http://"+proxy.genHost())
+	}
+
+	if lane := proxy.IO.DNSLane; lane != nil {
+		// bulk uploads of the carrier hold until the query is sent, the answer is prioritized by the upstream
+		var mu sync.Mutex
+		var carrier *string
+		leave := func() {
+			mu.Lock()
+			if carrier != nil {
+				lane.leave(*carrier)
+				carrier = nil
+			}
+			mu.Unlock()
+		}
+		defer leave()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if addr := info.Conn.RemoteAddr().String(); lane.enter(addr) {
+					mu.Lock()
+					carrier = &addr
+					mu.Unlock()
+				}
+			},
+			WroteRequest: func(httptrace.WroteRequestInfo) { leave() },
+		}))
+	}
+
+	resp, err := proxy.tpq.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tryClose(resp.Body)
+	ip, _ := codec.Base32Decode(resp.Header.Get(dnsRespHeader), true)
+	if ip == nil || len(ip) != net.IPv4len {
+		return nil, nil
+	}
+
+	return net.IP(ip), nil
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Listeners can be bound before the proxy starts, so it needn't run as root to serve ports like :443 or :53:
+// sockets are either inherited from the service manager by socket activation (LISTEN_FDS of systemd), or
+// opened by Preopen before dropping privileges, a listener of the same address takes its socket instead of binding
+var sockets struct {
+	sync.Mutex
+	tcp []net.Listener
+	udp []*net.UDPConn
+}
+
+// listenFdsStart is SD_LISTEN_FDS_START, the first fd passed by socket activation
+const listenFdsStart = 3
+
+// InheritSockets takes the TCP and UDP sockets passed by socket activation, it returns how many there are
+func InheritSockets() (int, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if n <= 0 || pid != os.Getpid() {
+		return 0, nil
+	}
+
+	// children, e.g. the restarted self, don't inherit them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		// FileListener and FilePacketConn dup the fd
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		if err == nil {
+			sockets.tcp = append(sockets.tcp, ln)
+			f.Close()
+			continue
+		}
+
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if c, ok := pc.(*net.UDPConn); err == nil && ok {
+			sockets.udp = append(sockets.udp, c)
+			continue
+		} else if err == nil {
+			pc.Close()
+		}
+
+		return 0, errors.New("socket activation: fd " + strconv.Itoa(fd) + " is neither a TCP listener nor a UDP socket")
+	}
+
+	return n, nil
+}
+
+// Preopen binds addr of network (tcp or udp) now for the listener started later, e.g. before dropping privileges,
+// addr may be a list of addresses like the listening address of the server, those having a socket already,
+// e.g. passed by socket activation, are skipped
+func Preopen(network, addr string) error {
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	for _, b := range bindAddrs(addr) {
+		if boundLocked(network, b.addr) {
+			continue
+		}
+
+		switch network {
+		case "tcp":
+			ln, err := net.Listen(b.network, b.addr)
+			if err != nil {
+				return err
+			}
+			sockets.tcp = append(sockets.tcp, ln)
+		case "udp":
+			if b.network == "tcp4" {
+				// transports listen on [::] of the port dual-stack
+				continue
+			}
+
+			a, err := net.ResolveUDPAddr("udp", b.addr)
+			if err != nil {
+				return err
+			}
+
+			c, err := net.ListenUDP("udp", a)
+			if err != nil {
+				return err
+			}
+			sockets.udp = append(sockets.udp, c)
+		default:
+			return errors.New("can't preopen " + network)
+		}
+	}
+
+	return nil
+}
+
+// boundLocked tells if there is a socket of network bound for addr
+func boundLocked(network, addr string) bool {
+	switch network {
+	case "tcp":
+		for _, ln := range sockets.tcp {
+			if sameAddr(ln.Addr(), addr) {
+				return true
+			}
+		}
+	case "udp":
+		for _, c := range sockets.udp {
+			if sameAddr(c.LocalAddr(), addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portAddr turns a port like 8100 into :8100
+func portAddr(addr string) string {
+	if _, err := strconv.Atoi(addr); err == nil {
+		return ":" + addr
+	}
+	return addr
+}
+
+// sameAddr tells if a socket bound to a serves addr, unspecified IPs like 0.0.0.0 and :: are the same
+func sameAddr(a net.Addr, addr string) bool {
+	host, port, err := net.SplitHostPort(portAddr(addr))
+	if err != nil {
+		return false
+	}
+
+	bhost, bport, err := net.SplitHostPort(a.String())
+	if err != nil || bport != port {
+		return false
+	}
+
+	ip, bip := net.ParseIP(host), net.ParseIP(bhost)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		return bip != nil && bip.IsUnspecified()
+	}
+	return ip != nil && ip.Equal(bip)
+}
+
+// takeListener returns the TCP socket bound for addr, nil if there is none
+func takeListener(addr string) net.Listener {
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	for i, ln := range sockets.tcp {
+		if sameAddr(ln.Addr(), addr) {
+			sockets.tcp = append(sockets.tcp[:i], sockets.tcp[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// takeUDP returns the UDP socket bound for addr, nil if there is none
+func takeUDP(addr string) *net.UDPConn {
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	for i, c := range sockets.udp {
+		if sameAddr(c.LocalAddr(), addr) {
+			sockets.udp = append(sockets.udp[:i], sockets.udp[i+1:]...)
+			return c
+		}
+	}
+	return nil
+}
+
+// listenTCP listens on TCP addr, through the socket bound for it if any
+func listenTCP(addr string) (net.Listener, error) {
+	if ln := takeListener(addr); ln != nil {
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
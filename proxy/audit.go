@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// auditPending is how many events wait for the webhook, later ones are only logged if it can't keep up
+const auditPending = 256
+
+// Audit records security events of the server, like users connecting from networks they aren't pinned to,
+// as JSON lines appended to a file, and posts each of them to a webhook as JSON, methods of a nil Audit do nothing
+type Audit struct {
+	Webhook string // URL the events are posted to, empty means none
+
+	mu      sync.Mutex
+	f       *os.File
+	e       *json.Encoder
+	once    sync.Once
+	pending chan *AuditEvent
+}
+
+// AuditEvent is an event recorded by Audit
+type AuditEvent struct {
+	TS    int64  `json:"ts"`
+	Event string `json:"event"`
+	User  string `json:"user,omitempty"`
+	Addr  string `json:"addr,omitempty"`
+}
+
+var auditClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewAudit returns the audit appending to the file of path and posting to webhook, either may be empty
+func NewAudit(path, webhook string) (*Audit, error) {
+	a := &Audit{Webhook: webhook}
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil {
+			return nil, err
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("audit webhook must be an http or https URL: " + webhook)
+		}
+	}
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.f, a.e = f, json.NewEncoder(f)
+	}
+	return a, nil
+}
+
+// record records event of user from addr
+func (a *Audit) record(event, user, addr string) {
+	if a == nil {
+		return
+	}
+
+	ev := &AuditEvent{TS: time.Now().UnixNano(), Event: event, User: user, Addr: addr}
+	if a.f != nil {
+		a.mu.Lock()
+		if err := a.e.Encode(ev); err != nil {
+			logg.E("audit: ", err)
+		}
+		a.mu.Unlock()
+	}
+
+	if a.Webhook == "" {
+		return
+	}
+
+	a.once.Do(func() {
+		a.pending = make(chan *AuditEvent, auditPending)
+		go a.post()
+	})
+
+	select {
+	case a.pending <- ev:
+	default:
+		logg.W("audit: the webhook can't keep up, event dropped: ", event, " ", user, " ", addr)
+	}
+}
+
+func (a *Audit) post() {
+	for ev := range a.pending {
+		buf, _ := json.Marshal(ev)
+		resp, err := auditClient.Post(a.Webhook, "application/json", bytes.NewReader(buf))
+		if err != nil {
+			logg.E("audit webhook: ", err)
+			continue
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logg.E("audit webhook: status ", strconv.Itoa(resp.StatusCode))
+		}
+	}
+}
+
+// Close closes the file, events are still posted to the webhook
+func (a *Audit) Close() error {
+	if a == nil || a.f == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
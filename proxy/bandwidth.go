@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The throughput of each upstream is estimated passively from the traffic of its tunnels: only busy seconds
+// (at least bandwidthMinSample bytes) tell how fast the link can go, a faster one replaces the estimation
+// and a slower one pulls it down smoothly, idle seconds leave it as is
+const (
+	bandwidthMinSample = 64 * 1024
+	bandwidthSmooth    = 8
+)
+
+// LinkSpeed is the estimated throughput of an upstream in bytes per second
+type LinkSpeed struct {
+	Up   float64 `json:"up_bytes_per_second"`
+	Down float64 `json:"down_bytes_per_second"`
+}
+
+type linkEstimate struct {
+	trafficMeter
+	lastIn, lastOut uint64
+	LinkSpeed
+}
+
+type bandwidthMeter struct {
+	links map[string]*linkEstimate // keyed by upstream
+	mu    sync.Mutex
+	once  sync.Once
+}
+
+func estimate(est float64, n uint64) float64 {
+	switch s := float64(n); {
+	case n < bandwidthMinSample:
+		return est
+	case s > est:
+		return s
+	default:
+		return est + (s-est)/bandwidthSmooth
+	}
+}
+
+// meter returns the meter counting the tunnels of upstream, it starts sampling on the first call
+func (b *bandwidthMeter) meter(upstream string) *trafficMeter {
+	b.once.Do(func() {
+		go func() {
+			for range time.Tick(time.Second) {
+				b.sample()
+			}
+		}()
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.links == nil {
+		b.links = make(map[string]*linkEstimate)
+	}
+
+	if b.links[upstream] == nil {
+		b.links[upstream] = &linkEstimate{}
+	}
+	return &b.links[upstream].trafficMeter
+}
+
+func (b *bandwidthMeter) sample() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, l := range b.links {
+		// on the client, bytes received come from the upstream
+		in, out := atomic.LoadUint64(&l.in), atomic.LoadUint64(&l.out)
+		l.Up, l.Down = estimate(l.Up, out-l.lastOut), estimate(l.Down, in-l.lastIn)
+		l.lastIn, l.lastOut = in, out
+	}
+}
+
+// Bandwidth returns the estimated throughput of upstreams which have carried bulk traffic
+func (b *bandwidthMeter) Bandwidth() map[string]LinkSpeed {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := make(map[string]LinkSpeed)
+	for up, l := range b.links {
+		if l.Up > 0 || l.Down > 0 {
+			m[up] = l.LinkSpeed
+		}
+	}
+	return m
+}
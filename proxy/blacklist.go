@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+	"github.com/coyove/goflyway/pkg/lru"
+)
+
+// BlacklistEntry describes an IP which sent invalid requests or was banned manually,
+// offenders are networks like 1.2.3.0/24 if they are aggregated by BanPrefixV4 or BanPrefixV6
+type BlacklistEntry struct {
+	Addr      string    `json:"addr"`
+	Hits      int64     `json:"hits"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Manual    bool      `json:"manual"`
+}
+
+// Defaults of the blacklist policy, the threshold is invalidRequestRetry
+const (
+	blacklistSize = 128
+	banDuration   = 10 * time.Minute
+)
+
+type offender struct {
+	first, last time.Time
+	hits        int64
+}
+
+// manual bans are kept outside the LRU so they won't be evicted by a flood of offenders
+type bans struct {
+	m  map[string]time.Time
+	mu sync.RWMutex
+}
+
+func (proxy *ProxyUpstream) offend(addr string) {
+	now, key := time.Now(), proxy.offenderKey(addr)
+	o := &offender{first: now, last: now, hits: 1}
+
+	// entries are replaced instead of updated, so blocked can read them without the lock
+	proxy.blacklistMu.Lock()
+	if v, ok := proxy.blacklist.Peek(key); ok {
+		if old, _ := v.(*offender); old != nil {
+			o.first, o.hits = old.first, old.hits+1
+		}
+	}
+	proxy.blacklist.Add(key, o)
+	proxy.blacklistMu.Unlock()
+
+	atomic.AddUint64(&proxy.offenses, 1)
+
+	if proxy.State != nil {
+		_, duration := proxy.banPolicy()
+		if _, err := proxy.State.Incr(stateOffense+key, duration); err != nil {
+			logg.W("shared state: ", err)
+		}
+	}
+}
+
+// banPolicy returns BanThreshold and BanDuration or their defaults
+func (proxy *ProxyUpstream) banPolicy() (int64, time.Duration) {
+	threshold, duration := int64(proxy.BanThreshold), proxy.BanDuration
+	if threshold <= 0 {
+		threshold = invalidRequestRetry
+	}
+	if duration <= 0 {
+		duration = banDuration
+	}
+	return threshold, duration
+}
+
+// offenderKey returns the key of addr in the blacklist, its network if BanPrefixV4 or BanPrefixV6 is set,
+// so offenders rotating addresses of a network are tracked as one
+func (proxy *ProxyUpstream) offenderKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && proxy.BanPrefixV4 > 0 && proxy.BanPrefixV4 < 32 {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(proxy.BanPrefixV4, 32)), Mask: net.CIDRMask(proxy.BanPrefixV4, 32)}).String()
+	} else if ip4 == nil && proxy.BanPrefixV6 > 0 && proxy.BanPrefixV6 < 128 {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(proxy.BanPrefixV6, 128)), Mask: net.CIDRMask(proxy.BanPrefixV6, 128)}).String()
+	}
+	return addr
+}
+
+// blocked reports whether addr sent more invalid requests than BanThreshold, its requests are then rejected
+// before anything is decrypted until BanDuration has passed since the last one, when the offender is forgotten.
+// Invalid requests sent to other servers sharing State count too
+func (proxy *ProxyUpstream) blocked(addr string) bool {
+	key := proxy.offenderKey(addr)
+	threshold, duration := proxy.banPolicy()
+
+	if v, ok := proxy.blacklist.Peek(key); ok {
+		if o, _ := v.(*offender); o != nil && o.hits > threshold {
+			if time.Since(o.last) <= duration {
+				atomic.AddUint64(&proxy.blockedHits, 1)
+				return true
+			}
+			proxy.blacklist.Remove(key)
+		}
+	}
+
+	if proxy.State != nil {
+		n, err := proxy.State.Get(stateOffense + key)
+		if err != nil {
+			logg.W("shared state: ", err)
+		} else if n > threshold {
+			atomic.AddUint64(&proxy.blockedHits, 1)
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes the offender of addr, from the shared state too
+func (proxy *ProxyUpstream) forget(addr string) {
+	key := proxy.offenderKey(addr)
+	proxy.blacklist.Remove(key)
+
+	if proxy.State != nil {
+		if err := proxy.State.Del(stateOffense + key); err != nil {
+			logg.W("shared state: ", err)
+		}
+	}
+}
+
+// banned reports whether addr is banned manually, callers reject the request so it counts as a hit
+func (proxy *ProxyUpstream) banned(addr string) bool {
+	proxy.bans.mu.RLock()
+	_, ok := proxy.bans.m[addr]
+	proxy.bans.mu.RUnlock()
+
+	if ok {
+		atomic.AddUint64(&proxy.bannedHits, 1)
+	}
+	return ok
+}
+
+// Ban rejects all requests from addr until it is unbanned
+func (proxy *ProxyUpstream) Ban(addr string) {
+	proxy.bans.mu.Lock()
+	proxy.bans.m[addr] = time.Now()
+	proxy.bans.mu.Unlock()
+}
+
+// Unban removes addr from both the manual bans and the tracked offenders, including its network if aggregated
+func (proxy *ProxyUpstream) Unban(addr string) {
+	proxy.bans.mu.Lock()
+	delete(proxy.bans.m, addr)
+	proxy.bans.mu.Unlock()
+	proxy.forget(addr)
+}
+
+// Banned returns manual bans and offenders being rejected for too many invalid requests, IPs or networks
+// like 1.2.3.0/24, sorted, so firewalls can drop them before they reach the server
+func (proxy *ProxyUpstream) Banned() []string {
+	ret := []string{}
+
+	proxy.bans.mu.RLock()
+	for addr := range proxy.bans.m {
+		ret = append(ret, addr)
+	}
+	proxy.bans.mu.RUnlock()
+
+	threshold, duration := proxy.banPolicy()
+	proxy.blacklist.Info(func(k lru.Key, v interface{}, h int64) {
+		if o, _ := v.(*offender); o != nil && o.hits > threshold && time.Since(o.last) <= duration {
+			ret = append(ret, k.(string))
+		}
+	})
+
+	sort.Strings(ret)
+	return ret
+}
+
+// Blacklist returns manual bans followed by tracked offenders, most hits first
+func (proxy *ProxyUpstream) Blacklist() []BlacklistEntry {
+	ret := []BlacklistEntry{}
+
+	proxy.bans.mu.RLock()
+	for addr, t := range proxy.bans.m {
+		ret = append(ret, BlacklistEntry{Addr: addr, FirstSeen: t, LastSeen: t, Manual: true})
+	}
+	proxy.bans.mu.RUnlock()
+
+	manual := len(ret)
+	proxy.blacklist.Info(func(k lru.Key, v interface{}, h int64) {
+		e := BlacklistEntry{Addr: k.(string), Hits: h}
+		if o, _ := v.(*offender); o != nil {
+			e.FirstSeen, e.LastSeen, e.Hits = o.first, o.last, o.hits
+		}
+		ret = append(ret, e)
+	})
+
+	sort.SliceStable(ret[manual:], func(i, j int) bool { return ret[manual+i].Hits > ret[manual+j].Hits })
+	return ret
+}
+
+// SaveBlacklist writes manual bans and tracked offenders to BlacklistFile as JSON,
+// bans from the config are not saved since they are restored by the config itself
+func (proxy *ProxyUpstream) SaveBlacklist() error {
+	if proxy.BlacklistFile == "" {
+		return nil
+	}
+
+	proxy.reloadMu.RLock()
+	fromConfig := make(map[string]bool)
+	for _, ip := range proxy.configBans {
+		fromConfig[ip] = true
+	}
+	proxy.reloadMu.RUnlock()
+
+	entries := []BlacklistEntry{}
+	for _, e := range proxy.Blacklist() {
+		if !e.Manual || !fromConfig[e.Addr] {
+			entries = append(entries, e)
+		}
+	}
+
+	buf, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(proxy.BlacklistFile, buf, 0644)
+}
+
+// loadBlacklist restores the blacklist saved by SaveBlacklist, a missing file is not an error
+func (proxy *ProxyUpstream) loadBlacklist() error {
+	buf, err := ioutil.ReadFile(proxy.BlacklistFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var entries []BlacklistEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.Manual {
+			proxy.bans.mu.Lock()
+			proxy.bans.m[e.Addr] = e.FirstSeen
+			proxy.bans.mu.Unlock()
+		} else {
+			proxy.blacklist.Add(e.Addr, &offender{first: e.FirstSeen, last: e.LastSeen, hits: e.Hits})
+		}
+	}
+	return nil
+}
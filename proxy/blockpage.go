@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const blockPageTemplate = `<html>
+<head><title>403 Blocked</title></head>
+<body>
+<h1>%s is blocked</h1>
+<p>The destination matches a blocking rule of goflyway (%s), the request was not sent.</p>
+</body>
+</html>`
+
+// tlsAccessDenied is a fatal access_denied alert, the record version is copied from the client
+var tlsAccessDenied = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 49}
+
+func blockPage(host, ext string) []byte {
+	return []byte(fmt.Sprintf(blockPageTemplate, html.EscapeString(host), html.EscapeString(strings.Trim(ext, " ()"))))
+}
+
+// serveBlocked responds the 403 page to a plain HTTP request of a blocked destination
+func serveBlocked(w http.ResponseWriter, host, ext string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(blockPage(host, ext))
+}
+
+// refuseTunnel answers a CONNECT to a blocked destination so browsers fail at once instead of timing out:
+// the tunnel is accepted, a TLS handshake gets an access_denied alert, anything else gets the 403 page
+func refuseTunnel(conn net.Conn, host, ext string) {
+	defer conn.Close()
+	conn.Write(okHTTP)
+
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	n, _ := conn.Read(buf)
+	if n == 0 {
+		return
+	}
+
+	if buf[0] == 0x16 {
+		alert := append([]byte{}, tlsAccessDenied...)
+		if n >= 3 {
+			copy(alert[1:3], buf[1:3])
+		}
+		conn.Write(alert)
+		return
+	}
+
+	page := blockPage(host, ext)
+	fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(page))
+	conn.Write(page)
+}
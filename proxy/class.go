@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+)
+
+// TrafficClass groups streams by their destinations so they share a policy on the server,
+// e.g. video streams throttled together, bulk downloads paced behind interactive ones
+type TrafficClass struct {
+	Name     string
+	Priority int              // the class of the highest priority wins if several match
+	Hosts    *acr.HostMatcher // nil matches any host
+	Ports    map[string]bool  // empty matches any port
+	Throttle int64            // bytes per second shared by all streams of the class, 0 means unlimited
+	Pacing   *Pacing          // paces each stream of the class in mux carriers, nil means disabled
+
+	bucket *TokenBucket
+}
+
+// TrafficClasses are sorted by priority, highest first
+type TrafficClasses []*TrafficClass
+
+// LoadTrafficClasses reads classes from a config file, each section is a class:
+//
+//	[video]
+//	hosts=*.googlevideo.com,(^|\.)twitch\.tv$
+//	ports=443,1935
+//	throttle=2048   # KB/s shared by the class
+//	pace=512        # KB/s of each stream
+//	priority=1
+func LoadTrafficClasses(path string) (TrafficClasses, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := config.ParseConf(string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	// numbers are parsed by the config, lists are strings
+	list := func(section, key string) []string {
+		v := cf.GetString(section, key, "")
+		if n := cf.GetInt(section, key, -1); n > -1 {
+			v = strconv.FormatInt(n, 10)
+		}
+
+		parts := []string{}
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		return parts
+	}
+
+	tc := TrafficClasses{}
+	for name := range *cf {
+		if name == "default" {
+			continue
+		}
+
+		c := &TrafficClass{
+			Name:     name,
+			Priority: int(cf.GetInt(name, "priority", 0)),
+			Ports:    make(map[string]bool),
+			Throttle: cf.GetInt(name, "throttle", 0) * 1024,
+		}
+
+		if hosts := list(name, "hosts"); len(hosts) > 0 {
+			if c.Hosts, err = acr.NewHostMatcher(hosts); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, p := range list(name, "ports") {
+			c.Ports[p] = true
+		}
+
+		if c.Throttle > 0 {
+			c.bucket = NewTokenBucket(c.Throttle, c.Throttle)
+		}
+
+		if pace := cf.GetInt(name, "pace", 0); pace > 0 {
+			c.Pacing = NewPacing(pace * 1024)
+		}
+
+		tc = append(tc, c)
+	}
+
+	sort.SliceStable(tc, func(i, j int) bool {
+		if tc[i].Priority == tc[j].Priority {
+			return tc[i].Name < tc[j].Name
+		}
+		return tc[i].Priority > tc[j].Priority
+	})
+
+	return tc, nil
+}
+
+// classify returns the class of the highest priority matching host, nil if none
+func (tc TrafficClasses) classify(host string) *TrafficClass {
+	name, port := splitHostPort(host)
+	name = strings.Trim(name, "[]")
+	port = strings.TrimPrefix(port, ":")
+
+	for _, c := range tc {
+		if len(c.Ports) > 0 && !c.Ports[port] {
+			continue
+		}
+
+		if c.Hosts != nil && !c.Hosts.Match(name) {
+			continue
+		}
+
+		return c
+	}
+
+	return nil
+}
+
+// apply attaches the policy of c to ioc, the class throttle replaces a looser user one
+func (c *TrafficClass) apply(ioc *IOConfig) {
+	if c.bucket != nil && (ioc.Bucket == nil || ioc.Bucket.Speed > c.Throttle) {
+		ioc.Bucket = c.bucket
+	}
+
+	if c.Pacing != nil {
+		ioc.Pacing = c.Pacing
+	}
+}
@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/tls"
 
 	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/codec"
 	"github.com/coyove/goflyway/pkg/logg"
 	"github.com/coyove/goflyway/pkg/lru"
 	"github.com/coyove/tcpmux"
@@ -18,6 +21,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,10 +40,82 @@ type ClientConfig struct {
 
 	Mux int
 
+	// AltUpstreams are tried in order when dialing Upstream fails, they must share the same key,
+	// the working one is used first until Upstream is probed again
+	AltUpstreams []string
+
+	Hosts    Hosts
 	DNSCache *lru.Cache
-	CA       tls.Certificate
-	CACache  *lru.Cache
-	ACL      *acr.ACL
+
+	// FakeIP answers DNS queries of apps through the UDP relay or a UDP forwarding to port 53 with
+	// virtual IPs, which are mapped back to the names when apps connect to them, nil means disabled
+	FakeIP *FakeIP
+
+	// DNSRewrite maps names to IPs answered to apps querying DNS through the UDP relay or a UDP
+	// forwarding to port 53, instead of the records returned by the upstream
+	DNSRewrite Hosts
+
+	CA      tls.Certificate
+	CACache *lru.Cache
+	ACL     *acr.ACL
+
+	// DNSTTL expires cached rules, 0 keeps them until evicted,
+	// DNSPrefetch remakes rules resolved by the upstream shortly before they expire if they are still in use
+	DNSTTL      time.Duration
+	DNSPrefetch bool
+
+	// Prewarm keeps N idle carriers dialed so the first request after startup or idle won't wait for them
+	Prewarm int
+
+	// RouteBook learns routes for hosts without explicit rules, nil to disable,
+	// Race races direct connections against the upstream with this handicap for those not learned yet
+	RouteBook *RouteBook
+	Race      time.Duration
+
+	// Deprecated: RaceBook is used as RouteBook if that is nil
+	RaceBook *RaceBook
+
+	// SkewTolerance is the clock skew against the upstream tolerated before warning, 0 means DefaultSkewTolerance
+	SkewTolerance time.Duration
+
+	// SoftFail connects tunnels directly when the upstream can't be dialed, except hosts matching SoftFailDeny
+	SoftFail     bool
+	SoftFailDeny *acr.HostMatcher
+
+	// ECDH exchanges X25519 keys with the upstream so each tunnel has its own cipher and past traffic
+	// stays safe if the password leaks, requests in forward mode still use the password
+	ECDH bool
+
+	// PartialSum asks the upstream to append checksums to partial streams both ways, see sumSuffix
+	PartialSum bool
+
+	// StreamBody sends tunnels as POST requests streaming the traffic in chunked request and response bodies,
+	// so HTTP/2 frontends which can't pass raw bytes after a request can front the upstream
+	StreamBody bool
+
+	// MaxRequestLine is the longest request line sent to the upstream, destinations making it longer, or
+	// encrypted into URIs intermediaries would rewrite, are carried in headers instead once the upstream
+	// has advertised collecting them, 0 means 2048
+	MaxRequestLine int
+
+	// WSPath sends WebSocket handshakes to this path with the destination in a header instead of the URI,
+	// so CDNs routing WebSocket by path can front the upstream, it needs PolicyWebSocket
+	WSPath string
+
+	// AccessRules block destinations in time windows, rules for some users are left to the server
+	AccessRules AccessRules
+
+	// Inventory pins hosts to named servers sharing the key of Upstream, nil means everything goes through Upstream
+	Inventory *Inventory
+
+	// Transport dials Upstream and AltUpstreams instead of TCP, nil means TCP, ignored in VPN mode
+	Transport Transport
+
+	// VLESS makes Upstream and AltUpstreams V2Ray/Xray VLESS inbounds instead of goflyway servers
+	VLESS *VLESS
+
+	// Tracer exports spans of tunnels, which the upstream joins if it traces too, nil means not traced
+	Tracer *Tracer
 
 	*Cipher
 }
@@ -50,17 +127,43 @@ type ProxyClient struct {
 	tp         *http.Transport // to upstream
 	tpq        *http.Transport // to upstream used for dns query
 	tpd        *http.Transport // to host directly
+	tpv        *http.Transport // to host through the VLESS upstream
 	dummies    *lru.Cache
 	pool       *tcpmux.DialPool
+	altPools   []*tcpmux.DialPool
+	active     int // index of the working pool, 0 is pool
+	failedAt   int64
+	drainEnd   map[int]int64 // pools draining for maintenance are dialed last until then
+	activeMu   sync.Mutex
+	bandwidth  bandwidthMeter
+	notices    []Notice
+	noticesMu  sync.Mutex
+	warm       chan net.Conn
+	warmDone   chan struct{} // closed by Close to stop the prewarm workers
+	closeOnce  sync.Once
+	softWarnAt int64
+	noUDPNAT   uint32 // the upstream is too old for NAT sessions, UDP is relayed the old way
+	longURLs   uint32 // the upstream collects long URLs from headers, see collectsLongURLs
+
+	skewMeter
 
 	Localaddr string
 	Listener  *listenerWrapper
 }
 
 func (proxy *ProxyClient) dialUpstream() (net.Conn, error) {
+	if conn := proxy.takeWarm(); conn != nil {
+		return conn, nil
+	}
+
+	return proxy.dialCarrier()
+}
+
+// dialCarrier dials a new conn to the upstream, through the HTTPS frontend if any
+func (proxy *ProxyClient) dialCarrier() (net.Conn, error) {
 	lat := time.Now().UnixNano()
 	if proxy.Connect2 == "" {
-		upstreamConn, err := proxy.pool.DialTimeout(timeoutDial)
+		upstreamConn, err := proxy.dialPools()
 		if err != nil {
 			return nil, err
 		}
@@ -177,24 +280,91 @@ func (proxy *ProxyClient) dialUpstream() (net.Conn, error) {
 	return connectConn, nil
 }
 
-func (proxy *ProxyClient) dialUpstreamAndBridge(downstreamConn net.Conn, host string, resp []byte, extra byte) net.Conn {
-	upstreamConn, err := proxy.dialUpstream()
+// openTunnel dials the upstream and asks it to connect host, the returned conn is ready for bridging with the IOConfig
+func (proxy *ProxyClient) openTunnel(host string, extra byte) (net.Conn, []byte, IOConfig, error) {
+	return proxy.openTunnelVia(func() (net.Conn, string, error) { return proxy.dialFor(host) }, host, extra, "", nil)
+}
+
+// openTunnelVia is openTunnel through the conn of dial, the tunnel joins the duplicated stream dupID if it's not empty,
+// the dial and the handshake are traced in span
+func (proxy *ProxyClient) openTunnelVia(dial func() (net.Conn, string, error), host string, extra byte, dupID string, span *Span) (net.Conn, []byte, IOConfig, error) {
+	return proxy.tunnelVia(dial, host, extra, dupID, span, true)
+}
+
+// tunnelVia is openTunnelVia, if the upstream dialed is draining and failover is true,
+// it is dialed last and the tunnel is opened once more, by another upstream if there is one
+func (proxy *ProxyClient) tunnelVia(dial func() (net.Conn, string, error), host string, extra byte, dupID string, span *Span, failover bool) (conn net.Conn, rkeybuf []byte, ioc IOConfig, err error) {
+	ioc = IOConfig{Partial: proxy.Partial}
+	ds := span.child("dial", time.Now())
+	upstreamConn, up, err := dial()
+	ds.set("upstream", up)
+	ds.end(err)
 	if err != nil {
-		logg.E(err)
-		downstreamConn.Close()
-		return nil
+		return nil, nil, ioc, unreachableError{err}
 	}
+	ioc.Meter = proxy.bandwidth.meter(up)
+
+	hs := span.child("handshake", time.Now())
+	defer func() { hs.end(err) }()
 
 	opt := Options(doConnect | extra)
 	if proxy.Partial {
 		opt.Set(doPartial)
 	}
 
-	rkey, rkeybuf := proxy.Cipher.NewIV(opt, nil, proxy.UserAuth)
-	pl := make([]string, 0, len(dummyHeaders)+3)
+	rkey, rkeybuf := proxy.newIV(opt)
+	logg.D("[", streamID(rkeybuf), "] tunnel ", host)
+
+	// reverse and notice channels need the hijacked conn
+	body, method := proxy.StreamBody && !strings.Contains(host, "://"), "GET"
+	if body {
+		method = "POST"
+	}
+
+	pl := make([]string, 0, len(dummyHeaders)+9)
+	if enc := proxy.Cipher.EncryptCompress(host, rkeybuf...); proxy.fitsURI(method, enc) || !proxy.collectsLongURLs() {
+		pl = append(pl, method+" /"+enc+" HTTP/1.1\r\n")
+	} else {
+		rkey, _ = proxy.Cipher.NewIV(opt|doLongURL, rkeybuf, proxy.UserAuth)
+		pl = append(pl, method+" /"+proxy.Cipher.GenWord(true)+" HTTP/1.1\r\n")
+		proxy.splitURI(enc, func(k, v string) { pl = append(pl, k+": "+v+"\r\n") })
+	}
+
 	pl = append(pl,
-		"GET /"+proxy.Cipher.EncryptCompress(host, rkeybuf...)+" HTTP/1.1\r\n",
-		"Host: "+proxy.genHost()+"\r\n")
+		"Host: "+proxy.genHost()+"\r\n",
+		"Date: "+httpDate()+"\r\n")
+
+	if body {
+		pl = append(pl, "Transfer-Encoding: chunked\r\n")
+	}
+
+	// reverse and notice channels don't bridge streams
+	var priv *ecdh.PrivateKey
+	if proxy.ECDH && !strings.Contains(host, "://") {
+		var pub string
+		if priv, pub, err = newECDHKey(&proxy.Cipher.Codec, rkeybuf); err != nil {
+			upstreamConn.Close()
+			return nil, nil, ioc, err
+		}
+		pl = append(pl, proxy.rkeyHeader+ecdhSuffix+": "+pub+"\r\n")
+	}
+
+	if dupID != "" {
+		pl = append(pl, proxy.rkeyHeader+dupSuffix+": "+proxy.Cipher.EncryptString(dupID, rkeybuf...)+"\r\n")
+	}
+
+	// duplicated streams are joined by other tunnels, UDP relays are datagrams
+	if proxy.Partial && proxy.PartialSum && dupID == "" && extra&doUDPRelay == 0 && !strings.Contains(host, "://") {
+		pl = append(pl, proxy.rkeyHeader+sumSuffix+": 1\r\n")
+	}
+
+	if host == udpNATHost {
+		pl = append(pl, proxy.rkeyHeader+natSuffix+": 1\r\n")
+	}
+
+	if span != nil {
+		pl = append(pl, proxy.rkeyHeader+traceSuffix+": "+proxy.Cipher.EncryptString(span.traceparent(), rkeybuf...)+"\r\n")
+	}
 
 	for _, i := range proxy.Rand.Perm(len(dummyHeaders)) {
 		if h := dummyHeaders[i]; h == "ph" {
@@ -205,16 +375,93 @@ func (proxy *ProxyClient) dialUpstreamAndBridge(downstreamConn net.Conn, host st
 	}
 
 	upstreamConn.Write([]byte(strings.Join(pl, "") + "\r\n"))
+	if body {
+		upstreamConn = newBodyConn(upstreamConn)
+	}
 
 	buf, err := readUntil(upstreamConn, "\r\n\r\n")
 	// the first 15 bytes MUST be "HTTP/1.1 200 OK"
 	if err != nil || len(buf) < 15 || !bytes.Equal(buf[:15], okHTTP[:15]) {
+		upstreamConn.Close()
+		if err == nil {
+			err = proxy.readCloseReason(host, buf, rkeybuf)
+		}
+
+		// pinned and Connect2 dials always reach the same upstream
+		if closeReasonOf(err) == CloseDraining && failover && dupID == "" && proxy.Connect2 == "" && proxy.drained(up, drainRetry(buf)) {
+			logg.W("upstream ", up, " is draining, fail over to the next one")
+			return proxy.tunnelVia(dial, host, extra, dupID, span, false)
+		}
+		return nil, nil, ioc, err
+	}
+
+	if dupID != "" && headerValue(buf, proxy.rkeyHeader+dupSuffix) == "" {
+		upstreamConn.Close()
+		return nil, nil, ioc, errNoDup
+	}
+
+	if priv != nil {
+		if ioc.Block, err = proxy.acceptedECDH(priv, buf, rkeybuf); err != nil {
+			upstreamConn.Close()
+			return nil, nil, ioc, err
+		}
+	}
+
+	if host == udpNATHost && headerValue(buf, proxy.rkeyHeader+natSuffix) == "" {
+		upstreamConn.Close()
+		return nil, nil, ioc, errNoNAT
+	}
+
+	if headerValue(buf, proxy.rkeyHeader+sumSuffix) != "" {
+		ioc.Sum = sumSource
+	}
+
+	if headerValue(buf, proxy.rkeyHeader+longURLSuffix) != "" {
+		atomic.StoreUint32(&proxy.longURLs, 1)
+	}
+
+	proxy.observe(headerValue(buf, "Date"), "upstream", proxy.SkewTolerance)
+	return upstreamConn, rkeybuf, ioc, nil
+}
+
+// acceptedECDH derives the cipher of the stream from the public key in the response of the upstream,
+// a response without it is an error, otherwise anyone in the middle could downgrade the stream
+func (proxy *ProxyClient) acceptedECDH(priv *ecdh.PrivateKey, resp, rkeybuf []byte) (cipher.Block, error) {
+	peer := headerValue(resp, proxy.rkeyHeader+ecdhSuffix)
+	if peer == "" {
+		return nil, errNoECDH
+	}
+	return finishECDH(&proxy.Cipher.Codec, priv, peer, rkeybuf)
+}
+
+// dialUpstreamAndBridge bridges downstreamConn with host through the upstream, the tunnel is traced in span if not nil
+func (proxy *ProxyClient) dialUpstreamAndBridge(downstreamConn net.Conn, host string, resp []byte, extra byte, span *Span) net.Conn {
+	if proxy.VLESS != nil {
+		return proxy.bridgeVLESS(downstreamConn, host, resp, extra, span)
+	}
+
+	if p := proxy.Inventory.pinned(host); p != nil && p.Duplicate && extra&doUDPRelay == 0 && proxy.Connect2 == "" {
+		logg.D(host, " duplicated through ", p.Name)
+		upstreamConn, err := proxy.bridgeDup(downstreamConn, host, resp, p, span)
 		if err != nil {
 			logg.E(host, ": ", err)
+			span.end(err)
+			replyFailure(downstreamConn, resp, closeReasonOf(err))
 		}
+		return upstreamConn
+	}
 
-		upstreamConn.Close()
-		downstreamConn.Close()
+	dial := func() (net.Conn, string, error) { return proxy.dialFor(host) }
+	upstreamConn, rkeybuf, ioc, err := proxy.openTunnelVia(dial, host, extra, "", span)
+	if err != nil {
+		if extra&doUDPRelay == 0 && proxy.softFail(host, err) {
+			proxy.dialHostAndBridge(downstreamConn, host, resp, span)
+			return nil
+		}
+
+		logg.E(host, ": ", err)
+		span.end(err)
+		replyFailure(downstreamConn, resp, closeReasonOf(err))
 		return nil
 	}
 
@@ -222,16 +469,38 @@ func (proxy *ProxyClient) dialUpstreamAndBridge(downstreamConn net.Conn, host st
 		downstreamConn.Write(resp)
 	}
 
-	go proxy.Cipher.IO.Bridge(downstreamConn, upstreamConn, rkeybuf, IOConfig{Partial: proxy.Partial})
+	ioc.Span = span
+	downstreamConn = proxy.Cipher.IO.Dump.Wrap(downstreamConn, host)
+	go proxy.Cipher.IO.Bridge(downstreamConn, upstreamConn, rkeybuf, ioc)
 
 	return upstreamConn
 }
 
-func (proxy *ProxyClient) dialUpstreamAndBridgeWS(downstreamConn net.Conn, host string, resp []byte, extra byte) net.Conn {
-	upstreamConn, err := proxy.dialUpstream()
+// dialUpstreamAndBridgeWS is dialUpstreamAndBridge by a WebSocket tunnel
+func (proxy *ProxyClient) dialUpstreamAndBridgeWS(downstreamConn net.Conn, host string, resp []byte, extra byte, span *Span) net.Conn {
+	ds := span.child("dial", time.Now())
+	upstreamConn, up, err := proxy.dialFor(host)
+	ds.set("upstream", up)
+	ds.end(err)
 	if err != nil {
+		if extra&doUDPRelay == 0 && proxy.softFail(host, unreachableError{err}) {
+			proxy.dialHostAndBridge(downstreamConn, host, resp, span)
+			return nil
+		}
+
 		logg.E(err)
-		downstreamConn.Close()
+		span.end(err)
+		replyFailure(downstreamConn, resp, CloseUnknown)
+		return nil
+	}
+
+	hs := span.child("handshake", time.Now())
+	fail := func(err error, reason CloseReason) net.Conn {
+		logg.E(host, ": ", err)
+		upstreamConn.Close()
+		hs.end(err)
+		span.end(err)
+		replyFailure(downstreamConn, resp, reason)
 		return nil
 	}
 
@@ -240,57 +509,101 @@ func (proxy *ProxyClient) dialUpstreamAndBridgeWS(downstreamConn net.Conn, host
 		opt.Set(doPartial)
 	}
 
-	rkey, rkeybuf := proxy.Cipher.NewIV(opt, nil, proxy.UserAuth)
+	rkey, rkeybuf := proxy.newIV(opt)
+	logg.D("[", streamID(rkeybuf), "] websocket tunnel ", host)
+
 	var pl string
-	if proxy.URLHeader == "" {
-		pl = "GET /" + proxy.Cipher.EncryptCompress(host, rkeybuf...) + " HTTP/1.1\r\n" +
+	if proxy.WSPath != "" {
+		pl = "GET " + proxy.WSPath + " HTTP/1.1\r\n" +
+			"Host: " + proxy.genHost() + "\r\n" +
+			proxy.rkeyHeader + wsHostSuffix + ": " + proxy.Cipher.EncryptCompress(host, rkeybuf...) + "\r\n"
+	} else if enc := proxy.Cipher.EncryptCompress(host, rkeybuf...); proxy.URLHeader == "" && proxy.fitsURI("GET", enc) {
+		pl = "GET /" + enc + " HTTP/1.1\r\n" +
 			"Host: " + proxy.genHost() + "\r\n"
+	} else if proxy.URLHeader == "" {
+		pl = "GET /" + proxy.Cipher.GenWord(true) + " HTTP/1.1\r\n" +
+			"Host: " + proxy.genHost() + "\r\n" +
+			proxy.rkeyHeader + wsHostSuffix + ": " + enc + "\r\n"
 	} else {
 		pl = "GET http://" + proxy.Upstream + "/ HTTP/1.1\r\n" +
 			"Host: " + proxy.Upstream + "\r\n" +
-			proxy.URLHeader + ": http://" + proxy.genHost() + "/" + proxy.Cipher.EncryptCompress(host, rkeybuf...) + "\r\n"
+			proxy.URLHeader + ": http://" + proxy.genHost() + "/" + enc + "\r\n"
+	}
+
+	var priv *ecdh.PrivateKey
+	if proxy.ECDH {
+		var pub string
+		if priv, pub, err = newECDHKey(&proxy.Cipher.Codec, rkeybuf); err != nil {
+			return fail(err, CloseUnknown)
+		}
+		pl += proxy.rkeyHeader + ecdhSuffix + ": " + pub + "\r\n"
+	}
+
+	if span != nil {
+		pl += proxy.rkeyHeader + traceSuffix + ": " + proxy.Cipher.EncryptString(span.traceparent(), rkeybuf...) + "\r\n"
 	}
 
+	wsKey := newWSKey()
 	pl += "Upgrade: websocket\r\n" +
 		"Connection: Upgrade\r\n" +
-		"Sec-WebSocket-Key: " + rkey[:24] + "\r\n" +
+		"Sec-WebSocket-Key: " + wsKey + "\r\n" +
 		"Sec-WebSocket-Version: 13\r\n" +
+		"Date: " + httpDate() + "\r\n" +
 		proxy.rkeyHeader + ": " + rkey + "\r\n\r\n"
 
 	upstreamConn.Write([]byte(pl))
 
 	buf, err := readUntil(upstreamConn, "\r\n\r\n")
-	if err != nil || !strings.HasPrefix(string(buf), "HTTP/1.1 101 Switching Protocols") {
-		if err != nil {
-			logg.E(host, ": ", err)
+	if err != nil || !strings.HasPrefix(string(buf), "HTTP/1.1 101") {
+		if err == nil {
+			err = proxy.readCloseReason(host, buf, rkeybuf)
 		}
+		return fail(err, closeReasonOf(err))
+	}
 
-		upstreamConn.Close()
-		downstreamConn.Close()
-		return nil
+	if proxy.WSPath != "" && headerValue(buf, "Sec-WebSocket-Accept") != wsAccept(wsKey) {
+		// older upstreams didn't compute it
+		return fail(errWSAccept, CloseUnknown)
+	}
+
+	ioc := IOConfig{Partial: proxy.Partial, WSCtrl: wsClient, Meter: proxy.bandwidth.meter(up)}
+	if priv != nil {
+		if ioc.Block, err = proxy.acceptedECDH(priv, buf, rkeybuf); err != nil {
+			return fail(err, CloseUnknown)
+		}
 	}
 
+	proxy.observe(headerValue(buf, "Date"), "upstream", proxy.SkewTolerance)
+	hs.end(nil)
 	if resp != nil {
 		downstreamConn.Write(resp)
 	}
 
-	go proxy.Cipher.IO.Bridge(downstreamConn, upstreamConn, rkeybuf, IOConfig{
-		Partial: proxy.Partial,
-		WSCtrl:  wsClient,
-	})
+	ioc.Span = span
+	downstreamConn = proxy.Cipher.IO.Dump.Wrap(downstreamConn, host)
+	go proxy.Cipher.IO.Bridge(downstreamConn, upstreamConn, rkeybuf, ioc)
 	return upstreamConn
 }
 
-func (proxy *ProxyClient) dialHostAndBridge(downstreamConn net.Conn, host string, resp []byte) {
-	targetSiteConn, err := net.Dial("tcp", host)
+// dialHostAndBridge bridges downstreamConn with host directly, the dial and the bridge are traced in span if not nil
+func (proxy *ProxyClient) dialHostAndBridge(downstreamConn net.Conn, host string, resp []byte, span *Span) {
+	ds := span.child("dial", time.Now())
+	targetSiteConn, err := (&net.Dialer{}).DialContext(ds.dnsTrace(), "tcp", host)
+	ds.end(err)
 	if err != nil {
+		span.end(err)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && proxy.RouteBook != nil {
+			name, _ := splitHostPort(host)
+			proxy.RouteBook.fail(name)
+		}
+
 		logg.E(err)
-		downstreamConn.Close()
+		replyFailure(downstreamConn, resp, dialCloseReason(err))
 		return
 	}
 
 	downstreamConn.Write(resp)
-	go proxy.Cipher.IO.Bridge(downstreamConn, targetSiteConn, nil, IOConfig{})
+	go proxy.Cipher.IO.Bridge(downstreamConn, targetSiteConn, nil, IOConfig{Span: span})
 }
 
 func (proxy *ProxyClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -321,25 +634,27 @@ func (proxy *ProxyClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// we are inside GFW and should pass data to upstream
-		host := r.URL.Host
-		if !hasPort.MatchString(host) {
-			host += ":80"
-		}
+		host := hostWithPort(r.URL.Host, "80")
 
-		if ans, ext := proxy.canDirectConnect(host); ans == ruleBlock {
+		if span, dst, ans, ext := proxy.traceRoute("tunnel", host); ans == ruleBlock {
+			span.end(nil)
 			logg.D("BLACKLIST ", host, ext)
-			proxyClient.Close()
+			refuseTunnel(proxyClient, host, ext)
 		} else if ans == rulePass {
 			logg.D("CONNECT ", r.RequestURI, ext)
-			proxy.dialHostAndBridge(proxyClient, host, okHTTP)
+			proxy.dialHostAndBridge(proxyClient, dst, okHTTP, span)
 		} else if proxy.Policy.IsSet(PolicyManInTheMiddle) {
-			proxy.manInTheMiddle(proxyClient, host)
+			span.end(nil)
+			proxy.manInTheMiddle(proxyClient, host, dst)
+		} else if ans == ruleRace {
+			logg.D("CONNECT~ ", r.RequestURI, ext)
+			proxy.raceAndBridge(proxyClient, dst, okHTTP, span)
 		} else if proxy.Policy.IsSet(PolicyWebSocket) {
 			logg.D("WS^ ", r.RequestURI, ext)
-			proxy.dialUpstreamAndBridgeWS(proxyClient, host, okHTTP, 0)
+			proxy.dialUpstreamAndBridgeWS(proxyClient, dst, okHTTP, 0, span)
 		} else {
 			logg.D("CONNECT^ ", r.RequestURI, ext)
-			proxy.dialUpstreamAndBridge(proxyClient, host, okHTTP, 0)
+			proxy.dialUpstreamAndBridge(proxyClient, dst, okHTTP, 0, span)
 		}
 	} else {
 		// normal http requests
@@ -356,23 +671,63 @@ func (proxy *ProxyClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Header.Del("Proxy-Authorization")
 		r.Header.Del("Proxy-Connection")
 
+		// Connection is between the local client and us, the stream to the upstream can serve
+		// the next requests no matter whether the local client keeps its connection
+		if !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+			r.Header.Del("Connection")
+			r.Header.Del("Keep-Alive")
+			r.Close = false
+		}
+
 		var resp *http.Response
 		var err error
 		var rkeybuf []byte
 
-		if ans, ext := proxy.canDirectConnect(r.Host); ans == ruleBlock {
+		span, dst, ans, ext := proxy.traceRoute("forward", r.Host)
+		r.URL.Host = dst
+
+		if ans == ruleBlock {
+			span.end(nil)
 			logg.D("BLACKLIST ", r.Host, ext)
-			w.WriteHeader(http.StatusServiceUnavailable)
+			serveBlocked(w, r.Host, ext)
 			return
-		} else if ans == rulePass {
+		}
+
+		dump := proxy.Cipher.IO.Dump.wrapHTTP(r, r.Host, dumpIn)
+		defer dump.end()
+
+		rt := span.child("roundtrip", time.Now())
+		if ans == rulePass {
 			logg.D(r.Method, " ", r.Host, ext)
 			resp, err = proxy.tpd.RoundTrip(r)
-		} else {
+		} else if proxy.VLESS != nil {
 			logg.D(r.Method, "^ ", r.Host, ext)
-			resp, rkeybuf, err = proxy.encryptAndTransport(r)
+			resp, err = proxy.tpv.RoundTrip(r)
+		} else {
+			var orig *http.Request
+			if proxy.SoftFail {
+				// r is rewritten for the upstream, its body isn't read if the upstream can't be dialed
+				orig = r.Clone(r.Context())
+			}
+
+			resp, rkeybuf, err = proxy.encryptAndTransport(r, span)
+			if err != nil && orig != nil && proxy.softFail(orig.Host, err) {
+				logg.D(orig.Method, " ", orig.Host, ext, " (soft-fail)")
+				r, rkeybuf = orig, nil
+				resp, err = proxy.tpd.RoundTrip(r)
+			} else {
+				logg.D("[", streamID(rkeybuf), "] ", r.Method, "^ ", r.Host, ext)
+			}
 		}
 
+		rt.end(err)
 		if err != nil {
+			span.end(err)
+			if rkeybuf != nil {
+				w.Header().Set(streamIDHeader, streamID(rkeybuf))
+				err = fmt.Errorf("[%s] %v", streamID(rkeybuf), err)
+			}
+
 			logg.E("HTTP forward: ", rURL, ", ", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -381,39 +736,50 @@ func (proxy *ProxyClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if resp.StatusCode >= 400 {
 			logg.D("[", resp.Status, "] - ", rURL)
 		}
+		span.set("status", resp.StatusCode)
 
-		copyHeaders(w.Header(), resp.Header, proxy.Cipher, false, rkeybuf)
+		copyHeaders(w.Header(), resp.Header, &proxy.Cipher.Codec, false, rkeybuf)
+		dump.response(resp, w.Header())
 		w.WriteHeader(resp.StatusCode)
 
-		if nr, err := proxy.Cipher.IO.Copy(w, resp.Body, rkeybuf, IOConfig{Partial: false}); err != nil {
+		nr, err := proxy.Cipher.IO.Copy(dump.writer(w), resp.Body, rkeybuf, IOConfig{Partial: false})
+		if err != nil {
 			logg.E("copy ", nr, " bytes: ", err)
 		}
 
 		tryClose(resp.Body)
+		span.set("bytes.source", nr)
+		span.end(err)
 	}
 }
 
-func (proxy *ProxyClient) authSocks(conn net.Conn) bool {
+// readSocksAuth reads the username/password subnegotiation (RFC 1929), returned as username:password
+func readSocksAuth(conn net.Conn) (string, bool) {
 	buf := make([]byte, 1+1+255+1+255)
 	n, err := io.ReadAtLeast(conn, buf, 2)
 	if err != nil {
 		logg.E(err)
-		return false
+		return "", false
 	}
 
 	ulen := int(buf[1])
 	if buf[0] != 0x01 || 2+ulen+1 > n {
-		return false
+		return "", false
 	}
 
 	username := string(buf[2 : 2+ulen])
 	plen := int(buf[2+ulen])
 	if 2+ulen+1+plen > n {
-		return false
+		return "", false
 	}
 
 	password := string(buf[2+ulen+1 : 2+ulen+1+plen])
-	return proxy.UserAuth == username+":"+password
+	return username + ":" + password, true
+}
+
+func (proxy *ProxyClient) authSocks(conn net.Conn) bool {
+	auth, ok := readSocksAuth(conn)
+	return ok && proxy.UserAuth == auth
 }
 
 func (proxy *ProxyClient) handleSocks(conn net.Conn) {
@@ -460,22 +826,23 @@ func (proxy *ProxyClient) handleSocks(conn net.Conn) {
 		return
 	}
 
-	host := addr.String()
+	host, resp := addr.String(), okSOCKS
 	switch method {
 	case 1:
-		if ans, ext := proxy.canDirectConnect(host); ans == ruleBlock {
-			logg.D("BLACKLIST ", host, ext)
-			conn.Close()
-		} else if ans == rulePass {
-			logg.D("SOCKS ", host, ext)
-			proxy.dialHostAndBridge(conn, host, okSOCKS)
-		} else if proxy.Policy.IsSet(PolicyWebSocket) {
-			logg.D("WS^ ", host, ext)
-			proxy.dialUpstreamAndBridgeWS(conn, host, okSOCKS, 0)
-		} else {
-			logg.D("SOCKS^ ", host, ext)
-			proxy.dialUpstreamAndBridge(conn, host, okSOCKS, 0)
+		if addr.ip != nil && proxy.Policy.IsSet(PolicySniff) {
+			// only the IP is known, reply first, then try to recover the hostname from what the client sends
+			conn.Write(okSOCKS)
+			resp = nil
+
+			var name string
+			port := strconv.Itoa(addr.port)
+			if name, conn = sniffHost(conn, port); name != "" {
+				logg.D("sniffed ", name, " from ", host)
+				host = net.JoinHostPort(name, port)
+			}
 		}
+
+		proxy.routeAndBridge(conn, host, resp, "SOCKS")
 	case 3:
 		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6zero, Port: 0})
 		if err != nil {
@@ -487,6 +854,41 @@ func (proxy *ProxyClient) handleSocks(conn net.Conn) {
 	}
 }
 
+// routeAndBridge bridges conn with host by the route of host, resp is written to conn once host is connected,
+// tag names the local protocol in logs
+func (proxy *ProxyClient) routeAndBridge(conn net.Conn, host string, resp []byte, tag string) {
+	if span, dst, ans, ext := proxy.traceRoute("tunnel", host); ans == ruleBlock {
+		span.end(nil)
+		logg.D("BLACKLIST ", host, ext)
+		replyFailure(conn, resp, CloseDenied)
+	} else if ans == rulePass {
+		logg.D(tag, " ", host, ext)
+		proxy.dialHostAndBridge(conn, dst, resp, span)
+	} else if ans == ruleRace {
+		logg.D(tag, "~ ", host, ext)
+		proxy.raceAndBridge(conn, dst, resp, span)
+	} else if proxy.Policy.IsSet(PolicyWebSocket) {
+		logg.D("WS^ ", host, ext)
+		proxy.dialUpstreamAndBridgeWS(conn, dst, resp, 0, span)
+	} else {
+		logg.D(tag, "^ ", host, ext)
+		proxy.dialUpstreamAndBridge(conn, dst, resp, 0, span)
+	}
+}
+
+// traceRoute is route in a new trace named name of the tunnel or forwarded request to host,
+// whose lookups are traced as the dns span
+func (proxy *ProxyClient) traceRoute(name, host string) (span *Span, dst string, ans byte, ext string) {
+	span = proxy.Tracer.start(name, spanClient, "", time.Now())
+	span.set("host", host)
+
+	dns := span.child("dns", time.Now())
+	dst, ans, ext = proxy.route(host)
+	dns.set("route", strings.TrimSpace(ext))
+	dns.end(nil)
+	return
+}
+
 func (proxy *ProxyClient) UpdateKey(newKey string) {
 	proxy.Cipher.Init(newKey)
 	proxy.rkeyHeader = "X-" + proxy.Cipher.Alias
@@ -496,6 +898,18 @@ func (proxy *ProxyClient) Start() error {
 	return http.Serve(proxy.Listener, proxy)
 }
 
+// Close stops accepting connections, Start returns then, and stops dialing prewarmed carriers
+func (proxy *ProxyClient) Close() error {
+	var err error
+	proxy.closeOnce.Do(func() {
+		proxy.stopPrewarm()
+		if proxy.Listener != nil {
+			err = proxy.Listener.Close()
+		}
+	})
+	return err
+}
+
 func NewClient(localaddr string, config *ClientConfig) *ProxyClient {
 	var mux net.Listener
 	var err error
@@ -520,16 +934,40 @@ func NewClient(localaddr string, config *ClientConfig) *ProxyClient {
 		ClientConfig: config,
 	}
 
+	for _, up := range config.AltUpstreams {
+		proxy.altPools = append(proxy.altPools, tcpmux.NewDialer(up, config.Mux))
+	}
+
+	if config.Inventory != nil {
+		config.Inventory.init(config.Mux)
+	}
+
+	if config.Transport != nil {
+		proxy.pool.OnDial = config.Transport.Dial
+		for _, p := range proxy.altPools {
+			p.OnDial = config.Transport.Dial
+		}
+	}
+
 	if config.Mux > 0 {
 		proxy.Cipher.IO.Ob = proxy.pool
 	}
 
-	tcpmux.Version = checksum1b([]byte(config.Cipher.Alias)) | 0x80
+	tcpmux.Version = codec.Checksum1b([]byte(config.Cipher.Alias)) | 0x80
 
-	if proxy.Connect2 != "" || proxy.Mux != 0 {
+	if proxy.Connect2 != "" || proxy.Mux != 0 || proxy.Transport != nil {
 		proxy.tp.Proxy, proxy.tpq.Proxy = nil, nil
-		proxy.tpq.Dial = func(network, address string) (net.Conn, error) { return proxy.dialUpstream() }
+		proxy.tpq.Dial = func(network, address string) (net.Conn, error) {
+			conn, err := proxy.dialUpstream()
+			if err != nil {
+				return nil, unreachableError{err}
+			}
+			return conn, nil
+		}
 		proxy.tp.Dial = proxy.tpq.Dial
+		proxy.tp.MaxIdleConnsPerHost = keepAliveStreams
+		// lookups keep their own streams warm, not waiting for new ones to open behind bulk streams
+		proxy.tpq.MaxIdleConnsPerHost = keepAliveStreams
 	}
 
 	if config.Policy.IsSet(PolicyManInTheMiddle) {
@@ -543,11 +981,41 @@ func NewClient(localaddr string, config *ClientConfig) *ProxyClient {
 		proxy.UDPRelayCoconn = 1
 	}
 
+	if proxy.VLESS != nil {
+		proxy.tpv = &http.Transport{TLSClientConfig: tlsSkip, Dial: func(network, address string) (net.Conn, error) {
+			conn, _, err := proxy.dialVLESS(address)
+			return conn, err
+		}}
+	}
+
+	// VLESS upstreams don't resolve names for clients
+	if proxy.ACL != nil && proxy.VLESS == nil {
+		proxy.ACL.Resolver = proxy.lookupRemote
+	}
+
+	if proxy.DNSTTL > 0 && proxy.DNSPrefetch {
+		go proxy.startDNSPrefetch()
+	}
+
+	if proxy.RouteBook == nil {
+		proxy.RouteBook = proxy.RaceBook
+	}
+
+	if proxy.Race > 0 && proxy.RouteBook == nil {
+		proxy.RouteBook, _ = LoadRouteBook("")
+	}
+
+	if proxy.RouteBook != nil {
+		go proxy.RouteBook.startSaving()
+	}
+
 	if port, lerr := strconv.Atoi(localaddr); lerr == nil {
-		mux, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6zero, Port: port})
+		if mux = takeListener(localaddr); mux == nil {
+			mux, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6zero, Port: port})
+		}
 		localaddr = "127.0.0.1:" + localaddr
 	} else {
-		mux, err = net.Listen("tcp", localaddr)
+		mux, err = listenTCP(localaddr)
 		if localaddr[0] == ':' {
 			localaddr = "127.0.0.1" + localaddr
 		}
@@ -563,6 +1031,9 @@ func NewClient(localaddr string, config *ClientConfig) *ProxyClient {
 
 	if proxy.Policy.IsSet(PolicyVPN) {
 		proxy.pool.OnDial = vpnDial
+		for _, p := range proxy.altPools {
+			p.OnDial = vpnDial
+		}
 		// proxy.tp.MaxIdleConns = 2
 		// proxy.tpd.MaxIdleConns = 2
 		// proxy.tpq.MaxIdleConns = 2
@@ -571,5 +1042,10 @@ func NewClient(localaddr string, config *ClientConfig) *ProxyClient {
 		proxy.pool.DialTimeout(time.Second)
 	}
 
+	// after OnDial is set, VPN must protect the carriers
+	if proxy.Prewarm > 0 {
+		proxy.startPrewarm()
+	}
+
 	return proxy
 }
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	minCompressSize = 1024
+	gzipSuffix      = "-Z" // the header of forwarded requests whose client accepts gzipped responses
+)
+
+// compressible tells whether resp is uncompressed text worth gzipping
+func compressible(resp *http.Response) bool {
+	if resp.Header.Get("Content-Encoding") != "" || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.Request != nil && resp.Request.Method == "HEAD" {
+		return false
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength < minCompressSize {
+		return false
+	}
+
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	if idx := strings.Index(ct, ";"); idx > -1 {
+		ct = ct[:idx]
+	}
+
+	switch {
+	case strings.HasPrefix(ct, "text/"), strings.HasSuffix(ct, "+xml"), strings.HasSuffix(ct, "+json"):
+		return true
+	}
+
+	switch ct {
+	case "application/json", "application/javascript", "application/x-javascript", "application/xml",
+		"application/x-www-form-urlencoded", "image/svg+xml":
+		return true
+	}
+
+	return false
+}
+
+type gzipBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+// gzipResponse compresses the body of resp on the fly and fixes its headers
+func gzipResponse(resp *http.Response) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(w)
+		_, err := io.Copy(gz, resp.Body)
+		if err == nil {
+			err = gz.Close()
+		}
+		w.CloseWithError(err)
+	}()
+
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	return &gzipBody{PipeReader: r, src: resp.Body}
+}
+
+func (b *gzipBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	configMagic = "GFWENC1\n"
+	configIter  = 100000 // PBKDF2 rounds
+)
+
+// configAEAD is AES-256-GCM keyed by PBKDF2-HMAC-SHA256 of pass
+func configAEAD(pass string, salt []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(pbkdf2.Key([]byte(pass), salt, configIter, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// EncryptConfig seals a config file: magic | salt (16) | nonce (12) | AES-GCM sealed config
+func EncryptConfig(buf []byte, pass string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := configAEAD(pass, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(append([]byte(configMagic), salt...), nonce...)
+	return aead.Seal(out, nonce, buf, []byte(configMagic)), nil
+}
+
+// IsEncryptedConfig reports whether buf is a config file sealed by EncryptConfig
+func IsEncryptedConfig(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(configMagic))
+}
+
+// DecryptConfig opens a config file sealed by EncryptConfig
+func DecryptConfig(buf []byte, pass string) ([]byte, error) {
+	buf = buf[len(configMagic):]
+	if len(buf) < 16 {
+		return nil, errors.New("truncated config")
+	}
+
+	aead, err := configAEAD(pass, buf[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	buf = buf[16:]
+	if len(buf) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("truncated config")
+	}
+
+	plain, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(configMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted config")
+	}
+	return plain, nil
+}
@@ -0,0 +1,551 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+	"github.com/coyove/goflyway/pkg/lru"
+)
+
+// ConfigError lists every invalid option of a config file
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// ConfigSource is where options of the config file are read, like a parsed config file
+type ConfigSource interface {
+	GetString(section, key string, def string) string
+	GetInt(section, key string, def int64) int64
+	GetBool(section, key string, def bool) bool
+}
+
+// EnvPrefix begins the environment variables overriding options of the config file, each is named
+// by the key in upper case, e.g. GOFLYWAY_UPSTREAM or GOFLYWAY_UDPMAXSESSIONS, so containers can be
+// configured without templating files. Flags given on the command line win over both
+const EnvPrefix = "GOFLYWAY_"
+
+// envNames are names of the environment variables kept from before EnvPrefix
+var envNames = map[string]string{"password": "GOFLYWAY_KEY"}
+
+// EnvName returns the environment variable overriding key
+func EnvName(key string) string {
+	if name, ok := envNames[key]; ok {
+		return name
+	}
+	return EnvPrefix + strings.ToUpper(key)
+}
+
+type envConfig struct {
+	cf   ConfigSource
+	fail func(msg string)
+}
+
+// EnvConfig returns cf whose options are overridden by the environment, cf is nil if there is no config file,
+// invalid numbers and booleans of the environment are reported to fail and cf is read instead
+func EnvConfig(cf ConfigSource, fail func(msg string)) ConfigSource {
+	return &envConfig{cf: cf, fail: fail}
+}
+
+func (e *envConfig) GetString(section, key string, def string) string {
+	if v, ok := os.LookupEnv(EnvName(key)); ok {
+		return v
+	}
+	if e.cf == nil {
+		return def
+	}
+	return e.cf.GetString(section, key, def)
+}
+
+func (e *envConfig) GetInt(section, key string, def int64) int64 {
+	if v, ok := os.LookupEnv(EnvName(key)); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			return n
+		}
+		e.fail(EnvName(key) + " is not a number: " + v)
+	}
+	if e.cf == nil {
+		return def
+	}
+	return e.cf.GetInt(section, key, def)
+}
+
+func (e *envConfig) GetBool(section, key string, def bool) bool {
+	if v, ok := os.LookupEnv(EnvName(key)); ok {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+		e.fail(EnvName(key) + " is not a boolean: " + v)
+	}
+	if e.cf == nil {
+		return def
+	}
+	return e.cf.GetBool(section, key, def)
+}
+
+// ConfigFiles resolves what config files leave to the program reading them, goflyway passes its own
+// so files are read like by -c and -k. Nil funcs, or a nil ConfigFiles, mean it's unsupported
+type ConfigFiles struct {
+	Passphrase func(path string) (string, error)    // of the encrypted config file at path, see EncryptConfig
+	Keychain   func(account string) (string, error) // the secret of account in the OS keychain
+}
+
+// Decrypt returns the plain config of buf read from path, buf is returned as is if it's not encrypted
+func (f *ConfigFiles) Decrypt(path string, buf []byte) ([]byte, error) {
+	if !IsEncryptedConfig(buf) {
+		return buf, nil
+	}
+
+	if f == nil || f.Passphrase == nil {
+		return nil, errors.New(path + " is encrypted but no passphrase is available")
+	}
+
+	pass, err := f.Passphrase(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptConfig(buf, pass)
+}
+
+// Key resolves a password option: '@path' reads the key from a file, which is either a 32-byte binary key
+// used as is, or a passphrase on its first line, 'keychain' reads it from the OS keychain, others are keys
+func (f *ConfigFiles) Key(password string) (string, error) {
+	if password == "keychain" {
+		if f == nil || f.Keychain == nil {
+			return "", errors.New("the OS keychain is unavailable")
+		}
+		return f.Keychain("password")
+	}
+
+	if !strings.HasPrefix(password, "@") {
+		return password, nil
+	}
+
+	path := password[1:]
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(buf) == 32 && !isText(buf) {
+		return string(buf), nil
+	}
+
+	if password = strings.TrimSpace(strings.SplitN(string(buf), "\n", 2)[0]); password == "" {
+		return "", errors.New("empty key file: " + path)
+	}
+	return password, nil
+}
+
+func isText(buf []byte) bool {
+	for _, b := range buf {
+		if (b < 0x20 || b > 0x7e) && b != '\t' && b != '\r' && b != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// confFile reads options of the goflyway config file, [default] and [misc] sections with the keys
+// of the command line flags, e.g. password, listen, upstream, throt. Values can be quoted like TOML,
+// and are overridden by the environment, see EnvConfig.
+type confFile struct {
+	cf        ConfigSource
+	files     *ConfigFiles
+	encrypted bool
+	errs      ConfigError
+}
+
+func openConfFile(path string, files *ConfigFiles) (*confFile, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &confFile{files: files, encrypted: IsEncryptedConfig(buf)}
+	if buf, err = files.Decrypt(path, buf); err != nil {
+		return nil, err
+	}
+
+	cf, err := config.ParseConf(string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	c.cf = EnvConfig(cf, c.fail)
+	return c, nil
+}
+
+func (c *confFile) str(key string, def string) string {
+	if v := c.cf.GetString("default", key, ""); v != "" {
+		return v
+	}
+	return c.cf.GetString("misc", key, def)
+}
+
+func (c *confFile) num(key string, def int64) int64 {
+	v := c.cf.GetInt("default", key, c.cf.GetInt("misc", key, def))
+	if v < 0 {
+		c.fail(key + " should not be negative")
+		return def
+	}
+	return v
+}
+
+func (c *confFile) flag(key string) bool {
+	return c.cf.GetBool("default", key, c.cf.GetBool("misc", key, false))
+}
+
+func (c *confFile) fail(msg string) {
+	c.errs = append(c.errs, msg)
+}
+
+func (c *confFile) cipher() *Cipher {
+	cipher := &Cipher{Partial: c.flag("partial")}
+	if key, err := c.files.Key(c.str("password", "")); err != nil {
+		c.fail("password: " + err.Error())
+	} else if key != "" {
+		cipher.Init(key)
+	} else {
+		c.fail("password is missing")
+	}
+
+	cipher.IO.LeakAge = time.Duration(c.num("leakage", 0)) * time.Second
+	if pace := c.num("pace", 0); pace > 0 {
+		cipher.IO.Pacing = NewPacing(pace * 1024)
+	}
+	if rate := c.num("dnslane", 0); rate > 0 {
+		cipher.IO.DNSLane = NewDNSLane(int(rate))
+	}
+	return cipher
+}
+
+func (c *confFile) listen() string {
+	addr := c.str("listen", "")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		c.fail("listen: " + err.Error())
+	}
+	return addr
+}
+
+func (c *confFile) list(key string) []string {
+	if v := c.str(key, ""); v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+// ips reads a list of IPs, nil if key is missing
+func (c *confFile) ips(key string) []string {
+	l := c.list(key)
+	for _, ip := range l {
+		if net.ParseIP(ip) == nil {
+			c.fail(key + ": invalid IP " + ip)
+		}
+	}
+	return l
+}
+
+// LoadServerConfig reads the listening address and the server config from a config file, which is read
+// through files, all options are validated and reported together in a ConfigError
+func LoadServerConfig(path string, files *ConfigFiles) (string, *ServerConfig, error) {
+	c, err := openConfFile(path, files)
+	if err != nil {
+		return "", nil, err
+	}
+
+	addr := c.listen()
+	sc := &ServerConfig{
+		Cipher:        c.cipher(),
+		Throttling:    c.num("throt", 0),
+		ThrottlingMax: c.num("throtmax", 1024*1024),
+		ProxyPassAddr: c.str("proxypass", ""),
+		DisableUDP:    c.flag("disableudp"),
+		ReverseSOCKS:  c.str("reversesocks", ""),
+		SOCKS:         c.str("socks", ""),
+		Sync:          c.str("sync", ""),
+		SyncPeer:      c.str("syncpeer", ""),
+		RemoteForward: c.flag("remoteforward"),
+		RemoteBinds:   c.list("remotebinds"),
+		Workers:       int(c.num("workers", 0)),
+		HotOrigins:    c.list("hotorigins"),
+		SkewTolerance: time.Duration(c.num("clockskew", 0)) * time.Second,
+		DNSCacheTTL:   time.Duration(c.num("dnscachettl", 60)) * time.Second,
+		AntiReplay:    c.flag("antireplay"),
+		UsersFile:     c.str("users", ""),
+		Bans:          c.ips("ban"),
+		BlacklistFile: c.str("blacklistfile", ""),
+	}
+
+	sc.UDPMaxSessions, sc.UDPTimeout = int(c.num("udpmaxsessions", 0)), time.Duration(c.num("udptimeout", 30))*time.Second
+	sc.IPConnRate, sc.IPMaxBridges = int(c.num("iprate", 0)), int(c.num("ipmaxstreams", 0))
+	sc.BlacklistSize, sc.BanThreshold, sc.BanDuration = int(c.num("blacklistsize", 0)), int(c.num("banthreshold", 0)), time.Duration(c.num("banduration", 0))*time.Second
+	sc.BanPrefixV4, sc.BanPrefixV6 = int(c.num("banprefixv4", 0)), int(c.num("banprefixv6", 0))
+
+	if sc.ThrottlingScope, err = ParseThrottlingScope(c.str("throtscope", "")); err != nil {
+		c.fail(err.Error())
+	}
+
+	if t, err := ParseTransport(c.str("transport", ""), c.str("kcp", "")); err != nil {
+		c.fail(err.Error())
+	} else if _, ok := t.(*TLSTransport); ok {
+		c.fail("transport: the server terminates TLS on its own listener by acme")
+	} else if t != nil {
+		sc.Transports = []Transport{t}
+	}
+
+	if (sc.Sync == "") != (sc.SyncPeer == "") {
+		c.fail("sync: sync and syncpeer go together")
+	}
+
+	if sc.UsersFile != "" {
+		if sc.Users, err = LoadUsers(sc.UsersFile); err != nil {
+			c.fail("users: " + err.Error())
+		}
+	}
+
+	if auth := c.str("auth", ""); auth != "" {
+		if sc.Users == nil {
+			sc.Users = map[string]UserConfig{}
+		}
+		sc.Users[userName(auth)] = UserConfig{Auth: auth}
+	}
+
+	if path := c.str("classes", ""); path != "" {
+		if sc.Classes, err = LoadTrafficClasses(path); err != nil {
+			c.fail("classes: " + err.Error())
+		}
+	}
+
+	if domains := c.list("acme"); len(domains) > 0 {
+		sc.TLS = NewACMEConfig(domains, c.str("acmedir", "acme"), "")
+	}
+
+	if sc.TLSRoute = c.str("sni", ""); sc.TLSRoute != "" && sc.TLS == nil {
+		c.fail("sni: TLS is off, see acme")
+	}
+
+	if path := c.str("tenants", ""); path != "" {
+		if sc.Tenants, err = LoadTenants(path); err != nil {
+			c.fail("tenants: " + err.Error())
+		}
+	}
+
+	if _, err := acr.NewHostMatcher(sc.HotOrigins); err != nil {
+		c.fail("hotorigins: " + err.Error())
+	}
+
+	if path := c.str("access", ""); path != "" {
+		if sc.AccessRules, err = LoadAccessRules(path); err != nil {
+			c.fail("access: " + err.Error())
+		}
+	}
+
+	if prefix := c.str("nat64", ""); prefix != "" {
+		if sc.NAT64, err = ParseNAT64(prefix); err != nil {
+			c.fail("nat64: " + err.Error())
+		}
+	}
+
+	if path := c.str("sshjump", ""); path != "" {
+		if sc.SSHJumps, err = LoadSSHJumps(path); err != nil {
+			c.fail("sshjump: " + err.Error())
+		}
+	}
+
+	if addr := c.str("sharedstate", ""); addr != "" {
+		if state, err := NewRedisState(addr); err != nil {
+			c.fail("sharedstate: " + err.Error())
+		} else {
+			sc.State = state
+		}
+	}
+
+	if path := c.str("wireguard", ""); path != "" {
+		if sc.WireGuard, err = LoadWireGuard(path); err != nil {
+			c.fail("wireguard: " + err.Error())
+		}
+	}
+
+	if r := c.str("resolver", ""); r != "" {
+		if sc.Resolver, err = ParseResolver(r); err != nil {
+			c.fail("resolver: " + err.Error())
+		}
+	}
+
+	if ep := c.str("otlp", ""); ep != "" {
+		if sc.Tracer, err = NewTracer(ep, "goflyway-server"); err != nil {
+			c.fail("otlp: " + err.Error())
+		}
+	}
+
+	if !c.encrypted {
+		// Reload reads plain files only
+		sc.ConfigFile = path
+	}
+
+	if len(c.errs) > 0 {
+		return "", nil, c.errs
+	}
+	return addr, sc, nil
+}
+
+// LoadClientConfig reads the listening address and the client config from a config file read through files,
+// only plain host:port upstreams are supported, URL ones (ws://, https://...) need the command line
+func LoadClientConfig(path string, files *ConfigFiles) (string, *ClientConfig, error) {
+	c, err := openConfFile(path, files)
+	if err != nil {
+		return "", nil, err
+	}
+
+	addr := c.listen()
+	cc := &ClientConfig{
+		Cipher:         c.cipher(),
+		UserAuth:       c.str("auth", ""),
+		Upstream:       c.str("upstream", ""),
+		AltUpstreams:   c.list("upstreamalt"),
+		UDPRelayCoconn: int(c.num("udptcp", 0)),
+		DNSCache:       lru.NewCache(int(c.num("dnscache", 1024))),
+		DNSTTL:         time.Duration(c.num("dnsttl", 0)) * time.Second,
+		DNSPrefetch:    c.flag("dnsprefetch"),
+		CACache:        lru.NewCache(256),
+		Mux:            int(c.num("mux", 0)),
+		Prewarm:        int(c.num("prewarm", 0)),
+		SkewTolerance:  time.Duration(c.num("clockskew", 0)) * time.Second,
+		SoftFail:       c.flag("softfail"),
+		ECDH:           c.flag("ecdh"),
+		PartialSum:     c.flag("partialsum"),
+		MaxRequestLine: int(c.num("maxrequestline", 0)),
+	}
+
+	for _, up := range append([]string{cc.Upstream}, cc.AltUpstreams...) {
+		if strings.Contains(up, "://") {
+			c.fail("upstream: URL upstreams are only supported by the command line: " + up)
+		} else if _, _, err := net.SplitHostPort(up); err != nil {
+			c.fail("upstream: " + err.Error())
+		}
+	}
+
+	if n := cc.MaxRequestLine; n != 0 && n < minRequestLine {
+		c.fail("maxrequestline: should be at least " + strconv.Itoa(minRequestLine))
+	}
+
+	if cc.Transport, err = ParseTransport(c.str("transport", ""), c.str("kcp", "")); err != nil {
+		c.fail(err.Error())
+	}
+
+	if t, ok := cc.Transport.(*TLSTransport); ok && c.str("sni", "") != "" {
+		cc.Transport = t.WithSNI(c.str("sni", ""))
+	}
+
+	if fp := c.str("fingerprint", ""); fp != "" {
+		if t, ok := cc.Transport.(*TLSTransport); !ok {
+			c.fail("fingerprint: the transport is not tls")
+		} else if cc.Transport, err = t.WithFingerprint(fp); err != nil {
+			c.fail("fingerprint: " + err.Error())
+		}
+	}
+
+	// like the command line, a missing default ACL is fine
+	acl := c.str("acl", "")
+	if cc.ACL, err = acr.LoadACL(c.str("acl", "chinalist.txt")); err != nil && acl != "" {
+		c.fail("acl: " + err.Error())
+	}
+	cc.ACL.ResolveRemote = c.flag("resolveremote")
+
+	if path := c.str("hosts", ""); path != "" {
+		if cc.Hosts, err = LoadHosts(path); err != nil {
+			c.fail("hosts: " + err.Error())
+		}
+	}
+
+	if path := c.str("dnsrewrite", ""); path != "" {
+		if cc.DNSRewrite, err = LoadHosts(path); err != nil {
+			c.fail("dnsrewrite: " + err.Error())
+		}
+	}
+
+	if cidr := c.str("fakeip", ""); cidr != "" {
+		if cc.FakeIP, err = NewFakeIP(cidr); err != nil {
+			c.fail("fakeip: " + err.Error())
+		}
+	}
+
+	if path := c.str("access", ""); path != "" {
+		if cc.AccessRules, err = LoadAccessRules(path); err != nil {
+			c.fail("access: " + err.Error())
+		}
+	}
+
+	if path := c.str("servers", ""); path != "" {
+		if cc.Inventory, err = LoadInventory(path); err != nil {
+			c.fail("servers: " + err.Error())
+		}
+	}
+
+	if ep := c.str("otlp", ""); ep != "" {
+		if cc.Tracer, err = NewTracer(ep, "goflyway-client"); err != nil {
+			c.fail("otlp: " + err.Error())
+		}
+	}
+
+	if deny := c.list("softfaildeny"); len(deny) > 0 {
+		if cc.SoftFailDeny, err = acr.NewHostMatcher(deny); err != nil {
+			c.fail("softfaildeny: " + err.Error())
+		}
+	}
+
+	for key, p := range map[string]byte{
+		"global":    PolicyGlobal,
+		"sniff":     PolicySniff,
+		"tunnellan": PolicyTunnelLAN,
+		"compress":  PolicyCompress,
+	} {
+		if c.flag(key) {
+			cc.Policy.Set(p)
+		}
+	}
+
+	if len(c.errs) > 0 {
+		return "", nil, c.errs
+	}
+	return addr, cc, nil
+}
+
+// NewServerFromConfig creates the server described by a config file, see LoadServerConfig
+func NewServerFromConfig(path string, files *ConfigFiles) (*ProxyUpstream, error) {
+	addr, sc, err := LoadServerConfig(path, files)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := NewServer(addr, sc)
+	if proxy == nil {
+		return nil, errors.New("can't create the server")
+	}
+	return proxy, nil
+}
+
+// NewClientFromConfig creates the client described by a config file, see LoadClientConfig
+func NewClientFromConfig(path string, files *ConfigFiles) (*ProxyClient, error) {
+	addr, cc, err := LoadClientConfig(path, files)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := NewClient(addr, cc)
+	if proxy == nil {
+		return nil, errors.New("can't create the client")
+	}
+	return proxy, nil
+}
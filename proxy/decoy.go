@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Active probers send crafted requests to tell a goflyway server from a web server, a request failing
+// any check, no matter which one, is answered by the decoy: the tenant's site, the site of ProxyPassAddr
+// or a stock nginx page. It comes after a random delay counted from the arrival of the request, so the
+// time spent on the checks doesn't tell which one failed
+const (
+	decoyDelayMin = 20 * time.Millisecond
+	decoyDelayMax = 120 * time.Millisecond
+
+	// the body of a request answered by the stock page is drained up to this like nginx does
+	decoyDrainSize = 64 * 1024
+)
+
+const decoyPageTemplate = `<html>
+<head><title>%[1]d %[2]s</title></head>
+<body>
+<center><h1>%[1]d %[2]s</h1></center>
+<hr><center>nginx</center>
+</body>
+</html>
+`
+
+// decoyStatus is the reason phrase nginx uses for code
+func decoyStatus(code int) string {
+	if code == http.StatusServiceUnavailable {
+		return "Service Temporarily Unavailable"
+	}
+	return http.StatusText(code)
+}
+
+// decoyPage writes the error page of nginx with its headers
+func decoyPage(w http.ResponseWriter, code int) {
+	page := fmt.Sprintf(decoyPageTemplate, code, decoyStatus(code))
+	w.Header().Set("Server", "nginx")
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", fmt.Sprint(len(page)))
+	w.WriteHeader(code)
+	io.WriteString(w, page)
+}
+
+// decoy answers r like a web server having nothing to do with goflyway, start is when r arrived
+func (proxy *ProxyUpstream) decoy(w http.ResponseWriter, r *http.Request, start time.Time) {
+	delay := decoyDelayMin + time.Duration(rand.Int63n(int64(decoyDelayMax-decoyDelayMin)))
+	time.Sleep(start.Add(delay).Sub(time.Now()))
+
+	if t := proxy.tenantOf(r.Host); t != nil {
+		t.ServeHTTP(w, r)
+	} else if proxy.rp != nil {
+		proxy.rp.ServeHTTP(w, r)
+	} else {
+		io.CopyN(ioutil.Discard, r.Body, decoyDrainSize)
+		decoyPage(w, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dnsCacheSize = 4096
+
+	// failed lookups are cached shorter, so a name fixed on the resolver comes back soon
+	dnsNegativeTTL = 10 * time.Second
+)
+
+type dnsAnswer struct {
+	ip  net.IP
+	err error
+}
+
+// resolve looks up the IPv4 of host for a client, answers are cached for the TTL of their records, at most
+// DNSCacheTTL, so hot domains asked by many clients don't hit the resolver each time
+func (proxy *ProxyUpstream) resolve(host string) (net.IP, error) {
+	if proxy.dnsCache != nil {
+		if v, ok := proxy.dnsCache.Get(host); ok {
+			atomic.AddUint64(&proxy.dnsCacheHits, 1)
+			a := v.(*dnsAnswer)
+			return a.ip, a.err
+		}
+	}
+
+	ip, recordTTL, err := proxy.lookup4(host)
+	a := &dnsAnswer{ip: ip, err: err}
+
+	if proxy.dnsCache != nil {
+		ttl := proxy.DNSCacheTTL
+		if err != nil && ttl > dnsNegativeTTL {
+			ttl = dnsNegativeTTL
+		} else if err == nil && recordTTL > 0 && ttl > recordTTL {
+			ttl = recordTTL
+		}
+		proxy.dnsCache.AddWithTTL(host, a, ttl)
+	}
+	return a.ip, a.err
+}
+
+// dnsTTL is the least TTL of the answers read by the lookups of a resolver, which net.Resolver doesn't tell
+type dnsTTL struct {
+	mu   sync.Mutex
+	ttl  uint32
+	seen bool
+}
+
+// resolver returns r reading answers through t, r may be nil like the system's
+func (t *dnsTTL) resolver(r *net.Resolver) *net.Resolver {
+	dial := (&net.Dialer{Timeout: timeoutDial}).DialContext
+	strict := false
+	if r != nil {
+		if r.Dial != nil {
+			dial = r.Dial
+		}
+		strict = r.StrictErrors
+	}
+
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: strict,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			c := &dnsTTLConn{Conn: conn, t: t}
+			if pc, ok := conn.(net.PacketConn); ok {
+				// the Go resolver exchanges one message per packet with packet conns
+				return &dnsTTLPacketConn{dnsTTLConn: c, pc: pc}, nil
+			}
+			c.stream = true
+			return c, nil
+		},
+	}
+}
+
+// see reads the TTLs of the answer records of msg
+func (t *dnsTTL) see(msg []byte) {
+	_, _, p, ok := parseDNSQuestion(msg)
+	if !ok || msg[2]&0x80 == 0 {
+		return
+	}
+
+	for n := int(binary.BigEndian.Uint16(msg[6:])); n > 0; n-- {
+		// the name, compressed or not
+		for p < len(msg) && msg[p] != 0 && msg[p]&0xc0 == 0 {
+			p += 1 + int(msg[p])
+		}
+		if p < len(msg) && msg[p] != 0 {
+			p++ // the pointer takes 2 bytes
+		}
+		p++
+
+		if p+10 > len(msg) {
+			return
+		}
+
+		ttl := binary.BigEndian.Uint32(msg[p+4:])
+		t.mu.Lock()
+		if !t.seen || ttl < t.ttl {
+			t.ttl, t.seen = ttl, true
+		}
+		t.mu.Unlock()
+		p += 10 + int(binary.BigEndian.Uint16(msg[p+8:]))
+	}
+}
+
+func (t *dnsTTL) get() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.ttl) * time.Second
+}
+
+// dnsTTLConn passes the DNS messages read to dnsTTL, those of streams are prefixed with their lengths
+type dnsTTLConn struct {
+	net.Conn
+	t      *dnsTTL
+	stream bool
+	buf    []byte // of the stream, not a whole message yet
+}
+
+func (c *dnsTTLConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stream {
+		c.t.see(b[:n])
+		return n, err
+	}
+
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 && len(c.buf) >= 2+int(binary.BigEndian.Uint16(c.buf)) {
+		end := 2 + int(binary.BigEndian.Uint16(c.buf))
+		c.t.see(c.buf[2:end])
+		c.buf = c.buf[end:]
+	}
+	return n, err
+}
+
+// dnsTTLPacketConn is dnsTTLConn of a packet conn, which the Go resolver tells by net.PacketConn
+type dnsTTLPacketConn struct {
+	*dnsTTLConn
+	pc net.PacketConn
+}
+
+func (c *dnsTTLPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	c.t.see(b[:n])
+	return n, addr, err
+}
+
+func (c *dnsTTLPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
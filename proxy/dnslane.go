@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// dnsLaneHold is how long a write of a bulk stream waits at most for the lookups in flight
+const dnsLaneHold = 50 * time.Millisecond
+
+// DNSLane gives lookups of names priority over bulk streams sharing their mux carrier: while a query
+// is being sent or its answer written, bulk streams hold their writes into that carrier, so pages don't wait for
+// names queued behind downloads. Carriers are told apart by the remote address of their streams, bulk streams
+// of other carriers are not held. Lookups beyond Rate per second go like other requests, a flood of them
+// can't stall the bulk streams.
+type DNSLane struct {
+	Rate int // prioritized lookups per second
+
+	mu       sync.Mutex
+	carriers map[string]*laneCarrier // with lookups in flight
+	tokens   float64
+	last     time.Time
+}
+
+type laneCarrier struct {
+	inflight int
+	idle     chan struct{} // closed when the last lookup in flight is done
+}
+
+func NewDNSLane(rate int) *DNSLane {
+	return &DNSLane{Rate: rate, tokens: float64(rate), last: time.Now(), carriers: make(map[string]*laneCarrier)}
+}
+
+// enter starts a lookup on carrier, true means it is prioritized and leave must be called when it is sent,
+// nil lanes prioritize nothing
+func (l *DNSLane) enter(carrier string) bool {
+	if l == nil || l.Rate <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.tokens += now.Sub(l.last).Seconds() * float64(l.Rate); l.tokens > float64(l.Rate) {
+		l.tokens = float64(l.Rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	c := l.carriers[carrier]
+	if c == nil {
+		c = &laneCarrier{idle: make(chan struct{})}
+		l.carriers[carrier] = c
+	}
+	c.inflight++
+	return true
+}
+
+func (l *DNSLane) leave(carrier string) {
+	l.mu.Lock()
+	if c := l.carriers[carrier]; c != nil {
+		if c.inflight--; c.inflight == 0 {
+			close(c.idle)
+			delete(l.carriers, carrier)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// yield blocks a write of a bulk stream until no lookups are in flight on its carrier, at most dnsLaneHold
+func (l *DNSLane) yield(carrier string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	var idle chan struct{}
+	if c := l.carriers[carrier]; c != nil {
+		idle = c.idle
+	}
+	l.mu.Unlock()
+
+	if idle == nil {
+		return
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(dnsLaneHold):
+	}
+}
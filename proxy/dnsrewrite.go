@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+const (
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsRewriteTTL = 60
+)
+
+// rewriteDNS replaces the answer of a DNS response relayed back to apps if the queried name
+// is mapped to an IP in h, so internal services can be reached at the address behind the tunnel
+// even if their public records differ. Queries of the other address family get an empty answer.
+// Responses which can't be parsed or whose name is not mapped are returned as is.
+func (h Hosts) rewriteDNS(msg []byte) []byte {
+	if len(h) == 0 || len(msg) < 17 || msg[2]&0x80 == 0 {
+		return msg
+	}
+
+	name, qtype, end, ok := parseDNSQuestion(msg)
+	if !ok || (qtype != dnsTypeA && qtype != dnsTypeAAAA) {
+		return msg
+	}
+
+	ip := net.ParseIP(h[name])
+	if ip == nil {
+		return msg
+	}
+
+	var rdata []byte
+	if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+		rdata = ip4
+	} else if ip4 == nil && qtype == dnsTypeAAAA {
+		rdata = ip.To16()
+	}
+
+	return dnsReply(msg, end, qtype, rdata, dnsRewriteTTL)
+}
+
+// parseDNSQuestion returns the lower-cased name and the type of the only question of a DNS message,
+// and where the question ends
+func parseDNSQuestion(msg []byte) (name string, qtype uint16, end int, ok bool) {
+	// header (12) + at least a root name (1) + type (2) + class (2)
+	if len(msg) < 17 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return
+	}
+
+	labels, p := []string{}, 12
+	for {
+		if p >= len(msg) {
+			return
+		}
+
+		ln := int(msg[p])
+		if ln == 0 {
+			p++
+			break
+		}
+
+		if ln&0xc0 != 0 || p+1+ln > len(msg) {
+			// questions are never compressed
+			return
+		}
+
+		labels = append(labels, string(msg[p+1:p+1+ln]))
+		p += 1 + ln
+	}
+
+	if p+4 > len(msg) {
+		return
+	}
+
+	return strings.ToLower(strings.Join(labels, ".")), binary.BigEndian.Uint16(msg[p:]), p + 4, true
+}
+
+// dnsReply answers the question of msg ending at end with rdata of qtype, nil rdata means an empty answer
+func dnsReply(msg []byte, end int, qtype uint16, rdata []byte, ttl uint32) []byte {
+	question := msg[12:end]
+	buf := make([]byte, 12, 12+len(question)+12+len(rdata))
+	copy(buf, msg[:4])
+	buf[2] |= 0x80  // response
+	buf[2] &^= 0x02 // not truncated
+	buf[3] &= 0xf0  // rcode: no error
+	buf[3] |= 0x80  // recursion available
+	buf[5] = 1      // qdcount
+	buf = append(buf, question...)
+
+	if rdata != nil {
+		buf[7] = 1 // ancount
+
+		rr := make([]byte, 12)
+		rr[0], rr[1] = 0xc0, 12 // pointer to the name in the question
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint16(rr[4:], 1) // class IN
+		binary.BigEndian.PutUint32(rr[6:], ttl)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		buf = append(append(buf, rr...), rdata...)
+	}
+
+	return buf
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// DefaultDrainRetry is how long clients stay away from a draining server if no hint is given
+const DefaultDrainRetry = time.Minute
+
+// Drain marks the server as draining before maintenance: bridged streams continue, new CONNECTs
+// are refused with CloseDraining and a Retry-After hint, so clients fail over to their alternate
+// upstreams and won't come back until the hint expires
+func (proxy *ProxyUpstream) Drain(retryAfter time.Duration) {
+	if retryAfter < time.Second {
+		retryAfter = DefaultDrainRetry
+	}
+
+	if atomic.SwapInt64(&proxy.draining, int64(retryAfter)) == 0 {
+		logg.L("draining, retry after ", retryAfter)
+		proxy.Broadcast("the server is draining for maintenance, please switch to other servers")
+	}
+}
+
+// Undrain accepts new CONNECTs again
+func (proxy *ProxyUpstream) Undrain() {
+	if atomic.SwapInt64(&proxy.draining, 0) != 0 {
+		logg.L("draining stopped")
+	}
+}
+
+// Draining returns the Retry-After hint if the server is draining
+func (proxy *ProxyUpstream) Draining() (time.Duration, bool) {
+	d := atomic.LoadInt64(&proxy.draining)
+	return time.Duration(d), d != 0
+}
+
+// drained moves the client off the upstream up which is draining, it is dialed last until after,
+// false is returned if up is not one of the upstreams (e.g. a pinned server) or there is no other one to fail over to
+func (proxy *ProxyClient) drained(up string, after time.Duration) bool {
+	now := time.Now().UnixNano()
+
+	proxy.activeMu.Lock()
+	defer proxy.activeMu.Unlock()
+
+	i := 0
+	for ; i <= len(proxy.altPools); i++ {
+		if _, u := proxy.poolAt(i); u == up {
+			break
+		}
+	}
+	if i > len(proxy.altPools) {
+		return false
+	}
+
+	if proxy.drainEnd == nil {
+		proxy.drainEnd = make(map[int]int64)
+	}
+	proxy.drainEnd[i] = now + int64(after)
+
+	for i := 0; i <= len(proxy.altPools); i++ {
+		if proxy.drainEnd[i] <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// drainRetry reads the Retry-After hint of a refused CONNECT
+func drainRetry(resp []byte) time.Duration {
+	if n, err := strconv.Atoi(headerValue(resp, "Retry-After")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return DefaultDrainRetry
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TrafficDump writes decrypted stream metadata of selected connections into a JSONL file,
+// optionally along with the first MaxPayload bytes of each direction, so protocol bugs
+// reported by users can be reproduced. Only the plaintext endpoint of a bridge is recorded:
+// the local application on the client, the target site on the server.
+type TrafficDump struct {
+	Filter     string // only dump hosts containing this string, empty means all
+	MaxPayload int    // bytes of payload recorded per direction, 0 means metadata only
+
+	id uint64
+	mu sync.Mutex
+	f  *os.File
+	e  *json.Encoder
+}
+
+type dumpRecord struct {
+	TS    int64  `json:"ts"`
+	ID    uint64 `json:"id"`
+	Event string `json:"event"`
+	Host  string `json:"host,omitempty"`
+	Len   int    `json:"len,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+func NewTrafficDump(path, filter string, maxPayload int) (*TrafficDump, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrafficDump{
+		Filter:     filter,
+		MaxPayload: maxPayload,
+		f:          f,
+		e:          json.NewEncoder(f),
+	}, nil
+}
+
+func (d *TrafficDump) write(r *dumpRecord) {
+	r.TS = time.Now().UnixNano()
+	d.mu.Lock()
+	d.e.Encode(r)
+	d.mu.Unlock()
+}
+
+const (
+	dumpIn = iota
+	dumpOut
+)
+
+// open starts the record of a stream of host, nil if d is nil or host doesn't match the filter
+func (d *TrafficDump) open(host string) *dumpStream {
+	if d == nil || !strings.Contains(host, d.Filter) {
+		return nil
+	}
+
+	s := &dumpStream{
+		d:      d,
+		id:     atomic.AddUint64(&d.id, 1),
+		remain: [2]int{d.MaxPayload, d.MaxPayload},
+	}
+
+	d.write(&dumpRecord{ID: s.id, Event: "open", Host: host})
+	return s
+}
+
+// Wrap returns conn as is if d is nil or host doesn't match the filter
+func (d *TrafficDump) Wrap(conn net.Conn, host string) net.Conn {
+	if conn == nil {
+		return conn
+	}
+
+	s := d.open(host)
+	if s == nil {
+		return conn
+	}
+	return &dumpConn{Conn: conn, dumpStream: s}
+}
+
+func (d *TrafficDump) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
+
+// dumpStream is the record of a conn, or of a forwarded HTTP exchange
+type dumpStream struct {
+	d      *TrafficDump
+	id     uint64
+	remain [2]int // in, out
+	once   sync.Once
+}
+
+func (s *dumpStream) record(dir int, p []byte) {
+	r := &dumpRecord{ID: s.id, Event: [...]string{"in", "out"}[dir], Len: len(p)}
+	if n := s.remain[dir]; n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+
+		r.Data = dup(p[:n])
+		s.remain[dir] -= n
+	}
+
+	s.d.write(r)
+}
+
+func (s *dumpStream) close() {
+	s.once.Do(func() { s.d.write(&dumpRecord{ID: s.id, Event: "close"}) })
+}
+
+type dumpConn struct {
+	net.Conn
+	*dumpStream
+}
+
+func (c *dumpConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.record(dumpIn, b[:n])
+	}
+	return
+}
+
+func (c *dumpConn) Write(b []byte) (n int, err error) {
+	if len(b) > 0 {
+		c.record(dumpOut, b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *dumpConn) Close() error {
+	c.close()
+	return c.Conn.Close()
+}
+
+// dumpHTTP records a forwarded HTTP exchange like a conn of its plaintext end: the request is in on the client,
+// from the local application, and out on the server, to the target site, the response the other way round
+type dumpHTTP struct {
+	*dumpStream
+	req int // the direction of the request
+}
+
+// wrapHTTP records the head of r and the body read from it, nil if d is nil or host doesn't match the filter
+func (d *TrafficDump) wrapHTTP(r *http.Request, host string, req int) *dumpHTTP {
+	s := d.open(host)
+	if s == nil {
+		return nil
+	}
+
+	// the URI of r may be the one of a proxy, or encrypted on the server
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	head, _ := httputil.DumpRequest(out, false)
+	s.record(req, head)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &dumpBody{ReadCloser: r.Body, s: s, dir: req}
+	}
+	return &dumpHTTP{dumpStream: s, req: req}
+}
+
+// response records the status of resp and header, the plaintext headers of it
+func (h *dumpHTTP) response(resp *http.Response, header http.Header) {
+	if h == nil {
+		return
+	}
+
+	head := &bytes.Buffer{}
+	head.WriteString(resp.Proto + " " + resp.Status + "\r\n")
+	header.Write(head)
+	head.WriteString("\r\n")
+	h.record(1-h.req, head.Bytes())
+}
+
+// body records the response body read from rc
+func (h *dumpHTTP) body(rc io.ReadCloser) io.ReadCloser {
+	if h == nil {
+		return rc
+	}
+	return &dumpBody{ReadCloser: rc, s: h.dumpStream, dir: 1 - h.req}
+}
+
+// writer records the response body written into w
+func (h *dumpHTTP) writer(w io.Writer) io.Writer {
+	if h == nil {
+		return w
+	}
+	return &dumpWriter{Writer: w, s: h.dumpStream, dir: 1 - h.req}
+}
+
+func (h *dumpHTTP) end() {
+	if h != nil {
+		h.close()
+	}
+}
+
+type dumpBody struct {
+	io.ReadCloser
+	s   *dumpStream
+	dir int
+}
+
+func (b *dumpBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.s.record(b.dir, p[:n])
+	}
+	return
+}
+
+type dumpWriter struct {
+	io.Writer
+	s   *dumpStream
+	dir int
+}
+
+func (w *dumpWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.s.record(w.dir, p)
+	}
+	return w.Writer.Write(p)
+}
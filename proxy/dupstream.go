@@ -0,0 +1,439 @@
+package proxy
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// A duplicated stream is carried by several tunnels at once, e.g. through the servers of a pin which
+// reach the same upstream by different routes, so a loss or a stall on one route won't delay the stream:
+// each end numbers the chunks read from its local conn and sends them through every tunnel,
+// the other end writes each chunk to its local conn once, in order, from whichever tunnel delivers it first
+//
+//	+--------+--------+---------+
+//	| seq 4b | len 2b | payload |   a chunk without payload ends the stream
+//	+--------+--------+---------+
+const (
+	dupSuffix  = "-D" // the header carrying the id of a duplicated stream, encrypted
+	dupChunk   = 16 * 1024
+	dupQueue   = 64   // chunks queued for a tunnel, a tunnel falling further behind is dropped
+	dupPending = 1024 // chunks received ahead of the next one, more means the stream is broken
+)
+
+var errNoDup = errors.New("upstream doesn't support duplicated streams, update it or remove 'duplicate' from the pin")
+
+type dupTunnel struct {
+	conn    net.Conn
+	r, w    *inplace_ctr_t
+	queue   chan []byte
+	stopped bool
+}
+
+type dupStream struct {
+	gc    *Cipher
+	ioc   IOConfig
+	role  byte // of the copy from the local conn, like Bridge
+	local net.Conn
+	bid   uint64        // of the local conn registered in the bridges
+	ready chan struct{} // closed when the local conn is set or the stream is closed
+
+	mu       sync.Mutex
+	tunnels  []*dupTunnel
+	writers  sync.WaitGroup
+	seq      uint32 // of the next chunk sent
+	next     uint32 // of the next chunk written to the local conn
+	pending  map[uint32][]byte
+	sent     bool // the local conn has been read to the end
+	received bool // the peer has ended the stream
+	writing  bool // a reader is writing to the local conn
+	closed   bool
+	onClose  func()
+
+	span, bridge *Span // the traced stream and its bridge, ended by close
+}
+
+func (gc *Cipher) newDupStream(ioc IOConfig, role byte) *dupStream {
+	return &dupStream{
+		gc:      gc,
+		ioc:     ioc,
+		role:    role,
+		ready:   make(chan struct{}),
+		pending: make(map[uint32][]byte),
+	}
+}
+
+func (d *dupStream) cipherStream(key []byte, block cipher.Block) *inplace_ctr_t {
+	ctr := d.gc.getCipherStream(key)
+	if block != nil {
+		ctr.b = block
+	}
+	return ctr
+}
+
+// attach adds a tunnel carrying the stream, chunks sent before it joins won't go through it
+func (d *dupStream) attach(conn net.Conn, key []byte, block cipher.Block) {
+	t := &dupTunnel{conn: conn, queue: make(chan []byte, dupQueue)}
+	t.r, t.w = d.cipherStream(key, block), d.cipherStream(key, block)
+
+	d.mu.Lock()
+	if d.closed || d.sent {
+		d.mu.Unlock()
+		conn.Close()
+		return
+	}
+	d.tunnels = append(d.tunnels, t)
+	d.writers.Add(1)
+	d.mu.Unlock()
+
+	go d.write(t)
+	go d.read(t)
+}
+
+// start bridges the stream to the local conn, it returns when the local conn has been read to the end
+func (d *dupStream) start(local net.Conn, span *Span) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		local.Close()
+		span.end(nil)
+		return
+	}
+	d.span, d.bridge = span, span.child("bridge", time.Now())
+	d.local, d.bid = local, d.gc.IO.br.open(local, local, &d.ioc)
+	d.mu.Unlock()
+	close(d.ready)
+
+	buf := make([]byte, dupChunk)
+	for {
+		n, err := local.Read(buf)
+		if n > 0 {
+			d.ioc.Meter.add(d.role, n)
+			if d.ioc.Bucket != nil {
+				d.ioc.Meter.throttle(d.ioc.Bucket.Consume(int64(n)))
+			}
+			d.send(buf[:n])
+		}
+
+		if err != nil {
+			d.gc.IO.br.half(d.bid)
+			d.send(nil)
+			return
+		}
+	}
+}
+
+// fail closes a stream whose local conn can't be set
+func (d *dupStream) fail() {
+	d.mu.Lock()
+	d.close()
+	d.mu.Unlock()
+	close(d.ready)
+}
+
+func (d *dupStream) send(p []byte) {
+	frame := make([]byte, 6+len(p))
+	copy(frame[6:], p)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(p)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	binary.BigEndian.PutUint32(frame, d.seq)
+	d.seq++
+
+	for _, t := range append([]*dupTunnel{}, d.tunnels...) {
+		select {
+		case t.queue <- frame:
+		default:
+			logg.W("duplicated stream: ", t.conn.RemoteAddr(), " falls behind, drop it")
+			d.drop(t)
+		}
+	}
+
+	if len(p) == 0 {
+		d.sent = true
+		for _, t := range d.tunnels {
+			t.stop()
+		}
+		d.finish()
+	}
+}
+
+func (d *dupStream) write(t *dupTunnel) {
+	defer d.writers.Done()
+	for frame := range t.queue {
+		buf := dup(frame)
+		t.w.XorBuffer(buf)
+		if _, err := t.conn.Write(buf); err != nil {
+			d.mu.Lock()
+			d.drop(t)
+			d.mu.Unlock()
+			for range t.queue {
+			}
+			return
+		}
+	}
+}
+
+func (d *dupStream) read(t *dupTunnel) {
+	hdr := make([]byte, 6)
+	for {
+		if _, err := io.ReadFull(t.conn, hdr); err != nil {
+			break
+		}
+		t.r.XorBuffer(hdr)
+
+		p := make([]byte, binary.BigEndian.Uint16(hdr[4:]))
+		if _, err := io.ReadFull(t.conn, p); err != nil {
+			break
+		}
+		t.r.XorBuffer(p)
+
+		<-d.ready
+		if !d.deliver(binary.BigEndian.Uint32(hdr), p) {
+			break
+		}
+	}
+
+	d.mu.Lock()
+	d.drop(t)
+	d.mu.Unlock()
+}
+
+// deliver writes the chunks in order to the local conn, it returns false if the stream is closed.
+// One reader writes at a time without holding d.mu, a slow local conn would block send otherwise,
+// chunks arriving meanwhile are left in pending for it
+func (d *dupStream) deliver(seq uint32, p []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed || d.received || seq-d.next >= 1<<31 {
+		// seq is before next, delivered by another tunnel
+		return !d.closed
+	}
+
+	if d.pending[seq] = p; len(d.pending) > dupPending {
+		logg.E("duplicated stream: too many chunks out of order")
+		d.close()
+		return false
+	}
+
+	if d.writing {
+		return true
+	}
+	d.writing = true
+	defer func() { d.writing = false }()
+
+	back := roleRecv
+	if d.role == roleRecv {
+		back = roleSend
+	}
+
+	for {
+		var chunks [][]byte
+		for !d.received {
+			p, ok := d.pending[d.next]
+			if !ok {
+				break
+			}
+
+			delete(d.pending, d.next)
+			d.next++
+
+			if len(p) == 0 {
+				d.received = true
+			} else {
+				chunks = append(chunks, p)
+			}
+		}
+
+		if len(chunks) == 0 && !d.received {
+			return true
+		}
+		eof := d.received
+
+		d.mu.Unlock()
+		var err error
+		for _, p := range chunks {
+			d.ioc.Meter.add(byte(back), len(p))
+			if _, err = d.local.Write(p); err != nil {
+				break
+			}
+		}
+		if c, ok := d.local.(interface{ CloseWrite() error }); ok && eof && err == nil {
+			c.CloseWrite()
+		}
+		d.mu.Lock()
+
+		if err != nil {
+			d.close()
+			return false
+		}
+
+		if d.closed {
+			return false
+		}
+
+		if eof {
+			d.finish()
+			return true
+		}
+	}
+}
+
+// stop ends the writer of the tunnel after the queued chunks, d.mu must be held
+func (t *dupTunnel) stop() {
+	if !t.stopped {
+		t.stopped = true
+		close(t.queue)
+	}
+}
+
+// drop closes a tunnel, the stream is closed along with the last one, d.mu must be held
+func (d *dupStream) drop(t *dupTunnel) {
+	for i, t2 := range d.tunnels {
+		if t2 == t {
+			d.tunnels = append(d.tunnels[:i], d.tunnels[i+1:]...)
+			t.stop()
+			t.conn.Close()
+			break
+		}
+	}
+
+	if len(d.tunnels) == 0 {
+		d.close()
+	}
+}
+
+// finish closes the stream when both ends are done and the tunnels have sent everything, d.mu must be held
+func (d *dupStream) finish() {
+	if !d.sent || !d.received {
+		return
+	}
+
+	go func() {
+		done := make(chan bool)
+		go func() {
+			d.writers.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(timeoutOp):
+		}
+
+		d.mu.Lock()
+		d.close()
+		d.mu.Unlock()
+	}()
+}
+
+// close closes the local conn and all tunnels, d.mu must be held
+func (d *dupStream) close() {
+	if d.closed {
+		return
+	}
+
+	d.closed = true
+	if d.local != nil {
+		d.local.Close()
+		d.gc.IO.br.close(d.bid)
+	}
+	d.bridge.end(nil)
+	d.span.end(nil)
+
+	for _, t := range d.tunnels {
+		t.stop()
+		t.conn.Close()
+	}
+	d.tunnels = nil
+
+	if d.onClose != nil {
+		go d.onClose()
+	}
+}
+
+// joinDup returns the duplicated stream of id, created is true if the tunnel is the first one of it
+func (proxy *ProxyUpstream) joinDup(id string, ioc IOConfig) (d *dupStream, created bool) {
+	proxy.dupsMu.Lock()
+	defer proxy.dupsMu.Unlock()
+
+	if d = proxy.dups[id]; d != nil {
+		return d, false
+	}
+
+	if proxy.dups == nil {
+		proxy.dups = make(map[string]*dupStream)
+	}
+
+	d = proxy.Cipher.newDupStream(ioc, roleRecv)
+	d.onClose = func() {
+		proxy.dupsMu.Lock()
+		if proxy.dups[id] == d {
+			delete(proxy.dups, id)
+		}
+		proxy.dupsMu.Unlock()
+	}
+
+	proxy.dups[id] = d
+	return d, true
+}
+
+// bridgeDup opens tunnels to host through the servers of the pin at the same time and bridges them
+// with downstreamConn as a duplicated stream, it returns the first tunnel opened
+func (proxy *ProxyClient) bridgeDup(downstreamConn net.Conn, host string, resp []byte, p *Pin, span *Span) (net.Conn, error) {
+	id := strconv.FormatUint(proxy.Rand.Uint64(), 16)
+
+	var d *dupStream
+	var first net.Conn
+	var lastErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, s := range p.Servers {
+		wg.Add(1)
+		go func(s *UpstreamServer) {
+			defer wg.Done()
+			dial := func() (net.Conn, string, error) {
+				conn, err := s.pool.DialTimeout(timeoutDial)
+				return conn, s.Name, err
+			}
+
+			conn, rkeybuf, ioc, err := proxy.openTunnelVia(dial, host, 0, id, span)
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				logg.W(host, " through ", s.Name, ": ", err)
+				lastErr = err
+				return
+			}
+
+			if d == nil {
+				d, first = proxy.Cipher.newDupStream(ioc, roleSend), conn
+			}
+			d.attach(conn, rkeybuf, ioc.Block)
+		}(s)
+	}
+
+	wg.Wait()
+	if d == nil {
+		return nil, lastErr
+	}
+
+	if resp != nil {
+		downstreamConn.Write(resp)
+	}
+
+	go d.start(proxy.Cipher.IO.Dump.Wrap(downstreamConn, host), span)
+	return first, nil
+}
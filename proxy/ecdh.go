@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/coyove/goflyway/pkg/codec"
+)
+
+// the header carrying X25519 public keys of a tunnel, encrypted like the other fields
+const ecdhSuffix = "-K"
+
+const ecdhConfirmLen = 16
+
+var (
+	errNoECDH       = errors.New("upstream doesn't support ECDH, update it or disable ECDH")
+	errECDHTampered = errors.New("ECDH keys are changed in the middle")
+)
+
+// newECDHKey generates an ephemeral key pair, its public key is sent encrypted with the IV of the stream
+func newECDHKey(gc *codec.Codec, rkeybuf []byte) (*ecdh.PrivateKey, string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	return priv, gc.EncryptString(string(priv.PublicKey().Bytes()), rkeybuf...), nil
+}
+
+// sessionBlock derives the cipher of the stream from the shared secret, the password and the IV,
+// so the traffic can't be decrypted with the password alone once the ephemeral keys are gone
+func sessionBlock(gc *codec.Codec, priv *ecdh.PrivateKey, peer []byte, rkeybuf []byte) (cipher.Block, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(gc.Key)
+	h.Write(rkeybuf)
+	return aes.NewCipher(h.Sum(nil))
+}
+
+// ecdhConfirm binds the public keys of both sides to the password and the IV, the encryption of the keys
+// doesn't tell bits flipped in the middle, but the client tells them by this sent along the key of the server
+func ecdhConfirm(gc *codec.Codec, rkeybuf, client, server []byte) []byte {
+	h := hmac.New(sha256.New, gc.Key)
+	h.Write(rkeybuf)
+	h.Write(client)
+	h.Write(server)
+	return h.Sum(nil)[:ecdhConfirmLen]
+}
+
+// acceptECDH answers the public key of the client, it returns the public key of the server with the confirmation
+// and the cipher of the stream
+func acceptECDH(gc *codec.Codec, peer string, rkeybuf []byte) (string, cipher.Block, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	client := []byte(gc.DecryptString(peer, rkeybuf...))
+	block, err := sessionBlock(gc, priv, client, rkeybuf)
+	if err != nil {
+		return "", nil, err
+	}
+
+	server := priv.PublicKey().Bytes()
+	return gc.EncryptString(string(append(server, ecdhConfirm(gc, rkeybuf, client, server)...)), rkeybuf...), block, nil
+}
+
+// finishECDH derives the cipher of the stream from the answer of the server, keys changed in the middle are refused
+func finishECDH(gc *codec.Codec, priv *ecdh.PrivateKey, answer string, rkeybuf []byte) (cipher.Block, error) {
+	buf := []byte(gc.DecryptString(answer, rkeybuf...))
+	if len(buf) <= ecdhConfirmLen {
+		return nil, errECDHTampered
+	}
+
+	server, confirm := buf[:len(buf)-ecdhConfirmLen], buf[len(buf)-ecdhConfirmLen:]
+	if !hmac.Equal(confirm, ecdhConfirm(gc, rkeybuf, priv.PublicKey().Bytes(), server)) {
+		return nil, errECDHTampered
+	}
+	return sessionBlock(gc, priv, server, rkeybuf)
+}
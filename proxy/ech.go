@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// echVersion is the version of ECH configs of draft-ietf-tls-esni, also the type of the extension carrying ECH
+const echVersion = 0xfe0d
+
+// the HPKE suites of the ECH keys generated: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM or ChaCha20Poly1305
+const (
+	hpkeX25519     = 0x0020
+	hpkeHKDFSHA256 = 0x0001
+	hpkeAES128GCM  = 0x0001
+	hpkeChaCha20   = 0x0003
+)
+
+// NewECHKey generates an ECH key, the outer ClientHellos encrypted by it present publicName as SNI,
+// which the server should have a certificate of, clients verify it if the server rejects ECH
+func NewECHKey(publicName string) (tls.EncryptedClientHelloKey, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return tls.EncryptedClientHelloKey{}, errors.New("ech: invalid public name " + publicName)
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, err
+	}
+
+	id := make([]byte, 1)
+	rand.Read(id)
+	return tls.EncryptedClientHelloKey{
+		Config:      marshalECHConfig(id[0], priv.PublicKey().Bytes(), publicName),
+		PrivateKey:  priv.Bytes(),
+		SendAsRetry: true,
+	}, nil
+}
+
+func marshalECHConfig(id byte, pub []byte, publicName string) []byte {
+	c := append([]byte{id}, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(c[1:], hpkeX25519)
+	binary.BigEndian.PutUint16(c[3:], uint16(len(pub)))
+	c = append(c, pub...)
+
+	suites := []uint16{hpkeHKDFSHA256, hpkeAES128GCM, hpkeHKDFSHA256, hpkeChaCha20}
+	c = binary.BigEndian.AppendUint16(c, uint16(2*len(suites)))
+	for _, s := range suites {
+		c = binary.BigEndian.AppendUint16(c, s)
+	}
+
+	// maximum name length (0 for the default padding), public name, no extensions
+	c = append(c, 0, byte(len(publicName)))
+	c = append(c, publicName...)
+	c = append(c, 0, 0)
+
+	config := binary.BigEndian.AppendUint16(nil, echVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(c)))
+	return append(config, c...)
+}
+
+// ECHConfigList returns the list of the configs of keys, which clients encrypt their ClientHellos by, see TransportOptions.ECH
+func ECHConfigList(keys []tls.EncryptedClientHelloKey) []byte {
+	var configs []byte
+	for _, k := range keys {
+		configs = append(configs, k.Config...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(configs))), configs...)
+}
+
+// echConfigID returns the id of an ECH config, false if it isn't one
+func echConfigID(config []byte) (byte, bool) {
+	if len(config) < 5 || binary.BigEndian.Uint16(config) != echVersion {
+		return 0, false
+	}
+	return config[4], true
+}
+
+// LoadECHKey loads the ECH key in the PEM file of path, the PKCS #8 private key and the ECHCONFIG list of its config
+// like those of OpenSSL, or generates one presenting publicName (see NewECHKey) and writes it there if there is no file
+func LoadECHKey(path, publicName string) (tls.EncryptedClientHelloKey, error) {
+	var key tls.EncryptedClientHelloKey
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if key, err = NewECHKey(publicName); err != nil {
+			return key, err
+		}
+
+		priv, _ := ecdh.X25519().NewPrivateKey(key.PrivateKey)
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return key, err
+		}
+
+		buf = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: ECHConfigList([]tls.EncryptedClientHelloKey{key})})...)
+		return key, ioutil.WriteFile(path, buf, 0600)
+	} else if err != nil {
+		return key, err
+	}
+
+	for {
+		var b *pem.Block
+		if b, buf = pem.Decode(buf); b == nil {
+			break
+		}
+
+		switch b.Type {
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+			priv, ok := k.(*ecdh.PrivateKey)
+			if err != nil || !ok || priv.Curve() != ecdh.X25519() {
+				return key, errors.New("ech: the private key in " + path + " should be of X25519")
+			}
+			key.PrivateKey = priv.Bytes()
+		case "ECHCONFIG":
+			// the first config of the list is the one of the key
+			if len(b.Bytes) < 6 {
+				return key, errors.New("ech: invalid config list in " + path)
+			}
+
+			end := 6 + int(binary.BigEndian.Uint16(b.Bytes[4:]))
+			if _, ok := echConfigID(b.Bytes[2:]); !ok || end > len(b.Bytes) {
+				return key, errors.New("ech: invalid config list in " + path)
+			}
+			key.Config = b.Bytes[2:end]
+		}
+	}
+
+	if key.PrivateKey == nil || key.Config == nil {
+		return key, errors.New("ech: no private key or config in " + path)
+	}
+	key.SendAsRetry = true
+	return key, nil
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+const (
+	hotIdleConns    = 32
+	hotWarmInterval = 30 * time.Second
+	hotWarmFor      = 10 * time.Minute // origins unused for longer are no longer warmed
+)
+
+// hotOrigins keeps more idle connections to matched origins than the default transport does,
+// and refreshes them with HEAD requests before origins close them, so API-heavy clients
+// in forward mode won't pay a TLS handshake for every burst of requests
+type hotOrigins struct {
+	tp    *http.Transport
+	match *acr.HostMatcher
+
+	mu   sync.Mutex
+	used map[string]time.Time // scheme://host of origins recently used
+}
+
+func newHotOrigins(rules []string, tp *http.Transport) (*hotOrigins, error) {
+	m, err := acr.NewHostMatcher(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hotOrigins{
+		tp: &http.Transport{
+			Dial:                tp.Dial,
+			TLSClientConfig:     tp.TLSClientConfig,
+			MaxIdleConnsPerHost: hotIdleConns,
+		},
+		match: m,
+		used:  make(map[string]time.Time),
+	}
+
+	go func() {
+		for range time.Tick(hotWarmInterval) {
+			h.warm()
+		}
+	}()
+
+	return h, nil
+}
+
+// transport returns the transport for u, nil if u is not a hot origin
+func (h *hotOrigins) transport(u *url.URL) *http.Transport {
+	if h == nil || !h.match.Match(strings.ToLower(u.Hostname())) {
+		return nil
+	}
+
+	h.mu.Lock()
+	h.used[u.Scheme+"://"+u.Host] = time.Now()
+	h.mu.Unlock()
+	return h.tp
+}
+
+func (h *hotOrigins) warm() {
+	h.mu.Lock()
+	origins := make([]string, 0, len(h.used))
+	for o, ts := range h.used {
+		if time.Since(ts) > hotWarmFor {
+			delete(h.used, o)
+			continue
+		}
+		origins = append(origins, o)
+	}
+	h.mu.Unlock()
+
+	for _, o := range origins {
+		go func(o string) {
+			req, _ := http.NewRequest("HEAD", o+"/", nil)
+			resp, err := h.tp.RoundTrip(req)
+			if err != nil {
+				logg.D("warm ", o, ": ", err)
+				return
+			}
+			resp.Body.Close()
+		}(o)
+	}
+}
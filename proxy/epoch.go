@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/codec"
+)
+
+// wireKey is the key a request is encrypted by, with the rkey header named after it
+type wireKey struct {
+	*codec.Codec
+	header string
+}
+
+func newWireKey(key string) wireKey {
+	c := codec.New(key)
+	return wireKey{Codec: c, header: "X-" + c.Alias}
+}
+
+// KeyEpochs rotates the key at every time of a schedule, evaluated in UTC so clients and servers agree
+// wherever they are: the key of an epoch is derived from the password and the time it began, and so is
+// the name of the header carrying it. The password itself is no longer accepted by the server, which
+// still accepts the previous epoch, handing over the clients rotating late until the next rotation
+type KeyEpochs struct {
+	Schedule *Schedule
+
+	password  string
+	mu        sync.RWMutex
+	cur, prev wireKey
+}
+
+// NewKeyEpochs starts the epoch of now, spec is like "0 4 * * 1", it fails if the schedule never rotates
+func NewKeyEpochs(password, spec string) (*KeyEpochs, error) {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &KeyEpochs{Schedule: s, password: password}
+	if !e.rotate(time.Now()) {
+		return nil, errors.New("key epochs never rotate: " + spec)
+	}
+	return e, nil
+}
+
+// epochKey derives the key of the epoch beginning at t
+func (e *KeyEpochs) epochKey(t time.Time) string {
+	h := hmac.New(sha256.New, []byte(e.password))
+	h.Write([]byte("goflyway key epoch " + t.UTC().Format(time.RFC3339)))
+	return string(h.Sum(nil))
+}
+
+// rotate moves to the epoch of now, false if the schedule has no time before now
+func (e *KeyEpochs) rotate(now time.Time) bool {
+	begin := e.Schedule.Prev(now.UTC())
+	if begin.IsZero() {
+		return false
+	}
+
+	cur := newWireKey(e.epochKey(begin))
+	var prev wireKey
+	if last := e.Schedule.Prev(begin.Add(-time.Minute)); !last.IsZero() {
+		prev = newWireKey(e.epochKey(last))
+	}
+
+	e.mu.Lock()
+	e.cur, e.prev = cur, prev
+	e.mu.Unlock()
+	return true
+}
+
+// Key returns the key of the current epoch, the one clients encrypt by
+func (e *KeyEpochs) Key() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.cur.KeyString
+}
+
+func (e *KeyEpochs) keys() (cur, prev wireKey) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.cur, e.prev
+}
+
+// Start rotates the key at every time of the schedule and calls fn with the new key, it never returns
+func (e *KeyEpochs) Start(fn func(key string)) {
+	for {
+		next := e.Schedule.Next(time.Now().UTC())
+		if next.IsZero() {
+			return
+		}
+
+		time.Sleep(next.Sub(time.Now()))
+		if e.rotate(time.Now()) && fn != nil {
+			fn(e.Key())
+		}
+	}
+}
+
+// keyOf returns the key the request is encrypted by: the password, or with KeyEpochs
+// the previous epoch if its header is found instead of the current one's
+func (proxy *ProxyUpstream) keyOf(r *http.Request) wireKey {
+	if proxy.KeyEpochs == nil {
+		return wireKey{Codec: &proxy.Cipher.Codec, header: proxy.rkeyHeader}
+	}
+
+	cur, prev := proxy.KeyEpochs.keys()
+	if prev.Codec != nil && r.Header.Get(cur.header) == "" && r.Header.Get(prev.header) != "" {
+		return prev
+	}
+	return cur
+}
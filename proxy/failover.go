@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+	"github.com/coyove/tcpmux"
+)
+
+// after failing over to an alternate upstream, the primary one will be tried first again after this
+const failoverProbe = time.Minute
+
+func (proxy *ProxyClient) poolAt(i int) (*tcpmux.DialPool, string) {
+	if i == 0 {
+		return proxy.pool, proxy.Upstream
+	}
+	return proxy.altPools[i-1], proxy.AltUpstreams[i-1]
+}
+
+// dialPools dials the upstream which worked last time first, then the others in order,
+// the working one is remembered so later dials won't wait for a blocked primary upstream
+func (proxy *ProxyClient) dialPools() (net.Conn, error) {
+	now := time.Now().UnixNano()
+	proxy.activeMu.Lock()
+	active := proxy.active
+	if active != 0 && now-proxy.failedAt > int64(failoverProbe) {
+		active = 0
+	}
+	proxy.activeMu.Unlock()
+
+	order := []int{active}
+	for i := 0; i <= len(proxy.altPools); i++ {
+		if i != active {
+			order = append(order, i)
+		}
+	}
+
+	// draining upstreams go last, stable for the others
+	proxy.activeMu.Lock()
+	sort.SliceStable(order, func(i, j int) bool {
+		return proxy.drainEnd[order[i]] <= now && proxy.drainEnd[order[j]] > now
+	})
+	active = order[0]
+	proxy.activeMu.Unlock()
+
+	var lastErr error
+	for _, i := range order {
+		pool, up := proxy.poolAt(i)
+		conn, err := pool.DialTimeout(timeoutDial)
+		if err != nil {
+			logg.W("dial ", up, ": ", err)
+			lastErr = err
+			continue
+		}
+
+		proxy.activeMu.Lock()
+		if i != 0 && active == 0 {
+			// the primary upstream has just failed
+			proxy.failedAt = now
+		}
+
+		old := proxy.active
+		proxy.active = i
+		proxy.activeMu.Unlock()
+
+		if old != i {
+			_, from := proxy.poolAt(old)
+			logg.L("upstream switched from ", from, " to ", up)
+		}
+
+		return conn, nil
+	}
+
+	return nil, lastErr
+}
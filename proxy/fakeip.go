@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// the TTL of fake answers is short, so apps ask again rather than keep an address which may be recycled
+const fakeIPTTL = 1
+
+// FakeIP answers DNS queries of apps locally with virtual IPs of a reserved network like 198.18.0.0/15,
+// connections to them are mapped back to the names, so no query leaks and rules match on names even
+// for apps which resolve before connecting. Addresses are recycled oldest first when all are taken
+type FakeIP struct {
+	Net *net.IPNet
+
+	mu     sync.Mutex
+	base   uint32
+	size   uint32
+	next   uint32            // offset of the next address to allocate
+	names  map[uint32]string // keyed by offset
+	byName map[string]uint32
+}
+
+// NewFakeIP returns the allocator of the IPv4 network cidr, the network and broadcast addresses are skipped
+func NewFakeIP(cidr string) (*FakeIP, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := n.Mask.Size()
+	if bits != 32 {
+		return nil, errors.New("fake IPs must be IPv4")
+	} else if ones > 24 || ones < 8 {
+		return nil, errors.New("fake IP networks should be /8 to /24")
+	}
+
+	return &FakeIP{
+		Net:    n,
+		base:   binary.BigEndian.Uint32(n.IP.To4()),
+		size:   1 << uint(32-ones),
+		next:   1,
+		names:  make(map[uint32]string),
+		byName: make(map[string]uint32),
+	}, nil
+}
+
+func (f *FakeIP) ip(off uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, f.base+off)
+	return ip
+}
+
+// alloc returns the fake IP of name
+func (f *FakeIP) alloc(name string) net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off, ok := f.byName[name]; ok {
+		return f.ip(off)
+	}
+
+	off := f.next
+	if old, ok := f.names[off]; ok {
+		delete(f.byName, old)
+	}
+	f.names[off], f.byName[name] = name, off
+
+	if f.next++; f.next >= f.size-1 {
+		f.next = 1
+	}
+	return f.ip(off)
+}
+
+// lookup maps host:port back to name:port if host is a fake IP allocated
+func (f *FakeIP) lookup(host string) (string, bool) {
+	if f == nil {
+		return host, false
+	}
+
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, false
+	}
+
+	ip := net.ParseIP(h).To4()
+	if ip == nil || !f.Net.Contains(ip) {
+		return host, false
+	}
+
+	f.mu.Lock()
+	name, ok := f.names[binary.BigEndian.Uint32(ip)-f.base]
+	f.mu.Unlock()
+	if !ok {
+		logg.W("fake IP ", h, " is unknown or recycled, the app may have kept it too long")
+		return host, false
+	}
+	return net.JoinHostPort(name, port), true
+}
+
+// reverse returns the fake IP of name if allocated, without allocating one
+func (f *FakeIP) reverse(name string) net.IP {
+	if f == nil || name == "" {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off, ok := f.byName[name]; ok {
+		return f.ip(off)
+	}
+	return nil
+}
+
+// answer replies to a DNS query, A queries get fake IPs and AAAA ones empty answers, so apps connect
+// by IPv4, nil means the query is not answered locally: it's not a query of a name, or the name
+// is special like .local or mapped by rewrite
+func (f *FakeIP) answer(query []byte, rewrite Hosts) []byte {
+	if f == nil || len(query) < 17 || query[2]&0x80 != 0 {
+		return nil
+	}
+
+	name, qtype, end, ok := parseDNSQuestion(query)
+	if !ok || (qtype != dnsTypeA && qtype != dnsTypeAAAA) || name == "" {
+		return nil
+	}
+
+	if special, _ := acr.SpecialUseDomain(name); special || rewrite[name] != "" {
+		return nil
+	}
+
+	if qtype == dnsTypeAAAA {
+		return dnsReply(query, end, qtype, nil, fakeIPTTL)
+	}
+	return dnsReply(query, end, qtype, f.alloc(name), fakeIPTTL)
+}
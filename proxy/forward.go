@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// ParseForward parses [bind:]port:host:hostport like ssh -L and -R
+func ParseForward(spec string) (listen, target string, err error) {
+	idx := strings.LastIndex(spec, ":")
+	if idx == -1 {
+		return "", "", errors.New("invalid port forwarding: " + spec)
+	}
+
+	// find the start of host, which may be a bracketed IPv6
+	start := strings.LastIndex(spec[:idx], ":")
+	if idx > 0 && spec[idx-1] == ']' {
+		start = strings.LastIndex(spec[:idx], "[") - 1
+	}
+
+	if start < 0 {
+		return "", "", errors.New("invalid port forwarding: " + spec)
+	}
+
+	listen, target = spec[:start], spec[start+1:]
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+
+	if _, _, err = net.SplitHostPort(listen); err != nil {
+		return
+	}
+
+	_, _, err = net.SplitHostPort(target)
+	return
+}
+
+// StartLocalForward listens on listen and tunnels every connection to target through the upstream
+func (proxy *ProxyClient) StartLocalForward(listen, target string) error {
+	ln, err := listenTCP(listen)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isClosedConnErr(err) {
+				return err
+			}
+			logg.E("local port forwarding: ", err)
+			continue
+		}
+
+		logg.D("FORWARD^ ", target)
+		if proxy.Policy.IsSet(PolicyWebSocket) {
+			go proxy.dialUpstreamAndBridgeWS(conn, target, nil, 0, nil)
+		} else {
+			go proxy.dialUpstreamAndBridge(conn, target, nil, 0, nil)
+		}
+	}
+}
+
+// StartUDPForward listens on UDP listen and relays packets of each peer to target through the upstream
+func (proxy *ProxyClient) StartUDPForward(listen, target string) error {
+	ln := takeUDP(listen)
+	if ln == nil {
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			return err
+		}
+
+		if ln, err = net.ListenUDP("udp", addr); err != nil {
+			return err
+		}
+	}
+
+	sessions, mu := make(map[string]*udpBridgeConn), sync.Mutex{}
+	buf := make([]byte, 2048)
+
+	var rewrite Hosts
+	var fake *FakeIP
+	if _, port := splitHostPort(target); port == ":53" {
+		rewrite, fake = proxy.DNSRewrite, proxy.FakeIP
+	}
+
+	for {
+		n, src, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			if isClosedConnErr(err) {
+				return err
+			}
+			logg.E("UDP port forwarding: ", err)
+			continue
+		}
+
+		// answered locally without opening a session
+		if reply := fake.answer(buf[:n], rewrite); reply != nil {
+			ln.WriteToUDP(reply, src)
+			continue
+		}
+
+		key := src.String()
+		mu.Lock()
+		s := sessions[key]
+		if s == nil {
+			s = &udpBridgeConn{UDPConn: ln, udpSrc: src, in: make(chan []byte, 64), rewrite: rewrite}
+			s.onClose = func() {
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}
+			sessions[key] = s
+
+			logg.D("UDP FORWARD^ ", key, " -> ", target)
+			if proxy.Policy.IsSet(PolicyWebSocket) {
+				go proxy.dialUpstreamAndBridgeWS(s, target, nil, doUDPRelay, nil)
+			} else {
+				go proxy.dialUpstreamAndBridge(s, target, nil, doUDPRelay, nil)
+			}
+		}
+		mu.Unlock()
+
+		select {
+		case s.in <- dup(buf[:n]):
+		default:
+			logg.D("UDP port forwarding: drop packet from ", key)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Hosts maps domains to IPs or other domains, it is consulted before any DNS query or ACL rule
+type Hosts map[string]string
+
+// LoadHosts reads a hosts file, each line looks like: <ip or domain> <name> [<name> ...],
+// all names will be rewritten to the first column, lines starting with '#' are comments
+func LoadHosts(path string) (Hosts, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := make(Hosts)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if idx := strings.Index(line, "#"); idx > -1 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			h[strings.ToLower(name)] = strings.Trim(fields[0], "[]")
+		}
+	}
+
+	return h, nil
+}
+
+// Lookup returns the mapped host, the port (if any) is preserved
+func (h Hosts) Lookup(host string) (string, bool) {
+	if len(h) == 0 {
+		return host, false
+	}
+
+	name, port := splitHostPort(host)
+	to, ok := h[strings.Trim(name, "[]")]
+	if !ok {
+		return host, false
+	}
+
+	if port == "" {
+		if strings.Contains(to, ":") {
+			return "[" + to + "]", true
+		}
+		return to, true
+	}
+
+	return net.JoinHostPort(to, port[1:]), true
+}
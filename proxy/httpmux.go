@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"encoding/binary"
+	"errors"
+	"strconv"
 	"time"
 
 	"github.com/coyove/goflyway/pkg/logg"
@@ -45,11 +48,82 @@ CONTINUE:
 	}
 
 	switch b {
-	case 0x04, 0x05:
-		// we are accepting SOCKS4 in case it goes to the HTTP handler
+	case 0x04:
+		go l.proxy.handleSocks4(wrapper)
+	case 0x05:
 		go l.proxy.handleSocks(wrapper)
-		goto CONTINUE
+	case 0x16:
+		// a TLS handshake, the client is redirected to us transparently
+		go l.proxy.handleTLS(wrapper)
 	default:
 		return wrapper, err
 	}
+
+	goto CONTINUE
+}
+
+// handleSocks4 serves CONNECT of SOCKS4 and SOCKS4a, which have no password, so they are refused if -a is set
+func (proxy *ProxyClient) handleSocks4(conn net.Conn) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		logg.E(err)
+		conn.Close()
+		return
+	}
+
+	user, err := readCString(conn)
+	if err != nil {
+		logg.E(err)
+		conn.Close()
+		return
+	}
+
+	if buf[1] != 0x01 || proxy.UserAuth != "" {
+		logg.E("SOCKS4 command ", buf[1], " from ", conn.RemoteAddr(), " (", user, ") refused")
+		replyFailure(conn, okSOCKS4, CloseDenied)
+		return
+	}
+
+	host := net.IP(buf[4:8]).String()
+	if buf[4] == 0 && buf[5] == 0 && buf[6] == 0 && buf[7] != 0 {
+		// SOCKS4a, the hostname follows
+		if host, err = readCString(conn); err != nil {
+			logg.E(err)
+			conn.Close()
+			return
+		}
+	}
+
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[2:])))
+	proxy.routeAndBridge(conn, net.JoinHostPort(host, port), okSOCKS4, "SOCKS4")
+}
+
+// readCString reads a null-terminated string of SOCKS4 byte by byte, so nothing after it is consumed
+func readCString(conn net.Conn) (string, error) {
+	buf := make([]byte, 0, 16)
+	b := make([]byte, 1)
+	for len(buf) < 256 {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", errors.New("SOCKS4: string too long")
+}
+
+// handleTLS serves a TLS connection redirected to the local port, e.g. by iptables or a DNS answer,
+// its destination is the SNI on port 443
+func (proxy *ProxyClient) handleTLS(conn net.Conn) {
+	name, conn := sniffHost(conn, "443")
+	if name == "" {
+		logg.W("TLS without SNI from ", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	proxy.routeAndBridge(conn, net.JoinHostPort(name, "443"), nil, "TLS")
 }
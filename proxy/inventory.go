@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+	"github.com/coyove/goflyway/pkg/logg"
+	"github.com/coyove/tcpmux"
+)
+
+// UpstreamServer is a named upstream sharing the key of Upstream, labels like region=us tell where it exits
+type UpstreamServer struct {
+	Name   string
+	Addr   string
+	Labels map[string]string
+
+	pool *tcpmux.DialPool
+}
+
+// Pin sends hosts through some servers instead of Upstream, e.g. streaming sites through a server in their region
+type Pin struct {
+	Name    string
+	Hosts   *acr.HostMatcher
+	Servers []*UpstreamServer // tried in order
+
+	// Duplicate sends tunnels through all servers at once as a duplicated stream, for critical traffic,
+	// they must be different routes to the same upstream since only one of them dials the destination
+	Duplicate bool
+
+	tp *http.Transport // forward mode
+}
+
+// Inventory is the named servers of a client, pins are sorted by name and the first matching one wins
+type Inventory struct {
+	Servers []*UpstreamServer
+	Pins    []*Pin
+}
+
+// LoadInventory reads servers and pins from a config file, each section is either of them:
+//
+//	[us-1]
+//	addr=us1.example.com:8100
+//	region=us              # any other key is a label
+//	provider=vultr
+//
+//	[streaming]
+//	hosts=*.netflix.com,*.hulu.com
+//	server=us-1            # a server name, or a label like region:us for every server having it
+//	duplicate=true         # send tunnels through all of them at once, they must reach the same upstream
+func LoadInventory(path string) (*Inventory, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := config.ParseConf(string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	inv, pins := &Inventory{}, []string{}
+	for name := range *cf {
+		switch addr, hosts := cf.GetString(name, "addr", ""), cf.GetString(name, "hosts", ""); {
+		case name == "default":
+		case addr != "" && hosts != "":
+			return nil, fmt.Errorf("%s: a server can't have hosts, pin them in another section", name)
+		case addr != "":
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+
+			s := &UpstreamServer{Name: name, Addr: addr, Labels: make(map[string]string)}
+			cf.Iterate(name, func(key string) {
+				if key != "addr" {
+					s.Labels[key] = fmt.Sprint((*cf)[name][key])
+				}
+			})
+			inv.Servers = append(inv.Servers, s)
+		case hosts != "":
+			pins = append(pins, name)
+		default:
+			return nil, fmt.Errorf("%s: either addr or hosts is needed", name)
+		}
+	}
+
+	sort.Slice(inv.Servers, func(i, j int) bool { return inv.Servers[i].Name < inv.Servers[j].Name })
+	sort.Strings(pins)
+
+	for _, name := range pins {
+		p, hosts := &Pin{Name: name}, strings.Split(cf.GetString(name, "hosts", ""), ",")
+		for i := range hosts {
+			hosts[i] = strings.TrimSpace(hosts[i])
+		}
+
+		if p.Hosts, err = acr.NewHostMatcher(hosts); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		server := cf.GetString(name, "server", "")
+		label := strings.SplitN(server, ":", 2)
+		for _, s := range inv.Servers {
+			if s.Name == server || (len(label) == 2 && label[1] != "" && s.Labels[label[0]] == label[1]) {
+				p.Servers = append(p.Servers, s)
+			}
+		}
+
+		if len(p.Servers) == 0 {
+			return nil, fmt.Errorf("%s: no server matches '%s'", name, server)
+		}
+
+		if p.Duplicate = cf.GetBool(name, "duplicate", false); p.Duplicate && len(p.Servers) < 2 {
+			return nil, fmt.Errorf("%s: duplicate needs at least 2 servers", name)
+		}
+
+		inv.Pins = append(inv.Pins, p)
+	}
+
+	return inv, nil
+}
+
+// pinned returns the pin of host, nil if it's not pinned
+func (inv *Inventory) pinned(host string) *Pin {
+	if inv == nil {
+		return nil
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, p := range inv.Pins {
+		if p.Hosts.Match(host) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// init creates the dial pools of the servers and the transports of the pins
+func (inv *Inventory) init(mux int) {
+	for _, s := range inv.Servers {
+		s.pool = tcpmux.NewDialer(s.Addr, mux)
+	}
+
+	for _, p := range inv.Pins {
+		p := p
+		p.tp = &http.Transport{
+			TLSClientConfig:     tlsSkip,
+			MaxIdleConnsPerHost: keepAliveStreams,
+			Dial: func(network, address string) (net.Conn, error) {
+				conn, _, err := p.dial()
+				return conn, err
+			},
+		}
+	}
+}
+
+// dial dials the servers of the pin in order
+func (p *Pin) dial() (net.Conn, *UpstreamServer, error) {
+	var lastErr error
+	for _, s := range p.Servers {
+		conn, err := s.pool.DialTimeout(timeoutDial)
+		if err == nil {
+			return conn, s, nil
+		}
+
+		logg.W("dial ", s.Name, " (", s.Addr, "): ", err)
+		lastErr = err
+	}
+
+	return nil, nil, lastErr
+}
+
+// dialFor dials the servers host is pinned to, or the upstream if it's not pinned, up names the one dialed
+func (proxy *ProxyClient) dialFor(host string) (conn net.Conn, up string, err error) {
+	if p := proxy.Inventory.pinned(host); p != nil && proxy.Connect2 == "" {
+		logg.D(host, " pinned to ", p.Name)
+		conn, s, err := p.dial()
+		if s != nil {
+			up = s.Name
+		}
+		return conn, up, err
+	}
+
+	conn, err = proxy.dialUpstream()
+	proxy.activeMu.Lock()
+	_, up = proxy.poolAt(proxy.active)
+	proxy.activeMu.Unlock()
+	return conn, up, err
+}
+
+// transportFor returns the transport of the pin of host in forward mode
+func (proxy *ProxyClient) transportFor(host string) *http.Transport {
+	if p := proxy.Inventory.pinned(host); p != nil && proxy.Connect2 == "" {
+		return p.tp
+	}
+
+	return proxy.tp
+}
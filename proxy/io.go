@@ -1,8 +1,11 @@
 package proxy
 
 import (
+	"crypto/cipher"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
 	"net"
 	"strconv"
@@ -12,7 +15,6 @@ import (
 	"unsafe"
 
 	"github.com/coyove/goflyway/pkg/logg"
-	"github.com/coyove/goflyway/pkg/rand"
 	"github.com/coyove/tcpmux"
 )
 
@@ -33,8 +35,77 @@ type IOConfig struct {
 	Partial bool
 	Role    byte
 	WSCtrl  byte
+	Pacing  *Pacing
+	Meter   *trafficMeter
+	Block   cipher.Block // the cipher of the stream negotiated by ECDH, nil means the one of the password
+	Sum     byte         // which end of Bridge is the tunnel carrying checksum trailers, sumTarget or sumSource, 0 means none
+	Span    *Span        // the traced tunnel, Bridge adds its bridge span and ends it
+	User    string       // who the bridge is of and where it goes, listed by Sessions
+	Host    string
 }
 
+// The traffic of a partial stream past the first sslRecordLen bytes is neither encrypted nor authenticated,
+// with checksums negotiated by the sumSuffix header, the sender frames every chunk it reads with its length
+// and the CRC-32C of both, an empty frame ends the stream. The receiver passes the data of each frame on
+// as soon as the frame is complete and checks out, so the stream silently corrupted by a broken middlebox
+// is reset before the corruption is delivered, and request/response protocols are never held back
+const (
+	sumSuffix   = "-S"
+	sumHeader   = 4 // the length of the frame
+	sumLen      = 4 // the checksum
+	sumMaxFrame = 1 << 20
+)
+
+const (
+	sumTarget byte = iota + 1
+	sumSource
+	sumWrite // Copy frames the stream
+	sumRead  // Copy checks the frames
+)
+
+var sumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// sumFrame returns the frame of p
+func sumFrame(p []byte) []byte {
+	f := make([]byte, sumHeader, sumHeader+len(p)+sumLen)
+	binary.BigEndian.PutUint32(f, uint32(len(p)))
+	f = append(f, p...)
+
+	var crc [sumLen]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(f, sumTable))
+	return append(f, crc[:]...)
+}
+
+// sumUnframe appends p to pending and returns the data of the complete frames, which are removed from pending,
+// end is true if the frame ending the stream is among them, a frame failing its checksum is errPartialSum
+func sumUnframe(pending *[]byte, p []byte) (data []byte, end bool, err error) {
+	buf := append(*pending, p...)
+	for len(buf) >= sumHeader {
+		n := binary.BigEndian.Uint32(buf)
+		if n > sumMaxFrame {
+			return nil, false, errPartialSum
+		}
+
+		size := sumHeader + int(n) + sumLen
+		if len(buf) < size {
+			break
+		}
+
+		if crc32.Checksum(buf[:size-sumLen], sumTable) != binary.BigEndian.Uint32(buf[size-sumLen:]) {
+			return nil, false, errPartialSum
+		}
+
+		end = end || n == 0
+		data = append(data, buf[sumHeader:size-sumLen]...)
+		buf = buf[size:]
+	}
+
+	*pending = append((*pending)[:0], buf...)
+	return data, end, nil
+}
+
+var errPartialSum = errors.New("checksum mismatch, the unencrypted traffic was corrupted on the way")
+
 func (iot *io_t) Bridge(target, source net.Conn, key []byte, options IOConfig) {
 	// copy from source, decrypt, to target
 	o := options
@@ -45,23 +116,51 @@ func (iot *io_t) Bridge(target, source net.Conn, key []byte, options IOConfig) {
 		o.WSCtrl = wsClientSrcIsUpstream
 	}
 
+	switch o.Sum {
+	case sumTarget:
+		o.Sum = sumWrite
+	case sumSource:
+		o.Sum = sumRead
+	}
+
 	// Roles are all relative to the "source"
 	o.Role = roleRecv
 
+	// only writes into a mux carrier are paced, other streams don't share it,
+	// the pacing of the stream (e.g. from its traffic class) overrides the global one
+	pacing := options.Pacing
+	if pacing == nil {
+		pacing = iot.Pacing
+	}
+
+	o.Pacing = nil
 	if s, _ := target.(*tcpmux.Stream); s != nil {
 		s.SetTimeout(iot.idleTime)
+		o.Pacing = pacing
 	}
 
 	if s, _ := source.(*tcpmux.Stream); s != nil {
 		s.SetTimeout(iot.idleTime)
+	} else {
+		pacing = nil
 	}
 
+	id := iot.br.open(target, source, &options)
+	o.Meter = options.Meter
+	defer iot.br.close(id)
+
+	span := options.Span.child("bridge", time.Now())
+	var toTarget int64
+	var targetErr error
+
 	exit := make(chan bool)
 	go func(config IOConfig) {
 		ts := time.Now()
-		if _, err := iot.Copy(target, source, key, config); err != nil {
-			logg.E("bridge ", int(time.Now().Sub(ts).Seconds()), "s: ", err)
+		if toTarget, targetErr = iot.Copy(target, source, key, config); targetErr != nil {
+			logg.E("bridge ", int(time.Now().Sub(ts).Seconds()), "s: ", targetErr)
 		}
+		iot.br.half(id)
+		closeNAT(target)
 		exit <- true
 	}(o)
 
@@ -74,11 +173,22 @@ func (iot *io_t) Bridge(target, source net.Conn, key []byte, options IOConfig) {
 		o.WSCtrl = wsClientDstIsUpstream
 	}
 
+	switch o.Sum {
+	case sumTarget:
+		o.Sum = sumRead
+	case sumSource:
+		o.Sum = sumWrite
+	}
+
 	o.Role = roleSend
+	o.Pacing = pacing
 	ts := time.Now()
-	if _, err := iot.Copy(source, target, key, o); err != nil {
+	toSource, err := iot.Copy(source, target, key, o)
+	if err != nil {
 		logg.E("bridge ", int(time.Now().Sub(ts).Seconds()), "s: ", err)
 	}
+	iot.br.half(id)
+	closeNAT(source)
 
 	select {
 	case <-exit:
@@ -86,18 +196,44 @@ func (iot *io_t) Bridge(target, source net.Conn, key []byte, options IOConfig) {
 
 	target.Close()
 	source.Close()
+
+	if span != nil {
+		if err == nil {
+			err = targetErr
+		}
+		span.set("bytes.target", toTarget)
+		span.set("bytes.source", toSource)
+		span.end(err)
+		options.Span.end(err)
+	}
+}
+
+// closeNAT closes conn if it's a NAT session when the other side stops writing into it,
+// datagrams have no half close, so NAT sessions end with their tunnels
+func closeNAT(conn net.Conn) {
+	if u, _ := conn.(*udpBridgeConn); u != nil && u.nat {
+		u.Close()
+	}
 }
 
 type io_t struct {
 	sync.Mutex
-	iid uint64
-	Tr  trafficSurvey // note 64bit align
+	iid         uint64
+	sumFailures uint64        // partial streams whose checksum trailers mismatched
+	Tr          trafficSurvey // note 64bit align
+	Lat         streamSurvey
 
 	started  bool
 	mconns   map[uintptr]*conn_state_t
 	idleTime int64
 
-	Ob tcpmux.Survey
+	Ob   tcpmux.Survey
+	Dump *TrafficDump
+
+	br      bridges
+	LeakAge time.Duration // warn about bridges half closed for longer than this, 0 means disabled
+	Pacing  *Pacing       // pace bulk streams in mux carriers, nil means disabled
+	DNSLane *DNSLane      // prioritize lookups over bulk streams in mux carriers, nil means disabled
 }
 
 type conn_state_t struct {
@@ -124,6 +260,10 @@ REPEAT:
 		src = *(*net.Conn)(unsafe.Pointer(src.(*tls.Conn)))
 		goto REPEAT
 	case *udpBridgeConn:
+		if src.(*udpBridgeConn).nat {
+			// NAT sessions go idle by their own timeouts
+			return
+		}
 		srcConn = src.(*udpBridgeConn)
 	case net.Conn:
 		srcConn = src.(net.Conn)
@@ -157,6 +297,7 @@ func (iot *io_t) StartPurgeConns(maxIdleTime int) {
 	iot.mconns = make(map[uintptr]*conn_state_t)
 	iot.idleTime = int64(maxIdleTime)
 	iot.Tr.Init(20 * 60 / trafficSurveyinterval) // 20 mins
+	iot.Lat.Init()
 
 	go func() {
 		count := 0
@@ -194,6 +335,8 @@ func (iot *io_t) StartPurgeConns(maxIdleTime int) {
 					c, s := iot.Ob.Count()
 					logg.D("multiplexer state: ", c, "/", s)
 				}
+
+				iot.reportLeaks()
 			}
 
 			iot.Unlock()
@@ -202,115 +345,53 @@ func (iot *io_t) StartPurgeConns(maxIdleTime int) {
 	}()
 }
 
-// wsWrite and wsRead are simple implementations of RFC6455
-// we assume that all payloads are 65535 bytes at max
-// we don't care control frames and everything is binary
-// we don't close it explicitly, it closes when the TCP connection closes
-// we don't ping or pong
-//
-//   0                   1                   2                   3
-//   0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
-//   +-+-+-+-+-------+-+-------------+-------------------------------+
-//   |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
-//   |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
-//   |N|V|V|V|       |S|             |   (if payload len==126/127)   |
-//   | |1|2|3|       |K|             |                               |
-//   +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
-//   |     Extended payload length continued, if payload len == 127  |
-//   + - - - - - - - - - - - - - - - +-------------------------------+
-//   |                               |Masking-key, if MASK set to 1  |
-//   +-------------------------------+-------------------------------+
-//   | Masking-key (continued)       |          Payload Data         |
-//   +-------------------------------- - - - - - - - - - - - - - - - +
-//   :                     Payload Data continued ...                :
-//   + - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
-//   |                     Payload Data continued ...                |
-//   +---------------------------------------------------------------+
-func wsWrite(dst io.Writer, payload []byte, mask bool) (n int, err error) {
-	if len(payload) > 65535 {
-		panic("don't support payload larger than 65535 yet")
-	}
-
-	buf := make([]byte, 4)
-	buf[0] = 2 // binary
-	buf[1] = 126
-	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
-
-	if mask {
-		buf[1] |= 0x80
-		buf = append(buf, 0, 0, 0, 0)
-		key := uint32(rand.GetCounter())
-		binary.BigEndian.PutUint32(buf[4:8], key)
-
-		for i, b := 0, buf[4:8]; i < len(payload); i++ {
-			payload[i] ^= b[i%4]
+func (iot *io_t) Copy(dst io.Writer, src io.Reader, key []byte, config IOConfig) (written int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logg.E("wtf, ", r)
 		}
-	}
+	}()
 
-	if n, err = dst.Write(buf); err != nil {
-		return
+	buf := make([]byte, 32*1024)
+	ctr := (*Cipher)(unsafe.Pointer(iot)).getCipherStream(key)
+	if ctr != nil && config.Block != nil {
+		ctr.b = config.Block
 	}
+	encrypted := 0
 
-	return dst.Write(payload)
-}
+	u := atomic.AddUint64(&iot.iid, 1)
 
-func wsRead(src io.Reader) (payload []byte, n int, err error) {
-	buf := make([]byte, 4)
-	if n, err = io.ReadAtLeast(src, buf, 4); err != nil {
-		return
+	var timer *streamTimer
+	if config.Role == roleRecv {
+		timer = iot.Lat.newTimer()
 	}
 
-	if buf[0] != 2 {
-		logg.W("goflyway doesn't accept opcode other than 2, please check")
+	pace := config.Pacing.newPacer(&iot.Tr)
+	// lookups on the carrier of dst are prioritized over bulk writes into it
+	carrier := ""
+	if stream, muxed := dst.(*tcpmux.Stream); muxed {
+		carrier = stream.RemoteAddr().String()
 	}
 
-	mask := (buf[1] & 0x80) > 0
-	ln := int(buf[1] & 0x7f)
+	crypt := func(xbuf []byte) {
+		if config.Partial && encrypted == sslRecordLen {
+			// goto direct_transmission
+		} else if ctr != nil {
 
-	if ln != 126 {
-		if ln == 127 {
-			logg.E("goflyway doesn't accept payload longer than 65535, please check")
-			return
-		}
-		// ln : 0 ~ 125
-	} else {
-		ln = int(binary.BigEndian.Uint16(buf[2:4]))
-	}
+			if encrypted+len(xbuf) > sslRecordLen && config.Partial {
+				ctr.XorBuffer(xbuf[:sslRecordLen-encrypted])
+				encrypted = sslRecordLen
+				// we are done, the traffic coming later will be transfered as is
+			} else {
+				ctr.XorBuffer(xbuf)
+				encrypted += len(xbuf)
+			}
 
-	if mask {
-		if n, err = io.ReadAtLeast(src, buf, 4); err != nil {
-			return
 		}
-		// now buf contains mask key
 	}
 
-	payload = make([]byte, ln)
-	if n, err = io.ReadAtLeast(src, payload, ln); err != nil {
-		return
-	}
-
-	if mask {
-		for i, b := 0, buf[:4]; i < len(payload); i++ {
-			payload[i] ^= b[i%4]
-		}
-	}
-
-	// n == ln, err == nil,
-	return
-}
-
-func (iot *io_t) Copy(dst io.Writer, src io.Reader, key []byte, config IOConfig) (written int64, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logg.E("wtf, ", r)
-		}
-	}()
-
-	buf := make([]byte, 32*1024)
-	ctr := (*Cipher)(unsafe.Pointer(iot)).getCipherStream(key)
-	encrypted := 0
-
-	u := atomic.AddUint64(&iot.iid, 1)
+	var pending []byte
+	eof, ended := false, false
 
 	for {
 		iot.markActive(src, u)
@@ -321,43 +402,50 @@ func (iot *io_t) Copy(dst io.Writer, src io.Reader, key []byte, config IOConfig)
 		case wsClientSrcIsUpstream, wsServerSrcIsDownstream:
 			// we are client, reading from upstream, or
 			// we are server, reading from downstream
-			buf, nr, er = wsRead(src)
+			buf, nr, er = wsRead(src, config.WSCtrl == wsClientSrcIsUpstream)
 		default:
 			nr, er = src.Read(buf)
 		}
 
 		if nr > 0 {
+			timer.Chunk()
 			xbuf := buf[0:nr]
 			if config.Role == roleSend {
 				atomic.AddUint64(&iot.Tr.totalSent, uint64(nr))
 			} else if config.Role == roleRecv {
 				atomic.AddUint64(&iot.Tr.totalRecved, uint64(nr))
 			}
+			config.Meter.add(config.Role, nr)
 
-			if config.Partial && encrypted == sslRecordLen {
-				// goto direct_transmission
-			} else if ctr != nil {
-
-				if encrypted+nr > sslRecordLen && config.Partial {
-					ctr.XorBuffer(xbuf[:sslRecordLen-encrypted])
-					encrypted = sslRecordLen
-					// we are done, the traffic coming later will be transfered as is
-				} else {
-					ctr.XorBuffer(xbuf)
-					encrypted += nr
-				}
+			if config.Sum == sumWrite {
+				xbuf = sumFrame(xbuf)
+			}
+
+			crypt(xbuf)
 
+			if config.Sum == sumRead {
+				var fe bool
+				if xbuf, fe, err = sumUnframe(&pending, xbuf); err != nil {
+					break
+				}
+				ended = ended || fe
 			}
 
 			if config.Bucket != nil {
-				config.Bucket.Consume(int64(len(xbuf)))
+				config.Meter.throttle(config.Bucket.Consume(int64(len(xbuf))))
+			}
+			pace.Wait(len(xbuf))
+			if carrier != "" && written >= pacingBulkSize {
+				iot.DNSLane.yield(carrier)
 			}
 
 			var nw int
 			var ew error
 			iot.markActive(dst, u)
-			if config.Chunked {
-				hlen := strconv.FormatInt(int64(nr), 16)
+			if len(xbuf) == 0 {
+				// the frame is incomplete
+			} else if config.Chunked {
+				hlen := strconv.FormatInt(int64(len(xbuf)), 16)
 				if _, ew = dst.Write([]byte(hlen + "\r\n")); ew == nil {
 					if nw, ew = dst.Write(xbuf); ew == nil {
 						_, ew = dst.Write([]byte("\r\n"))
@@ -386,7 +474,7 @@ func (iot *io_t) Copy(dst io.Writer, src io.Reader, key []byte, config IOConfig)
 				break
 			}
 
-			if nr != nw {
+			if len(xbuf) != nw {
 				logg.D(nr, " ", nw, xbuf)
 				err = io.ErrShortWrite
 				break
@@ -399,10 +487,25 @@ func (iot *io_t) Copy(dst io.Writer, src io.Reader, key []byte, config IOConfig)
 			if er != io.EOF && !isClosedConnErr(er) && !isTimeoutErr(er) {
 				err = er
 			}
+			eof = er == io.EOF
 			break
 		}
 	}
 
+	switch {
+	case config.Sum == sumWrite && eof:
+		end := sumFrame(nil)
+		crypt(end)
+		dst.Write(end)
+	case config.Sum == sumRead && (err == errPartialSum || eof && (!ended || len(pending) > 0)):
+		atomic.AddUint64(&iot.sumFailures, 1)
+		if c, ok := dst.(interface{ SetLinger(int) error }); ok {
+			// the application sees a reset instead of the end of the stream
+			c.SetLinger(0)
+		}
+		err = errPartialSum
+	}
+
 	if config.Chunked {
 		dst.Write([]byte("0\r\n\r\n"))
 	}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// ipLimitIdle is how long the usage of an IP without bridges is kept, its tokens are refilled by then
+const ipLimitIdle = time.Minute
+
+// ipLimiter caps new connections per second and concurrent bridges of each source IP, unlike the blacklist
+// which only tracks invalid requests, it stops clients with a valid key and scanners flooding the server
+type ipLimiter struct {
+	mu    sync.Mutex
+	ips   map[string]*ipUsage
+	swept time.Time
+}
+
+type ipUsage struct {
+	tokens  float64 // connections which can be accepted now, refilled at IPConnRate per second up to as many
+	last    time.Time
+	bridges int
+}
+
+// usage returns the usage of ip, l.mu must be held
+func (l *ipLimiter) usage(ip string, now time.Time, rate int) *ipUsage {
+	if l.ips == nil {
+		l.ips = make(map[string]*ipUsage)
+	}
+
+	if now.Sub(l.swept) > ipLimitIdle {
+		for k, u := range l.ips {
+			if u.bridges == 0 && now.Sub(u.last) > ipLimitIdle {
+				delete(l.ips, k)
+			}
+		}
+		l.swept = now
+	}
+
+	u := l.ips[ip]
+	if u == nil {
+		u = &ipUsage{tokens: float64(rate), last: now}
+		l.ips[ip] = u
+	}
+
+	if rate > 0 {
+		if u.tokens += now.Sub(u.last).Seconds() * float64(rate); u.tokens > float64(rate) {
+			u.tokens = float64(rate)
+		}
+	}
+	u.last = now
+	return u
+}
+
+// allowConn takes a token of ip for a new connection, false means it connects faster than IPConnRate
+func (proxy *ProxyUpstream) allowConn(ip string) bool {
+	if proxy.IPConnRate <= 0 {
+		return true
+	}
+
+	proxy.limiter.mu.Lock()
+	defer proxy.limiter.mu.Unlock()
+
+	u := proxy.limiter.usage(ip, time.Now(), proxy.IPConnRate)
+	if u.tokens < 1 {
+		atomic.AddUint64(&proxy.ipRateHits, 1)
+		return false
+	}
+	u.tokens--
+	return true
+}
+
+// acquireBridge counts a bridge of ip, false means ip has IPMaxBridges already,
+// releaseBridge must be called when the acquired bridge ends
+func (proxy *ProxyUpstream) acquireBridge(ip string) bool {
+	if proxy.IPMaxBridges <= 0 {
+		return true
+	}
+
+	proxy.limiter.mu.Lock()
+	defer proxy.limiter.mu.Unlock()
+
+	u := proxy.limiter.usage(ip, time.Now(), proxy.IPConnRate)
+	if u.bridges >= proxy.IPMaxBridges {
+		atomic.AddUint64(&proxy.ipCapHits, 1)
+		return false
+	}
+	u.bridges++
+	return true
+}
+
+func (proxy *ProxyUpstream) releaseBridge(ip string) {
+	if proxy.IPMaxBridges <= 0 {
+		return
+	}
+
+	proxy.limiter.mu.Lock()
+	if u := proxy.limiter.ips[ip]; u != nil && u.bridges > 0 {
+		u.bridges--
+	}
+	proxy.limiter.mu.Unlock()
+}
+
+// allowShared counts a connection of ip in State by windows of a second, so servers behind the load balancer
+// take at most IPConnRate new connections per second from ip together
+func (proxy *ProxyUpstream) allowShared(ip string) bool {
+	if proxy.IPConnRate <= 0 || proxy.State == nil {
+		return true
+	}
+
+	n, err := proxy.State.Incr(stateRate+ip+":"+strconv.FormatInt(time.Now().Unix(), 10), 2*time.Second)
+	if err != nil {
+		logg.W("shared state: ", err)
+		return true
+	}
+
+	if n > int64(proxy.IPConnRate) {
+		atomic.AddUint64(&proxy.ipRateHits, 1)
+		return false
+	}
+	return true
+}
+
+// limitListener closes connections of IPs connecting faster than IPConnRate as soon as they are accepted,
+// only the connections accepted are counted, not the streams multiplexed in them
+type limitListener struct {
+	net.Listener
+	proxy *ProxyUpstream
+}
+
+func (proxy *ProxyUpstream) limit(ln net.Listener) net.Listener {
+	return &limitListener{Listener: ln, proxy: proxy}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.proxy.admit(conn) {
+			return conn, err
+		}
+	}
+}
+
+// admit counts conn once, in State if there is one, which is asked without holding up the accepting loop,
+// so conn may be read from before being closed. False means conn is closed
+func (proxy *ProxyUpstream) admit(conn net.Conn) bool {
+	if proxy.IPConnRate <= 0 {
+		return true
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+
+	if proxy.State != nil {
+		go func() {
+			if !proxy.allowShared(ip) {
+				logg.D("too many connections from ", ip, " to the servers sharing state, close")
+				conn.Close()
+			}
+		}()
+	} else if !proxy.allowConn(ip) {
+		logg.D("too many connections from ", ip, ", close")
+		conn.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// kcpWindow is the send and receive window in packets, the default 32 of kcp-go
+// caps the throughput of long-distance links
+const kcpWindow = 1024
+
+func init() {
+	RegisterTransport("kcp", &KCPConfig{NoDelay: 1, Interval: 20, Resend: 2, NoCongestion: 1})
+}
+
+// KCPConfig is the transport carrying the connections to the upstream by KCP over UDP, which recovers
+// from losses much faster than TCP on long-distance lossy links at the cost of more bandwidth,
+// the fields are the parameters of ikcp_nodelay
+type KCPConfig struct {
+	NoDelay      int // 1 to resend without waiting for the RTO to double
+	Interval     int // of the internal update in milliseconds
+	Resend       int // fast resend after this many ACKs skipping a packet, 0 to disable
+	NoCongestion int // 1 to disable the congestion control
+
+	Hop *PortHop // hops the UDP port of the upstream if not nil, see WithHop
+}
+
+// ParseKCPConfig parses "nodelay,interval,resend,nc" like "1,20,2,1", or "fast" for it, empty means disabled
+func ParseKCPConfig(s string) (*KCPConfig, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "fast":
+		s = "1,20,2,1"
+	}
+
+	p := strings.Split(s, ",")
+	if len(p) != 4 {
+		return nil, errors.New("kcp: expect nodelay,interval,resend,nc like 1,20,2,1")
+	}
+
+	v := make([]int, 4)
+	for i := range p {
+		n, err := strconv.Atoi(strings.TrimSpace(p[i]))
+		if err != nil || n < 0 {
+			return nil, errors.New("kcp: invalid parameter " + p[i])
+		}
+		v[i] = n
+	}
+
+	if v[1] < 10 {
+		return nil, errors.New("kcp: interval should be at least 10ms")
+	}
+
+	return &KCPConfig{NoDelay: v[0], Interval: v[1], Resend: v[2], NoCongestion: v[3]}, nil
+}
+
+// Tune returns the config of opts.Params (see ParseKCPConfig), c if there are none
+func (c *KCPConfig) Tune(opts TransportOptions) (Transport, error) {
+	if opts.Fingerprint != "" || len(opts.ECH) > 0 {
+		return nil, errors.New("kcp: no TLS ClientHello to mimic or encrypt")
+	}
+
+	if opts.Params == "" {
+		return c, nil
+	}
+
+	tuned, err := ParseKCPConfig(opts.Params)
+	if err != nil {
+		return nil, err
+	}
+	tuned.Hop = c.Hop
+	return tuned, nil
+}
+
+// WithHop returns a copy of c hopping the UDP port of the upstream by h, the server listens on every port of its range
+// and clients ignore the port of the upstream address
+func (c *KCPConfig) WithHop(h *PortHop) *KCPConfig {
+	hc := *c
+	hc.Hop = h
+	return &hc
+}
+
+// Network tells the server listens on the UDP port
+func (c *KCPConfig) Network() string { return "udp" }
+
+func (c *KCPConfig) String() string {
+	return strconv.Itoa(c.NoDelay) + "," + strconv.Itoa(c.Interval) + "," + strconv.Itoa(c.Resend) + "," + strconv.Itoa(c.NoCongestion)
+}
+
+func (c *KCPConfig) tune(s *kcp.UDPSession) {
+	s.SetStreamMode(true)
+	s.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
+	s.SetWindowSize(kcpWindow, kcpWindow)
+}
+
+// Dial dials a KCP session, the payload is encrypted by goflyway already
+func (c *KCPConfig) Dial(address string) (net.Conn, error) {
+	if c.Hop != nil {
+		return c.dialHop(address)
+	}
+
+	s, err := kcp.DialWithOptions(address, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c.tune(s)
+	return s, nil
+}
+
+// hopSession closes the socket of the session too, kcp-go leaves the sockets it didn't create open
+type hopSession struct {
+	*kcp.UDPSession
+	conn *net.UDPConn
+}
+
+func (s *hopSession) Close() error {
+	err := s.UDPSession.Close()
+	s.conn.Close()
+	return err
+}
+
+func (c *KCPConfig) dialHop(address string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := kcp.NewConn(address, nil, 0, 0, &hopClientConn{UDPConn: conn, hop: c.Hop, remote: remote})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.tune(s)
+	return &hopSession{UDPSession: s, conn: conn}, nil
+}
+
+type kcpListener struct {
+	*kcp.Listener
+	c   *KCPConfig
+	hop *hopServerConn // the sockets of the ports hopped across, if any
+}
+
+func (l *kcpListener) Close() error {
+	err := l.Listener.Close()
+	if l.hop != nil {
+		l.hop.Close()
+	}
+	return err
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	s, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+
+	l.c.tune(s)
+	return s, nil
+}
+
+// Listen listens on the UDP port of address, through the socket bound for it if any,
+// or on every port of the range of c.Hop on the host of address
+func (c *KCPConfig) Listen(address string) (net.Listener, error) {
+	if c.Hop != nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		hop, err := listenPortHop(host, c.Hop)
+		if err != nil {
+			return nil, err
+		}
+
+		ln, err := kcp.ServeConn(nil, 0, 0, hop)
+		if err != nil {
+			hop.Close()
+			return nil, err
+		}
+		return &kcpListener{Listener: ln, c: c, hop: hop}, nil
+	}
+
+	var ln *kcp.Listener
+	var err error
+	if conn := takeUDP(address); conn != nil {
+		ln, err = kcp.ServeConn(nil, 0, 0, conn)
+	} else {
+		ln, err = kcp.ListenWithOptions(address, nil, 0, 0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &kcpListener{Listener: ln, c: c}, nil
+}
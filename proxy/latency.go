@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of histogram buckets in milliseconds, the last bucket is +Inf
+var latencyBuckets = []int64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+type histogram struct {
+	counts []uint64 // len(latencyBuckets) + 1
+	sum    uint64   // milliseconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	ms := int64(d / time.Millisecond)
+	i := 0
+	for ; i < len(latencyBuckets) && ms > latencyBuckets[i]; i++ {
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(ms))
+}
+
+// Expose writes h in the Prometheus text format, buckets are cumulative
+func (h *histogram) Expose(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.series(w, name, "")
+}
+
+// series writes the samples of h without the HELP and TYPE lines, labels are like `a="b"`,
+// so histograms of the same name can be told apart by them
+func (h *histogram) series(w io.Writer, name, labels string) {
+	sep, set := "", ""
+	if labels != "" {
+		sep, set = ",", "{"+labels+"}"
+	}
+
+	total := uint64(0)
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(float64(latencyBuckets[i])/1000, 'f', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, le, total)
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, set, float64(atomic.LoadUint64(&h.sum))/1000, name, set, total)
+}
+
+// Quantile estimates the q-quantile in milliseconds by interpolating within its bucket like
+// histogram_quantile of Prometheus, the bound of the last bucket is returned beyond it, 0 if h is empty
+func (h *histogram) Quantile(q float64) float64 {
+	counts := make([]uint64, len(h.counts))
+	total := uint64(0)
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank, seen := q*float64(total), uint64(0)
+	for i, n := range counts {
+		if i == len(latencyBuckets) {
+			break
+		}
+
+		if n > 0 && float64(seen+n) >= rank {
+			lower := int64(0)
+			if i > 0 {
+				lower = latencyBuckets[i-1]
+			}
+			return float64(lower) + float64(latencyBuckets[i]-lower)*(rank-float64(seen))/float64(n)
+		}
+		seen += n
+	}
+
+	return float64(latencyBuckets[len(latencyBuckets)-1])
+}
+
+// streamSurvey aggregates latencies of the receiving half of all streams,
+// i.e. the responses coming back from the upstream (client) or the target site (server)
+type streamSurvey struct {
+	TTFB   *histogram // time to first byte
+	Jitter *histogram // variation between consecutive inter-chunk gaps
+}
+
+func (s *streamSurvey) Init() {
+	s.TTFB, s.Jitter = newHistogram(), newHistogram()
+}
+
+func (s *streamSurvey) Expose(w io.Writer) {
+	if s.TTFB == nil {
+		return
+	}
+
+	s.TTFB.Expose(w, "goflyway_stream_ttfb_seconds", "Time to first byte of streams.")
+	s.Jitter.Expose(w, "goflyway_stream_jitter_seconds", "Variation between consecutive chunk gaps of streams.")
+}
+
+// streamTimer tracks a single stream, it is not goroutine safe
+type streamTimer struct {
+	s       *streamSurvey
+	start   time.Time
+	last    time.Time
+	lastGap time.Duration
+}
+
+func (s *streamSurvey) newTimer() *streamTimer {
+	if s.TTFB == nil {
+		return nil
+	}
+
+	return &streamTimer{s: s, start: time.Now()}
+}
+
+func (t *streamTimer) Chunk() {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	if t.last.IsZero() {
+		t.s.TTFB.Observe(now.Sub(t.start))
+		t.last = now
+		return
+	}
+
+	gap := now.Sub(t.last)
+	if t.lastGap > 0 {
+		if d := gap - t.lastGap; d < 0 {
+			t.s.Jitter.Observe(-d)
+		} else {
+			t.s.Jitter.Observe(d)
+		}
+	}
+
+	t.last, t.lastGap = now, gap
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// BridgeInfo describes a bridge which hasn't closed both ends yet
+type BridgeInfo struct {
+	ID         uint64
+	Target     string
+	Source     string
+	Age        time.Duration
+	HalfClosed time.Duration // since the first direction finished, 0 if both are running
+	User       string
+	Host       string
+	In, Out    uint64 // bytes from and to the downstream
+}
+
+type bridgeState struct {
+	target, source net.Conn
+	opened         time.Time
+	halfClosed     time.Time
+	user, host     string
+	meter          *trafficMeter
+	bucket         *TokenBucket
+}
+
+// bridges registers every running bridge, a bridge whose one direction has finished
+// while the other is still running for long is likely to be a leak
+type bridges struct {
+	mu   sync.Mutex
+	m    map[uint64]*bridgeState
+	next uint64
+}
+
+// open registers the bridge of o, whose meter is replaced by the one of the bridge counting into it
+func (b *bridges) open(target, source net.Conn, o *IOConfig) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.m == nil {
+		b.m = make(map[uint64]*bridgeState)
+	}
+
+	o.Meter = &trafficMeter{parent: o.Meter}
+	b.next++
+	b.m[b.next] = &bridgeState{
+		target: target, source: source, opened: time.Now(),
+		user: o.User, host: o.Host, meter: o.Meter, bucket: o.Bucket,
+	}
+	return b.next
+}
+
+func (b *bridges) half(id uint64) {
+	b.mu.Lock()
+	if s := b.m[id]; s != nil && s.halfClosed.IsZero() {
+		s.halfClosed = time.Now()
+	}
+	b.mu.Unlock()
+}
+
+func (b *bridges) close(id uint64) {
+	b.mu.Lock()
+	delete(b.m, id)
+	b.mu.Unlock()
+}
+
+// kill closes both ends of the bridge, false if it isn't open
+func (b *bridges) kill(id uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.m[id]
+	if s == nil {
+		return false
+	}
+	s.target.Close()
+	s.source.Close()
+	return true
+}
+
+// closeAll closes both ends of every bridge
+func (b *bridges) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.m {
+		s.target.Close()
+		s.source.Close()
+	}
+}
+
+// OpenBridges lists bridges which haven't closed both ends, oldest first,
+// tests use it to verify every stream they open eventually closes
+func (iot *io_t) OpenBridges() []BridgeInfo {
+	iot.br.mu.Lock()
+	now, list := time.Now(), make([]BridgeInfo, 0, len(iot.br.m))
+	for id, s := range iot.br.m {
+		bi := BridgeInfo{
+			ID:     id,
+			Target: remoteAddr(s.target),
+			Source: remoteAddr(s.source),
+			Age:    now.Sub(s.opened),
+			User:   s.user,
+			Host:   s.host,
+			In:     atomic.LoadUint64(&s.meter.in),
+			Out:    atomic.LoadUint64(&s.meter.out),
+		}
+
+		if !s.halfClosed.IsZero() {
+			bi.HalfClosed = now.Sub(s.halfClosed)
+		}
+
+		list = append(list, bi)
+	}
+	iot.br.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// reportLeaks logs bridges which have been half closed for longer than LeakAge
+func (iot *io_t) reportLeaks() {
+	if iot.LeakAge <= 0 {
+		return
+	}
+
+	for _, bi := range iot.OpenBridges() {
+		if bi.HalfClosed > iot.LeakAge {
+			logg.W("possible bridge leak #", bi.ID, ": ", bi.Source, " <-> ", bi.Target, ", open for ", bi.Age, ", half closed for ", bi.HalfClosed)
+		}
+	}
+}
+
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return "?"
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+)
+
+// bindAddr is an address the server listens on, network is tcp4 or tcp6 for wildcard addresses
+// which must be bound to their own families, tcp otherwise
+type bindAddr struct {
+	network string
+	addr    string
+}
+
+// bindAddrs splits a comma-separated list of listening addresses like "0.0.0.0:8100,[::]:8100,127.0.0.1:8200",
+// a bare port is of all addresses. A wildcard address alone is dual-stack, Go binds both 0.0.0.0 and [::]
+// to IPv4 and IPv6, so when both of a port are listed each is bound to its own family
+func bindAddrs(list string) []bindAddr {
+	var addrs []bindAddr
+	wildcards := make(map[string]map[int]bool) // port -> families
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+
+		b := bindAddr{network: "tcp", addr: portAddr(a)}
+		if port, family := wildcardFamily(b.addr); family > 0 {
+			if wildcards[port] == nil {
+				wildcards[port] = make(map[int]bool)
+			}
+			wildcards[port][family] = true
+		}
+		addrs = append(addrs, b)
+	}
+
+	for i, b := range addrs {
+		if port, family := wildcardFamily(b.addr); family > 0 && len(wildcards[port]) == 2 {
+			addrs[i].network = map[int]string{4: "tcp4", 6: "tcp6"}[family]
+		}
+	}
+	return addrs
+}
+
+// wildcardFamily returns the port of addr and 4 or 6 if addr is 0.0.0.0 (or empty) or [::], 0 otherwise
+func wildcardFamily(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0
+	}
+
+	switch ip := net.ParseIP(host); {
+	case host == "" || (ip != nil && ip.Equal(net.IPv4zero)):
+		return port, 4
+	case ip != nil && ip.Equal(net.IPv6unspecified):
+		return port, 6
+	}
+	return "", 0
+}
+
+// startAll listens on all addresses of Localaddr, through the sockets bound for them if any
+func (proxy *ProxyUpstream) startAll(addrs []bindAddr) error {
+	var lns []net.Listener
+	for _, b := range addrs {
+		ln := takeListener(b.addr)
+		if ln == nil {
+			var err error
+			if ln, err = net.Listen(b.network, b.addr); err != nil {
+				for _, ln := range lns {
+					ln.Close()
+				}
+				return err
+			}
+		}
+		lns = append(lns, ln)
+	}
+	return proxy.serveAll(lns)
+}
+
+// serveAll serves lns until one of them fails, connections are counted by all of them
+func (proxy *ProxyUpstream) serveAll(lns []net.Listener) error {
+	errs, s := make(chan error, len(lns)), surveys{}
+	for _, ln := range lns {
+		pool := proxy.wrap(ln)
+		s = append(s, pool)
+		go func() { errs <- proxy.serve(pool) }()
+	}
+
+	proxy.Cipher.IO.Ob = s
+	return <-errs
+}
+
+// familyNetwork narrows tcp or udp to the family of the IP of addr, so the destination is dialed
+// by its own family, names are left to the dialer which tries both
+func familyNetwork(network, addr string) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return network
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		return network
+	} else if ip.To4() != nil {
+		return network + "4"
+	}
+	return network + "6"
+}
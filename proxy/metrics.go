@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+)
+
+// trafficMeter counts the traffic of the streams sharing it, e.g. of a user, a nil meter counts nothing,
+// the traffic is counted by its parent too, so a bridge has its own meter under the one of its user
+type trafficMeter struct {
+	in, out   uint64 // bytes from and to the downstream
+	throttled int64  // nanoseconds spent waiting for token buckets
+	parent    *trafficMeter
+}
+
+func (m *trafficMeter) add(role byte, n int) {
+	for ; m != nil; m = m.parent {
+		switch role {
+		case roleRecv:
+			atomic.AddUint64(&m.in, uint64(n))
+		case roleSend:
+			atomic.AddUint64(&m.out, uint64(n))
+		}
+	}
+}
+
+func (m *trafficMeter) throttle(d time.Duration) {
+	for ; m != nil && d > 0; m = m.parent {
+		atomic.AddInt64(&m.throttled, int64(d))
+	}
+}
+
+// serverMetrics are counters of the server exposed in the Prometheus text format
+type serverMetrics struct {
+	bannedHits   uint64 // requests rejected because of manual bans
+	offenses     uint64 // invalid requests tracked in the blacklist
+	blockedHits  uint64 // requests rejected early because of too many offenses
+	ipRateHits   uint64 // connections closed because of IPConnRate
+	ipCapHits    uint64 // streams refused because of IPMaxBridges
+	dnsLookups   uint64
+	dnsFailures  uint64
+	dnsCacheHits uint64
+	udpSessions  int64 // NAT sessions open, see UDPMaxSessions
+
+	meters   map[string]*trafficMeter // keyed by username, "" if the server has no users
+	metersMu sync.Mutex
+
+	dials     map[string]*histogram // dial latencies keyed by dialNetworks
+	dialsOnce sync.Once
+}
+
+// dialNetworks are the networks destinations are reached on, their dial latencies tell the operator
+// whether a route of the VPS provider is in trouble, e.g. to China or over IPv6.
+// IPv6 destinations aren't split as ChinaIP has only IPv4 ranges
+var dialNetworks = []string{"v4/cn", "v4/intl", "v6"}
+
+func dialNetwork(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp.IP.To4() == nil {
+		return "v6"
+	}
+
+	if acr.IsChinaIP(tcp.IP.String()) {
+		return "v4/cn"
+	}
+	return "v4/intl"
+}
+
+func (m *serverMetrics) dialHistograms() map[string]*histogram {
+	m.dialsOnce.Do(func() {
+		m.dials = make(map[string]*histogram)
+		for _, n := range dialNetworks {
+			m.dials[n] = newHistogram()
+		}
+	})
+	return m.dials
+}
+
+// dial dials a destination for clients and records how long it took by the network it is reached on
+func (proxy *ProxyUpstream) dial(network, addr string) (net.Conn, error) {
+	return proxy.dialTraced(network, addr, nil)
+}
+
+// dialTraced is dial as the dial span of the traced tunnel span, with lookups of the name as its dns spans
+func (proxy *ProxyUpstream) dialTraced(network, addr string, span *Span) (conn net.Conn, err error) {
+	ds := span.child("dial", time.Now())
+	defer func() { ds.end(err) }()
+
+	if j := proxy.SSHJumps.match(addr); j != nil {
+		// the bastion is reached wherever the destination is, which its latency says nothing about
+		ds.set("ssh.jump", j.Name)
+		return j.dial(network, addr)
+	}
+
+	start := time.Now()
+	if proxy.WireGuard != nil {
+		conn, err = proxy.WireGuard.dial(ds.dnsTrace(), network, addr, proxy.Resolver)
+	} else {
+		conn, err = proxy.NAT64.dial(ds.dnsTrace(), &net.Dialer{Resolver: proxy.Resolver}, network, addr)
+	}
+	if err == nil {
+		proxy.dialHistograms()[dialNetwork(conn.RemoteAddr())].Observe(time.Since(start))
+	}
+	return conn, err
+}
+
+// Percentiles are estimated from a latency histogram, in milliseconds
+type Percentiles struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+// DialLatency returns the percentiles of dial latencies keyed by the network destinations are reached on
+func (proxy *ProxyUpstream) DialLatency() map[string]Percentiles {
+	p := make(map[string]Percentiles)
+	for n, h := range proxy.dialHistograms() {
+		p[n] = Percentiles{P50: h.Quantile(0.5), P90: h.Quantile(0.9), P99: h.Quantile(0.99)}
+	}
+	return p
+}
+
+func (m *serverMetrics) meter(user string) *trafficMeter {
+	m.metersMu.Lock()
+	defer m.metersMu.Unlock()
+
+	if m.meters == nil {
+		m.meters = make(map[string]*trafficMeter)
+	}
+
+	if m.meters[user] == nil {
+		m.meters[user] = &trafficMeter{}
+	}
+	return m.meters[user]
+}
+
+// Expose writes traffic per user, open bridges, blacklist hits and DNS lookups in the Prometheus text format
+func (proxy *ProxyUpstream) Expose(w io.Writer) {
+	proxy.expose(w, func(user string) string { return user })
+}
+
+// ExposeHashed writes the same as Expose but labels users by a hash keyed by the password,
+// for endpoints reachable by others, who can tell users apart but not learn their names
+func (proxy *ProxyUpstream) ExposeHashed(w io.Writer) {
+	proxy.expose(w, proxy.hashUser)
+}
+
+func (proxy *ProxyUpstream) hashUser(user string) string {
+	h := hmac.New(sha256.New, proxy.Cipher.Key)
+	h.Write([]byte(user))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (proxy *ProxyUpstream) expose(w io.Writer, label func(user string) string) {
+	m := &proxy.serverMetrics
+	help := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	m.metersMu.Lock()
+	users := make([]string, 0, len(m.meters))
+	for user := range m.meters {
+		users = append(users, user)
+	}
+	m.metersMu.Unlock()
+	sort.Strings(users)
+
+	help("goflyway_user_bytes_total", "counter", "Bytes bridged for each user, in from and out to the clients.")
+	for _, user := range users {
+		tm := m.meter(user)
+		fmt.Fprintf(w, "goflyway_user_bytes_total{user=%q,direction=\"in\"} %d\n", label(user), atomic.LoadUint64(&tm.in))
+		fmt.Fprintf(w, "goflyway_user_bytes_total{user=%q,direction=\"out\"} %d\n", label(user), atomic.LoadUint64(&tm.out))
+	}
+
+	if proxy.SyncPeer != "" {
+		traffic := proxy.ClusterTraffic()
+		users := make([]string, 0, len(traffic))
+		for user := range traffic {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+
+		help("goflyway_cluster_user_bytes_total", "counter", "Bytes bridged for each user by this server and its sync peer together.")
+		for _, user := range users {
+			fmt.Fprintf(w, "goflyway_cluster_user_bytes_total{user=%q,direction=\"in\"} %d\n", label(user), traffic[user][0])
+			fmt.Fprintf(w, "goflyway_cluster_user_bytes_total{user=%q,direction=\"out\"} %d\n", label(user), traffic[user][1])
+		}
+	}
+
+	help("goflyway_user_throttled_seconds_total", "counter", "Time streams of each user spent waiting for throttling.")
+	for _, user := range users {
+		fmt.Fprintf(w, "goflyway_user_throttled_seconds_total{user=%q} %g\n", label(user), time.Duration(atomic.LoadInt64(&m.meter(user).throttled)).Seconds())
+	}
+
+	help("goflyway_bridges", "gauge", "Number of streams being bridged.")
+	fmt.Fprintf(w, "goflyway_bridges %d\n", len(proxy.IO.OpenBridges()))
+
+	help("goflyway_partial_checksum_failures_total", "counter", "Partial streams reset because the checksum of their unencrypted traffic mismatched.")
+	fmt.Fprintf(w, "goflyway_partial_checksum_failures_total %d\n", atomic.LoadUint64(&proxy.IO.sumFailures))
+
+	help("goflyway_udp_sessions", "gauge", "Number of UDP NAT sessions open.")
+	fmt.Fprintf(w, "goflyway_udp_sessions %d\n", atomic.LoadInt64(&m.udpSessions))
+
+	help("goflyway_blacklist_hits_total", "counter", "Requests rejected by manual bans (banned), tracked as invalid (offense) or rejected for too many offenses (blocked).")
+	fmt.Fprintf(w, "goflyway_blacklist_hits_total{reason=\"banned\"} %d\n", atomic.LoadUint64(&m.bannedHits))
+	fmt.Fprintf(w, "goflyway_blacklist_hits_total{reason=\"offense\"} %d\n", atomic.LoadUint64(&m.offenses))
+	fmt.Fprintf(w, "goflyway_blacklist_hits_total{reason=\"blocked\"} %d\n", atomic.LoadUint64(&m.blockedHits))
+
+	help("goflyway_ip_limit_hits_total", "counter", "Connections closed for coming too fast (rate) and streams refused for too many bridges (bridges) of an IP.")
+	fmt.Fprintf(w, "goflyway_ip_limit_hits_total{limit=\"rate\"} %d\n", atomic.LoadUint64(&m.ipRateHits))
+	fmt.Fprintf(w, "goflyway_ip_limit_hits_total{limit=\"bridges\"} %d\n", atomic.LoadUint64(&m.ipCapHits))
+
+	help("goflyway_dns_lookups_total", "counter", "DNS lookups made for clients.")
+	fmt.Fprintf(w, "goflyway_dns_lookups_total %d\n", atomic.LoadUint64(&m.dnsLookups))
+	help("goflyway_dns_failures_total", "counter", "DNS lookups made for clients which failed.")
+	fmt.Fprintf(w, "goflyway_dns_failures_total %d\n", atomic.LoadUint64(&m.dnsFailures))
+	help("goflyway_dns_cache_hits_total", "counter", "DNS lookups made for clients which were answered by the cache.")
+	fmt.Fprintf(w, "goflyway_dns_cache_hits_total %d\n", atomic.LoadUint64(&m.dnsCacheHits))
+
+	help("goflyway_dial_seconds", "histogram", "Time to dial destinations for clients by the network they are reached on.")
+	for _, n := range dialNetworks {
+		m.dialHistograms()[n].series(w, "goflyway_dial_seconds", fmt.Sprintf("network=%q", n))
+	}
+}
@@ -40,12 +40,14 @@ func publicKey(priv interface{}) interface{} {
 	}
 }
 
-func (proxy *ProxyClient) sign(host string) *tls.Certificate {
-	if cert, ok := proxy.CACache.Get(host); ok {
+// sign returns the certificate of hosts signed by the CA, the first is the subject
+func (proxy *ProxyClient) sign(hosts ...string) *tls.Certificate {
+	key := strings.Join(hosts, ",")
+	if cert, ok := proxy.CACache.Get(key); ok {
 		return cert.(*tls.Certificate)
 	}
 
-	logg.D("self signing: ", host)
+	logg.D("self signing: ", key)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -69,7 +71,14 @@ func (proxy *ProxyClient) sign(host string) *tls.Certificate {
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{host},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
 
 	pubKey := publicKey(proxy.CA.PrivateKey)
@@ -84,14 +93,21 @@ func (proxy *ProxyClient) sign(host string) *tls.Certificate {
 		PrivateKey:  proxy.CA.PrivateKey,
 	}
 
-	proxy.CACache.Add(host, cert)
+	proxy.CACache.Add(key, cert)
 	return cert
 }
 
-func (proxy *ProxyClient) manInTheMiddle(client net.Conn, host string) {
+// manInTheMiddle decrypts the TLS of host and forwards the requests in it to dst, the destination routed,
+// which differs from host if Hosts maps it
+func (proxy *ProxyClient) manInTheMiddle(client net.Conn, host, dst string) {
+	// try self signing a cert of this host, the browser verifies the name it asked for
 	_host, _ := splitHostPort(host)
-	// try self signing a cert of this host
-	cert := proxy.sign(_host)
+	names := []string{_host}
+	if _dst, _ := splitHostPort(dst); _dst != _host {
+		names = append(names, _dst)
+	}
+
+	cert := proxy.sign(names...)
 	if cert == nil {
 		return
 	}
@@ -153,9 +169,12 @@ func (proxy *ProxyClient) manInTheMiddle(client net.Conn, host string) {
 				rURL = req.URL.String()
 			}
 
+			// the request goes where the CONNECT was routed, like forwarded ones
+			req.URL.Host = strings.TrimSuffix(dst, ":443")
+
 			logg.D(req.Method, "^ ", rURL)
 
-			resp, rkeybuf, err := proxy.encryptAndTransport(req)
+			resp, rkeybuf, err := proxy.encryptAndTransport(req, nil)
 			if err != nil {
 				logg.E("proxy pass: ", rURL, ", ", err)
 				tlsClient.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n" + err.Error()))
@@ -178,7 +197,7 @@ func (proxy *ProxyClient) manInTheMiddle(client net.Conn, host string) {
 			_ = httputil.DumpResponse
 
 			hdr := http.Header{}
-			copyHeaders(hdr, resp.Header, proxy.Cipher, false, rkeybuf)
+			copyHeaders(hdr, resp.Header, &proxy.Cipher.Codec, false, rkeybuf)
 			if err := hdr.Write(tlsClient); err != nil {
 				logg.W("write header: ", err)
 				break
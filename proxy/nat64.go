@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// NAT64 lets an IPv6-only upstream reach IPv4-only destinations through their addresses
+// synthesized with Prefix, only /96 prefixes are supported (RFC 6052)
+type NAT64 struct {
+	Prefix net.IP
+}
+
+// ipv4only.arpa resolves to these addresses, a DNS64 resolver embeds them into its prefix (RFC 7050)
+var ipv4OnlyARPA = []net.IP{net.IPv4(192, 0, 0, 170).To4(), net.IPv4(192, 0, 0, 171).To4()}
+
+// ParseNAT64 parses a prefix like 64:ff9b::/96, or "auto" to discover it from the DNS64 resolver
+func ParseNAT64(s string) (*NAT64, error) {
+	if s == "auto" {
+		ips, err := net.LookupIP("ipv4only.arpa")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			if ip.To4() == nil && (bytes.Equal(ip[12:], ipv4OnlyARPA[0]) || bytes.Equal(ip[12:], ipv4OnlyARPA[1])) {
+				return &NAT64{Prefix: append(net.IP{}, ip[:12]...)}, nil
+			}
+		}
+
+		return nil, errors.New("the resolver doesn't support DNS64")
+	}
+
+	if !strings.Contains(s, "/") {
+		s += "/96"
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if ones, bits := n.Mask.Size(); ones != 96 || bits != 128 {
+		return nil, errors.New("only /96 NAT64 prefixes are supported")
+	}
+
+	return &NAT64{Prefix: n.IP[:12]}, nil
+}
+
+func (n *NAT64) synthesize(ip net.IP) net.IP {
+	ip4 := ip.To4()
+	if n == nil || ip4 == nil {
+		return ip
+	}
+
+	x := make(net.IP, net.IPv6len)
+	copy(x, n.Prefix)
+	copy(x[12:], ip4)
+	return x
+}
+
+// Dial dials addr, IPv4 destinations are reached through their synthesized addresses,
+// names with IPv6 addresses are dialed as is
+func (n *NAT64) Dial(network, addr string) (net.Conn, error) {
+	return n.dial(context.Background(), &net.Dialer{}, network, addr)
+}
+
+// dial is Dial by d in ctx, names are looked up by its resolver
+func (n *NAT64) dial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if n == nil {
+		return d.DialContext(ctx, familyNetwork(network, addr), addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := d.Resolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, x := range ips {
+			if x.To4() == nil {
+				return d.DialContext(ctx, network, net.JoinHostPort(x.String(), port))
+			}
+		}
+
+		if len(ips) == 0 {
+			return nil, errors.New("no address for " + host)
+		}
+
+		ip = ips[0]
+	}
+
+	return d.DialContext(ctx, network, net.JoinHostPort(n.synthesize(ip).String(), port))
+}
+
+// UDPAddr maps an IPv4 UDP destination to its synthesized address
+func (n *NAT64) UDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	if n == nil || addr == nil || addr.IP.To4() == nil {
+		return addr
+	}
+
+	return &net.UDPAddr{IP: n.synthesize(addr.IP), Port: addr.Port}
+}
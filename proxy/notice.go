@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/codec"
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Notices are pushed by the upstream through a long-lived tunnel whose host is noticeScheme,
+// each notice is an encrypted line, empty lines are heartbeats
+const (
+	noticeScheme    = "notice://"
+	noticeHeartbeat = 60 * time.Second
+	noticeKeep      = 16
+)
+
+type Notice struct {
+	Time time.Time
+	Text string
+}
+
+type noticeSubscriber struct {
+	net.Conn
+	gc  *codec.Codec // the key the client subscribed by
+	key []byte
+	mu  sync.Mutex
+}
+
+func (s *noticeSubscriber) send(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.SetWriteDeadline(time.Now().Add(timeoutOp))
+	_, err := s.Write([]byte(line + "\n"))
+	return err
+}
+
+type noticeBoard struct {
+	subs map[*noticeSubscriber]bool
+	mu   sync.Mutex
+}
+
+func (proxy *ProxyUpstream) subscribeNotice(conn net.Conn, gc *codec.Codec, key []byte) {
+	s := &noticeSubscriber{Conn: conn, gc: gc, key: key}
+
+	proxy.notices.mu.Lock()
+	proxy.notices.subs[s] = true
+	proxy.notices.mu.Unlock()
+
+	go func() {
+		for range time.Tick(noticeHeartbeat) {
+			if s.send("") != nil {
+				break
+			}
+		}
+
+		proxy.notices.mu.Lock()
+		delete(proxy.notices.subs, s)
+		proxy.notices.mu.Unlock()
+		conn.Close()
+	}()
+}
+
+// Broadcast pushes text to all connected clients and returns how many of them received it
+func (proxy *ProxyUpstream) Broadcast(text string) int {
+	proxy.notices.mu.Lock()
+	subs := make([]*noticeSubscriber, 0, len(proxy.notices.subs))
+	for s := range proxy.notices.subs {
+		subs = append(subs, s)
+	}
+	proxy.notices.mu.Unlock()
+
+	n := 0
+	for _, s := range subs {
+		if s.send(s.gc.EncryptCompress(text, s.key...)) == nil {
+			n++
+		} else {
+			s.Close()
+		}
+	}
+
+	logg.L("broadcast to ", n, " clients: ", text)
+	return n
+}
+
+// StartNotice subscribes to notices of the upstream and keeps reconnecting
+func (proxy *ProxyClient) StartNotice() {
+	go func() {
+		for {
+			if err := proxy.waitNotice(); err != nil {
+				logg.D("notice channel: ", err)
+			}
+			time.Sleep(reverseRetry)
+		}
+	}()
+}
+
+func (proxy *ProxyClient) waitNotice() error {
+	upstreamConn, rkeybuf, _, err := proxy.openTunnel(noticeScheme, 0)
+	if err != nil {
+		return err
+	}
+	defer upstreamConn.Close()
+
+	for {
+		upstreamConn.SetReadDeadline(time.Now().Add(noticeHeartbeat * 3))
+		buf, err := readUntil(upstreamConn, "\n")
+		if err != nil {
+			return err
+		}
+
+		line := strings.TrimSpace(string(buf))
+		if line == "" {
+			continue
+		}
+
+		text := proxy.Cipher.DecryptDecompress(line, rkeybuf...)
+		logg.W("upstream notice: ", text)
+
+		proxy.noticesMu.Lock()
+		if proxy.notices = append(proxy.notices, Notice{Time: time.Now(), Text: text}); len(proxy.notices) > noticeKeep {
+			proxy.notices = proxy.notices[1:]
+		}
+		proxy.noticesMu.Unlock()
+	}
+}
+
+// Notices returns recent notices pushed by the upstream, oldest first
+func (proxy *ProxyClient) Notices() []Notice {
+	proxy.noticesMu.Lock()
+	defer proxy.noticesMu.Unlock()
+	return append([]Notice{}, proxy.notices...)
+}
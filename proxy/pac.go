@@ -17,8 +17,14 @@ func (proxy *ProxyClient) servePACFile(w http.ResponseWriter, r *http.Request) {
 
 	pac := &bytes.Buffer{}
 	pac.WriteString("function slowMatch(host) { ")
-	if len(table2) > 0 {
+	if len(table2) > 0 || len(proxy.ACL.White.DomainExactMatch) > 0 || len(proxy.ACL.White.DomainWildcardMatch) > 0 {
 		pac.WriteString("return ")
+		for d := range proxy.ACL.White.DomainExactMatch {
+			pac.WriteString("host==\"" + d + "\"||")
+		}
+		for d := range proxy.ACL.White.DomainWildcardMatch {
+			pac.WriteString("dnsDomainIs(host,\"." + d + "\")||")
+		}
 		for _, r := range table2 {
 			pac.WriteString("host.match(/" + r.String() + "/)||")
 		}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"time"
+)
+
+const (
+	pacingBulkSize   = 1024 * 1024 // streams become bulk after writing this many bytes
+	pacingDefaultRTT = 100 * time.Millisecond
+	pacingMinBurst   = 32 * 1024 // a full buffer of Copy
+)
+
+// Pacing caps the writes of each bulk stream into a mux carrier at the fixed Rate, so they won't fill
+// the carrier's buffers and delay the interactive streams sharing it. The rate is not derived from
+// the link, only bursts are sized by what Rate sends during the latency of dialing the upstream.
+// Short streams are never paced.
+type Pacing struct {
+	Rate int64 // bytes per second of each bulk stream
+}
+
+func NewPacing(rate int64) *Pacing {
+	return &Pacing{Rate: rate}
+}
+
+// burst returns the bytes sent at Rate during rtt, at least a full buffer of Copy
+func (p *Pacing) burst(rtt time.Duration) int64 {
+	n := p.Rate * int64(rtt) / int64(time.Second)
+	if n < pacingMinBurst {
+		n = pacingMinBurst
+	}
+	return n
+}
+
+type pacer struct {
+	p       *Pacing
+	survey  *trafficSurvey
+	written int64
+	tb      *TokenBucket
+}
+
+func (p *Pacing) newPacer(survey *trafficSurvey) *pacer {
+	if p == nil || p.Rate <= 0 {
+		return nil
+	}
+	return &pacer{p: p, survey: survey}
+}
+
+// Wait blocks until n bytes can be written, it is a no-op for nil pacers
+func (pc *pacer) Wait(n int) {
+	if pc == nil {
+		return
+	}
+
+	if pc.tb == nil {
+		if pc.written += int64(n); pc.written < pacingBulkSize {
+			return
+		}
+
+		// RTT is taken once the stream turns bulk
+		rtt := pc.survey.Latency()
+		if rtt <= 0 {
+			rtt = pacingDefaultRTT
+		}
+
+		// start with a full burst, bytes until now are not paced
+		pc.tb = NewTokenBucket(pc.p.Rate, pc.p.burst(rtt))
+		pc.tb.capacity = pc.tb.maxCapacity
+		return
+	}
+
+	pc.tb.Consume(int64(n))
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PingResult is the outcome of one step of Ping
+type PingResult struct {
+	Step string
+	Cost time.Duration
+	Err  error
+}
+
+// Ping checks the upstream step by step: the handshake, a remote DNS query,
+// a CONNECT tunnel and a forwarded HTTP request, all targeting host (port 80 if omitted).
+// It never stops halfway so every broken step gets reported.
+func (proxy *ProxyClient) Ping(host string) []PingResult {
+	name, _ := splitHostPort(host)
+	name = strings.Trim(name, "[]")
+
+	steps := []struct {
+		name string
+		f    func() error
+	}{
+		{"handshake", func() error {
+			conn, err := proxy.dialUpstream()
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}},
+		{"dns", func() error {
+			ip, err := proxy.lookupRemote(name)
+			if err == nil && ip == nil {
+				err = errors.New("upstream failed to resolve " + name)
+			}
+			return err
+		}},
+		{"connect", func() error {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+
+			if proxy.dialUpstreamAndBridge(c2, hostWithPort(host, "80"), nil, 0, nil) == nil {
+				return errors.New("upstream refused the tunnel")
+			}
+
+			c1.SetDeadline(time.Now().Add(timeoutOp))
+			if _, err := c1.Write([]byte("HEAD / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n")); err != nil {
+				return err
+			}
+
+			buf, err := readUntil(c1, "\r\n\r\n")
+			if err == nil && !strings.HasPrefix(string(buf), "HTTP/") {
+				err = errors.New("unexpected response through the tunnel")
+			}
+			return err
+		}},
+		{"forward", func() error {
+			req, _ := http.NewRequest("HEAD", "http://"+host+"/", strings.NewReader(""))
+			resp, _, err := proxy.encryptAndTransport(req, nil)
+			if err == nil {
+				tryClose(resp.Body)
+			}
+			return err
+		}},
+	}
+
+	ret := make([]PingResult, 0, len(steps))
+	for _, s := range steps {
+		start := time.Now()
+		err := s.f()
+		ret = append(ret, PingResult{Step: s.name, Cost: time.Now().Sub(start), Err: err})
+	}
+
+	return ret
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHopInterval = 30 * time.Second
+
+// PortHop hops the UDP port between clients and the upstream across a range on a schedule derived from the password,
+// so both agree on it without talking: the server listens on every port of the range, and clients send to the port
+// of the time, sessions going on hop too. ISPs throttling a busy UDP port see the traffic spread over the range
+type PortHop struct {
+	Low, High int           // the range of ports, inclusive
+	Interval  time.Duration // between hops, in whole seconds
+
+	key []byte
+}
+
+// ParsePortHop parses "low-high" or "low-high/interval" like "20000-20099/30s", the interval is 30s by default
+func ParsePortHop(spec, password string) (*PortHop, error) {
+	h := &PortHop{Interval: defaultHopInterval, key: []byte(password)}
+	if idx := strings.Index(spec, "/"); idx > -1 {
+		d, err := time.ParseDuration(spec[idx+1:])
+		if err != nil || d < time.Second || d%time.Second != 0 {
+			return nil, errors.New("port hop: the interval should be whole seconds: " + spec[idx+1:])
+		}
+		h.Interval, spec = d, spec[:idx]
+	}
+
+	p := strings.Split(spec, "-")
+	if len(p) != 2 {
+		return nil, errors.New("port hop: expect low-high/interval like 20000-20099/30s")
+	}
+
+	var err1, err2 error
+	h.Low, err1 = strconv.Atoi(strings.TrimSpace(p[0]))
+	h.High, err2 = strconv.Atoi(strings.TrimSpace(p[1]))
+	if err1 != nil || err2 != nil || h.Low < 1 || h.High > 65535 || h.Low > h.High {
+		return nil, errors.New("port hop: invalid range " + spec)
+	}
+	return h, nil
+}
+
+// Port returns the port of t
+func (h *PortHop) Port(t time.Time) int {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte("goflyway port hop " + strconv.FormatInt(t.Unix()/int64(h.Interval/time.Second), 10)))
+	return h.Low + int(binary.BigEndian.Uint32(mac.Sum(nil))%uint32(h.High-h.Low+1))
+}
+
+func (h *PortHop) String() string {
+	return strconv.Itoa(h.Low) + "-" + strconv.Itoa(h.High) + "/" + h.Interval.String()
+}
+
+// hopClientConn sends to the port of the time of remote, and tells packets are from remote whichever port they are from
+type hopClientConn struct {
+	*net.UDPConn
+	hop    *PortHop
+	remote *net.UDPAddr
+}
+
+func (c *hopClientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to := *c.remote
+	to.Port = c.hop.Port(time.Now())
+	return c.UDPConn.WriteTo(b, &to)
+}
+
+func (c *hopClientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.UDPConn.ReadFrom(b)
+	return n, c.remote, err
+}
+
+type hopPacket struct {
+	buf  []byte
+	addr net.Addr
+}
+
+// hopServerConn reads from the sockets of every port of the range, and answers a peer by the socket it sent to last,
+// which its NAT expects the answers from
+type hopServerConn struct {
+	conns   []*net.UDPConn
+	packets chan hopPacket
+	done    chan struct{}
+	err     error
+	once    sync.Once
+
+	mu    sync.Mutex
+	peers map[string]*net.UDPConn
+}
+
+func listenPortHop(host string, h *PortHop) (*hopServerConn, error) {
+	c := &hopServerConn{
+		packets: make(chan hopPacket, 256),
+		done:    make(chan struct{}),
+		peers:   make(map[string]*net.UDPConn),
+	}
+
+	for port := h.Low; port <= h.High; port++ {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, conn)
+	}
+
+	for _, conn := range c.conns {
+		go c.read(conn)
+	}
+	return c, nil
+}
+
+func (c *hopServerConn) read(conn *net.UDPConn) {
+	for {
+		buf := make([]byte, 65536)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.mu.Lock()
+		c.peers[addr.String()] = conn
+		c.mu.Unlock()
+
+		select {
+		case c.packets <- hopPacket{buf: buf[:n], addr: addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *hopServerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.buf), p.addr, nil
+	case <-c.done:
+		return 0, nil, c.err
+	}
+}
+
+func (c *hopServerConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	conn := c.peers[addr.String()]
+	c.mu.Unlock()
+
+	if conn == nil {
+		conn = c.conns[0]
+	}
+	return conn.WriteTo(b, addr)
+}
+
+func (c *hopServerConn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+	})
+}
+
+func (c *hopServerConn) Close() error {
+	c.close(errors.New("port hop: closed"))
+	return nil
+}
+
+// LocalAddr is the address of the lowest port of the range
+func (c *hopServerConn) LocalAddr() net.Addr { return c.conns[0].LocalAddr() }
+
+// deadlines of the sockets would stop reading from all of them
+func (c *hopServerConn) SetDeadline(t time.Time) error {
+	return errors.New("port hop: no deadlines")
+}
+
+func (c *hopServerConn) SetReadDeadline(t time.Time) error {
+	return errors.New("port hop: no deadlines")
+}
+
+func (c *hopServerConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("port hop: no deadlines")
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+	"github.com/coyove/goflyway/pkg/lru"
+)
+
+func (proxy *ProxyClient) startDNSPrefetch() {
+	for range time.Tick(proxy.DNSTTL / 10) {
+		if n := proxy.prefetchDNS(); n > 0 {
+			logg.D("prefetched ", n, " rules")
+		}
+	}
+}
+
+// prefetchDNS remakes rules which were resolved by the upstream, used within the last DNSTTL
+// and will expire in DNSTTL/10, so the next connection to them won't wait for a tunnel round trip
+func (proxy *ProxyClient) prefetchDNS() int {
+	now, ttl := time.Now().UnixNano(), int64(proxy.DNSTTL)
+	hosts := []string{}
+
+	proxy.DNSCache.Info(func(k lru.Key, v interface{}, h int64) {
+		rule, _ := v.(*Rule)
+		if rule == nil || !rule.Remote || rule.Ans != rule.OldAns {
+			return
+		}
+
+		if now-rule.Time > ttl*9/10 && now-atomic.LoadInt64(&rule.Used) < ttl {
+			hosts = append(hosts, k.(string))
+		}
+	})
+
+	// one by one, there is no hurry
+	for _, host := range hosts {
+		proxy.makeRule(host)
+	}
+
+	return len(hosts)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// idle carriers are redialed after this, frontends and NATs may have dropped them silently
+const prewarmMaxIdle = 30 * time.Second
+
+func (proxy *ProxyClient) startPrewarm() {
+	proxy.warm = make(chan net.Conn)
+	proxy.warmDone = make(chan struct{})
+	for i := 0; i < proxy.Prewarm; i++ {
+		go proxy.prewarmWorker(proxy.warmDone)
+	}
+}
+
+// prewarmWorker keeps one carrier dialed, handshakes with the HTTPS frontend included, and hands it to dialUpstream
+// until done is closed by Close
+func (proxy *ProxyClient) prewarmWorker(done chan struct{}) {
+	for {
+		conn, err := proxy.dialCarrier()
+		if err != nil {
+			logg.D("prewarm: ", err)
+			select {
+			case <-time.After(reverseRetry):
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case proxy.warm <- conn:
+		case <-time.After(prewarmMaxIdle):
+			conn.Close()
+		case <-done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// stopPrewarm stops the workers of startPrewarm, carriers they hold are closed
+func (proxy *ProxyClient) stopPrewarm() {
+	if proxy.warmDone != nil {
+		close(proxy.warmDone)
+		proxy.warmDone = nil
+	}
+}
+
+// takeWarm returns a prewarmed carrier, or nil if none is ready
+func (proxy *ProxyClient) takeWarm() net.Conn {
+	select {
+	case conn := <-proxy.warm:
+		return conn
+	default:
+		return nil
+	}
+}
@@ -1,10 +1,44 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/lru"
+	"github.com/coyove/tcpmux"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestCipher(t *testing.T) {
@@ -45,7 +79,7 @@ func BenchmarkGenWord(b *testing.B) {
 	r.Init("12345678")
 
 	for i := 0; i < b.N; i++ {
-		r.genWord(false)
+		r.GenWord(false)
 	}
 }
 
@@ -66,3 +100,5458 @@ func BenchmarkConvert2(b *testing.B) {
 	}
 	_ = buf[0]
 }
+
+func TestIPv6Host(t *testing.T) {
+	for _, c := range [][3]string{
+		{"example.com:443", "example.com", ":443"},
+		{"Example.COM", "example.com", ""},
+		{"1.2.3.4:80", "1.2.3.4", ":80"},
+		{"[::1]:443", "[::1]", ":443"},
+		{"[2001:db8::1]", "[2001:db8::1]", ""},
+		{"2001:DB8::1", "[2001:db8::1]", ""},
+	} {
+		if h, p := splitHostPort(c[0]); h != c[1] || p != c[2] {
+			t.Error("splitHostPort:", c[0], h, p)
+		}
+	}
+
+	for _, c := range [][2]string{
+		{"example.com", "example.com:80"},
+		{"example.com:443", "example.com:443"},
+		{"[::1]", "[::1]:80"},
+		{"[::1]:443", "[::1]:443"},
+		{"2001:db8::1", "[2001:db8::1]:80"},
+	} {
+		if h := hostWithPort(c[0], "80"); h != c[1] {
+			t.Error("hostWithPort:", c[0], h)
+		}
+	}
+}
+
+func TestSOCKSAddrIPv6(t *testing.T) {
+	test := func(buf []byte, expected string) {
+		_, addr, err := parseUDPHeader(nil, buf, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if addr.String() != expected || addr.size != len(buf) {
+			t.Error("parseUDPHeader:", addr.String(), expected)
+		}
+	}
+
+	v6 := []byte{0, 0, 0, socksAddrIPv6}
+	v6 = append(v6, net.ParseIP("2001:db8::1")...)
+	test(append(v6, 1, 187), "[2001:db8::1]:443")
+
+	mapped := []byte{0, 0, 0, socksAddrIPv6}
+	mapped = append(mapped, net.ParseIP("1.2.3.4")...)
+	test(append(mapped, 0, 80), "1.2.3.4:80")
+
+	domain := append([]byte{0, 0, 0, socksAddrDomain, 3}, "::1"...)
+	test(append(domain, 0, 53), "[::1]:53")
+}
+
+func TestHostsLookup(t *testing.T) {
+	h := Hosts{"staging.example.com": "10.0.0.2", "a.test": "b.test", "v6.test": "::1"}
+
+	for _, c := range [][2]string{
+		{"staging.example.com:443", "10.0.0.2:443"},
+		{"STAGING.example.com", "10.0.0.2"},
+		{"a.test:80", "b.test:80"},
+		{"v6.test:80", "[::1]:80"},
+		{"v6.test", "[::1]"},
+		{"other.test:80", "other.test:80"},
+	} {
+		if to, _ := h.Lookup(c[0]); to != c[1] {
+			t.Error("hosts lookup:", c[0], to)
+		}
+	}
+}
+
+func TestMITMHosts(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("staging"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	c := &Cipher{}
+	c.Init("12345678")
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	defer upstream.Close()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goflyway test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	ca, _ := x509.ParseCertificate(der)
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream: upstream.Listener.Addr().String(),
+		Policy:   Options(PolicyManInTheMiddle),
+		Cipher:   c,
+		CA:       tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv},
+		DNSCache: lru.NewCache(16),
+		CACache:  lru.NewCache(16),
+		ACL:      acl,
+		Hosts:    Hosts{"staging.example.com": "127.0.0.1"},
+	})
+	defer client.Listener.Close()
+	go client.Start()
+
+	// the mapped IP is proxied rather than connected directly
+	now := time.Now().UnixNano()
+	client.DNSCache.Add("127.0.0.1", &Rule{IP: "127.0.0.1", Ans: ruleProxy, OldAns: ruleProxy, Time: now, Used: now})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	proxyURL, _ := url.Parse("http://" + client.Listener.Addr().String())
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	// the browser verifies the name it asked for, the request goes to the mapped destination
+	resp, err := hc.Get("https://staging.example.com:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if buf, _ := ioutil.ReadAll(resp.Body); string(buf) != "staging" {
+		t.Error("the request should reach the mapped destination:", string(buf))
+	}
+
+	cert := client.sign("staging.example.com", "127.0.0.1")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.VerifyHostname("staging.example.com") != nil || leaf.VerifyHostname("127.0.0.1") != nil {
+		t.Error("the certificate should be of both the name and the destination:", leaf.DNSNames, leaf.IPAddresses)
+	}
+}
+
+func TestSniffTLS(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go tls.Client(c1, &tls.Config{ServerName: "www.example.com"}).Handshake()
+
+	host, conn := sniffHost(c2, "443")
+	if host != "www.example.com" {
+		t.Error("SNI sniffing failed:", host)
+	}
+
+	// peeked bytes must still be readable
+	buf := make([]byte, 1)
+	if n, _ := conn.Read(buf); n != 1 || buf[0] != 0x16 {
+		t.Error("sniffed conn lost the buffered data")
+	}
+
+	c1.Close()
+	c2.Close()
+}
+
+func TestLocalProtocols(t *testing.T) {
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := &ProxyClient{ClientConfig: &ClientConfig{Cipher: c, DNSCache: lru.NewCache(16)}}
+	proxy.DNSCache.Add("127.0.0.1", &Rule{Ans: rulePass})
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	l := &listenerWrapper{ln, proxy}
+
+	// only HTTP comes out of Accept
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(echo.Addr().(*net.TCPAddr).Port))
+
+	socks4 := append(append([]byte{4, 1}, port...), 127, 0, 0, 1, 'u', 0)
+	socks4a := append(append([]byte{4, 1}, port...), append([]byte{0, 0, 0, 1, 0}, "localhost\x00"...)...)
+	for _, req := range [][]byte{socks4, socks4a} {
+		conn, _ := net.Dial("tcp", ln.Addr().String())
+		conn.Write(append(req, "ping"...))
+
+		buf := make([]byte, 12)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(okSOCKS4)+"ping" {
+			t.Error("SOCKS4:", buf, err)
+		}
+		conn.Close()
+	}
+
+	proxy.UserAuth = "a:b"
+	conn, _ := net.Dial("tcp", ln.Addr().String())
+	conn.Write(socks4)
+	if buf, _ := ioutil.ReadAll(conn); len(buf) != 8 || buf[1] != 0x5b {
+		t.Error("SOCKS4 should be refused with a password:", buf)
+	}
+
+	conn, _ = net.Dial("tcp", ln.Addr().String())
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	select {
+	case h := <-accepted:
+		h.Close()
+	case <-time.After(time.Second):
+		t.Error("HTTP should be accepted")
+	}
+	conn.Close()
+}
+
+func TestSniffHTTP(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		// header arrives in pieces
+		c1.Write([]byte("GET / HTTP/1.1\r\nUser-Agent: test\r\n"))
+		c1.Write([]byte("HOST: www.example.com:8080\r\n\r\n"))
+	}()
+
+	if host, _ := sniffHost(c2, "80"); host != "www.example.com" {
+		t.Error("Host sniffing failed:", host)
+	}
+
+	c1.Close()
+	c2.Close()
+}
+
+func TestThrottlingScope(t *testing.T) {
+	proxy := NewServer("8101", &ServerConfig{
+		Throttling:    1024,
+		ThrottlingMax: 1024,
+		Users:         map[string]UserConfig{"a": {}, "b": {Throttling: 2048, ThrottlingMax: 2048}},
+		Cipher:        &Cipher{},
+	})
+
+	if proxy.getIOConfig("a").Bucket == proxy.getIOConfig("a").Bucket {
+		t.Error("per-conn streams should not share buckets")
+	}
+
+	proxy.ThrottlingScope = ThrottlingPerUser
+	if a, b := proxy.getIOConfig("a").Bucket, proxy.getIOConfig("b").Bucket; a != proxy.getIOConfig("a").Bucket || a == b || b.Speed != 2048 {
+		t.Error("per-user streams should share buckets of their own")
+	}
+
+	proxy.ThrottlingScope = ThrottlingGlobal
+	if a, b := proxy.getIOConfig("a").Bucket, proxy.getIOConfig("b").Bucket; a != b || a.Speed != 1024 {
+		t.Error("global streams should share one bucket")
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}})
+
+	proxy.offend("1.1.1.1")
+	proxy.offend("2.2.2.2")
+	proxy.offend("2.2.2.2")
+	proxy.Ban("3.3.3.3")
+
+	list := proxy.Blacklist()
+	if len(list) != 3 || !list[0].Manual || list[1].Addr != "2.2.2.2" || list[1].Hits != 2 {
+		t.Error("unexpected blacklist:", list)
+	}
+
+	if list[1].FirstSeen.After(list[1].LastSeen) {
+		t.Error("first seen should not be after last seen")
+	}
+
+	if !proxy.banned("3.3.3.3") || proxy.banned("2.2.2.2") {
+		t.Error("only manual bans should be rejected")
+	}
+
+	proxy.Unban("3.3.3.3")
+	proxy.Unban("2.2.2.2")
+	if list = proxy.Blacklist(); len(list) != 1 || proxy.banned("3.3.3.3") {
+		t.Error("unban failed:", list)
+	}
+}
+
+func TestBlacklistPolicy(t *testing.T) {
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, BlacklistSize: 2, BanThreshold: 2, BanDuration: time.Hour, BanPrefixV4: 24})
+
+	proxy.offend("1.2.3.4")
+	proxy.offend("1.2.3.5")
+	if proxy.blocked("1.2.3.6") {
+		t.Error("offenders within the threshold should not be rejected")
+	}
+
+	proxy.offend("1.2.3.6")
+	if !proxy.blocked("1.2.3.7") || proxy.blocked("1.2.4.1") {
+		t.Error("offenses should be aggregated by /24")
+	}
+
+	if list := proxy.Blacklist(); len(list) != 1 || list[0].Addr != "1.2.3.0/24" || list[0].Hits != 3 {
+		t.Error("unexpected blacklist:", list)
+	}
+
+	proxy.offend("5.5.5.5")
+	proxy.offend("6.6.6.6")
+	if proxy.blocked("1.2.3.4") || len(proxy.Blacklist()) != 2 {
+		t.Error("the least recent offender should be forgotten")
+	}
+
+	proxy.BanDuration = time.Millisecond
+	for i := 0; i < 3; i++ {
+		proxy.offend("7.7.7.7")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if proxy.blocked("7.7.7.7") {
+		t.Error("the ban should have expired")
+	}
+	if _, ok := proxy.blacklist.Peek("7.7.7.7"); ok {
+		t.Error("expired offenders should be forgotten")
+	}
+
+	// concurrent offenses all count
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxy.offend("8.8.8.8")
+		}()
+	}
+	wg.Wait()
+	if list := proxy.Blacklist(); list[0].Addr != "8.8.8.0/24" || list[0].Hits != 50 {
+		t.Error("offenses should not be lost:", list)
+	}
+
+	proxy.BanPrefixV6 = 64
+	if k := proxy.offenderKey("2001:db8::1"); k != "2001:db8::/64" {
+		t.Error(k)
+	}
+}
+
+func TestBlockedUnlock(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := NewServer("8101", &ServerConfig{Cipher: c, BanThreshold: 1, BanDuration: time.Hour, BanPrefixV4: 24})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://www.example.com/", nil)
+		r.RemoteAddr = "1.2.3.4:1234"
+		proxy.ServeHTTP(w, r)
+		if w.Code != 404 {
+			t.Fatal("requests without the key should be decoyed:", w.Code)
+		}
+	}
+	if !proxy.blocked("1.2.3.5") {
+		t.Fatal("the offender's network should be blocked")
+	}
+
+	hits := func() int64 {
+		for _, e := range proxy.Blacklist() {
+			if e.Addr == "1.2.3.0/24" {
+				return e.Hits
+			}
+		}
+		return 0
+	}
+	before := hits()
+
+	// a header of another key would count as an offense if it were decrypted
+	other := &Cipher{}
+	other.Init("87654321")
+	wrong, _ := other.NewIV(doConnect, nil, "")
+	connect, _ := c.NewIV(doConnect, nil, "")
+	for _, h := range []string{wrong, connect} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://www.example.com/"+c.EncryptString("www.example.com:443"), nil)
+		r.RemoteAddr = "1.2.3.5:1234"
+		r.Header.Set(proxy.rkeyHeader, h)
+		proxy.ServeHTTP(w, r)
+		if w.Code != 404 {
+			t.Error("requests from blocked addresses should be decoyed:", w.Code)
+		}
+	}
+	if hits() != before {
+		t.Error("requests from blocked addresses should be rejected without decryption:", before, hits())
+	}
+
+	// shaped like the unlock token but not one
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	r.RemoteAddr = "1.2.3.5:1234"
+	r.Header.Set(proxy.rkeyHeader, connect)
+	proxy.ServeHTTP(w, r)
+	if w.Code != 404 || !proxy.blocked("1.2.3.5") {
+		t.Error("only the unlock token should get through:", w.Code)
+	}
+
+	// a client with the key behind the same prefix sends its unlock token
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "http://www.example.com/", nil)
+	r.RemoteAddr = "1.2.3.5:1234"
+	r.Header.Set(proxy.rkeyHeader, genTrustedToken("unlock", "", c))
+	proxy.ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Error("the unlock token should not be decoyed:", w.Code, w.Body.String())
+	}
+	if proxy.blocked("1.2.3.4") {
+		t.Error("the unlock should forget the offender")
+	}
+}
+
+// fakeRedis serves the commands of RedisState from a map, expiry is ignored
+func fakeRedis(t *testing.T, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	kv := map[string]string{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for authed := password == ""; ; {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					cmd := make([]string, n)
+					for i := range cmd {
+						r.ReadString('\n')
+						arg, _ := r.ReadString('\n')
+						cmd[i] = strings.TrimSuffix(arg, "\r\n")
+					}
+
+					mu.Lock()
+					reply := "+OK"
+					switch cmd[0] {
+					case "AUTH":
+						if authed = cmd[1] == password; !authed {
+							reply = "-WRONGPASS invalid password"
+						}
+					case "INCR":
+						v, _ := strconv.Atoi(kv[cmd[1]])
+						kv[cmd[1]] = strconv.Itoa(v + 1)
+						reply = ":" + kv[cmd[1]]
+					case "PEXPIRE", "DEL":
+						if cmd[0] == "DEL" {
+							delete(kv, cmd[1])
+						}
+						reply = ":1"
+					case "GET":
+						if v, ok := kv[cmd[1]]; ok {
+							reply = "$" + strconv.Itoa(len(v)) + "\r\n" + v
+						} else {
+							reply = "$-1"
+						}
+					case "SET":
+						if _, ok := kv[cmd[1]]; ok {
+							reply = "$-1"
+						} else {
+							kv[cmd[1]] = cmd[2]
+						}
+					}
+					if !authed && cmd[0] != "AUTH" {
+						reply = "-NOAUTH Authentication required"
+					}
+					mu.Unlock()
+					conn.Write([]byte(reply + "\r\n"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSharedState(t *testing.T) {
+	addr := fakeRedis(t, "secret")
+	if _, err := NewRedisState("http://" + addr); err == nil {
+		t.Error("only redis URLs should be accepted")
+	}
+
+	if state, _ := NewRedisState("redis://:wrong@" + addr); state.Ping() == nil {
+		t.Error("the wrong password should be rejected")
+	}
+
+	state, err := NewRedisState("redis://:secret@" + addr + "/0")
+	if err != nil || state.Ping() != nil {
+		t.Fatal(err)
+	}
+
+	a := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, BanThreshold: 2, IPConnRate: 2, State: state})
+	b := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, BanThreshold: 2, IPConnRate: 2, State: state})
+
+	for i := 0; i < 3; i++ {
+		a.offend("1.2.3.4")
+	}
+	if !b.blocked("1.2.3.4") || b.blocked("1.2.3.5") {
+		t.Error("offenses should be shared")
+	}
+	b.Unban("1.2.3.4")
+	if b.blocked("1.2.3.4") {
+		t.Error("unbanned offenders should be forgotten by the shared state")
+	}
+
+	iv := make([]byte, ivLen)
+	rand.Read(iv)
+	binary.BigEndian.PutUint32(iv[ivLen-4:], uint32(time.Now().Unix()))
+	if a.replayed(iv) || !b.replayed(iv) {
+		t.Error("IVs seen by a should be replayed on b")
+	}
+
+	for i := 0; i < 3; i++ {
+		sec := time.Now().Unix()
+		allowed := a.allowShared("5.5.5.5") && b.allowShared("5.5.5.5") && !a.allowShared("5.5.5.5")
+		if time.Now().Unix() == sec {
+			if !allowed {
+				t.Error("connection rates should be counted together")
+			}
+			break
+		}
+	}
+
+	// requests on a connection are not counted, nor is the connection counted locally too
+	c := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, IPConnRate: 1, State: state})
+	srv := httptest.NewUnstartedServer(c)
+	srv.Listener = c.limit(srv.Listener)
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil || resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatal("requests on one connection should be served:", resp, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	c.limiter.mu.Lock()
+	if len(c.limiter.ips) != 0 {
+		t.Error("connections should only be counted in the shared state")
+	}
+	c.limiter.mu.Unlock()
+}
+
+func TestRedisBackoff(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	state, _ := NewRedisState("redis://" + addr)
+	if err := state.Ping(); err == nil || err == errRedisDown {
+		t.Fatal("the first call should dial:", err)
+	}
+
+	start := time.Now()
+	if err := state.Ping(); err != errRedisDown || time.Since(start) > 100*time.Millisecond {
+		t.Error("calls should fail at once while backing off:", err)
+	}
+
+	state.Addr = fakeRedis(t, "")
+	state.mu.Lock()
+	state.retryAt = time.Time{}
+	state.mu.Unlock()
+
+	if err := state.Ping(); err != nil || state.backoff != 0 {
+		t.Error("the backoff should be reset after dialing Redis:", err, state.backoff)
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("CONNECT", "/", strings.NewReader("ping"))
+
+	c := newStreamConn(w, r)
+	buf := make([]byte, 4)
+	if n, _ := io.ReadFull(c, buf); n != 4 || string(buf) != "ping" {
+		t.Error("read from request body failed")
+	}
+
+	c.Write([]byte("pong"))
+	if !w.Flushed || w.Body.String() != "pong" {
+		t.Error("write should be flushed into the response")
+	}
+
+	c.Close()
+	if _, err := c.Write([]byte("pong")); err == nil {
+		t.Error("write after close should fail")
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// the upstream is reached by HTTP/2 through a frontend, which can't be hijacked
+	upstream := httptest.NewUnstartedServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.Transport = upstream.Client().Transport
+	var h2 int32
+	rp.ModifyResponse = func(resp *http.Response) error {
+		if resp.ProtoMajor == 2 {
+			atomic.AddInt32(&h2, 1)
+		}
+		return nil
+	}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).EnableFullDuplex()
+		rp.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+
+	addr := strings.TrimPrefix(frontend.URL, "http://")
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:   addr,
+		Transport:  plainTransport{},
+		Cipher:     c,
+		DNSCache:   lru.NewCache(16),
+		CACache:    lru.NewCache(16),
+		ACL:        acl,
+		StreamBody: true,
+	})
+
+	dial := func() (net.Conn, string, error) {
+		conn, err := net.Dial("tcp", addr)
+		return conn, addr, err
+	}
+	conn, rkeybuf, ioc, err := client.openTunnelVia(dial, echo.Addr().String(), 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	app, local := net.Pipe()
+	defer app.Close()
+	go c.IO.Bridge(local, conn, rkeybuf, ioc)
+
+	// each message is echoed before the next one is sent, the stream is full-duplex
+	for _, msg := range []string{"ping", "pong"} {
+		app.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		app.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(app, buf); err != nil || string(buf) != msg {
+			t.Fatal(string(buf), err)
+		}
+	}
+
+	if atomic.LoadInt32(&h2) != 1 {
+		t.Error("the upstream should be reached by HTTP/2")
+	}
+}
+
+func TestStreamSurvey(t *testing.T) {
+	s := &streamSurvey{}
+	s.Init()
+
+	timer := s.newTimer()
+	for _, gap := range []time.Duration{0, 2, 2, 8} {
+		time.Sleep(gap * time.Millisecond)
+		timer.Chunk()
+	}
+
+	buf := &bytes.Buffer{}
+	s.Expose(buf)
+	if !strings.Contains(buf.String(), "goflyway_stream_ttfb_seconds_count 1\n") ||
+		!strings.Contains(buf.String(), "goflyway_stream_jitter_seconds_count 2\n") ||
+		!strings.Contains(buf.String(), "goflyway_stream_jitter_seconds_bucket{le=\"+Inf\"} 2\n") {
+		t.Error("unexpected metrics:", buf.String())
+	}
+
+	if (&streamSurvey{}).newTimer() != nil {
+		t.Error("timer should be nil before the survey starts")
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	text := strings.Repeat("goflyway ", 1000)
+	resp := &http.Response{
+		StatusCode:    200,
+		ContentLength: int64(len(text)),
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Length": {strconv.Itoa(len(text))}},
+		Body:          ioutil.NopCloser(strings.NewReader(text)),
+	}
+
+	if !compressible(resp) {
+		t.Fatal("text/html should be compressible")
+	}
+
+	body := gzipResponse(resp)
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Length") != "" {
+		t.Error("headers are not fixed:", resp.Header)
+	}
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, _ := ioutil.ReadAll(gz); string(buf) != text {
+		t.Error("gzip round trip failed")
+	}
+	body.Close()
+
+	resp.Header = http.Header{"Content-Type": {"image/png"}}
+	if compressible(resp) {
+		t.Error("image/png should not be compressible")
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	test := func(spec, listen, target string) {
+		l, tg, err := ParseForward(spec)
+		if listen == "" && err == nil {
+			t.Error("should fail:", spec)
+		} else if listen != "" && (err != nil || l != listen || tg != target) {
+			t.Error("parse failed:", spec, l, tg, err)
+		}
+	}
+
+	test("8080:192.168.1.10:80", ":8080", "192.168.1.10:80")
+	test("127.0.0.1:8080:nas:80", "127.0.0.1:8080", "nas:80")
+	test("[::1]:8080:[fe80::1]:80", "[::1]:8080", "[fe80::1]:80")
+	test("192.168.1.10:80", "", "")
+	test("8080", "", "")
+}
+
+func TestCloseReason(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	server := &ProxyUpstream{ServerConfig: &ServerConfig{Cipher: c}}
+	client := &ProxyClient{ClientConfig: &ClientConfig{Cipher: c}}
+
+	c1, c2 := net.Pipe()
+	_, rkeybuf := c.NewIV(doConnect, nil, "")
+	go server.refuse(nil, c1, &c.Codec, rkeybuf, CloseDialRefused)
+
+	buf, _ := ioutil.ReadAll(c2)
+	if !bytes.HasPrefix(buf, []byte("HTTP/1.1 502 ")) {
+		t.Fatal(string(buf))
+	}
+
+	err := client.readCloseReason("example.com:80", buf, rkeybuf)
+	if ce, ok := err.(*CloseError); !ok || ce.Reason != CloseDialRefused {
+		t.Fatal(err)
+	}
+
+	if _, ok := client.readCloseReason("example.com:80", []byte("HTTP/1.1 403 Forbidden\r\n\r\n"), rkeybuf).(*CloseError); ok {
+		t.Fatal("reason without the header")
+	}
+}
+
+type plainTransport struct{}
+
+func (plainTransport) Dial(address string) (net.Conn, error)       { return net.Dial("tcp", address) }
+func (plainTransport) Listen(address string) (net.Listener, error) { return net.Listen("tcp", address) }
+
+func TestForwardKeepAlive(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+
+	var streams int64
+	upstream := httptest.NewUnstartedServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	upstream.Config.ConnState = func(conn net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt64(&streams, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", origin.URL, http.NoBody)
+		resp, _, err := client.encryptAndTransport(req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	if n := atomic.LoadInt64(&streams); n != 1 {
+		t.Error("requests should share one stream, got", n)
+	}
+}
+
+func TestForwardGzip(t *testing.T) {
+	text := strings.Repeat("goflyway ", 1000)
+	var leaked int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k := range r.Header {
+			if strings.HasSuffix(k, gzipSuffix) {
+				atomic.StoreInt32(&leaked, 1)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(text))
+	}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Transport: plainTransport{},
+		Policy:    Options(PolicyCompress),
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+
+	for _, accept := range []string{"gzip, deflate", ""} {
+		req, _ := http.NewRequest("GET", origin.URL, http.NoBody)
+		req.Header.Set("Accept-Encoding", accept)
+		resp, rkeybuf, err := client.encryptAndTransport(req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		c.IO.Copy(buf, resp.Body, rkeybuf, IOConfig{})
+		resp.Body.Close()
+
+		if accept == "" {
+			if resp.Header.Get("X-Content-Encoding") != "" || buf.String() != text {
+				t.Error("the response should not be gzipped if the browser doesn't accept it:", resp.Header)
+			}
+			continue
+		}
+
+		if resp.Header.Get("X-Content-Encoding") != "gzip" {
+			t.Fatal("the response should be gzipped:", resp.Header)
+		}
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain, _ := ioutil.ReadAll(gz); string(plain) != text {
+			t.Error("gzip round trip failed")
+		}
+	}
+
+	if atomic.LoadInt32(&leaked) == 1 {
+		t.Error("the header asking for gzip should not reach the origin")
+	}
+}
+
+func TestTrafficDumpForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("pong"))
+	}))
+	defer origin.Close()
+
+	dir, _ := ioutil.TempDir("", "dump")
+	defer os.RemoveAll(dir)
+
+	dump := func(c *Cipher, name string) string {
+		path := filepath.Join(dir, name)
+		d, err := NewTrafficDump(path, "127.0.0.1", 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.IO.Dump = d
+		return path
+	}
+
+	cs, cc := &Cipher{}, &Cipher{}
+	cs.Init("12345678")
+	cc.Init("12345678")
+	serverDump, clientDump := dump(cs, "server.jsonl"), dump(cc, "client.jsonl")
+	defer cs.IO.Dump.Close()
+	defer cc.IO.Dump.Close()
+
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: cs}))
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Transport: plainTransport{},
+		Cipher:    cc,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+	defer client.Listener.Close()
+
+	now := time.Now().UnixNano()
+	client.DNSCache.Add("127.0.0.1", &Rule{IP: "127.0.0.1", Ans: ruleProxy, OldAns: ruleProxy, Time: now, Used: now})
+
+	w := httptest.NewRecorder()
+	client.ServeHTTP(w, httptest.NewRequest("POST", origin.URL+"/x", strings.NewReader("ping")))
+	if w.Code != 200 || w.Body.String() != "pong" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// the data of each event, once the exchange is closed
+	read := func(path string) map[string]string {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			buf, _ := ioutil.ReadFile(path)
+			events := map[string]string{}
+			for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+				r := dumpRecord{}
+				json.Unmarshal([]byte(line), &r)
+				events[r.Event] += r.Host + string(r.Data)
+			}
+			if _, closed := events["close"]; closed {
+				return events
+			}
+		}
+		t.Fatal(path, "is not closed")
+		return nil
+	}
+
+	for _, c := range []struct {
+		path string
+		req  string
+		resp string
+	}{
+		{clientDump, "in", "out"},
+		{serverDump, "out", "in"},
+	} {
+		events := read(c.path)
+		if !strings.Contains(events["open"], "127.0.0.1") {
+			t.Error(c.path, "host:", events["open"])
+		}
+		if req := events[c.req]; !strings.HasPrefix(req, "POST /x HTTP/1.1") || !strings.HasSuffix(req, "ping") {
+			t.Error(c.path, "request:", req)
+		}
+		if resp := events[c.resp]; !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "pong") {
+			t.Error(c.path, "response:", resp)
+		}
+	}
+}
+
+func TestSocksReply(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err := net.Dial("tcp", addr)
+	if r := dialCloseReason(err); r != CloseDialRefused {
+		t.Error("refused dial:", r, err)
+	}
+
+	c1, c2 := net.Pipe()
+	go replyFailure(c1, okSOCKS, CloseDialTimeout)
+	if buf, _ := ioutil.ReadAll(c2); !bytes.Equal(buf, socksReply(CloseDialTimeout)) || buf[1] != 0x06 {
+		t.Error("SOCKS reply:", buf)
+	}
+
+	c1, c2 = net.Pipe()
+	go replyFailure(c1, okHTTP, CloseDialTimeout)
+	if buf, _ := ioutil.ReadAll(c2); len(buf) != 0 {
+		t.Error("HTTP downstream got:", buf)
+	}
+
+	if socksReply(closeReasonOf(errors.New("x")))[1] != 0x01 || socksReply(CloseReason(255))[1] != 0x01 {
+		t.Error("unknown reasons should be general failures")
+	}
+}
+
+func TestDNSPrefetch(t *testing.T) {
+	acl, _ := acr.LoadACL("nonexist")
+	proxy := &ProxyClient{ClientConfig: &ClientConfig{
+		DNSCache: lru.NewCache(16),
+		DNSTTL:   time.Minute,
+		ACL:      acl,
+		Policy:   PolicyGlobal, // don't ask the upstream
+	}}
+
+	now, ttl := time.Now().UnixNano(), int64(time.Minute)
+	proxy.DNSCache.Add("fresh", &Rule{Remote: true, Time: now, Used: now})
+	proxy.DNSCache.Add("expiring", &Rule{Remote: true, Time: now - ttl*95/100, Used: now})
+	proxy.DNSCache.Add("idle", &Rule{Remote: true, Time: now - ttl*95/100, Used: now - ttl*2})
+	proxy.DNSCache.Add("local", &Rule{Time: now - ttl*95/100, Used: now})
+	proxy.DNSCache.Add("changed", &Rule{Ans: rulePass, OldAns: ruleProxy, Remote: true, Time: now - ttl*95/100, Used: now})
+
+	if n := proxy.prefetchDNS(); n != 1 {
+		t.Error("prefetched:", n)
+	}
+
+	stale := &Rule{Time: now - ttl*2}
+	if !proxy.expired(stale) {
+		t.Error("rule should expire")
+	}
+
+	if stale.OldAns = rulePass; proxy.expired(stale) {
+		t.Error("rules changed by the user should never expire")
+	}
+
+	if proxy.DNSTTL = 0; proxy.expired(&Rule{}) {
+		t.Error("rules should be kept when DNSTTL is 0")
+	}
+}
+
+func TestRace(t *testing.T) {
+	path := os.TempDir() + "/goflyway_race_test"
+	defer os.Remove(path)
+
+	book, _ := LoadRouteBook(path)
+	book.learn("a.com", rulePass)
+	book.learn("b.com", ruleProxy)
+	if err := book.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if book, _ = LoadRouteBook(path); len(book.m) != 2 || book.m["a.com"].r != rulePass || book.m["b.com"].r != ruleProxy {
+		t.Fatal("route book:", book.m)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, _ := ln.Accept()
+		conn.Write([]byte("direct"))
+		conn.Close()
+	}()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := &ProxyClient{ClientConfig: &ClientConfig{Cipher: c, Race: time.Second, RouteBook: book}}
+
+	c1, c2 := net.Pipe()
+	go proxy.raceAndBridge(c1, ln.Addr().String(), okSOCKS, nil)
+
+	buf := make([]byte, len(okSOCKS)+6)
+	io.ReadFull(c2, buf)
+	c2.Close()
+	if string(buf) != string(okSOCKS)+"direct" {
+		t.Error("direct should win:", buf)
+	}
+
+	if r, _ := book.get("127.0.0.1"); r != rulePass {
+		t.Error("winner should be learned")
+	}
+}
+
+func TestRouteBook(t *testing.T) {
+	book, _ := LoadRouteBook("")
+	for i := 0; i < routeDirectFails; i++ {
+		if _, ok := book.get("a.com"); ok {
+			t.Fatal("learned too early:", i)
+		}
+		book.fail("a.com")
+	}
+
+	if r, ok := book.get("a.com"); !ok || r != ruleProxy {
+		t.Error("a.com should be proxied")
+	}
+
+	book.m["b.com"] = routeVerdict{r: rulePass, time: time.Now().Add(-routeMaxAge - time.Hour).Unix()}
+	if _, ok := book.get("b.com"); ok || len(book.m) != 1 {
+		t.Error("b.com should be forgotten")
+	}
+
+	// timeouts out of the window start over
+	stale := time.Now().Add(-routeFailWindow - time.Minute).Unix()
+	book.fails["c.com"] = routeFails{n: routeDirectFails - 1, since: stale}
+	if book.fail("c.com"); book.fails["c.com"].n != 1 {
+		t.Error("old timeouts should be forgotten:", book.fails["c.com"])
+	}
+
+	// hosts never visited again are pruned
+	book.fails["d.com"] = routeFails{n: 1, since: stale}
+	book.m["e.com"] = routeVerdict{r: rulePass, time: time.Now().Add(-routeMaxAge - time.Hour).Unix()}
+	book.prune(time.Now())
+	if _, ok := book.fails["d.com"]; ok || len(book.fails) != 1 {
+		t.Error("stale timeouts should be pruned:", book.fails)
+	}
+	if _, ok := book.m["e.com"]; ok || len(book.m) != 1 {
+		t.Error("old routes should be pruned:", book.m)
+	}
+
+	acl, _ := acr.LoadACL("nonexist")
+	proxy := &ProxyClient{ClientConfig: &ClientConfig{DNSCache: lru.NewCache(16), ACL: acl, RouteBook: book}}
+	proxy.DNSCache.Add("a.com", &Rule{Ans: rulePass, OldAns: rulePass, R: acr.RulePass})
+	if _, r, ext := proxy.route("a.com:80"); r != ruleProxy {
+		t.Error("learned route:", r, ext)
+	}
+
+	proxy.DNSCache.Add("a.com", &Rule{Ans: rulePass, OldAns: rulePass, R: acr.RuleMatchedPass})
+	if _, r, ext := proxy.route("a.com:80"); r != rulePass {
+		t.Error("explicit rules should be trusted:", r, ext)
+	}
+
+	// clients configured before the rename keep working
+	old, _ := LoadRaceBook("")
+	c := &Cipher{}
+	c.Init("12345678")
+	client := NewClient("127.0.0.1:0", &ClientConfig{Cipher: c, DNSCache: lru.NewCache(16), CACache: lru.NewCache(16), ACL: acl, RaceBook: old})
+	defer client.Listener.Close()
+	if client.RouteBook != old {
+		t.Error("RaceBook should be used as RouteBook")
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	proxy := &ProxyClient{
+		ClientConfig: &ClientConfig{Prewarm: 2, Cipher: &Cipher{}},
+		pool:         tcpmux.NewDialer(ln.Addr().String(), 0),
+	}
+
+	if proxy.takeWarm() != nil {
+		t.Fatal("nothing should be warm before starting")
+	}
+
+	proxy.startPrewarm()
+	for i := 0; i < 2; i++ {
+		ln.Accept()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if proxy.takeWarm() == nil || proxy.takeWarm() == nil {
+		t.Fatal("carriers should be warm")
+	}
+
+	// the workers redial, and close what they hold when the client is closed
+	held := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		conn, _ := ln.Accept()
+		held = append(held, conn)
+	}
+
+	proxy.Close()
+	for _, conn := range held {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Error("carriers held by the workers should be closed:", err)
+		}
+	}
+	if proxy.takeWarm() != nil {
+		t.Error("nothing should be warm after closing")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	primary := tcpmux.NewDialer(dead.Addr().String(), 0)
+	dials := 0
+	primary.OnDial = func(addr string) (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", addr)
+	}
+
+	proxy := &ProxyClient{
+		ClientConfig: &ClientConfig{Upstream: dead.Addr().String(), AltUpstreams: []string{ln.Addr().String()}},
+		pool:         primary,
+		altPools:     []*tcpmux.DialPool{tcpmux.NewDialer(ln.Addr().String(), 0)},
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := proxy.dialPools(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if dials != 1 || proxy.active != 1 {
+		t.Error("the alternate should be used directly after failover:", dials, proxy.active)
+	}
+
+	proxy.failedAt -= int64(failoverProbe)
+	proxy.dialPools()
+	if dials != 2 || proxy.active != 1 {
+		t.Error("the primary should be probed again:", dials, proxy.active)
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	n, err := ParseNAT64("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip := n.synthesize(net.ParseIP("192.0.2.33")); ip.String() != "64:ff9b::c000:221" {
+		t.Error("synthesized:", ip)
+	}
+
+	if ip := n.synthesize(net.ParseIP("2001:db8::1")); ip.String() != "2001:db8::1" {
+		t.Error("IPv6 should be kept:", ip)
+	}
+
+	if a := n.UDPAddr(&net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}); a.String() != "[64:ff9b::808:808]:53" {
+		t.Error("UDP:", a)
+	}
+
+	if _, err := ParseNAT64("64:ff9b::/64"); err == nil {
+		t.Error("only /96 is supported")
+	}
+
+	var disabled *NAT64
+	if a := disabled.UDPAddr(&net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}); a.String() != "8.8.8.8:53" {
+		t.Error("nil NAT64 should change nothing:", a)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	ln, err := listenReusePort("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ln2, err := listenReusePort("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("the second listener should share the port:", err)
+	}
+
+	ln.Close()
+	ln2.Close()
+}
+
+func TestListenAddrs(t *testing.T) {
+	addrs := bindAddrs("8100, [::]:8100,0.0.0.0:8200,[::]:8300,127.0.0.1:8100")
+	expect := []bindAddr{{"tcp4", ":8100"}, {"tcp6", "[::]:8100"}, {"tcp", "0.0.0.0:8200"}, {"tcp", "[::]:8300"}, {"tcp", "127.0.0.1:8100"}}
+	if len(addrs) != len(expect) {
+		t.Fatal(addrs)
+	}
+	for i := range addrs {
+		if addrs[i] != expect[i] {
+			t.Error(i, addrs[i])
+		}
+	}
+
+	if familyNetwork("tcp", "[::1]:80") != "tcp6" || familyNetwork("udp", "1.2.3.4:53") != "udp4" ||
+		familyNetwork("tcp", "example.com:80") != "tcp" || familyNetwork("tcp4", "[::1]:80") != "tcp4" {
+		t.Error("networks of destinations")
+	}
+
+	free := func(network, addr string) string {
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			t.Skip(err)
+		}
+		defer ln.Close()
+		return ln.Addr().String()
+	}
+	v4, v6 := free("tcp4", "127.0.0.1:0"), free("tcp6", "[::1]:0")
+
+	c := &Cipher{}
+	c.Init("12345678")
+	upstream := NewServer(v4+","+v6, &ServerConfig{Cipher: c})
+	go upstream.Start()
+
+	for _, addr := range []string{v4, v6} {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 9)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "HTTP/1.1 " {
+			t.Error(addr, "should be served, got:", string(buf), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestIPLimit(t *testing.T) {
+	proxy := &ProxyUpstream{ServerConfig: &ServerConfig{IPConnRate: 2, IPMaxBridges: 1}}
+	if !proxy.allowConn("1.2.3.4") || !proxy.allowConn("1.2.3.4") || proxy.allowConn("1.2.3.4") {
+		t.Error("the third connection within a second should be refused")
+	}
+	if !proxy.allowConn("5.6.7.8") {
+		t.Error("other IPs should have their own rate")
+	}
+
+	if !proxy.acquireBridge("1.2.3.4") || proxy.acquireBridge("1.2.3.4") {
+		t.Error("the second bridge should be refused")
+	}
+	proxy.releaseBridge("1.2.3.4")
+	if !proxy.acquireBridge("1.2.3.4") {
+		t.Error("the bridge should be acquired after the release")
+	}
+
+	if proxy.ipRateHits != 1 || proxy.ipCapHits != 1 {
+		t.Error("hits:", proxy.ipRateHits, proxy.ipCapHits)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	upstream := NewServer(addr, &ServerConfig{Cipher: c, IPConnRate: 1})
+	go upstream.Start()
+
+	served := func() bool {
+		conn, err := net.Dial("tcp", addr)
+		for i := 0; i < 50 && err != nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			conn, err = net.Dial("tcp", addr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 9)
+		_, err = io.ReadFull(conn, buf)
+		return err == nil && string(buf) == "HTTP/1.1 "
+	}
+
+	if !served() {
+		t.Error("the first connection should be served")
+	}
+	if served() {
+		t.Error("the second connection within a second should be closed")
+	}
+
+	// the SOCKS inbound is limited too
+	socks := NewServer(addr, &ServerConfig{Cipher: c, IPConnRate: 1, SOCKS: "127.0.0.1:0",
+		Users: map[string]UserConfig{"u": {Auth: "u:p"}}})
+	ln, _ = net.Listen("tcp", "127.0.0.1:0")
+	socks.SOCKS = ln.Addr().String()
+	ln.Close()
+	go socks.StartSOCKS()
+
+	greeted := func() bool {
+		conn, err := net.Dial("tcp", socks.SOCKS)
+		for i := 0; i < 50 && err != nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			conn, err = net.Dial("tcp", socks.SOCKS)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte{5, 1, 2})
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		return err == nil && buf[1] == 2
+	}
+
+	if !greeted() {
+		t.Error("the first SOCKS connection should be greeted")
+	}
+	if greeted() {
+		t.Error("the second SOCKS connection within a second should be closed")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	var wd *Watchdog
+	if wd.Shedding() {
+		t.Fatal("nil watchdog should never shed")
+	}
+
+	dir, _ := ioutil.TempDir("", "goflyway_watchdog")
+	defer os.RemoveAll(dir)
+
+	wd = &Watchdog{MaxGoroutines: 1, ProfileDir: dir}
+	if wd.check(); !wd.Shedding() {
+		t.Fatal("should shed")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Error("profiles:", len(files))
+	}
+
+	wd.MaxGoroutines = 1 << 20
+	if wd.check(); wd.Shedding() {
+		t.Error("should stop shedding")
+	}
+
+	buf := &bytes.Buffer{}
+	wd.Expose(buf)
+	if !strings.Contains(buf.String(), "\ngoflyway_goroutines ") || !strings.Contains(buf.String(), "\ngoflyway_shedding 0\n") {
+		t.Error(buf.String())
+	}
+}
+
+func TestBridgeLeak(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		c.IO.Bridge(a1, b1, nil, IOConfig{})
+		done <- true
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if list := c.IO.OpenBridges(); len(list) != 1 || list[0].HalfClosed != 0 {
+		t.Fatal("open bridges:", list)
+	}
+
+	// one end is gone, the other direction keeps the bridge open
+	b2.Close()
+	time.Sleep(50 * time.Millisecond)
+	if list := c.IO.OpenBridges(); len(list) != 1 || list[0].HalfClosed == 0 {
+		t.Fatal("half closed bridge:", list)
+	}
+
+	a2.Close()
+	<-done
+	if list := c.IO.OpenBridges(); len(list) != 0 {
+		t.Error("leaked bridges:", list)
+	}
+}
+
+func TestStreamID(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	rkey, rkeybuf := c.NewIV(doConnect, nil, "")
+	_, rkeybuf2, _ := c.ReverseIV(rkey)
+	if id := streamID(rkeybuf); len(id) != 8 || id != streamID(rkeybuf2) {
+		t.Error("both sides should derive the same ID:", id, streamID(rkeybuf2))
+	}
+
+	_, other := c.NewIV(doConnect, nil, "")
+	if streamID(rkeybuf) == streamID(other) {
+		t.Error("IDs of different streams should differ")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	token := func(offset time.Duration) []byte {
+		buf := make([]byte, ivLen)
+		copy(buf, "unlock")
+		binary.BigEndian.PutUint32(buf[12:], uint32(time.Now().Add(offset).Unix()))
+		return buf
+	}
+
+	for _, c := range []struct {
+		offset time.Duration
+		want   int
+	}{
+		{0, 1},
+		{-20 * time.Second, 1},
+		{20 * time.Second, 1},
+		{-time.Minute, -1},
+		{time.Minute, -1},
+	} {
+		if r := isTrustedToken("unlock", token(c.offset), 30*time.Second); r != c.want {
+			t.Error("token off by", c.offset, "got", r, "want", c.want)
+		}
+	}
+
+	var m skewMeter
+	if _, ok := m.ClockSkew(); ok {
+		t.Error("no samples yet")
+	}
+
+	m.observe("garbage", "peer", 0)
+	m.observe(time.Now().Add(time.Minute).UTC().Format(time.RFC1123), "peer", 0)
+	if skew, ok := m.ClockSkew(); !ok || skew < 59*time.Second || skew > 61*time.Second {
+		t.Error("skew should be about 1 min:", skew)
+	}
+
+	if v := headerValue([]byte("HTTP/1.1 200 OK\r\ndate: "+httpDate()+"\r\n\r\n"), "Date"); v == "" {
+		t.Error("Date header not found")
+	}
+}
+
+func TestPacing(t *testing.T) {
+	var pc *pacer
+	pc.Wait(1 << 20) // nil pacers never block
+
+	var survey trafficSurvey
+	pc = NewPacing(1024 * 1024).newPacer(&survey)
+
+	start := time.Now()
+	pc.Wait(pacingBulkSize)
+	pc.Wait(100 * 1024) // a burst of BDP at the default RTT
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatal("short streams and the first burst should not be paced:", d)
+	}
+
+	pc.Wait(200 * 1024)
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Error("bulk streams should be paced:", d)
+	}
+}
+
+func TestDNSLane(t *testing.T) {
+	var l *DNSLane
+	if l.enter("a") {
+		t.Error("nil lanes prioritize nothing")
+	}
+	l.yield("a")
+
+	l = NewDNSLane(2)
+	start := time.Now()
+	l.yield("a")
+	if !l.enter("a") || !l.enter("a") || l.enter("a") {
+		t.Fatal("lookups beyond the rate should not be prioritized")
+	}
+
+	l.leave("a")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.leave("a")
+	}()
+	l.yield("a")
+	if d := time.Since(start); d < 15*time.Millisecond || d > dnsLaneHold {
+		t.Error("bulk writes should hold until lookups are done:", d)
+	}
+
+	l = NewDNSLane(1)
+	l.enter("a")
+	start = time.Now()
+	l.yield("b")
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Error("bulk writes of other carriers should not hold:", d)
+	}
+
+	start = time.Now()
+	l.yield("a")
+	if d := time.Since(start); d < dnsLaneHold || d > 2*dnsLaneHold {
+		t.Error("bulk writes should hold for dnsLaneHold at most:", d)
+	}
+}
+
+func TestDNSLaneOvertake(t *testing.T) {
+	// two carriers, each written by a bulk stream in chunks taking 1ms to go out
+	var mu sync.Mutex
+	var writes []string
+	write := func(what string) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		writes = append(writes, what)
+		mu.Unlock()
+	}
+
+	l := NewDNSLane(10)
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for _, carrier := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(carrier string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l.yield(carrier)
+				write(carrier)
+			}
+		}(carrier)
+	}
+
+	// an answer on carrier a taking 20ms to be written
+	time.Sleep(10 * time.Millisecond)
+	l.enter("a")
+	mu.Lock()
+	from := len(writes)
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	write("dns")
+	l.leave("a")
+
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	var a, b int
+	for _, w := range writes[from:] {
+		if w == "dns" {
+			break
+		}
+		if w == "a" {
+			a++
+		} else {
+			b++
+		}
+	}
+
+	// the chunk of a being written when the lookup began may still go before the answer
+	if a > 1 || b < 5 {
+		t.Error("the answer should overtake bulk writes of its carrier only, chunks before it:", a, b)
+	}
+}
+
+func TestRewriteDNS(t *testing.T) {
+	// response to "git.corp A?" with a public answer
+	query := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0, 3, 'g', 'i', 't', 4, 'c', 'o', 'r', 'p', 0, 0, 1, 0, 1}
+	resp := append(dup(query), 0xc0, 12, 0, 1, 0, 1, 0, 0, 1, 0, 0, 4, 1, 2, 3, 4)
+	h := Hosts{"git.corp": "10.0.0.7"}
+
+	buf := h.rewriteDNS(resp)
+	if !bytes.Equal(buf[:2], query[:2]) || buf[7] != 1 || !bytes.Equal(buf[len(buf)-4:], []byte{10, 0, 0, 7}) {
+		t.Error("answer not rewritten:", buf)
+	}
+
+	aaaa := dup(resp)
+	aaaa[len(query)-3] = dnsTypeAAAA
+	if buf := h.rewriteDNS(aaaa); buf[7] != 0 || len(buf) != len(query) {
+		t.Error("AAAA queries of IPv4 entries should get an empty answer:", buf)
+	}
+
+	if buf := (Hosts{"other.corp": "10.0.0.7"}).rewriteDNS(resp); !bytes.Equal(buf, resp) {
+		t.Error("unmapped names should not be rewritten")
+	}
+
+	if buf := h.rewriteDNS(resp[:15]); !bytes.Equal(buf, resp[:15]) {
+		t.Error("malformed responses should not be rewritten")
+	}
+}
+
+func TestTrafficClasses(t *testing.T) {
+	f, _ := ioutil.TempFile("", "classes")
+	defer os.Remove(f.Name())
+	f.WriteString(`[video]
+hosts=*.googlevideo.com,(^|\.)twitch\.tv$
+throttle=64
+priority=1
+
+[rtmp]
+ports=1935
+pace=16
+
+[bulk]
+hosts=dl.example.com
+ports=80,443
+`)
+	f.Close()
+
+	tc, err := LoadTrafficClasses(f.Name())
+	if err != nil || len(tc) != 3 || tc[0].Name != "video" {
+		t.Fatal(tc, err)
+	}
+
+	for host, want := range map[string]string{
+		"r1.googlevideo.com:443": "video",
+		"live.twitch.tv:1935":    "video", // higher priority than rtmp
+		"example.org:1935":       "rtmp",
+		"dl.example.com:443":     "bulk",
+		"dl.example.com:8080":    "",
+		"www.example.com:443":    "",
+	} {
+		name := ""
+		if c := tc.classify(host); c != nil {
+			name = c.Name
+		}
+		if name != want {
+			t.Error(host, "is in class", name, "want", want)
+		}
+	}
+
+	ioc := IOConfig{Bucket: NewTokenBucket(1<<20, 1<<20)}
+	tc.classify("r1.googlevideo.com:443").apply(&ioc)
+	if ioc.Bucket.Speed != 64*1024 {
+		t.Error("class throttle should replace a looser one")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("shop"))
+	}))
+	defer backend.Close()
+
+	dir, _ := ioutil.TempDir("", "goflyway_tenants")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/index.html", []byte("blog"), 0644)
+
+	f, _ := ioutil.TempFile("", "tenants")
+	defer os.Remove(f.Name())
+	f.WriteString(`[shop]
+hosts=shop.example.com
+proxypass=` + backend.URL + `
+log=` + dir + `/shop.log
+token=shop-token
+
+[blog]
+hosts=*.blog.example.com
+proxypass=` + dir + `
+throttle=64
+quota=1
+token=blog-token
+`)
+	f.Close()
+
+	tenants, err := LoadTenants(f.Name())
+	if err != nil || len(tenants) != 2 || tenants[0].Name != "blog" || tenants[1].Throttle != 0 {
+		t.Fatal(tenants, err)
+	}
+	if tenants[0].Quota != 1<<20 || tenants[1].Quota != 0 {
+		t.Fatal("unexpected quotas:", tenants[0].Quota, tenants[1].Quota)
+	}
+	tenants[0].Quota = 6
+
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, Tenants: tenants})
+	for host, want := range map[string]string{
+		"shop.example.com":      "shop",
+		"SHOP.example.com:8080": "shop",
+		"www.blog.example.com":  "blog",
+		"www.example.com":       "404 Not Found",
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		proxy.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), want) {
+			t.Error(host, "is served", w.Body.String(), "want", want)
+		}
+	}
+
+	if s, err := proxy.TenantStat("shop-token"); err != nil || s.Name != "shop" || s.Requests != 2 || s.Bytes != 8 {
+		t.Error(s, err)
+	}
+
+	if _, err := proxy.TenantStat("shop"); err == nil {
+		t.Error("a wrong token should be rejected")
+	}
+
+	if buf, _ := ioutil.ReadFile(dir + "/shop.log"); strings.Count(string(buf), "\n") != 2 || strings.Contains(string(buf), "blog") {
+		t.Error("unexpected access log:", string(buf))
+	}
+
+	// the blog has served 4 of its 6 bytes, the next response goes over the quota and later ones are refused
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://www.blog.example.com/", nil))
+		if w.Code != want {
+			t.Error("blog should be served", want, "got", w.Code)
+		}
+	}
+
+	if s, _ := proxy.TenantStat("blog-token"); s.Requests != 3 || s.Bytes != 8 || s.Quota != 6 {
+		t.Error("unexpected blog stats:", s)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://shop.example.com/", nil))
+	if w.Body.String() != "shop" {
+		t.Error("other tenants should not be refused:", w.Code, w.Body.String())
+	}
+
+	f, _ = os.Create(f.Name())
+	f.WriteString("[a]\nhosts=a.com\nproxypass=/tmp\ntoken=x\n[b]\nhosts=b.com\nproxypass=/tmp\ntoken=x\n")
+	f.Close()
+	if _, err := LoadTenants(f.Name()); err == nil {
+		t.Error("tenants sharing a token should be rejected")
+	}
+}
+
+func TestHotOrigins(t *testing.T) {
+	heads := make(chan bool, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			heads <- true
+		}
+	}))
+	defer origin.Close()
+
+	h, err := newHotOrigins([]string{"127.0.0.1", "*.example.com"}, &http.Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for u, hot := range map[string]bool{
+		origin.URL:                  true,
+		"https://api.example.com/v": true,
+		"https://example.com/":      false,
+		"http://localhost/":         false,
+	} {
+		pu, _ := url.Parse(u)
+		if (h.transport(pu) != nil) != hot {
+			t.Error(u, "should be hot:", hot)
+		}
+	}
+
+	h.mu.Lock()
+	delete(h.used, "https://api.example.com")
+	h.mu.Unlock()
+
+	h.warm()
+	select {
+	case <-heads:
+	case <-time.After(time.Second):
+		t.Error("recently used origins should be warmed")
+	}
+}
+
+func TestSoftFail(t *testing.T) {
+	deny, _ := acr.NewHostMatcher([]string{"*.corp.example.com", "10.0.0.0/8"})
+	proxy := &ProxyClient{ClientConfig: &ClientConfig{SoftFail: true, SoftFailDeny: deny}}
+	unreachable := unreachableError{errors.New("connection refused")}
+
+	for host, direct := range map[string]bool{
+		"example.com:443":          true,
+		"git.corp.example.com:443": false,
+		"10.1.2.3:22":              false,
+		"[::1]:80":                 true,
+	} {
+		if proxy.softFail(host, unreachable) != direct {
+			t.Error(host, "should connect directly:", direct)
+		}
+	}
+
+	if proxy.softFail("example.com:443", &CloseError{Reason: CloseDialRefused}) {
+		t.Error("streams refused by the upstream should not connect directly")
+	}
+
+	proxy.SoftFail = false
+	if proxy.softFail("example.com:443", unreachable) {
+		t.Error("soft fail is disabled")
+	}
+}
+
+func TestSoftFailPaths(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer origin.Close()
+	host := origin.Listener.Addr().String()
+
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	acl, _ := acr.LoadACL("nonexist")
+
+	// requests are forwarded by an HTTP upstream, or by streams dialed by the transport
+	for _, tr := range []Transport{nil, plainTransport{}} {
+		client := NewClient("127.0.0.1:0", &ClientConfig{
+			Upstream:  dead.Addr().String(),
+			Transport: tr,
+			SoftFail:  true,
+			Cipher:    c,
+			DNSCache:  lru.NewCache(16),
+			CACache:   lru.NewCache(16),
+			ACL:       acl,
+		})
+		defer client.Listener.Close()
+
+		// the origin is proxied rather than connected directly
+		now := time.Now().UnixNano()
+		client.DNSCache.Add("127.0.0.1", &Rule{IP: "127.0.0.1", Ans: ruleProxy, OldAns: ruleProxy, Time: now, Used: now})
+
+		forward := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			client.ServeHTTP(w, httptest.NewRequest("GET", origin.URL+"/", nil))
+			return w
+		}
+
+		if w := forward(); w.Code != 200 || w.Body.String() != "direct" {
+			t.Error(tr, "forwarded requests should soft fail:", w.Code, w.Body.String())
+		}
+
+		c1, c2 := net.Pipe()
+		go client.dialUpstreamAndBridge(c2, host, okHTTP, 0, nil)
+		r := bufio.NewReader(c1)
+		if head, err := readUntil(r, "\r\n\r\n"); err != nil || !bytes.Equal(head, okHTTP) {
+			t.Fatal(tr, "tunnels should soft fail:", string(head), err)
+		}
+
+		go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\n\r\n"))
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(tr, err)
+		}
+		if buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 6)); string(buf) != "direct" {
+			t.Error(tr, "the tunnel should be bridged directly:", string(buf))
+		}
+		c1.Close()
+
+		client.SoftFail = false
+		if w := forward(); w.Code != http.StatusInternalServerError {
+			t.Error(tr, "soft fail is disabled:", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	f, _ := ioutil.TempFile("", "users")
+	defer os.Remove(f.Name())
+	f.WriteString(`# username:password [throttling [throttling max]]
+alice:secret
+bob:p:ss 2048
+carol:123 4096 8192
+`)
+	f.Close()
+
+	users, err := LoadUsers(f.Name())
+	if err != nil || len(users) != 3 || users["bob"].Auth != "bob:p:ss" || users["carol"].ThrottlingMax != 8192 {
+		t.Fatal(users, err)
+	}
+
+	proxy := NewServer("8101", &ServerConfig{
+		Throttling:      1024,
+		ThrottlingMax:   1024,
+		ThrottlingScope: ThrottlingPerUser,
+		Users:           users,
+		Cipher:          &Cipher{},
+	})
+
+	for auth, want := range map[string]string{
+		"alice:secret": "alice",
+		"alice:wrong":  "",
+		"alice":        "",
+		"bob:p:ss":     "bob",
+		"dave:secret":  "",
+		"":             "",
+	} {
+		if user, ok := proxy.auth(auth); user != want || ok != (want != "") {
+			t.Error(auth, "should be authed as", want, "got", user)
+		}
+	}
+
+	a, b, c := proxy.getIOConfig("alice").Bucket, proxy.getIOConfig("bob").Bucket, proxy.getIOConfig("carol").Bucket
+	if a == b || b == c || a.Speed != 1024 || b.Speed != 2048 || c.Speed != 4096 {
+		t.Error("users should be throttled independently by their own limits")
+	}
+
+	for _, bad := range []string{"alice", "alice:secret 1k", "alice:secret 1 2 3"} {
+		ioutil.WriteFile(f.Name(), []byte(bad), 0644)
+		if _, err := LoadUsers(f.Name()); err == nil {
+			t.Error(bad, "should be rejected")
+		}
+	}
+}
+
+func TestUserSources(t *testing.T) {
+	f, _ := ioutil.TempFile("", "users")
+	defer os.Remove(f.Name())
+	f.WriteString("alice:secret 2048 from=10.0.0.0/8,192.168.1.1,2001:db8::/32\nbob:secret\n")
+	f.Close()
+
+	users, err := LoadUsers(f.Name())
+	if err != nil || users["alice"].Throttling != 2048 || len(users["alice"].Sources) != 3 {
+		t.Fatal(users, err)
+	}
+
+	for addr, ok := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"bad":         false,
+	} {
+		if users["alice"].allows(addr) != ok || !users["bob"].allows(addr) {
+			t.Error(addr, "should be allowed:", ok)
+		}
+	}
+
+	if _, err := ParseSources("10.0.0.0/33"); err == nil {
+		t.Error("invalid CIDR should be rejected")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	posted := make(chan AuditEvent, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := AuditEvent{}
+		json.NewDecoder(r.Body).Decode(&ev)
+		posted <- ev
+	}))
+	defer hook.Close()
+
+	if _, err := NewAudit("", "ftp://example.com"); err == nil {
+		t.Error("webhooks should be http or https URLs")
+	}
+
+	f, _ := ioutil.TempFile("", "audit")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	audit, err := NewAudit(f.Name(), hook.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	sources, _ := ParseSources("10.0.0.0/8")
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := NewServer("8101", &ServerConfig{
+		Cipher: c,
+		Users:  map[string]UserConfig{"alice": {Auth: "alice:secret", Sources: sources}},
+		Audit:  audit,
+	})
+
+	if !proxy.allows("alice", "10.1.2.3") || proxy.allows("alice", "192.168.1.2") {
+		t.Fatal("alice is pinned to 10.0.0.0/8")
+	}
+
+	select {
+	case ev := <-posted:
+		if ev.Event != "source-denied" || ev.User != "alice" || ev.Addr != "192.168.1.2" {
+			t.Error("unexpected event:", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the violation should be posted to the webhook")
+	}
+
+	buf, _ := ioutil.ReadFile(f.Name())
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	ev := AuditEvent{}
+	if json.Unmarshal([]byte(lines[0]), &ev); len(lines) != 1 || ev.User != "alice" || ev.Addr != "192.168.1.2" {
+		t.Error("the violation should be appended to the file:", string(buf))
+	}
+
+	// a nil audit does nothing
+	(*Audit)(nil).record("source-denied", "alice", "192.168.1.2")
+}
+
+func TestInboundSOCKS(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := NewServer("8101", &ServerConfig{
+		Users:  map[string]UserConfig{"u": {Auth: "u:p"}},
+		Cipher: c,
+	})
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	connect := []byte{socksVersion5, 1, 0, 1, 127, 0, 0, 1, byte(p >> 8), byte(p)}
+
+	for auth, ok := range map[string]bool{"u:p": true, "u:x": false} {
+		c1, c2 := net.Pipe()
+		go proxy.handleSocks(c1)
+
+		up := strings.SplitN(auth, ":", 2)
+		buf := make([]byte, 2)
+		c2.Write([]byte{socksVersion5, 1, 0x02})
+		io.ReadFull(c2, buf)
+		c2.Write(append(append(append([]byte{1, byte(len(up[0]))}, up[0]...), byte(len(up[1]))), up[1]...))
+		io.ReadFull(c2, buf)
+		if (buf[1] == 0) != ok {
+			t.Error(auth, "should be authed:", ok)
+		}
+
+		if ok {
+			c2.Write(connect)
+			buf = make([]byte, len(okSOCKS)+5)
+			io.ReadFull(c2, buf)
+			if string(buf) != string(okSOCKS)+"hello" {
+				t.Error("unexpected reply:", buf)
+			}
+		}
+		c2.Close()
+	}
+
+	// without users it must not be an open proxy off loopback
+	proxy.Users = nil
+	c1, c2 := net.Pipe()
+	go proxy.handleSocks(c1)
+	c2.Write([]byte{socksVersion5, 1, 0})
+	if n, _ := c2.Read(make([]byte, 2)); n != 0 {
+		t.Error("a conn off loopback should be closed once the users are gone")
+	}
+
+	for addr, want := range map[string]error{":0": errOpenSOCKS, "0.0.0.0:0": errOpenSOCKS, "127.0.0.1:99999": nil} {
+		proxy.SOCKS = addr
+		if err := proxy.StartSOCKS(); (err == errOpenSOCKS) != (want == errOpenSOCKS) {
+			t.Error(addr, "should be refused:", want, err)
+		}
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := NewServer("8101", &ServerConfig{Cipher: c, RemoteForward: true})
+	key := make([]byte, ivLen)
+
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := free.Addr().String()
+	free.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	closed := func() bool {
+		for i := 0; i < 50; i++ {
+			proxy.reverseMu.Lock()
+			pool := proxy.reverse[reverseKey{name: addr + "/target:80"}]
+			proxy.reverseMu.Unlock()
+			if pool == nil {
+				_, err := net.Dial("tcp", addr)
+				return err != nil
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	srv, cli := net.Pipe()
+	proxy.parkReverse(srv, "", "0.0.0.0:"+port+"/target:80", &proxy.Cipher.Codec, key, false)
+	if _, err := cli.Read(make([]byte, 1)); err == nil || len(proxy.reverse) > 0 {
+		t.Error("listening on all interfaces should be refused")
+	}
+
+	proxy.RemoteBinds = []string{"0.0.0.0:" + port}
+	if !proxy.allowBind("0.0.0.0:"+port) || proxy.allowBind("0.0.0.0:1") || !proxy.allowBind("[::1]:1") {
+		t.Error("only loopback and listed addresses should be allowed")
+	}
+
+	// the client leaves without using the tunnel
+	srv, cli = net.Pipe()
+	proxy.parkReverse(srv, "", addr+"/target:80", &proxy.Cipher.Codec, key, false)
+	cli.Close()
+	if !closed() {
+		t.Error("the listener should be closed with the last tunnel")
+	}
+
+	srv, cli = net.Pipe()
+	proxy.parkReverse(srv, "", addr+"/target:80", &proxy.Cipher.Codec, key, false)
+	go func() {
+		buf, _ := readUntil(cli, "\n")
+		if target := c.DecryptDecompress(strings.TrimSpace(string(buf)), key...); target != "target:80" {
+			t.Error("unexpected target:", target)
+		}
+		io.CopyN(cli, cli, 4)
+		cli.Close()
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatal(string(buf), err)
+	}
+
+	conn.Close()
+	if !closed() {
+		t.Error("the listener should be closed when the bridged tunnel ends")
+	}
+}
+
+func TestReverseSOCKS(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	proxy := NewServer("8101", &ServerConfig{Cipher: c, ReverseSOCKS: "127.0.0.1:0"})
+	if err := proxy.StartReverseSOCKS(); err == nil {
+		t.Error("the reverse SOCKS should need users")
+	}
+
+	proxy = NewServer("8101", &ServerConfig{
+		Cipher:       c,
+		ReverseSOCKS: "127.0.0.1:0",
+		Users:        map[string]UserConfig{"alice": {Auth: "alice:pw"}, "bob": {Auth: "bob:pw"}},
+	})
+
+	// alice's client parks a tunnel and echoes
+	key := make([]byte, ivLen)
+	srv, cli := net.Pipe()
+	proxy.parkReverse(srv, "alice", "", &proxy.Cipher.Codec, key, false)
+	go func() {
+		buf, _ := readUntil(cli, "\n")
+		if target := c.DecryptDecompress(strings.TrimSpace(string(buf)), key...); target != "127.0.0.1:80" {
+			t.Error("unexpected target:", target)
+		}
+		io.CopyN(cli, cli, 4)
+		cli.Close()
+	}()
+
+	connect := []byte{socksVersion5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+	for _, auth := range []string{"", "alice:wrong", "bob:pw", "alice:pw"} {
+		c1, c2 := net.Pipe()
+		go proxy.handleReverseSocks(c1)
+		c2.SetDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, 2)
+		if auth == "" {
+			c2.Write([]byte{socksVersion5, 1, 0})
+			if io.ReadFull(c2, buf); buf[1] != 0xff {
+				t.Error("clients without credentials should be refused")
+			}
+			c2.Close()
+			continue
+		}
+
+		up := strings.SplitN(auth, ":", 2)
+		c2.Write([]byte{socksVersion5, 1, 0x02})
+		io.ReadFull(c2, buf)
+		c2.Write(append(append(append([]byte{1, byte(len(up[0]))}, up[0]...), byte(len(up[1]))), up[1]...))
+		io.ReadFull(c2, buf)
+		if (buf[1] == 0) != (auth != "alice:wrong") {
+			t.Error(auth, "is authed wrongly")
+		}
+		if buf[1] != 0 {
+			c2.Close()
+			continue
+		}
+
+		c2.Write(connect)
+		reply := make([]byte, len(okSOCKS))
+		io.ReadFull(c2, reply)
+		if auth == "bob:pw" {
+			if reply[1] == 0 {
+				t.Error("bob should not exit through alice's client")
+			}
+			c2.Close()
+			continue
+		}
+
+		c2.Write([]byte("ping"))
+		echo := make([]byte, 4)
+		if _, err := io.ReadFull(c2, echo); err != nil || reply[1] != 0 || string(echo) != "ping" {
+			t.Error(reply, string(echo), err)
+		}
+		c2.Close()
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	f, _ := ioutil.TempFile("", "goflyway.conf")
+	defer os.Remove(f.Name())
+	f.WriteString(`[default]
+password = "secret"
+listen = "127.0.0.1:8100"
+upstream = "example.com:8100"
+auth = "u:p"
+global = true
+
+[misc]
+throt = 1024
+throtscope = per-user
+hotorigins = api.example.com,*.example.org
+mux = 4
+`)
+	f.Close()
+
+	addr, sc, err := LoadServerConfig(f.Name(), nil)
+	if err != nil || addr != "127.0.0.1:8100" || sc.Throttling != 1024 || sc.ThrottlingScope != ThrottlingPerUser ||
+		len(sc.HotOrigins) != 2 || sc.Users["u"].Auth != "u:p" || sc.Cipher.KeyString != "secret" || sc.ConfigFile != f.Name() {
+		t.Fatal(addr, sc, err)
+	}
+
+	addr, cc, err := LoadClientConfig(f.Name(), nil)
+	if err != nil || cc.Upstream != "example.com:8100" || cc.Mux != 4 || !cc.Policy.IsSet(PolicyGlobal) || cc.ACL == nil {
+		t.Fatal(addr, cc, err)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("[default]\nlisten=8100\nupstream=ws://example.com\n[misc]\nthrot=-1\nthrotscope=per-host\n"), 0644)
+	if _, _, err := LoadServerConfig(f.Name(), nil); err == nil || len(err.(ConfigError)) != 4 {
+		t.Error("listen, password, throt and throtscope should be reported:", err)
+	}
+
+	if _, _, err := LoadClientConfig(f.Name(), nil); err == nil || !strings.Contains(err.Error(), "URL upstreams") {
+		t.Error("URL upstreams should be rejected:", err)
+	}
+}
+
+func TestConfigFileProxies(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from the config"))
+	}))
+	defer origin.Close()
+
+	dir, _ := ioutil.TempDir("", "goflyway")
+	defer os.RemoveAll(dir)
+	write := func(name string, buf []byte) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, buf, 0600)
+		return path
+	}
+
+	// the server config is encrypted, the client reads the same key from a key file
+	keyFile := write("key", []byte("file secret\n"))
+	sealed, _ := EncryptConfig([]byte("[default]\npassword=\"file secret\"\nlisten=127.0.0.1:0\n[misc]\nudpmaxsessions=3\n"), "pass")
+	serverConf := write("server.conf", sealed)
+
+	files := &ConfigFiles{Passphrase: func(path string) (string, error) {
+		if path != serverConf {
+			t.Error("passphrase of", path)
+		}
+		return "pass", nil
+	}}
+
+	if _, err := NewServerFromConfig(serverConf, nil); err == nil {
+		t.Error("encrypted configs need a passphrase")
+	}
+	if _, err := NewServerFromConfig(serverConf, &ConfigFiles{Passphrase: func(string) (string, error) { return "wrong", nil }}); err == nil {
+		t.Error("the wrong passphrase should fail")
+	}
+
+	server, err := NewServerFromConfig(serverConf, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.UDPMaxSessions != 3 || server.ConfigFile != "" {
+		t.Error("encrypted configs are not reloaded:", server.UDPMaxSessions, server.ConfigFile)
+	}
+	server.Cipher.IO.StartPurgeConns(1)
+
+	upstream := httptest.NewServer(server)
+	defer upstream.Close()
+
+	clientConf := write("client.conf", []byte("[default]\npassword=@"+keyFile+"\nlisten=127.0.0.1:0\nupstream="+
+		strings.TrimPrefix(upstream.URL, "http://")+"\nacl="+write("acl", nil)+"\ntunnellan=true\n"))
+	client, err := NewClientFromConfig(clientConf, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Listener.Close()
+
+	if client.Cipher.KeyString != server.Cipher.KeyString {
+		t.Fatal("keys should match:", client.Cipher.KeyString, server.Cipher.KeyString)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go client.routeAndBridge(c2, strings.TrimPrefix(origin.URL, "http://"), nil, "TEST")
+	go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadAll(resp.Body); string(buf) != "from the config" {
+		t.Error("the client should tunnel through the server:", string(buf))
+	}
+
+	// keys kept in the keychain, and problems of both reported together
+	write("client.conf", []byte("[default]\npassword=keychain\nlisten=127.0.0.1:0\nupstream=127.0.0.1:8100\n"))
+	keychain := &ConfigFiles{Keychain: func(account string) (string, error) { return account + " in keychain", nil }}
+	if _, cc, err := LoadClientConfig(clientConf, keychain); err != nil || cc.Cipher.KeyString != "password in keychain" {
+		t.Error("the key should be read from the keychain:", err)
+	}
+
+	write("client.conf", []byte("[default]\npassword=@"+keyFile+".nonexist\nlisten=127.0.0.1\nupstream=127.0.0.1:8100\n"))
+	if _, _, err := LoadClientConfig(clientConf, files); err == nil || len(err.(ConfigError)) != 2 || !strings.Contains(err.Error(), "password: ") {
+		t.Error("the key file and listen should be reported:", err)
+	}
+}
+
+func TestEnvConfig(t *testing.T) {
+	f, _ := ioutil.TempFile("", "goflyway.conf")
+	defer os.Remove(f.Name())
+	f.WriteString("[default]\npassword=secret\nlisten=127.0.0.1:8100\n[misc]\nthrot=1024\n")
+	f.Close()
+
+	for k, v := range map[string]string{"GOFLYWAY_KEY": "fromenv", "GOFLYWAY_THROT": "2048", "GOFLYWAY_ANTIREPLAY": "true"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	addr, sc, err := LoadServerConfig(f.Name(), nil)
+	if err != nil || addr != "127.0.0.1:8100" || sc.Cipher.KeyString != "fromenv" || sc.Throttling != 2048 || !sc.AntiReplay {
+		t.Fatal(addr, sc, err)
+	}
+
+	if EnvName("udpmaxsessions") != "GOFLYWAY_UDPMAXSESSIONS" {
+		t.Error(EnvName("udpmaxsessions"))
+	}
+
+	os.Setenv("GOFLYWAY_THROT", "fast")
+	if _, _, err := LoadServerConfig(f.Name(), nil); err == nil || !strings.Contains(err.Error(), "GOFLYWAY_THROT") {
+		t.Error("invalid numbers of the environment should be reported:", err)
+	}
+
+	var failed bool
+	cf := EnvConfig(nil, func(string) { failed = true })
+	if cf.GetString("default", "password", "") != "fromenv" || cf.GetInt("misc", "pace", 7) != 7 || cf.GetInt("misc", "throt", 0) != 0 || !failed {
+		t.Error("the environment alone should be read")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	server := NewServer("8101", &ServerConfig{Cipher: c})
+
+	server.Drain(90 * time.Second)
+	if d, ok := server.Draining(); !ok || d != 90*time.Second || !server.Status().Draining {
+		t.Fatal("server should be draining:", d, ok)
+	}
+
+	c1, c2 := net.Pipe()
+	go server.refuse(nil, c1, &server.Cipher.Codec, []byte("0123456789abcdef"), CloseDraining)
+	buf, _ := ioutil.ReadAll(c2)
+	if drainRetry(buf) != 90*time.Second || !strings.Contains(string(buf), "502") {
+		t.Error("refusal should carry the hint:", string(buf))
+	}
+
+	if server.Undrain(); server.Status().Draining {
+		t.Error("server should not be draining")
+	}
+
+	up := func() string {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+		go func() {
+			for {
+				if _, err := ln.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	a, b := up(), up()
+	proxy := &ProxyClient{
+		ClientConfig: &ClientConfig{Upstream: a, AltUpstreams: []string{b}},
+		pool:         tcpmux.NewDialer(a, 0),
+		altPools:     []*tcpmux.DialPool{tcpmux.NewDialer(b, 0)},
+	}
+
+	if proxy.drained("pinned:443", time.Minute) {
+		t.Error("pinned servers are not failed over")
+	}
+
+	if !proxy.drained(a, time.Minute) {
+		t.Fatal("the alternate should be available")
+	}
+
+	proxy.dialPools()
+	if proxy.active != 1 {
+		t.Error("the draining upstream should be dialed last")
+	}
+
+	if proxy.drained(b, time.Minute) {
+		t.Error("all upstreams are draining")
+	}
+}
+
+func TestDrainRetry(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	server := NewServer("8101", &ServerConfig{Cipher: c})
+	server.Drain(time.Minute)
+	upstream := httptest.NewServer(server)
+	defer upstream.Close()
+
+	// both upstreams are the same server which keeps answering draining
+	addr := strings.TrimPrefix(upstream.URL, "http://")
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:     addr,
+		AltUpstreams: []string{addr},
+		Transport:    plainTransport{},
+		Cipher:       c,
+		DNSCache:     lru.NewCache(16),
+		CACache:      lru.NewCache(16),
+		ACL:          acl,
+	})
+
+	for _, up := range []string{addr, "pinned"} {
+		dials := 0
+		dial := func() (net.Conn, string, error) {
+			dials++
+			conn, err := net.Dial("tcp", addr)
+			return conn, up, err
+		}
+
+		_, _, _, err := client.openTunnelVia(dial, "example.com:80", 0, "", nil)
+		if closeReasonOf(err) != CloseDraining {
+			t.Error("draining should be reported:", err)
+		}
+		if want := map[string]int{addr: 2, "pinned": 1}[up]; dials != want {
+			t.Error(up, "should be dialed", want, "times, not", dials)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	users, _ := ioutil.TempFile("", "users")
+	defer os.Remove(users.Name())
+	users.WriteString("alice:secret\nbob:secret 2048\n")
+	users.Close()
+
+	conf, _ := ioutil.TempFile("", "goflyway.conf")
+	defer os.Remove(conf.Name())
+	conf.WriteString("[misc]\nthrot=1024\nthrotscope=per-user\nban=1.1.1.1\n")
+	conf.Close()
+
+	proxy := NewServer("8101", &ServerConfig{
+		Throttling: 512,
+		Users:      map[string]UserConfig{"alice": {Auth: "alice:secret"}, "bob": {Auth: "bob:secret"}, "cli": {Auth: "cli:p"}},
+		UsersFile:  users.Name(),
+		Bans:       []string{"2.2.2.2"},
+		ConfigFile: conf.Name(),
+		Cipher:     &Cipher{},
+	})
+
+	old := proxy.getIOConfig("alice").Bucket
+	ioutil.WriteFile(users.Name(), []byte("bob:changed 4096\n"), 0644)
+	if err := proxy.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := proxy.auth("alice:secret"); ok {
+		t.Error("removed users should be rejected")
+	}
+
+	if _, ok := proxy.auth("bob:changed"); !ok {
+		t.Error("changed users should be accepted")
+	}
+
+	if _, ok := proxy.auth("cli:p"); !ok {
+		t.Error("users not from the file should be kept")
+	}
+
+	if proxy.ThrottlingScope != ThrottlingPerUser || proxy.getIOConfig("bob").Bucket.Speed != 4096 || proxy.getIOConfig("cli").Bucket == old {
+		t.Error("throttling should be reloaded")
+	}
+
+	if !proxy.banned("1.1.1.1") || proxy.banned("2.2.2.2") {
+		t.Error("bans should be reloaded")
+	}
+
+	bannedAt := func(addr string) time.Time {
+		for _, e := range proxy.Blacklist() {
+			if e.Addr == addr && e.Manual {
+				return e.FirstSeen
+			}
+		}
+		return time.Time{}
+	}
+	since := bannedAt("1.1.1.1")
+
+	ioutil.WriteFile(conf.Name(), []byte("[misc]\nthrotscope=per-user\nauth=carol:one\nban=1.1.1.1,3.3.3.3\n"), 0644)
+	if err := proxy.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxy.auth("carol:one"); !ok || !proxy.banned("3.3.3.3") {
+		t.Error("the auth and bans of the config should be added")
+	}
+
+	ioutil.WriteFile(conf.Name(), []byte("[misc]\nthrotscope=per-user\nauth=dave:two\nban=1.1.1.1\n"), 0644)
+	if err := proxy.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxy.auth("carol:one"); ok {
+		t.Error("the auth removed from the config should be rejected")
+	}
+	if _, ok := proxy.auth("dave:two"); !ok {
+		t.Error("the new auth of the config should be accepted")
+	}
+	if proxy.banned("3.3.3.3") || !proxy.banned("1.1.1.1") || !bannedAt("1.1.1.1").Equal(since) {
+		t.Error("only bans removed from the config should be lifted:", since, bannedAt("1.1.1.1"))
+	}
+
+	ioutil.WriteFile(conf.Name(), []byte("[misc]\nthrotscope=per-host\n"), 0644)
+	if err := proxy.Reload(); err == nil || proxy.ThrottlingScope != ThrottlingPerUser {
+		t.Error("invalid configs should be rejected as a whole")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	proxy := NewServer(addr, &ServerConfig{Cipher: &Cipher{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- proxy.StartContext(ctx) }()
+
+	time.Sleep(100 * time.Millisecond)
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	defer a2.Close()
+	defer b2.Close()
+	go proxy.Cipher.IO.Bridge(a1, b1, nil, IOConfig{})
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Error("StartContext should return when canceled:", err)
+	}
+
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("new connections should be refused")
+	}
+
+	if len(proxy.IO.OpenBridges()) != 1 {
+		t.Fatal("bridges should continue after canceled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("unfinished bridges should be reported:", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(proxy.IO.OpenBridges()); n != 0 {
+		t.Error("bridges should be closed:", n)
+	}
+
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Error("nothing to wait:", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	proxy := NewServer(addr, &ServerConfig{Cipher: &Cipher{}})
+	if proxy.Ready() {
+		t.Error("the server should not be ready before listening")
+	}
+
+	go proxy.Start()
+	for i := 0; i < 50 && !proxy.Ready(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !proxy.Ready() {
+		t.Fatal("the server should be ready")
+	}
+
+	proxy.Drain(time.Minute)
+	if proxy.Ready() {
+		t.Error("draining servers should not be ready")
+	}
+
+	proxy.Undrain()
+	proxy.Shutdown(context.Background())
+	if proxy.Ready() {
+		t.Error("servers shut down should not be ready")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule("30 4 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saturday
+	now := time.Date(2020, 1, 4, 12, 0, 0, 0, time.UTC)
+	if next := s.Next(now); !next.Equal(time.Date(2020, 1, 6, 4, 30, 0, 0, time.UTC)) {
+		t.Error("should be next Monday:", next)
+	}
+	if prev := s.Prev(now); !prev.Equal(time.Date(2020, 1, 3, 4, 30, 0, 0, time.UTC)) {
+		t.Error("should be last Friday:", prev)
+	}
+
+	s, _ = ParseSchedule("*/20 * * * *")
+	if next := s.Next(now.Add(45 * time.Minute)); next.Minute() != 0 || next.Hour() != 13 {
+		t.Error("should be the next hour:", next)
+	}
+
+	if prev := s.Prev(now.Add(45 * time.Minute)); prev.Minute() != 40 || prev.Hour() != 12 || !s.Prev(prev).Equal(prev) {
+		t.Error("should be the last 20 minutes:", prev)
+	}
+
+	if s, _ = ParseSchedule("0 0 30 2 *"); !s.Next(now).IsZero() || !s.Prev(now).IsZero() {
+		t.Error("Feb 30th should never come")
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Error("invalid schedule accepted:", spec)
+		}
+	}
+}
+
+func TestKeyEpochs(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	e, err := NewKeyEpochs("12345678", "0 4 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 4, 0, 0, 0, time.UTC) }
+	e.rotate(day(3).Add(time.Hour))
+
+	c := &Cipher{}
+	c.Init("12345678")
+	srv := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c, KeyEpochs: e}))
+	defer srv.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	newClient := func(key string) *ProxyClient {
+		cc := &Cipher{}
+		cc.Init(key)
+		return NewClient("127.0.0.1:0", &ClientConfig{
+			Upstream: srv.Listener.Addr().String(),
+			Cipher:   cc,
+			DNSCache: lru.NewCache(16),
+			CACache:  lru.NewCache(16),
+			ACL:      acl,
+		})
+	}
+
+	// forward mode
+	get := func(key string) bool {
+		client := newClient(key)
+		defer client.Listener.Close()
+
+		req, _ := http.NewRequest("GET", origin.URL, http.NoBody)
+		resp, rkeybuf, err := client.encryptAndTransport(req, nil)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		buf := &bytes.Buffer{}
+		client.Cipher.IO.Copy(buf, resp.Body, rkeybuf, IOConfig{})
+		return buf.String() == "ok"
+	}
+
+	// tunnels
+	connect := func(key string) bool {
+		client := newClient(key)
+		defer client.Listener.Close()
+
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		if client.dialUpstreamAndBridge(c2, strings.TrimPrefix(origin.URL, "http://"), nil, 0, nil) == nil {
+			return false
+		}
+
+		go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(c1), nil)
+		return err == nil && resp.StatusCode == 200
+	}
+
+	for d, want := range map[int]bool{3: true, 2: true, 1: false} {
+		if key := e.epochKey(day(d)); get(key) != want || connect(key) != want {
+			t.Error("the epoch of Jan", d, "should be accepted:", want)
+		}
+	}
+
+	if get("12345678") {
+		t.Error("the password itself should not be accepted")
+	}
+
+	// clients still on the epoch of Jan 3 are handed over until the next rotation
+	e.rotate(day(4).Add(time.Minute))
+	if e.Key() != e.epochKey(day(4)) || !get(e.Key()) || !connect(e.epochKey(day(3))) || get(e.epochKey(day(2))) {
+		t.Error("the server should have rotated to the epoch of Jan 4")
+	}
+
+	if _, err := NewKeyEpochs("12345678", "0 0 30 2 *"); err == nil {
+		t.Error("epochs never rotating should be rejected")
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	proxy := NewServer("8101", &ServerConfig{Throttling: 1024, ThrottlingMax: 1024, Cipher: &Cipher{}})
+	proxy.Cipher.Init("12345678")
+
+	if err := proxy.AddUser("alice", UserConfig{}); err == nil {
+		t.Error("auth without password should be rejected")
+	}
+	if err := proxy.AddUser("alice:secret", UserConfig{Throttling: 2048}); err != nil || !proxy.multiUser() {
+		t.Fatal("alice should be added:", err)
+	}
+	if err := proxy.AddUser("alice:other", UserConfig{}); err == nil {
+		t.Error("existing users should not be replaced")
+	}
+	if user, ok := proxy.auth("alice:secret"); !ok || user != "alice" {
+		t.Error("alice should be authed")
+	}
+
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	defer a2.Close()
+	defer b2.Close()
+
+	ioc := proxy.getIOConfig("alice")
+	ioc.Host = "example.com:443"
+	bucket := ioc.Bucket
+	done := make(chan bool)
+	go func() {
+		proxy.Cipher.IO.Bridge(a1, b1, nil, ioc)
+		done <- true
+	}()
+
+	go b2.Write([]byte("hello"))
+	a2.Read(make([]byte, 5))
+	time.Sleep(50 * time.Millisecond)
+
+	list := proxy.IO.OpenBridges()
+	if len(list) != 1 || list[0].User != "alice" || list[0].Host != "example.com:443" || list[0].In != 5 {
+		t.Fatal("sessions:", list)
+	}
+	if u := proxy.ListUsers(); len(u) != 1 || u[0].Name != "alice" || u[0].In != 5 || u[0].Throttling != 2048 {
+		t.Error("users:", u)
+	}
+
+	if err := proxy.SetThrottling("alice", 4096, 8192); err != nil || bucket.Speed != 4096 {
+		t.Error("the running stream should be throttled at once:", err, bucket.Speed)
+	}
+	if err := proxy.SetThrottling("bob", 4096, 0); err == nil {
+		t.Error("unknown users can't be throttled")
+	}
+	if b := proxy.getIOConfig("alice").Bucket; b.Speed != 4096 || b.maxCapacity != 8192 {
+		t.Error("new streams should get the new throttling")
+	}
+
+	if proxy.KillSession(list[0].ID + 1) {
+		t.Error("unknown sessions can't be killed")
+	}
+	if !proxy.KillSession(list[0].ID) {
+		t.Fatal("the session should be killed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the killed bridge should end")
+	}
+
+	if !proxy.RemoveUser("alice") || proxy.RemoveUser("alice") {
+		t.Error("alice should be removed once")
+	}
+	if _, ok := proxy.auth("alice:secret"); ok {
+		t.Error("removed users should not be authed")
+	}
+}
+
+func TestSaveBlacklist(t *testing.T) {
+	f, _ := ioutil.TempFile("", "blacklist")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, Bans: []string{"1.1.1.1"}, BlacklistFile: f.Name()})
+	proxy.offend("2.2.2.2")
+	proxy.offend("2.2.2.2")
+	proxy.offend("4.4.4.4")
+	proxy.Ban("3.3.3.3")
+	if err := proxy.SaveBlacklist(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy = NewServer("8101", &ServerConfig{Cipher: &Cipher{}, BlacklistFile: f.Name(), BanThreshold: 1})
+	list := proxy.Blacklist()
+	if len(list) != 3 || list[0].Addr != "3.3.3.3" || !list[0].Manual || list[1].Addr != "2.2.2.2" || list[1].Hits != 2 {
+		t.Error("unexpected blacklist:", list)
+	}
+
+	if banned := proxy.Banned(); len(banned) != 2 || banned[0] != "2.2.2.2" || banned[1] != "3.3.3.3" {
+		t.Error("offenders over the threshold should stay banned after restarts:", banned)
+	}
+
+	if proxy.banned("1.1.1.1") {
+		t.Error("bans from the config should not be saved")
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, Throttling: 16 * 1024, ThrottlingMax: 1024})
+
+	ioc := proxy.getIOConfig("alice")
+	ioc.Role = roleRecv
+	proxy.IO.Copy(ioutil.Discard, strings.NewReader(strings.Repeat("x", 2048)), nil, ioc)
+
+	proxy.Ban("1.1.1.1")
+	proxy.banned("1.1.1.1")
+	proxy.offend("2.2.2.2")
+
+	buf := &bytes.Buffer{}
+	proxy.Expose(buf)
+	out := buf.String()
+	for _, line := range []string{
+		`goflyway_user_bytes_total{user="alice",direction="in"} 2048`,
+		`goflyway_user_bytes_total{user="alice",direction="out"} 0`,
+		`goflyway_blacklist_hits_total{reason="banned"} 1`,
+		`goflyway_blacklist_hits_total{reason="offense"} 1`,
+		`goflyway_bridges 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Error("missing:", line)
+		}
+	}
+
+	if !strings.Contains(out, `goflyway_user_throttled_seconds_total{user="alice"} 0.`) {
+		t.Error("throttling should be counted:", out)
+	}
+
+	buf.Reset()
+	proxy.ExposeHashed(buf)
+	out = buf.String()
+	if strings.Contains(out, "alice") {
+		t.Error("hashed metrics should not name users:", out)
+	}
+	if !strings.Contains(out, `goflyway_user_bytes_total{user="`+proxy.hashUser("alice")+`",direction="in"} 2048`) {
+		t.Error("hashed metrics should still count each user:", out)
+	}
+}
+
+func TestRefuseTunnel(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go refuseTunnel(c2, "ads.example.com:443", " (match-block)")
+
+	buf := make([]byte, len(okHTTP))
+	io.ReadFull(c1, buf)
+	go c1.Write([]byte{0x16, 0x03, 0x03, 0x00, 0x10})
+
+	alert, _ := ioutil.ReadAll(c1)
+	if !bytes.Equal(alert, []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 49}) {
+		t.Error("TLS handshake should get an access_denied alert:", alert)
+	}
+
+	c1, c2 = net.Pipe()
+	go refuseTunnel(c2, "ads.example.com:80", " (match-block)")
+	io.ReadFull(c1, buf)
+	go c1.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil || resp.StatusCode != 403 {
+		t.Fatal("plain HTTP should get the 403 page:", err)
+	}
+
+	page, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(page), "ads.example.com:80 is blocked") || !strings.Contains(string(page), "(match-block)") {
+		t.Error("unexpected page:", string(page))
+	}
+}
+
+func TestECDH(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	_, rkeybuf := c.NewIV(doConnect, nil, "")
+
+	priv, pub, err := newECDHKey(&c.Codec, rkeybuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, sblock, err := acceptECDH(&c.Codec, pub, rkeybuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cblock, err := finishECDH(&c.Codec, priv, answer, rkeybuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, y, z := make([]byte, 16), make([]byte, 16), make([]byte, 16)
+	sblock.Encrypt(x, rkeybuf)
+	cblock.Encrypt(y, rkeybuf)
+	c.Block.Encrypt(z, rkeybuf)
+	if !bytes.Equal(x, y) || bytes.Equal(x, z) {
+		t.Error("both sides should derive the same cipher, other than the one of the password")
+	}
+
+	if _, _, err := acceptECDH(&c.Codec, c.EncryptString("short", rkeybuf...), rkeybuf); err == nil {
+		t.Error("invalid public key accepted")
+	}
+
+	// flipping bits of the encrypted keys flips the same bits of the keys
+	flip := func(enc string) string {
+		buf := []byte(c.DecryptString(enc, rkeybuf...))
+		buf[0] ^= 1
+		return c.EncryptString(string(buf), rkeybuf...)
+	}
+
+	flipped, _, err := acceptECDH(&c.Codec, flip(pub), rkeybuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := finishECDH(&c.Codec, priv, flipped, rkeybuf); err != errECDHTampered {
+		t.Error("the key of the client changed in the middle should be told:", err)
+	}
+	if _, err := finishECDH(&c.Codec, priv, flip(answer), rkeybuf); err != errECDHTampered {
+		t.Error("the key of the server changed in the middle should be told:", err)
+	}
+}
+
+func TestECDHTunnel(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	srv := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	defer srv.Close()
+
+	// the relay in front of the server replaces a character of the public key of the client if tamper is set
+	var tamper int32
+	relay, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer relay.Close()
+	go func() {
+		for {
+			conn, err := relay.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				up, err := net.Dial("tcp", srv.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer up.Close()
+
+				head, err := readUntil(conn, "\r\n\r\n")
+				if err != nil {
+					return
+				}
+
+				lines := strings.Split(string(head), "\r\n")
+				for i, l := range lines {
+					if idx := strings.Index(l, ecdhSuffix+": "); idx > 0 && atomic.LoadInt32(&tamper) == 1 {
+						v := []byte(l[idx+len(ecdhSuffix)+2:])
+						v[0], v[1] = v[1], v[0]
+						lines[i] = l[:idx+len(ecdhSuffix)+2] + string(v)
+					}
+				}
+
+				up.Write([]byte(strings.Join(lines, "\r\n")))
+				go io.Copy(up, conn)
+				io.Copy(conn, up)
+			}()
+		}
+	}()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream: relay.Addr().String(),
+		ECDH:     true,
+		Cipher:   c,
+		DNSCache: lru.NewCache(16),
+		CACache:  lru.NewCache(16),
+		ACL:      acl,
+	})
+	defer client.Listener.Close()
+
+	dial := func() (net.Conn, string, error) {
+		conn, err := net.Dial("tcp", relay.Addr().String())
+		return conn, relay.Addr().String(), err
+	}
+
+	get := func() error {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+
+		upstreamConn, rkeybuf, ioc, err := client.tunnelVia(dial, strings.TrimPrefix(origin.URL, "http://"), 0, "", nil, false)
+		if err != nil {
+			return err
+		}
+		if ioc.Block == nil {
+			return errors.New("the stream should have its own cipher")
+		}
+		go c.IO.Bridge(c2, upstreamConn, rkeybuf, ioc)
+
+		go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(c1), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "ok" {
+			return errors.New("unexpected body: " + string(body))
+		}
+		return nil
+	}
+
+	if err := get(); err != nil {
+		t.Fatal("the tunnel should carry the traffic by the cipher of ECDH:", err)
+	}
+
+	atomic.StoreInt32(&tamper, 1)
+	if err := get(); err != errECDHTampered {
+		t.Error("the key changed in the middle should be refused:", err)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	f, _ := ioutil.TempFile("", "access")
+	f.WriteString("[gaming]\nhosts=*.steampowered.com\ntime=09:00-17:00\ndays=1-5\n" +
+		"[night]\nhosts=*.example.com\ntime=22:00-07:00\nusers=alice\n")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	ar, err := LoadAccessRules(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday
+	at := func(day, h, m int) time.Time { return time.Date(2020, 1, 6+day, h, m, 0, 0, time.Local) }
+	for _, c := range []struct {
+		user, host string
+		t          time.Time
+		rule       string
+	}{
+		{"", "store.steampowered.com:443", at(0, 9, 0), "gaming"},
+		{"", "store.steampowered.com:443", at(0, 17, 0), ""},
+		{"", "store.steampowered.com:443", at(5, 10, 0), ""}, // Saturday
+		{"alice", "www.example.com:80", at(0, 23, 0), "night"},
+		{"alice", "www.example.com:80", at(1, 6, 59), "night"},
+		{"alice", "www.example.com:80", at(1, 7, 0), ""},
+		{"bob", "www.example.com:80", at(0, 23, 0), ""},
+		{"", "www.example.com:80", at(0, 23, 0), ""},
+	} {
+		r := ar.blocked(c.user, c.host, c.t)
+		if (r == nil && c.rule != "") || (r != nil && r.Name != c.rule) {
+			t.Error(c.user, c.host, c.t, "should be blocked by:", c.rule, r)
+		}
+	}
+
+	for _, bad := range []string{"[x]\ntime=9-17\nhosts=a.com\n", "[x]\ndays=1-7\nhosts=a.com\n", "[x]\ntime=09:00-17:00\n"} {
+		ioutil.WriteFile(f.Name(), []byte(bad), 0644)
+		if _, err := LoadAccessRules(f.Name()); err == nil {
+			t.Error("invalid rule accepted:", bad)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	client := &ProxyClient{ClientConfig: &ClientConfig{Cipher: c}}
+
+	var cache replayCache
+	rkey, rkeybuf := client.newIV(doConnect)
+	if _, buf, _ := c.ReverseIV(rkey); !bytes.Equal(buf, rkeybuf) {
+		t.Fatal("stamped IV not recovered")
+	}
+
+	if cache.replayed(rkeybuf, time.Second) {
+		t.Error("fresh request rejected")
+	}
+	if !cache.replayed(rkeybuf, time.Second) {
+		t.Error("replayed request accepted")
+	}
+
+	_, old := c.NewIV(doConnect, nil, "")
+	binary.BigEndian.PutUint32(old[ivLen-4:], uint32(time.Now().Unix()-replayAge-5))
+	if !cache.replayed(old, time.Second) {
+		t.Error("expired request accepted")
+	}
+	if cache.replayed(old, 10*time.Second) {
+		t.Error("request within the tolerance rejected")
+	}
+}
+
+func TestInventory(t *testing.T) {
+	f, _ := ioutil.TempFile("", "servers")
+	f.WriteString("[us-1]\naddr=127.0.0.1:8101\nregion=us\n[us-2]\naddr=127.0.0.1:8102\nregion=us\n[jp-1]\naddr=127.0.0.1:8103\nregion=jp\n" +
+		"[streaming]\nhosts=*.netflix.com, *.hulu.com\nserver=region:us\n[tv]\nhosts=*.abema.tv\nserver=jp-1\n")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	inv, err := LoadInventory(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inv.Servers) != 3 || inv.Servers[0].Name != "jp-1" || inv.Servers[1].Labels["region"] != "us" {
+		t.Fatal(inv.Servers)
+	}
+
+	if p := inv.pinned("www.netflix.com:443"); p == nil || len(p.Servers) != 2 || p.Servers[0].Name != "us-1" {
+		t.Error("netflix should be pinned to us-1 and us-2")
+	}
+	if p := inv.pinned("video.abema.tv"); p == nil || p.Servers[0].Name != "jp-1" {
+		t.Error("abema should be pinned to jp-1")
+	}
+	if inv.pinned("example.com:80") != nil || (*Inventory)(nil).pinned("abema.tv") != nil {
+		t.Error("unexpected pin")
+	}
+
+	for _, bad := range []string{"[a]\nhosts=*.a.com\nserver=nobody\n", "[a]\nregion=us\n", "[a]\naddr=noport\n"} {
+		ioutil.WriteFile(f.Name(), []byte(bad), 0644)
+		if _, err := LoadInventory(f.Name()); err == nil {
+			t.Error("invalid inventory accepted:", bad)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	var b bandwidthMeter
+	m := b.meter("us-1")
+
+	m.add(roleRecv, 1024*1024)
+	m.add(roleSend, 1024)
+	b.sample()
+	if s := b.Bandwidth()["us-1"]; s.Down != 1024*1024 || s.Up != 0 {
+		t.Fatal(s)
+	}
+
+	// idle seconds tell nothing
+	b.sample()
+	if s := b.Bandwidth()["us-1"]; s.Down != 1024*1024 {
+		t.Fatal(s)
+	}
+
+	m.add(roleRecv, 128*1024)
+	b.sample()
+	if s := b.Bandwidth()["us-1"]; s.Down >= 1024*1024 || s.Down <= 128*1024 {
+		t.Error("a slower second should pull the estimation down smoothly:", s)
+	}
+
+	b.meter("idle")
+	if _, ok := b.Bandwidth()["idle"]; ok {
+		t.Error("upstreams without bulk traffic have no estimation")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	// the example of RFC6455
+	if a := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); a != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal(a)
+	}
+
+	for _, ln := range []int{0, 100, 1000, 70000} {
+		buf := &bytes.Buffer{}
+		payload := bytes.Repeat([]byte{'x'}, ln)
+		if n, err := wsWrite(buf, payload, true); n != ln || err != nil {
+			t.Fatal(n, err)
+		}
+
+		if !bytes.Equal(payload, bytes.Repeat([]byte{'x'}, ln)) {
+			t.Fatal("the payload should not be masked in place")
+		}
+
+		if buf.Bytes()[0] != 0x82 || buf.Bytes()[1]&0x80 == 0 {
+			t.Error("frames should be final, binary and masked")
+		}
+
+		if p, n, err := wsRead(buf, false); n != ln || err != nil || !bytes.Equal(p, payload) {
+			t.Error(ln, n, err)
+		}
+	}
+
+	// a ping in the middle is answered with a pong carrying its payload
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		wsFrame(s, 9, []byte("ping"), false)
+		wsFrame(s, 2, []byte("data"), false)
+		wsFrame(s, 8, nil, false)
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 10)
+		io.ReadFull(s, buf)
+		for i := range buf[6:] {
+			buf[6+i] ^= buf[2+i%4]
+		}
+		pong <- buf
+	}()
+
+	if p, _, err := wsRead(c, true); err != nil || string(p) != "data" {
+		t.Fatal(string(p), err)
+	}
+	if _, _, err := wsRead(c, true); err != io.EOF {
+		t.Error("close frames should end the stream:", err)
+	}
+	if p := <-pong; p[0] != 0x8a || p[1] != 0x84 || string(p[6:]) != "ping" {
+		t.Error("masked pong expected:", p)
+	}
+}
+
+func TestDupStream(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+	key := make([]byte, ivLen)
+
+	client, server := c.newDupStream(IOConfig{}, roleSend), c.newDupStream(IOConfig{}, roleRecv)
+	a1, b1 := net.Pipe()
+	a2, b2 := net.Pipe()
+	client.attach(a1, key, nil)
+	client.attach(a2, key, nil)
+	server.attach(b1, key, nil)
+	server.attach(b2, key, nil)
+
+	app, l1 := net.Pipe()
+	l2, target := net.Pipe()
+	go client.start(l1, nil)
+	go server.start(l2, nil)
+
+	expect := func(conn net.Conn, str string) {
+		buf := make([]byte, len(str))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != str {
+			t.Fatal(string(buf), err)
+		}
+
+		// chunks delivered by both tunnels are written once
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := conn.Read(buf); n > 0 || err == nil {
+			t.Fatal("duplicated:", string(buf[:n]))
+		}
+	}
+
+	app.Write([]byte("hello"))
+	expect(target, "hello")
+	target.Write([]byte("bye"))
+	expect(app, "bye")
+
+	// the stream survives losing a tunnel
+	a1.Close()
+	app.Write([]byte("again"))
+	expect(target, "again")
+
+	target.Close()
+	app.Close()
+
+	for i := 0; i < 50; i++ {
+		client.mu.Lock()
+		server.mu.Lock()
+		closed := client.closed && server.closed
+		server.mu.Unlock()
+		client.mu.Unlock()
+
+		if closed {
+			if b := c.IO.OpenBridges(); len(b) > 0 {
+				t.Fatal("bridges left open:", b)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("duplicated streams are not closed")
+}
+
+func TestDupStreamSlowLocal(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	d := c.newDupStream(IOConfig{}, roleRecv)
+	tunnel, peer := net.Pipe()
+	defer peer.Close()
+	d.attach(tunnel, make([]byte, ivLen), nil)
+
+	local, app := net.Pipe()
+	defer app.Close()
+	d.local = local
+	close(d.ready)
+
+	// the local conn isn't read, the chunk written to it blocks
+	delivered := make(chan bool)
+	go func() { delivered <- d.deliver(0, []byte("x")) }()
+	time.Sleep(50 * time.Millisecond)
+
+	sent := make(chan bool)
+	go func() {
+		d.send([]byte("y"))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send is blocked by a slow local conn")
+	}
+
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(app, buf); err != nil || buf[0] != 'x' || !<-delivered {
+		t.Error(string(buf), err)
+	}
+}
+
+func TestKCPConfig(t *testing.T) {
+	if c, err := ParseKCPConfig(""); c != nil || err != nil {
+		t.Fatal(c, err)
+	}
+
+	c, err := ParseKCPConfig("fast")
+	if err != nil || *c != (KCPConfig{NoDelay: 1, Interval: 20, Resend: 2, NoCongestion: 1}) {
+		t.Fatal(c, err)
+	}
+
+	if c, err = ParseKCPConfig("0, 40, 0, 0"); err != nil || c.String() != "0,40,0,0" {
+		t.Fatal(c, err)
+	}
+
+	for _, s := range []string{"1,20,2", "1,20,2,x", "1,5,2,1", "1,20,-2,1"} {
+		if _, err := ParseKCPConfig(s); err == nil {
+			t.Error(s)
+		}
+	}
+}
+
+func TestPortHop(t *testing.T) {
+	for _, s := range []string{"20000", "20000-19999", "0-10", "20000-70000", "20000-20099/0s", "20000-20099/1500ms", "a-b/30s"} {
+		if _, err := ParsePortHop(s, "x"); err == nil {
+			t.Error(s)
+		}
+	}
+
+	h, err := ParsePortHop("20000-20099", "12345678")
+	if err != nil || h.Interval != defaultHopInterval || h.String() != "20000-20099/30s" {
+		t.Fatal(h, err)
+	}
+
+	other, _ := ParsePortHop("20000-20099/30s", "87654321")
+	ports, differs := map[int]bool{}, false
+	for i := 0; i < 20; i++ {
+		at := time.Unix(int64(i*30), 0)
+		p := h.Port(at)
+		if p < 20000 || p > 20099 || p != h.Port(at.Add(29*time.Second)) {
+			t.Fatal("the port should stay within the range and the interval:", p)
+		}
+		ports[p] = true
+		differs = differs || other.Port(at) != p
+	}
+	if len(ports) < 2 || !differs {
+		t.Error("the port should hop by a schedule of the password:", ports, differs)
+	}
+
+	// find a free range of the server
+	var srv *hopServerConn
+	for base := 42000; srv == nil && base < 43000; base += 10 {
+		h, _ = ParsePortHop(strconv.Itoa(base)+"-"+strconv.Itoa(base+3)+"/1h", "12345678")
+		srv, _ = listenPortHop("127.0.0.1", h)
+	}
+	if srv == nil {
+		t.Skip("no free ports")
+	}
+	defer srv.Close()
+
+	remote, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1")
+	conn, _ := net.ListenUDP("udp", nil)
+	client := &hopClientConn{UDPConn: conn, hop: h, remote: remote}
+	defer client.Close()
+
+	buf := make([]byte, 16)
+	client.WriteTo([]byte("ping"), remote)
+	n, peer, err := srv.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || peer.(*net.UDPAddr).Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal(string(buf[:n]), peer, err)
+	}
+
+	srv.mu.Lock()
+	at := srv.peers[peer.String()].LocalAddr().(*net.UDPAddr).Port
+	srv.mu.Unlock()
+	if at != h.Port(time.Now()) {
+		t.Error("the client should send to the port of the time:", at)
+	}
+
+	// the client hopped to another port in the session, the server answers by it, the client takes it as remote's
+	next := h.Low + (at-h.Low+1)%(h.High-h.Low+1)
+	conn.WriteTo([]byte("hop"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: next})
+	if n, peer, err = srv.ReadFrom(buf); err != nil || string(buf[:n]) != "hop" {
+		t.Fatal(string(buf[:n]), err)
+	}
+
+	srv.WriteTo([]byte("pong"), peer)
+	n, from, err := client.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" || from != remote {
+		t.Fatal(string(buf[:n]), from, err)
+	}
+
+	srv.Close()
+	if _, _, err := srv.ReadFrom(buf); err == nil {
+		t.Error("reading a closed conn should fail")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	for _, name := range []string{"", "tcp"} {
+		if tr, err := ParseTransport(name, ""); tr != nil || err != nil {
+			t.Fatal(name, tr, err)
+		}
+	}
+
+	if tr, err := ParseTransport("kcp", ""); err != nil || tr != GetTransport("kcp") {
+		t.Fatal(tr, err)
+	}
+
+	if tr, err := ParseTransport("", "0,40,0,0"); err != nil || tr.(*KCPConfig).String() != "0,40,0,0" {
+		t.Fatal(tr, err)
+	}
+
+	type fake struct{ Transport }
+	RegisterTransport("test", &fake{})
+	defer func() {
+		transports.Lock()
+		delete(transports.m, "test")
+		transports.Unlock()
+	}()
+
+	if tr, err := ParseTransport("test", ""); err != nil || tr == nil {
+		t.Fatal(tr, err)
+	}
+
+	if names := Transports(); strings.Join(names, ",") != "kcp,test,tls,ws" {
+		t.Fatal(names)
+	}
+
+	for _, s := range [][2]string{{"udp", ""}, {"test", "fast"}, {"tls", "fast"}} {
+		if _, err := ParseTransport(s[0], s[1]); err == nil {
+			t.Error(s)
+		}
+	}
+
+	if tr, err := NewTransport("kcp:fast", TransportOptions{SNI: "example.com"}); err != nil || tr.(*KCPConfig).String() != "1,20,2,1" {
+		t.Fatal(tr, err)
+	}
+
+	if tr, err := NewTransport("ws:tunnel", TransportOptions{}); err != nil || tr.(*WSTransport).Path != "/tunnel" {
+		t.Fatal(tr, err)
+	}
+
+	tr, err := NewTransport("tls", TransportOptions{SNI: "cdn.example.com", Fingerprint: "chrome"})
+	if tt, ok := tr.(*TLSTransport); err != nil || !ok || tt.SNI != "cdn.example.com" || tt.Fingerprint != "chrome" {
+		t.Fatal(tr, err)
+	}
+
+	for _, spec := range []string{"", "kcp", "ws", "test"} {
+		if _, err := NewTransport(spec, TransportOptions{Fingerprint: "chrome"}); err == nil {
+			t.Error(spec, "has no ClientHello to mimic")
+		}
+	}
+
+	for name, network := range map[string]string{"kcp": "udp", "tls": "tcp", "ws": "http", "test": ""} {
+		if n := TransportNetwork(GetTransport(name)); n != network {
+			t.Error(name, n)
+		}
+	}
+}
+
+func TestWSTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	tr := &WSTransport{Path: "/carrier"}
+	upstream := NewServer(addr, &ServerConfig{Cipher: c, Transports: []Transport{tr}})
+	go upstream.Start()
+	defer upstream.Shutdown(context.Background())
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = tr.Dial(addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := (&WSTransport{Path: "/other"}).Dial(addr); err != errWSAccept {
+		t.Error("handshakes to other paths should be answered by the site:", err)
+	}
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  addr,
+		Transport: tr,
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+
+	req, _ := http.NewRequest("GET", origin.URL, http.NoBody)
+	resp, rkeybuf, err := client.encryptAndTransport(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buf := &bytes.Buffer{}
+	if c.IO.Copy(buf, resp.Body, rkeybuf, IOConfig{}); buf.String() != "ok" {
+		t.Error("the request should be carried by ws:", buf.String())
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	site := httptest.NewTLSServer(http.NotFoundHandler())
+	site.Close()
+
+	srv := &TLSTransport{Config: &tls.Config{Certificates: site.TLS.Certificates}}
+	ln, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	if _, err := (&TLSTransport{}).Dial(ln.Addr().String()); err == nil {
+		t.Error("a certificate of another host should be rejected")
+	}
+
+	roots := site.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	conn, err := (&TLSTransport{Config: &tls.Config{RootCAs: roots}}).Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 4)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Error(string(buf), err)
+	}
+
+	if _, err := (&TLSTransport{}).Listen("127.0.0.1:0"); err == nil {
+		t.Error("listening without certificates should fail")
+	}
+
+	if c := NewACMEConfig([]string{"example.com"}, os.TempDir(), ""); c.GetCertificate == nil || c.NextProtos[0] != "http/1.1" {
+		t.Error(c.NextProtos)
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	site := httptest.NewTLSServer(http.NotFoundHandler())
+	site.Close()
+
+	srv := &TLSTransport{Config: &tls.Config{Certificates: site.TLS.Certificates}}
+	ln, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	roots := site.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	tr := &TLSTransport{Config: &tls.Config{RootCAs: roots}}
+	if _, err := tr.WithFingerprint("netscape"); err == nil {
+		t.Error("an unknown fingerprint should be rejected")
+	}
+
+	for _, name := range Fingerprints() {
+		ft, err := tr.WithFingerprint(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ft.WithSNI("127.0.0.1").Fingerprint != name {
+			t.Error("WithSNI lost the fingerprint")
+		}
+
+		conn, err := ft.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		buf := make([]byte, 4)
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Error(name, string(buf), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestECH(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ech")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ech.pem")
+	key, err := LoadECHKey(path, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadECHKey(path, "other.com"); err != nil || !bytes.Equal(loaded.Config, key.Config) || !bytes.Equal(loaded.PrivateKey, key.PrivateKey) {
+		t.Fatal("the key generated should be loaded again:", err)
+	}
+	list := ECHConfigList([]tls.EncryptedClientHelloKey{key})
+
+	// the outer ClientHello presents the public name only
+	raw, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer raw.Close()
+	go (&TLSTransport{Config: &tls.Config{ServerName: "tunnel.example.com"}}).WithECH(list).Dial(raw.Addr().String())
+
+	conn, err := raw.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := peekHello(bufio.NewReaderSize(conn, sniffBufferSize))
+	conn.Close()
+
+	id, _ := echConfigID(key.Config)
+	if sni := parseSNI(hello); sni != "example.com" {
+		t.Error("the outer SNI should be the public name:", sni)
+	}
+	if cid, ok := parseECH(hello); !ok || cid != id {
+		t.Error("the ClientHello should be encrypted by the config:", cid, ok)
+	}
+
+	// the site can't decrypt ECH, so ClientHellos encrypted by the keys of the server are of the tunnel
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("site"))
+	}))
+	defer site.Close()
+
+	proxy := NewServer("8101", &ServerConfig{
+		Cipher:        &Cipher{},
+		TLS:           &tls.Config{Certificates: site.TLS.Certificates, EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key}},
+		TLSRoute:      "tunnel.example.com",
+		ProxyPassAddr: site.URL,
+	})
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	l := proxy.newSNIListener(ln)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	roots := site.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	tr := (&TLSTransport{Config: &tls.Config{ServerName: "example.com", RootCAs: roots}}).WithECH(list)
+	conn, err = tr.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !conn.(*tls.Conn).ConnectionState().ECHAccepted {
+		t.Error("ECH should be accepted")
+	}
+
+	buf := make([]byte, 4)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Error("the ClientHello encrypted should be of the tunnel:", string(buf), err)
+	}
+
+	if _, err := tr.Tune(TransportOptions{ECH: list, Fingerprint: "chrome"}); err == nil {
+		t.Error("a mimicked ClientHello can't be encrypted")
+	}
+	if _, err := NewTransport("kcp", TransportOptions{ECH: list}); err == nil {
+		t.Error("kcp has no ClientHello to encrypt")
+	}
+}
+
+// acmeCert writes the certificate of name as autocert caches it under key in dir, org tells certificates apart
+func acmeCert(t *testing.T, dir, key, name, org string) *x509.Certificate {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{org}},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(priv)
+
+	buf := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := ioutil.WriteFile(filepath.Join(dir, key), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestSNIRoute(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("site"))
+	}))
+	defer site.Close()
+
+	// certificates of Let's Encrypt obtained before, and the one answering the pending challenge
+	dir, _ := ioutil.TempDir("", "acme")
+	defer os.RemoveAll(dir)
+	cert := acmeCert(t, dir, "example.com", "example.com", "site")
+	acmeCert(t, dir, "example.com+token", "example.com", "challenge")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	proxy := NewServer("8101", &ServerConfig{
+		Cipher:        &Cipher{},
+		TLS:           NewACMEConfig([]string{"example.com"}, dir, ""),
+		TLSRoute:      "tunnel.example.com",
+		ProxyPassAddr: site.URL,
+	})
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	l := proxy.newSNIListener(ln)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// the client presents the secret SNI and verifies the certificate of the site's name
+	bySNI := (&TLSTransport{Config: &tls.Config{ServerName: "example.com", RootCAs: roots}}).WithSNI("tunnel.example.com")
+	byALPN := &TLSTransport{Config: &tls.Config{ServerName: "example.com", RootCAs: roots, NextProtos: []string{"tunnel.example.com"}}}
+	for _, tr := range []*TLSTransport{bySNI, byALPN} {
+		conn, err := tr.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 4)
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Error(tr.SNI, "should be of the tunnel:", string(buf), err)
+		}
+		conn.Close()
+	}
+
+	if _, err := (&TLSTransport{Config: &tls.Config{ServerName: "other.com", RootCAs: roots}}).WithSNI("tunnel.example.com").Dial(ln.Addr().String()); err == nil {
+		t.Error("the certificate should be verified against the site's name")
+	}
+
+	// the challenge of Let's Encrypt is answered with the token certificate instead of passed to the site
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com", NextProtos: []string{acme.ALPNProto}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org := conn.ConnectionState().PeerCertificates[0].Subject.Organization; len(org) != 1 || org[0] != "challenge" {
+		t.Error("the challenge should be answered:", org)
+	}
+	conn.Close()
+
+	resp, err := site.Client().Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if buf, _ := ioutil.ReadAll(resp.Body); string(buf) != "site" {
+		t.Error("visitors should be passed to the site:", string(buf))
+	}
+}
+
+func TestPreopen(t *testing.T) {
+	for _, c := range []struct {
+		bound, addr string
+		same        bool
+	}{
+		{"[::]:53", ":53", true},
+		{"[::]:53", "0.0.0.0:53", true},
+		{"0.0.0.0:53", "53", true},
+		{"127.0.0.1:53", "127.0.0.1:53", true},
+		{"127.0.0.1:53", ":53", false},
+		{"[::]:53", ":54", false},
+	} {
+		a, _ := net.ResolveTCPAddr("tcp", c.bound)
+		if sameAddr(a, c.addr) != c.same {
+			t.Error(c)
+		}
+	}
+
+	if err := Preopen("tcp", "127.0.0.1:18981"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the listener takes the socket instead of binding again
+	ln, err := listenTCP("127.0.0.1:18981")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	if err := Preopen("udp", "18981"); err != nil {
+		t.Fatal(err)
+	}
+
+	// sockets passed by socket activation aren't bound again
+	if err := Preopen("udp", "0.0.0.0:18981"); err != nil {
+		t.Fatal("addresses having a socket should be skipped:", err)
+	}
+
+	c := takeUDP("0.0.0.0:18981")
+	if c == nil || takeUDP("0.0.0.0:18981") != nil {
+		t.Fatal("the socket should be taken once")
+	}
+	c.Close()
+
+	// the server listens on the socket bound before, another bind of the port would fail
+	if err := Preopen("tcp", "127.0.0.1:18982"); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := &Cipher{}
+	c2.Init("12345678")
+	server := NewServer("127.0.0.1:18982", &ServerConfig{Cipher: c2})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.StartContext(ctx)
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err := http.Get("http://127.0.0.1:18982/"); err == nil {
+			resp.Body.Close()
+			break
+		} else if time.Since(start) > time.Second {
+			t.Fatal("the server should serve the socket:", err)
+		}
+	}
+
+	sockets.Lock()
+	defer sockets.Unlock()
+	if len(sockets.tcp) != 0 {
+		t.Error("the socket should be taken by the server:", sockets.tcp)
+	}
+}
+
+func TestDecoy(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	proxy := NewServer("8101", &ServerConfig{
+		Cipher: c,
+		Users:  map[string]UserConfig{"a": {Auth: "a:b"}},
+		Bans:   []string{"1.1.1.1"},
+	})
+
+	noKey := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	badAuth := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	rkey, _ := c.NewIV(doConnect, nil, "a:c")
+	badAuth.Header.Set(proxy.rkeyHeader, rkey)
+	banned := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	banned.RemoteAddr = "1.1.1.1:1234"
+
+	var first *httptest.ResponseRecorder
+	for _, r := range []*http.Request{noKey, badAuth, banned} {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		proxy.ServeHTTP(w, r)
+
+		if time.Since(start) < decoyDelayMin {
+			t.Error("the decoy should be delayed")
+		}
+
+		if first == nil {
+			first = w
+			if w.Code != 404 || w.Header().Get("Server") != "nginx" || !strings.Contains(w.Body.String(), "404 Not Found") {
+				t.Fatal(w.Code, w.Header(), w.Body.String())
+			}
+			continue
+		}
+
+		if w.Code != first.Code || w.Body.String() != first.Body.String() || len(w.Header()) != len(first.Header()) {
+			t.Error("failures should look alike:", w.Code, w.Header(), w.Body.String())
+		}
+		for k := range first.Header() {
+			if w.Header().Get(k) != first.Header().Get(k) {
+				t.Error(k, "differs:", w.Header().Get(k))
+			}
+		}
+	}
+}
+
+func TestDialLatency(t *testing.T) {
+	for addr, want := range map[net.Addr]string{
+		&net.TCPAddr{IP: net.ParseIP("1.2.4.8")}:     "v4/cn",
+		&net.TCPAddr{IP: net.ParseIP("8.8.8.8")}:     "v4/intl",
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}: "v6",
+	} {
+		if n := dialNetwork(addr); n != want {
+			t.Error(addr, "is on", n, "want", want)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}})
+	for i := 0; i < 3; i++ {
+		conn, err := proxy.dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	if p := proxy.DialLatency()["v4/intl"]; p.P50 <= 0 || p.P50 > p.P99 {
+		t.Error("unexpected percentiles:", p)
+	}
+
+	buf := &bytes.Buffer{}
+	proxy.Expose(buf)
+	if !strings.Contains(buf.String(), "goflyway_dial_seconds_count{network=\"v4/intl\"} 3") ||
+		!strings.Contains(buf.String(), "goflyway_dial_seconds_bucket{network=\"v6\",le=\"+Inf\"} 0") {
+		t.Error(buf.String())
+	}
+
+	h := newHistogram()
+	for _, ms := range []int64{2, 3, 4, 7} {
+		h.Observe(time.Duration(ms) * time.Millisecond)
+	}
+	if q := h.Quantile(0.5); q <= 1 || q > 5 {
+		t.Error("median should be interpolated within (1, 5]:", q)
+	}
+}
+
+func TestSync(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	f, _ := ioutil.TempFile("", "users")
+	f.WriteString("a:b\n")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	primary := NewServer("8101", &ServerConfig{Cipher: c, UsersFile: f.Name(), Users: map[string]UserConfig{"a": {Auth: "a:b"}}})
+	standby := NewServer("8101", &ServerConfig{Cipher: c, Users: map[string]UserConfig{}})
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(buf, []byte("a:b")) || bytes.Contains(buf, []byte("users")) {
+			t.Error("pushes should be encrypted")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		standby.serveSync(w, r)
+	}))
+	defer peer.Close()
+	primary.SyncPeer = strings.TrimPrefix(peer.URL, "http://")
+
+	primary.Ban("1.1.1.1")
+	primary.offend("2.2.2.2")
+	primary.meter("a").add(roleRecv, 100)
+	standby.meter("a").add(roleRecv, 20)
+
+	if err := primary.push(http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := standby.auth("a:b"); !ok {
+		t.Error("users should be replicated")
+	}
+
+	if !standby.banned("1.1.1.1") || len(standby.Blacklist()) != 2 {
+		t.Error("the blacklist should be replicated:", standby.Blacklist())
+	}
+
+	if tr := standby.ClusterTraffic()["a"]; tr[0] != 120 {
+		t.Error("traffic of both servers should be added up:", tr)
+	}
+
+	primary.Unban("1.1.1.1")
+	if err := primary.push(http.DefaultClient); err != nil || standby.banned("1.1.1.1") {
+		t.Error("unbans should be replicated", err)
+	}
+
+	if err := standby.apply(&replica{At: 1}); err == nil {
+		t.Error("stale pushes should be ignored")
+	}
+
+	other := &Cipher{}
+	other.Init("87654321")
+	intruder := NewServer("8101", &ServerConfig{Cipher: other})
+	intruder.SyncPeer = primary.SyncPeer
+	if err := intruder.push(http.DefaultClient); err == nil {
+		t.Error("pushes signed by another password should be rejected")
+	}
+
+	standby.Sync = "127.0.0.1:0"
+	errs := make(chan error, 1)
+	go func() { errs <- standby.StartSync() }()
+	for n := 0; n == 0; time.Sleep(10 * time.Millisecond) {
+		standby.serversMu.Lock()
+		n = len(standby.servers)
+		standby.serversMu.Unlock()
+	}
+	if standby.Ready() {
+		t.Error("the sync listener alone should not make the server ready")
+	}
+
+	standby.Shutdown(context.Background())
+	select {
+	case err := <-errs:
+		if err != http.ErrServerClosed {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("sync should stop on shutdown")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	// a DNS server answering A records of 1 sec, and NXDOMAIN of names starting with nxdomain
+	var mu sync.Mutex
+	queries := 0
+	dns, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			name, qtype, end, ok := parseDNSQuestion(buf[:n])
+			if !ok {
+				continue
+			}
+
+			mu.Lock()
+			queries++
+			mu.Unlock()
+
+			var reply []byte
+			switch {
+			case strings.HasPrefix(name, "nxdomain"):
+				reply = dnsReply(buf[:n], end, qtype, nil, 0)
+				reply[3] |= 3
+			case qtype == dnsTypeA:
+				reply = dnsReply(buf[:n], end, qtype, []byte{127, 0, 0, 2}, 1)
+			default:
+				reply = dnsReply(buf[:n], end, qtype, nil, 0)
+			}
+			dns.WriteTo(reply, addr)
+		}
+	}()
+
+	asked := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, DNSCacheTTL: time.Minute, Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", dns.LocalAddr().String())
+		},
+	}})
+
+	for i := 0; i < 2; i++ {
+		if ip, err := proxy.resolve("localhost"); err != nil || !ip.IsLoopback() {
+			t.Fatal(ip, err)
+		}
+	}
+	if proxy.dnsCacheHits != 1 {
+		t.Error("the second lookup should be cached:", proxy.dnsCacheHits)
+	}
+
+	// answers are cached for the TTL of their records, shorter than DNSCacheTTL
+	if ip, err := proxy.resolve("ttl.example.com"); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatal(ip, err)
+	}
+	n := asked()
+	if _, err := proxy.resolve("ttl.example.com"); err != nil || asked() != n {
+		t.Error("the answer should be cached:", err, asked(), n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := proxy.resolve("ttl.example.com"); err != nil || asked() == n {
+		t.Error("the answer should expire by the TTL of the record:", err)
+	}
+
+	// failures are cached too
+	if _, err := proxy.resolve("nxdomain.example.com"); err == nil {
+		t.Fatal("nxdomain.example.com should not be resolved")
+	}
+	n = asked()
+	if _, err := proxy.resolve("nxdomain.example.com"); err == nil || asked() != n {
+		t.Error("the failure should be cached:", err, asked(), n)
+	}
+}
+
+func TestPartialSum(t *testing.T) {
+	c := &Cipher{Partial: true}
+	c.Init("12345678")
+	_, key := c.NewIV(doConnect|doPartial, nil, "")
+
+	for _, n := range []int{0, 10, sslRecordLen - 2, sslRecordLen + 100, 100 * 1024} {
+		data := bytes.Repeat([]byte("goflyway"), n/8+1)[:n]
+
+		wire := &bytes.Buffer{}
+		if _, err := c.IO.Copy(wire, bytes.NewReader(data), key, IOConfig{Partial: true, Sum: sumWrite}); err != nil {
+			t.Fatal(err)
+		}
+		if wire.Len() < n+sumHeader+sumLen {
+			t.Fatal(n, "the frames are missing:", wire.Len())
+		}
+
+		out := &bytes.Buffer{}
+		if _, err := c.IO.Copy(out, bytes.NewReader(wire.Bytes()), key, IOConfig{Partial: true, Sum: sumRead}); err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Error(n, "the stream should pass intact:", err)
+		}
+
+		if n > sslRecordLen {
+			corrupted := wire.Bytes()
+			corrupted[wire.Len()-sumHeader-sumLen-sumLen-1] ^= 1
+			out.Reset()
+			if _, err := c.IO.Copy(out, bytes.NewReader(corrupted), key, IOConfig{Partial: true, Sum: sumRead}); err != errPartialSum {
+				t.Error(n, "corruption should be detected:", err)
+			}
+			if out.Len() >= n || !bytes.HasPrefix(data, out.Bytes()) {
+				t.Error(n, "corrupted data should not be delivered")
+			}
+		}
+	}
+
+	for _, wire := range []string{"ab", string(sumFrame([]byte("ab")))} {
+		if _, err := c.IO.Copy(ioutil.Discard, strings.NewReader(wire), key, IOConfig{Partial: true, Sum: sumRead}); err != errPartialSum {
+			t.Error("a truncated stream should be detected:", err)
+		}
+	}
+
+	// an interactive exchange, every message gets through at once instead of waiting for more data
+	src1, src2 := net.Pipe()
+	wire1, wire2 := net.Pipe()
+	out1, out2 := net.Pipe()
+	defer src2.Close()
+	defer out2.Close()
+	go c.IO.Copy(wire1, src1, key, IOConfig{Partial: true, Sum: sumWrite})
+	go c.IO.Copy(out1, wire2, key, IOConfig{Partial: true, Sum: sumRead})
+
+	for _, msg := range []string{strings.Repeat("x", sslRecordLen-3), "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", "ping"} {
+		go src2.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		out2.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(out2, buf); err != nil || string(buf) != msg {
+			t.Fatal("the message should be delivered at once:", err, string(buf))
+		}
+	}
+}
+
+func TestRequestLine(t *testing.T) {
+	for uri, ok := range map[string]bool{
+		"abc": true, "a.b/c": true, "abc/": true, "a/./b": false, "a/../b": false,
+		"..": false, "a/.": false, "a//b": false, "/ab": false, ".a/b..": true,
+	} {
+		if validURI(uri) != ok {
+			t.Error(uri, "should be valid:", ok)
+		}
+	}
+
+	c := &Cipher{}
+	c.Init("12345678")
+	client := &ProxyClient{ClientConfig: &ClientConfig{Cipher: c, MaxRequestLine: 200}, rkeyHeader: "X-" + c.Alias}
+	server := &ProxyUpstream{ServerConfig: &ServerConfig{Cipher: c}, rkeyHeader: "X-" + c.Alias}
+
+	if !client.fitsURI("GET", strings.Repeat("a", 200-14)) || client.fitsURI("GET", strings.Repeat("a", 200-13)) {
+		t.Error("the request line should be kept within 200 bytes")
+	}
+	if client.MaxRequestLine = 1; client.fitsURI("GET", strings.Repeat("a", minRequestLine)) {
+		t.Error("the limit should be raised to", minRequestLine)
+	}
+
+	_, rkeybuf := c.NewIV(doConnect|doLongURL, nil, "")
+	enc := c.EncryptCompress("very.long.example.com:443"+strings.Repeat("/x", 2000), rkeybuf...)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	client.splitURI(enc, req.Header.Set)
+	if len(req.Header) < 2 || server.longURL(req, server.rkeyHeader) != enc {
+		t.Error("the URI should be carried in headers intact")
+	}
+}
+
+func TestLongURLForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("q")))
+	}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+
+	var lines []int
+	server := NewServer("8101", &ServerConfig{Cipher: c})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lines = append(lines, len(r.RequestURI))
+		server.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:       strings.TrimPrefix(upstream.URL, "http://"),
+		Transport:      plainTransport{},
+		Cipher:         c,
+		DNSCache:       lru.NewCache(16),
+		CACache:        lru.NewCache(16),
+		ACL:            acl,
+		MaxRequestLine: 200,
+	})
+
+	q := strings.Repeat("saml", 1000)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", origin.URL+"/?q="+q, http.NoBody)
+		resp, rkeybuf, err := client.encryptAndTransport(req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		c.IO.Copy(buf, resp.Body, rkeybuf, IOConfig{})
+		resp.Body.Close()
+		if buf.String() != q || resp.Header.Get(client.rkeyHeader+longURLSuffix) != "" {
+			t.Fatal("unexpected response:", buf.Len(), resp.Header)
+		}
+	}
+
+	// the URL goes in headers only after the upstream has advertised collecting them
+	if len(lines) != 2 || lines[0] <= 200 || lines[1] > 200 {
+		t.Error("unexpected request lines:", lines)
+	}
+}
+
+// dnsAnswerA answers the A question of query with ip, other questions get no answers
+func dnsAnswerA(query []byte, ip net.IP) []byte {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	end += 5
+
+	// the header without the EDNS record and the question
+	resp := append([]byte{}, query[:end]...)
+	resp[2], resp[3], resp[11] = 0x81, 0x80, 0
+	if qtype := binary.BigEndian.Uint16(resp[end-4:]); qtype != 1 {
+		return resp
+	}
+
+	resp[7] = 1
+	resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+	return append(resp, ip.To4()...)
+}
+
+func TestResolver(t *testing.T) {
+	for _, s := range []string{"", "example.com", "8.8.8.8,dns.example.com"} {
+		if _, err := ParseResolver(s); err == nil {
+			t.Error(s, "should be invalid")
+		}
+	}
+
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsAnswerA(buf[:n], net.IPv4(10, 0, 0, 1)), addr)
+		}
+	}()
+
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohContentType || len(query) < 16 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(dnsAnswerA(query, net.IPv4(10, 0, 0, 2)))
+	}))
+	defer doh.Close()
+
+	for s, want := range map[string]net.IP{
+		"127.0.0.2:1," + pc.LocalAddr().String(): net.IPv4(10, 0, 0, 1),
+		doh.URL + "/dns-query":                   net.IPv4(10, 0, 0, 2),
+	} {
+		r, err := ParseResolver(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, Resolver: r})
+		if ip, err := proxy.resolve("goflyway.example.com"); err != nil || !ip.Equal(want) {
+			t.Error(s, "should answer", want, ip, err)
+		}
+		if addr, err := proxy.resolveUDP("goflyway.example.com:53"); err != nil || !addr.IP.Equal(want) || addr.Port != 53 {
+			t.Error(s, "should answer", want, addr, err)
+		}
+	}
+}
+
+func TestVLESS(t *testing.T) {
+	for _, s := range []string{"vless://example.com:443", "vless://1234@example.com:443", "vmess://" + strings.Repeat("0", 32) + "@example.com:443"} {
+		if _, _, err := ParseVLESS(s); err == nil {
+			t.Error(s, "should be invalid")
+		}
+	}
+
+	const id = "b831381d-6324-4d53-ad4f-8cda48b30811"
+	for _, q := range []string{"security=reality", "type=ws", "flow=xtls-rprx-vision", "alpn=h2", "sni=example.com"} {
+		if _, _, err := ParseVLESS("vless://" + id + "@example.com:443?" + q); err == nil {
+			t.Error(q, "should be rejected")
+		}
+	}
+
+	up, v, err := ParseVLESS("vless://" + id + "@example.com:443?security=tls&sni=cdn.example.com&type=tcp&encryption=none#name")
+	if err != nil || up != "example.com:443" || v.ID[0] != 0xb8 || v.ID[15] != 0x11 || !v.TLS || v.SNI != "cdn.example.com" {
+		t.Fatal(up, v, err)
+	}
+
+	hdr, _ := v.header("example.com:80")
+	if want := append(append([]byte{0}, v.ID[:]...), 0, 1, 0, 80, 2, 11); !bytes.Equal(hdr, append(want, "example.com"...)) {
+		t.Error("unexpected header:", hdr)
+	}
+
+	// a VLESS inbound dialing IPv4 destinations
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				buf := make([]byte, 26)
+				if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf[1:17], v.ID[:]) || buf[21] != 1 {
+					conn.Close()
+					return
+				}
+
+				target, err := net.Dial("tcp", net.JoinHostPort(net.IP(buf[22:26]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[19:])))))
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				conn.Write([]byte{0, 2, 'x', 'y'})
+				go io.Copy(conn, target)
+				io.Copy(target, conn)
+			}()
+		}
+	}()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through vless"))
+	}))
+	defer origin.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream: ln.Addr().String(),
+		VLESS:    v,
+		Cipher:   &Cipher{},
+		DNSCache: lru.NewCache(16),
+		CACache:  lru.NewCache(16),
+		ACL:      acl,
+	})
+	defer client.Listener.Close()
+
+	c1, c2 := net.Pipe()
+	if client.dialUpstreamAndBridge(c2, strings.TrimPrefix(origin.URL, "http://"), nil, 0, nil) == nil {
+		t.Fatal("the tunnel should be opened")
+	}
+	go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\n\r\n"))
+	if resp, err := http.ReadResponse(bufio.NewReader(c1), nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal("tunnel:", err)
+	}
+	c1.Close()
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	resp, err := client.tpv.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "through vless" {
+		t.Error("forward mode:", string(body))
+	}
+	resp.Body.Close()
+
+	if _, err := client.lookupRemote("example.com"); err != errVLESSDNS {
+		t.Error("names should not be resolved by the upstream:", err)
+	}
+}
+
+func TestFakeIP(t *testing.T) {
+	for _, cidr := range []string{"fd00::/64", "198.18.0.0/30", "198.18.0.0"} {
+		if _, err := NewFakeIP(cidr); err == nil {
+			t.Error(cidr, "should be rejected")
+		}
+	}
+
+	f, _ := NewFakeIP("198.18.0.0/24")
+
+	// query of "git.corp A?"
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'g', 'i', 't', 4, 'c', 'o', 'r', 'p', 0, 0, 1, 0, 1}
+	buf := f.answer(query, nil)
+	if len(buf) < 4 || buf[2]&0x80 == 0 || buf[7] != 1 || !bytes.Equal(buf[len(buf)-4:], []byte{198, 18, 0, 1}) {
+		t.Fatal("A queries should get fake IPs:", buf)
+	}
+	if buf := f.answer(query, nil); !bytes.Equal(buf[len(buf)-4:], []byte{198, 18, 0, 1}) {
+		t.Error("names should keep their fake IPs")
+	}
+
+	aaaa := dup(query)
+	aaaa[len(query)-3] = dnsTypeAAAA
+	if buf := f.answer(aaaa, nil); buf == nil || buf[7] != 0 {
+		t.Error("AAAA queries should get empty answers:", buf)
+	}
+
+	if f.answer(query, Hosts{"git.corp": "10.0.0.7"}) != nil || f.answer(append(query[:12:12], 3, 'n', 'a', 's', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 1, 0, 1), nil) != nil {
+		t.Error("rewritten and special names should be relayed")
+	}
+
+	acl, _ := acr.LoadACL("nonexist")
+	proxy := &ProxyClient{ClientConfig: &ClientConfig{FakeIP: f, Hosts: Hosts{"git.corp": "10.0.0.7"}, DNSCache: lru.NewCache(16), ACL: acl}}
+	if dst, _, _ := proxy.route("198.18.0.1:22"); dst != "10.0.0.7:22" {
+		t.Error("fake IPs should be mapped back to names:", dst)
+	}
+	if dst, _, _ := proxy.route("198.18.0.9:22"); dst != "198.18.0.9:22" {
+		t.Error("unknown fake IPs should be kept:", dst)
+	}
+
+	for i := 0; i < 254; i++ {
+		f.alloc(strconv.Itoa(i) + ".example.com")
+	}
+	if name, ok := f.lookup("198.18.0.1:443"); !ok || name != "253.example.com:443" {
+		t.Error("the oldest address should be recycled:", name)
+	}
+}
+
+func TestWireGuard(t *testing.T) {
+	f, _ := ioutil.TempFile("", "wireguard")
+	defer os.Remove(f.Name())
+	f.WriteString(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.200.0.2/32, fd00::2/128
+MTU = 1280
+PostUp = iptables -A FORWARD # about the OS, ignored
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 127.0.0.1:51820
+PersistentKeepalive = 25
+`)
+	f.Close()
+
+	w, err := LoadWireGuard(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Address) != 2 || w.Address[0].String() != "10.200.0.2" || w.MTU != 1280 {
+		t.Error("unexpected interface:", w.Address, w.MTU)
+	}
+
+	cfg, err := w.ipc(func(e string) (string, error) { return e, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != "private_key=c809f3e5317e9575c9b5ed78b638b7ce530dabe85ddab614220241801ddf0669\nreplace_peers=true\n"+
+		"public_key=c53201039adba14be71f886da1d8dbe9eebded08cb111b75340078999aa9f038\nendpoint=127.0.0.1:51820\n"+
+		"persistent_keepalive_interval=25\nallowed_ip=0.0.0.0/0\nallowed_ip=::/0\n" {
+		t.Error("unexpected IPC config:\n" + cfg)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("[Interface]\nPrivateKey = short\n"), 0644)
+	if _, err := LoadWireGuard(f.Name()); err == nil {
+		t.Error("invalid keys should be rejected")
+	}
+
+	// destinations are dialed by an address of a family the interface has
+	ips := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}}
+	for _, c := range []struct {
+		addr []string
+		want string
+	}{
+		{[]string{"10.200.0.2", "fd00::2"}, "2001:db8::1"},
+		{[]string{"10.200.0.2"}, "192.0.2.1"},
+		{[]string{"::ffff:10.200.0.2"}, "192.0.2.1"},
+		{[]string{"fd00::2"}, "2001:db8::1"},
+	} {
+		wg := &WireGuard{}
+		for _, a := range c.addr {
+			wg.Address = append(wg.Address, netip.MustParseAddr(a))
+		}
+		if ip := wg.pick(ips); ip.String() != c.want {
+			t.Error(c.addr, "should dial", c.want, "not", ip)
+		}
+	}
+
+	if ip := (&WireGuard{Address: []netip.Addr{netip.MustParseAddr("10.200.0.2")}}).pick(ips[:1]); ip != nil {
+		t.Error("IPv6 destinations can't be dialed from an IPv4 interface:", ip)
+	}
+}
+
+func TestUDPNAT(t *testing.T) {
+	echo := func() *net.UDPConn {
+		conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, src, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteToUDP(append([]byte("echo "), buf[:n]...), src)
+			}
+		}()
+		return conn
+	}
+	e1, e2 := echo(), echo()
+	defer e1.Close()
+	defer e2.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+
+	server := NewServer("8101", &ServerConfig{Cipher: c, UDPMaxSessions: 1})
+	upstream := httptest.NewServer(server)
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+
+	relay, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	ctrl, app := net.Pipe()
+	go client.handleUDPtoTCP(relay, ctrl)
+
+	resp := make([]byte, len(okSOCKS))
+	io.ReadFull(app, resp)
+
+	sock, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer sock.Close()
+	sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// one association talks to both peers through one session
+	buf := make([]byte, 2048)
+	for i, e := range []*net.UDPConn{e1, e2, e1} {
+		hdr := udpAddrHeader("127.0.0.1", e.LocalAddr().(*net.UDPAddr).Port)
+		if _, err := sock.WriteTo(append(hdr, "ping"...), relay.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := sock.Read(buf)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(buf[:n], append(hdr, "echo ping"...)) {
+			t.Error(i, "replies should carry the peer:", buf[:n])
+		}
+	}
+
+	if n := atomic.LoadInt64(&server.udpSessions); n != 1 {
+		t.Error("the association should be one session:", n)
+	}
+
+	if _, err := server.openNAT(""); err != errUDPBusy {
+		t.Error("sessions should be limited:", err)
+	}
+
+	app.Close()
+	for i := 0; i < 50 && atomic.LoadInt64(&server.udpSessions) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&server.udpSessions); n != 0 {
+		t.Error("the session should end with the association:", n)
+	}
+}
+
+func TestSSHJump(t *testing.T) {
+	origin, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("behind the bastion"))
+			conn.Close()
+		}
+	}()
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	sc := &ssh.ServerConfig{PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		if c.User() == "alice" && string(pass) == "123456" {
+			return nil, nil
+		}
+		return nil, errors.New("denied")
+	}}
+	sc.AddHostKey(signer)
+
+	var channels int64
+	bastion, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer bastion.Close()
+	go func() {
+		for {
+			conn, err := bastion.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, sc)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					var dst struct {
+						Host     string
+						Port     uint32
+						OrigHost string
+						OrigPort uint32
+					}
+					ssh.Unmarshal(nc.ExtraData(), &dst)
+					target, err := net.Dial("tcp", net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.Port))))
+					if err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					atomic.AddInt64(&channels, 1)
+					ch, creqs, _ := nc.Accept()
+					go ssh.DiscardRequests(creqs)
+					go func() { io.Copy(ch, target); ch.Close() }()
+				}
+			}()
+		}
+	}()
+
+	f, _ := ioutil.TempFile("", "sshjump")
+	defer os.Remove(f.Name())
+	f.WriteString("[corp]\nhosts=10.0.0.0/8,*.corp\njump=" + bastion.Addr().String() + "\nuser=alice\npassword=123456\nhostkey=" + ssh.FingerprintSHA256(signer.PublicKey()) + "\n")
+	f.Close()
+
+	jumps, err := LoadSSHJumps(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jumps.match("git.corp:22") == nil || jumps.match("10.1.2.3:443") == nil || jumps.match("example.com:443") != nil {
+		t.Error("unexpected matches")
+	}
+
+	// let the local origin be behind the bastion
+	jumps[0].Hosts, _ = acr.NewHostMatcher([]string{"127.0.0.1"})
+	proxy := NewServer("8101", &ServerConfig{Cipher: &Cipher{}, SSHJumps: jumps})
+
+	for i := 0; i < 2; i++ {
+		conn, err := proxy.dial("tcp", origin.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(buf) != "behind the bastion" {
+			t.Error("unexpected response:", string(buf))
+		}
+	}
+	if n := atomic.LoadInt64(&channels); n != 2 {
+		t.Error("streams should be forwarded by the bastion:", n)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("[corp]\njump=127.0.0.1\nuser=alice\npassword=123456\n"), 0644)
+	if _, err := LoadSSHJumps(f.Name()); err == nil {
+		t.Error("bastions should be verified")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	for ep, expect := range map[string]string{
+		"localhost:4318":              "http://localhost:4318/v1/traces",
+		"https://otel.example.com/":   "https://otel.example.com/v1/traces",
+		"http://127.0.0.1:4318/spans": "http://127.0.0.1:4318/spans",
+		"ftp://example.com":           "",
+	} {
+		if tr, err := NewTracer(ep, ""); expect == "" && err == nil {
+			t.Error(ep, "should be rejected")
+		} else if expect != "" && (err != nil || tr.Endpoint != expect) {
+			t.Error(ep, err)
+		}
+	}
+
+	type span struct {
+		TraceID, SpanID, ParentSpanID, Name string
+	}
+
+	var mu sync.Mutex
+	spans := make(map[string][]span) // by service
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Value struct{ StringValue string }
+					}
+				}
+				ScopeSpans []struct{ Spans []span }
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				service := rs.Resource.Attributes[0].Value.StringValue
+				spans[service] = append(spans[service], ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("traced"))
+	}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	c.IO.StartPurgeConns(1) // bridges half closed by the app end when idle
+
+	st, _ := NewTracer(collector.URL, "server")
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c, Tracer: st}))
+	defer upstream.Close()
+
+	ct, _ := NewTracer(collector.URL, "client")
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Policy:    PolicyTunnelLAN,
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+		Tracer:    ct,
+	})
+	defer client.Listener.Close()
+
+	c1, c2 := net.Pipe()
+	go client.routeAndBridge(c2, strings.TrimPrefix(origin.URL, "http://"), nil, "TEST")
+	go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n"))
+	if resp, err := http.ReadResponse(bufio.NewReader(c1), nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal("tunnel:", err)
+	}
+	c1.Close()
+
+	names := func(service string) map[string]span {
+		m := make(map[string]span)
+		mu.Lock()
+		for _, s := range spans[service] {
+			m[s.Name] = s
+		}
+		mu.Unlock()
+		return m
+	}
+
+	for i := 0; i < 250 && (names("client")["tunnel"].SpanID == "" || names("server")["tunnel"].SpanID == ""); i++ {
+		time.Sleep(20 * time.Millisecond)
+		ct.Flush()
+		st.Flush()
+	}
+
+	cs, ss := names("client"), names("server")
+	for _, n := range []string{"tunnel", "dns", "dial", "handshake", "bridge"} {
+		if cs[n].SpanID == "" {
+			t.Error("client span missing:", n)
+		}
+	}
+	for _, n := range []string{"tunnel", "handshake", "dial", "bridge"} {
+		if ss[n].SpanID == "" {
+			t.Error("server span missing:", n)
+		}
+	}
+
+	if ss["tunnel"].TraceID != cs["tunnel"].TraceID || ss["tunnel"].ParentSpanID != cs["tunnel"].SpanID {
+		t.Error("the server should join the trace of the client:", cs["tunnel"], ss["tunnel"])
+	}
+
+	if cs["bridge"].ParentSpanID != cs["tunnel"].SpanID || cs["tunnel"].ParentSpanID != "" {
+		t.Error("client spans:", cs)
+	}
+
+	wait := func(name string) (map[string]span, map[string]span) {
+		for i := 0; i < 250 && (names("client")[name].SpanID == "" || names("server")[name].SpanID == ""); i++ {
+			time.Sleep(20 * time.Millisecond)
+			ct.Flush()
+			st.Flush()
+		}
+		return names("client"), names("server")
+	}
+
+	// forwarded requests
+	mu.Lock()
+	spans = make(map[string][]span)
+	mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	client.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+"/forward", nil))
+	if rec.Code != 200 || rec.Body.String() != "traced" {
+		t.Fatal("forward:", rec.Code, rec.Body.String())
+	}
+
+	cs, ss = wait("forward")
+	for _, n := range []string{"forward", "dns", "roundtrip"} {
+		if cs[n].SpanID == "" {
+			t.Error("client span of the forwarded request missing:", n)
+		}
+	}
+	if ss["roundtrip"].ParentSpanID != ss["forward"].SpanID {
+		t.Error("server spans of the forwarded request:", ss)
+	}
+	if ss["forward"].TraceID != cs["forward"].TraceID || ss["forward"].ParentSpanID != cs["forward"].SpanID {
+		t.Error("the server should join the trace of the forwarded request:", cs["forward"], ss["forward"])
+	}
+
+	// WebSocket tunnels
+	mu.Lock()
+	spans = make(map[string][]span)
+	mu.Unlock()
+
+	client.Policy.Set(PolicyWebSocket)
+	c1, c2 = net.Pipe()
+	go client.routeAndBridge(c2, strings.TrimPrefix(origin.URL, "http://"), nil, "TEST")
+	go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n"))
+	if resp, err := http.ReadResponse(bufio.NewReader(c1), nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal("WebSocket tunnel:", err)
+	}
+	c1.Close()
+
+	cs, ss = wait("tunnel")
+	for _, n := range []string{"tunnel", "dial", "handshake", "bridge"} {
+		if cs[n].SpanID == "" {
+			t.Error("client span of the WebSocket tunnel missing:", n)
+		}
+	}
+	if ss["tunnel"].TraceID != cs["tunnel"].TraceID || ss["tunnel"].ParentSpanID != cs["tunnel"].SpanID {
+		t.Error("the server should join the trace of the WebSocket tunnel:", cs["tunnel"], ss["tunnel"])
+	}
+}
+
+func TestPing(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	c.IO.StartPurgeConns(1)
+
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Policy:    PolicyTunnelLAN,
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+	defer client.Listener.Close()
+
+	steps := []string{"handshake", "dns", "connect", "forward"}
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	res := client.Ping(host)
+	if len(res) != len(steps) {
+		t.Fatal(res)
+	}
+	for i, r := range res {
+		if r.Step != steps[i] || r.Err != nil || r.Cost <= 0 {
+			t.Error("step should pass:", r)
+		}
+	}
+
+	// every step is still tried and reported when the upstream is down
+	upstream.Close()
+	res = client.Ping(host)
+	if len(res) != len(steps) {
+		t.Fatal(res)
+	}
+	for i, r := range res {
+		if r.Step != steps[i] || r.Err == nil {
+			t.Error("step should fail:", r)
+		}
+	}
+}
+
+func TestAltUpstreams(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via the alternate"))
+	}))
+	defer origin.Close()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	c.IO.StartPurgeConns(1)
+
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	defer upstream.Close()
+
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	tunnel := func(alts ...string) (string, error) {
+		client := NewClient("127.0.0.1:0", &ClientConfig{
+			Upstream:     dead.Addr().String(),
+			AltUpstreams: alts,
+			Policy:       PolicyTunnelLAN,
+			Cipher:       c,
+			DNSCache:     lru.NewCache(16),
+			CACache:      lru.NewCache(16),
+			ACL:          acl,
+		})
+		defer client.Listener.Close()
+
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go client.dialUpstreamAndBridge(c2, strings.TrimPrefix(origin.URL, "http://"), okHTTP, 0, nil)
+
+		r := bufio.NewReader(c1)
+		if _, err := http.ReadResponse(r, nil); err != nil {
+			return "", err
+		}
+
+		go c1.Write([]byte("GET / HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n"))
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return "", err
+		}
+		buf, err := ioutil.ReadAll(resp.Body)
+		return string(buf), err
+	}
+
+	if body, err := tunnel(upstream.Listener.Addr().String()); err != nil || body != "via the alternate" {
+		t.Error("the tunnel should be opened through the alternate:", body, err)
+	}
+
+	if _, err := tunnel(); err == nil {
+		t.Error("the tunnel should fail without alternates")
+	}
+}
+
+func TestLocalForward(t *testing.T) {
+	db, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer db.Close()
+	go func() {
+		for {
+			conn, err := db.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte("ready\n"))
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	c := &Cipher{}
+	c.Init("12345678")
+	c.IO.StartPurgeConns(1)
+
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Policy:    PolicyTunnelLAN,
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+	defer client.Listener.Close()
+
+	// the forwarder takes the socket bound here, closing it stops the forwarder
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	sockets.Lock()
+	sockets.tcp = append(sockets.tcp, ln)
+	sockets.Unlock()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- client.StartLocalForward(ln.Addr().String(), db.Addr().String()) }()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		r := bufio.NewReader(conn)
+		if line, err := r.ReadString('\n'); err != nil || line != "ready\n" {
+			t.Fatal(i, "the destination should be reached:", line, err)
+		}
+
+		conn.Write([]byte("select 1\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != "select 1\n" {
+			t.Error(i, "the tunnel should carry both ways:", line, err)
+		}
+		conn.Close()
+	}
+
+	ln.Close()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("the forwarder should stop with the listener")
+		}
+	case <-time.After(time.Second):
+		t.Error("the forwarder should stop with the listener")
+	}
+}
+
+func TestUDPForward(t *testing.T) {
+	var mu sync.Mutex
+	srcs := make(map[string]string) // of the peers by the payload
+
+	echo, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			if prev, ok := srcs[string(buf[:n])]; ok && prev != src.String() {
+				srcs[string(buf[:n])] = "moved"
+			} else {
+				srcs[string(buf[:n])] = src.String()
+			}
+			mu.Unlock()
+			echo.WriteToUDP(append([]byte("echo "), buf[:n]...), src)
+		}
+	}()
+
+	c := &Cipher{}
+	c.Init("12345678")
+
+	upstream := httptest.NewServer(NewServer("8101", &ServerConfig{Cipher: c}))
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+	defer client.Listener.Close()
+
+	// the forwarder takes the socket bound here, closing it stops the forwarder
+	ln, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	sockets.Lock()
+	sockets.udp = append(sockets.udp, ln)
+	sockets.Unlock()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- client.StartUDPForward(ln.LocalAddr().String(), echo.LocalAddr().String()) }()
+
+	// peers have their own sessions, replies go back to the peer of the session
+	buf := make([]byte, 2048)
+	for _, msg := range []string{"a", "b"} {
+		peer, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer peer.Close()
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		for i := 0; i < 2; i++ {
+			if _, err := peer.WriteTo([]byte(msg), ln.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := peer.Read(buf)
+			if err != nil || string(buf[:n]) != "echo "+msg {
+				t.Fatal(msg, i, "the destination should answer:", string(buf[:n]), err)
+			}
+		}
+	}
+
+	mu.Lock()
+	if srcs["a"] == "moved" || srcs["b"] == "moved" || srcs["a"] == srcs["b"] {
+		t.Error("each peer should have a session of its own:", srcs)
+	}
+	mu.Unlock()
+
+	ln.Close()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("the forwarder should stop with the socket")
+		}
+	case <-time.After(time.Second):
+		t.Error("the forwarder should stop with the socket")
+	}
+}
+
+func TestNotice(t *testing.T) {
+	c := &Cipher{}
+	c.Init("12345678")
+
+	server := NewServer("8101", &ServerConfig{Cipher: c})
+	upstream := httptest.NewServer(server)
+	defer upstream.Close()
+
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  strings.TrimPrefix(upstream.URL, "http://"),
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+	defer client.Listener.Close()
+
+	if n := server.Broadcast("nobody"); n != 0 {
+		t.Error("no client is subscribed:", n)
+	}
+
+	go client.waitNotice()
+	for i := 0; i < 100 && server.Broadcast("maintenance at 2:00") == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for i := 0; i < noticeKeep+4; i++ {
+		if n := server.Broadcast("quota " + strconv.Itoa(i)); n != 1 {
+			t.Fatal("the client should receive the notice:", n)
+		}
+	}
+
+	last := "quota " + strconv.Itoa(noticeKeep+3)
+	var ns []Notice
+	for i := 0; i < 100; i++ {
+		if ns = client.Notices(); len(ns) > 0 && ns[len(ns)-1].Text == last {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if len(ns) != noticeKeep || ns[0].Text != "quota 4" || ns[len(ns)-1].Text != last {
+		t.Error("recent notices should be kept in order:", ns)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	origin, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(conn, conn); conn.Close() }()
+		}
+	}()
+
+	// each end counts its own bridges and traffic
+	c, sc := &Cipher{}, &Cipher{}
+	c.Init("12345678")
+	sc.Init("12345678")
+	c.IO.StartPurgeConns(1)
+	sc.IO.StartPurgeConns(1)
+
+	server := NewServer("8101", &ServerConfig{Cipher: sc})
+	upstream := httptest.NewServer(server)
+	defer upstream.Close()
+
+	up := strings.TrimPrefix(upstream.URL, "http://")
+	acl, _ := acr.LoadACL("nonexist")
+	client := NewClient("127.0.0.1:0", &ClientConfig{
+		Upstream:  up,
+		Policy:    PolicyTunnelLAN,
+		Transport: plainTransport{},
+		Cipher:    c,
+		DNSCache:  lru.NewCache(16),
+		CACache:   lru.NewCache(16),
+		ACL:       acl,
+	})
+	defer client.Listener.Close()
+
+	c1, c2 := net.Pipe()
+	go client.dialUpstreamAndBridge(c2, origin.Addr().String(), nil, 0, nil)
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	c1.Write([]byte("status"))
+	if _, err := io.ReadFull(c1, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, ss := client.Status(), server.Status()
+	if cs.Role != "client" || cs.Upstream != up || cs.Bridges != 1 || cs.Latency <= 0 || cs.Sent == 0 || cs.Received == 0 {
+		t.Error("client status:", cs)
+	}
+	if ss.Role != "server" || ss.Upstream != "" || ss.Bridges != 1 || ss.Draining {
+		t.Error("server status:", ss)
+	}
+
+	c1.Close()
+	for i := 0; i < 250 && (client.Status().Bridges > 0 || server.Status().Bridges > 0); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if cs, ss := client.Status(), server.Status(); cs.Bridges != 0 || ss.Bridges != 0 {
+		t.Error("closed bridges should be gone:", cs.Bridges, ss.Bridges)
+	}
+
+	// fields are named for scripts, empty ones of the other role are omitted
+	buf, _ := json.Marshal(server.Status())
+	m := map[string]interface{}{}
+	json.Unmarshal(buf, &m)
+	for _, k := range []string{"version", "role", "uptime_seconds", "bridges", "sent_bytes", "received_bytes", "clock_skew_seconds"} {
+		if _, ok := m[k]; !ok {
+			t.Error("missing", k, string(buf))
+		}
+	}
+	if _, ok := m["upstream"]; ok {
+		t.Error("the server has no upstream:", string(buf))
+	}
+}
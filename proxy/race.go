@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+var errRaceLost = errors.New("race lost")
+
+type raceResult struct {
+	conn    net.Conn
+	rkeybuf []byte
+	ioc     IOConfig
+	r       byte
+	err     error
+}
+
+// raceAndBridge dials host directly and through the upstream, the latter starts after a handicap of Race
+// unless the direct one fails earlier, the first established conn will be bridged and the winner remembered,
+// both dials are traced in span along with the bridge
+func (proxy *ProxyClient) raceAndBridge(downstreamConn net.Conn, host string, resp []byte, span *Span) {
+	results, done, directFailed := make(chan raceResult, 2), make(chan bool), make(chan bool)
+
+	go func() {
+		ds := span.child("dial", time.Now())
+		ds.set("upstream", "direct")
+		conn, err := net.DialTimeout("tcp", host, timeoutDial)
+		ds.end(err)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				name, _ := splitHostPort(host)
+				proxy.RouteBook.fail(name)
+			}
+			close(directFailed)
+		}
+		results <- raceResult{conn: conn, r: rulePass, err: err}
+	}()
+
+	go func() {
+		select {
+		case <-time.After(proxy.Race):
+		case <-directFailed:
+		case <-done:
+			results <- raceResult{err: errRaceLost}
+			return
+		}
+
+		dial := func() (net.Conn, string, error) { return proxy.dialFor(host) }
+		conn, rkeybuf, ioc, err := proxy.openTunnelVia(dial, host, 0, "", span)
+		results <- raceResult{conn: conn, rkeybuf: rkeybuf, ioc: ioc, r: ruleProxy, err: err}
+	}()
+
+	var direct, tunnel error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			if res.r == rulePass {
+				direct = res.err
+			} else {
+				tunnel = res.err
+			}
+			continue
+		}
+
+		close(done)
+		if i == 0 {
+			go func() {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}()
+		}
+
+		name, _ := splitHostPort(host)
+		proxy.RouteBook.learn(name, res.r)
+
+		if resp != nil {
+			downstreamConn.Write(resp)
+		}
+
+		if res.r == rulePass {
+			logg.D("race ", host, ": direct won")
+			span.set("race", "direct")
+			go proxy.Cipher.IO.Bridge(downstreamConn, res.conn, nil, IOConfig{Span: span})
+		} else {
+			logg.D("race ", host, ": upstream won")
+			span.set("race", "upstream")
+			res.ioc.Span = span
+			downstreamConn = proxy.Cipher.IO.Dump.Wrap(downstreamConn, host)
+			go proxy.Cipher.IO.Bridge(downstreamConn, res.conn, res.rkeybuf, res.ioc)
+		}
+		return
+	}
+
+	logg.E("race ", host, ": ", direct, ", ", tunnel)
+	if tunnel != errRaceLost {
+		span.end(tunnel)
+	} else {
+		span.end(direct)
+	}
+	if reason := closeReasonOf(tunnel); reason != CloseUnknown {
+		replyFailure(downstreamConn, resp, reason)
+	} else {
+		replyFailure(downstreamConn, resp, dialCloseReason(direct))
+	}
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/codec"
+)
+
+// CloseReason tells the client why the upstream refused a stream, it is sent encrypted
+// in the closeReasonHeader of the non-200 response
+type CloseReason byte
+
+const (
+	CloseUnknown CloseReason = iota
+	CloseDialFailed
+	CloseDialTimeout
+	CloseDialRefused
+	CloseUDPDisabled
+	CloseUnsupported
+	CloseDenied
+	CloseNetUnreachable
+	CloseHostUnreachable
+	CloseDraining
+	CloseUDPBusy
+	CloseIPBusy
+)
+
+const closeReasonHeader = "X-Request-Id"
+
+var closeReasonText = [...]string{
+	"unknown",
+	"upstream failed to dial the target",
+	"upstream timed out dialing the target",
+	"target refused the connection",
+	"upstream disabled UDP relay",
+	"upstream doesn't support this kind of stream",
+	"upstream denied the stream",
+	"network unreachable",
+	"host unreachable",
+	"upstream is draining for maintenance",
+	"upstream has too many UDP sessions",
+	"upstream has too many streams from the address",
+}
+
+// SOCKS5 reply codes of each reason, see RFC 1928 section 6
+var closeReasonSOCKS = [...]byte{
+	CloseUnknown:         0x01, // general failure
+	CloseDialFailed:      0x01,
+	CloseDialTimeout:     0x06, // TTL expired
+	CloseDialRefused:     0x05, // connection refused
+	CloseUDPDisabled:     0x07, // command not supported
+	CloseUnsupported:     0x07,
+	CloseDenied:          0x02, // not allowed by ruleset
+	CloseNetUnreachable:  0x03, // network unreachable
+	CloseHostUnreachable: 0x04, // host unreachable
+	CloseDraining:        0x01,
+	CloseUDPBusy:         0x01,
+	CloseIPBusy:          0x01,
+}
+
+func (r CloseReason) String() string {
+	if int(r) < len(closeReasonText) {
+		return closeReasonText[r]
+	}
+	return "reason " + strconv.Itoa(int(r))
+}
+
+// CloseError is returned when the upstream explicitly refused the stream
+type CloseError struct {
+	Reason CloseReason
+	Stream string
+}
+
+func (e *CloseError) Error() string {
+	return "upstream refused the stream [" + e.Stream + "]: " + e.Reason.String()
+}
+
+// dialCloseReason classifies the error returned by net.Dial
+func dialCloseReason(err error) CloseReason {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseDialTimeout
+	}
+
+	if oe, ok := err.(*net.OpError); ok {
+		if _, ok := oe.Err.(*net.DNSError); ok {
+			return CloseHostUnreachable
+		}
+	}
+
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "connection refused"):
+		return CloseDialRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return CloseNetUnreachable
+	case strings.Contains(msg, "no route to host"), strings.Contains(msg, "host is down"):
+		return CloseHostUnreachable
+	}
+
+	return CloseDialFailed
+}
+
+// closeReasonOf returns the reason sent by the upstream, or CloseUnknown if err is a local one
+func closeReasonOf(err error) CloseReason {
+	if ce, ok := err.(*CloseError); ok {
+		return ce.Reason
+	}
+	return CloseUnknown
+}
+
+// socksReply builds the failure reply to a SOCKS5 CONNECT
+func socksReply(reason CloseReason) []byte {
+	code := byte(0x01)
+	if int(reason) < len(closeReasonSOCKS) {
+		code = closeReasonSOCKS[reason]
+	}
+	return []byte{socksVersion5, code, 0, 1, 0, 0, 0, 0, 0, 0}
+}
+
+// replyFailure tells the downstream why its CONNECT failed if it is still waiting for resp
+func replyFailure(downstreamConn net.Conn, resp []byte, reason CloseReason) {
+	if len(resp) == len(okSOCKS) && resp[0] == socksVersion5 {
+		downstreamConn.Write(socksReply(reason))
+	} else if bytes.Equal(resp, okSOCKS4) {
+		downstreamConn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+	}
+	downstreamConn.Close()
+}
+
+// refuse responds a 502 carrying the reason encrypted by gc and closes conn,
+// refusals of a draining server also carry the Retry-After hint
+func (proxy *ProxyUpstream) refuse(w http.ResponseWriter, conn net.Conn, gc *codec.Codec, rkeybuf []byte, reason CloseReason) {
+	v := gc.EncryptCompress(strconv.Itoa(int(reason)), rkeybuf...)
+
+	var retry string
+	if d, ok := proxy.Draining(); ok && reason == CloseDraining {
+		retry = strconv.Itoa(int(d / time.Second))
+	}
+
+	if _, ok := conn.(*streamConn); ok {
+		w.Header().Set(closeReasonHeader, v)
+		if retry != "" {
+			w.Header().Set("Retry-After", retry)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	} else {
+		if retry != "" {
+			retry = "Retry-After: " + retry + "\r\n"
+		}
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n" + closeReasonHeader + ": " + v + "\r\n" + retry + "Content-Length: 0\r\n\r\n"))
+	}
+
+	conn.Close()
+}
+
+// readCloseReason extracts the reason from the response header sent by refuse
+func (proxy *ProxyClient) readCloseReason(host string, resp []byte, rkeybuf []byte) error {
+	if v := headerValue(resp, closeReasonHeader); v != "" {
+		v = proxy.Cipher.DecryptDecompress(v, rkeybuf...)
+		if r, err := strconv.Atoi(v); err == nil {
+			return &CloseError{Reason: CloseReason(r), Stream: streamID(rkeybuf)}
+		}
+	}
+
+	return errors.New("upstream refused to connect " + host + " [" + streamID(rkeybuf) + "]")
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Reload re-reads users, throttling and bans from ConfigFile and UsersFile, options missing from
+// the config keep their values. Bridged streams keep their token buckets, new ones get the new limits.
+func (proxy *ProxyUpstream) Reload() error {
+	proxy.reloadMu.RLock()
+	throt, max, scope := proxy.Throttling, proxy.ThrottlingMax, proxy.ThrottlingScope
+	usersFile, bans := proxy.UsersFile, proxy.configBans
+	proxy.reloadMu.RUnlock()
+
+	var auth string
+	if proxy.ConfigFile != "" {
+		c, err := openConfFile(proxy.ConfigFile, nil)
+		if err != nil {
+			return err
+		}
+
+		throt, max = c.num("throt", throt), c.num("throtmax", max)
+		if s := c.str("throtscope", ""); s != "" {
+			if scope, err = ParseThrottlingScope(s); err != nil {
+				c.fail(err.Error())
+			}
+		}
+
+		if l := c.ips("ban"); l != nil {
+			bans = l
+		}
+
+		usersFile, auth = c.str("users", usersFile), c.str("auth", "")
+		if len(c.errs) > 0 {
+			return c.errs
+		}
+	}
+
+	var fromFile map[string]UserConfig
+	if usersFile != "" {
+		var err error
+		if fromFile, err = LoadUsers(usersFile); err != nil {
+			return err
+		}
+	}
+
+	proxy.reloadMu.Lock()
+	// users not from the file (e.g. -a) are kept
+	users := make(map[string]UserConfig)
+	for name, u := range proxy.Users {
+		if !proxy.fileUsers[name] {
+			users[name] = u
+		}
+	}
+
+	proxy.fileUsers = make(map[string]bool)
+	for name, u := range fromFile {
+		users[name] = u
+		proxy.fileUsers[name] = true
+	}
+
+	if auth != "" {
+		// so it is dropped or replaced when the config changes
+		users[userName(auth)] = UserConfig{Auth: auth}
+		proxy.fileUsers[userName(auth)] = true
+	}
+
+	if len(users) > 0 || proxy.Users != nil {
+		proxy.Users = users
+	}
+
+	proxy.Throttling, proxy.ThrottlingMax, proxy.ThrottlingScope = throt, max, scope
+	proxy.UsersFile = usersFile
+	proxy.replica.usersAt = usersStamp(usersFile)
+	oldBans := proxy.configBans
+	proxy.configBans = bans
+	proxy.reloadMu.Unlock()
+
+	proxy.bucketsMu.Lock()
+	proxy.buckets = make(map[string]*TokenBucket)
+	proxy.bucketsMu.Unlock()
+
+	// bans still in the config are kept as they are, so when they were banned isn't reset
+	kept := make(map[string]bool)
+	for _, ip := range bans {
+		kept[ip] = true
+	}
+	for _, ip := range oldBans {
+		if !kept[ip] {
+			proxy.Unban(ip)
+		}
+	}
+	proxy.bans.mu.Lock()
+	for _, ip := range bans {
+		if _, ok := proxy.bans.m[ip]; !ok {
+			proxy.bans.m[ip] = time.Now()
+		}
+	}
+	proxy.bans.mu.Unlock()
+
+	logg.L("reloaded, ", len(users), " users, throttling ", throt, " bytes/s")
+	return nil
+}
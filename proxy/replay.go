@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Clients stamp the last 4 bytes of every request's IV with the upstream's time (their own
+// clock corrected by the estimated skew), so with AntiReplay the upstream can reject a captured
+// request header sent again by an active prober: it is either too old or already seen
+const replayAge = 10 // seconds a request is valid for, like trusted tokens
+
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[[ivLen]byte]int64 // IV -> time stamped in it
+	purged int64
+}
+
+// newIV generates the IV of a request, stamped with the time
+func (proxy *ProxyClient) newIV(o Options) (string, []byte) {
+	_, buf := proxy.Cipher.NewIV(o, nil, proxy.UserAuth)
+
+	now := time.Now()
+	if skew, ok := proxy.ClockSkew(); ok {
+		now = now.Add(skew)
+	}
+
+	binary.BigEndian.PutUint32(buf[ivLen-4:], uint32(now.Unix()))
+	return proxy.Cipher.NewIV(o, buf, proxy.UserAuth)
+}
+
+// replayed tells if rkeybuf is stamped out of the window or has been seen, by this server or others sharing State
+func (proxy *ProxyUpstream) replayed(rkeybuf []byte) bool {
+	tol := proxy.skewTolerance()
+	if proxy.replay.replayed(rkeybuf, tol) {
+		return true
+	}
+
+	if proxy.State == nil {
+		return false
+	}
+
+	fresh, err := proxy.State.Add(stateIV+hex.EncodeToString(rkeybuf), replayAge*time.Second+2*tol)
+	if err != nil {
+		logg.W("shared state: ", err)
+		return false
+	}
+	return !fresh
+}
+
+// replayed tells if rkeybuf is stamped out of the window, or has been seen within it,
+// tol widens the window on both sides so clients whose clocks are slightly off won't be rejected
+func (c *replayCache) replayed(rkeybuf []byte, tol time.Duration) bool {
+	if len(rkeybuf) != ivLen {
+		return true
+	}
+
+	sent, now := int64(binary.BigEndian.Uint32(rkeybuf[ivLen-4:])), time.Now().Unix()
+	t := int64(tol / time.Second)
+	if d := now - sent; d >= replayAge+t || d < -t {
+		return true
+	}
+
+	var iv [ivLen]byte
+	copy(iv[:], rkeybuf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen == nil {
+		c.seen = make(map[[ivLen]byte]int64)
+	}
+
+	// IVs stamped out of the window will be rejected anyway, no need to remember them
+	if now != c.purged {
+		for k, s := range c.seen {
+			if now-s >= replayAge+t {
+				delete(c.seen, k)
+			}
+		}
+		c.purged = now
+	}
+
+	if _, ok := c.seen[iv]; ok {
+		return true
+	}
+
+	c.seen[iv] = sent
+	return false
+}
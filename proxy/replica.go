@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// A warm standby shares users, traffic counters and the blacklist with its peer, so clients failing over
+// between the two (see ClientConfig.AltUpstreams) are admitted, accounted and rejected the same way.
+// Each server pushes its state to the other every syncInterval, encrypted and signed with the shared password:
+//   - users are taken from the side whose users file was modified later
+//   - the traffic of each user on the peer is kept apart and added up by ClusterTraffic
+//   - bans and unbans made since the last push are applied, new offenders are tracked
+const (
+	syncInterval = 5 * time.Second
+	syncPath     = "/sync"
+	syncHeader   = "X-Sync-Signature"
+)
+
+// replica is the state pushed to the peer
+type replica struct {
+	At        int64                 `json:"at"`       // unix nanoseconds of the push, older pushes are ignored
+	UsersAt   int64                 `json:"users_at"` // see usersStamp
+	Users     map[string]UserConfig `json:"users"`
+	Traffic   map[string][2]uint64  `json:"traffic"` // bytes in and out of each user on the sender only
+	Bans      map[string]time.Time  `json:"bans"`
+	Offenders []BlacklistEntry      `json:"offenders"`
+}
+
+type replicaState struct {
+	mu        sync.Mutex
+	last      int64                // At of the last push applied
+	usersAt   int64                // guarded by reloadMu instead
+	traffic   map[string][2]uint64 // of the last push
+	bans      map[string]bool      // of the last push
+	offenders map[string]bool      // of the last push
+	up        bool                 // the last push to the peer succeeded
+}
+
+// usersStamp is when the users file was modified, a server without one never overrides its peer
+func usersStamp(path string) int64 {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.ModTime().UnixNano()
+	}
+	return 0
+}
+
+func (proxy *ProxyUpstream) sign(buf []byte) string {
+	mac := hmac.New(sha256.New, proxy.Cipher.Key)
+	mac.Write(buf)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts a push under a random IV prepended to it, users and their credentials are included
+func (proxy *ProxyUpstream) seal(buf []byte) []byte {
+	iv := make([]byte, ivLen)
+	rand.Read(iv)
+	return append(iv, proxy.Cipher.Encrypt(buf, iv...)...)
+}
+
+// unseal decrypts a push sealed by the peer, its signature should have been checked
+func (proxy *ProxyUpstream) unseal(buf []byte) []byte {
+	if len(buf) < ivLen {
+		return nil
+	}
+	return proxy.Cipher.Decrypt(buf[ivLen:], buf[:ivLen]...)
+}
+
+// snapshot returns the state of this server to push, what was learned from the peer is included
+// except the traffic, which is only of this server
+func (proxy *ProxyUpstream) snapshot() *replica {
+	r := &replica{
+		At:    time.Now().UnixNano(),
+		Users: make(map[string]UserConfig),
+		Bans:  make(map[string]time.Time),
+	}
+
+	proxy.reloadMu.RLock()
+	r.UsersAt = proxy.replica.usersAt
+	for name, u := range proxy.Users {
+		r.Users[name] = u
+	}
+	proxy.reloadMu.RUnlock()
+
+	r.Traffic = proxy.traffic()
+	for _, e := range proxy.Blacklist() {
+		if e.Manual {
+			r.Bans[e.Addr] = e.FirstSeen
+		} else {
+			r.Offenders = append(r.Offenders, e)
+		}
+	}
+	return r
+}
+
+// apply merges a push of the peer
+func (proxy *ProxyUpstream) apply(r *replica) error {
+	s := &proxy.replica
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.At <= s.last {
+		return errors.New("stale push")
+	}
+	s.last = r.At
+
+	proxy.reloadMu.Lock()
+	replaced := r.UsersAt > s.usersAt
+	if replaced {
+		s.usersAt = r.UsersAt
+		proxy.Users = r.Users
+		// replaced by the users file again on Reload
+		proxy.fileUsers = make(map[string]bool)
+		for name := range r.Users {
+			proxy.fileUsers[name] = true
+		}
+		logg.L("users replicated from the peer, ", len(r.Users), " users")
+	}
+	proxy.reloadMu.Unlock()
+
+	if replaced {
+		proxy.bucketsMu.Lock()
+		proxy.buckets = make(map[string]*TokenBucket)
+		proxy.bucketsMu.Unlock()
+	}
+
+	s.traffic = r.Traffic
+
+	bans := make(map[string]bool)
+	for addr, t := range r.Bans {
+		bans[addr] = true
+		if !s.bans[addr] {
+			proxy.bans.mu.Lock()
+			if _, ok := proxy.bans.m[addr]; !ok {
+				proxy.bans.m[addr] = t
+			}
+			proxy.bans.mu.Unlock()
+		}
+	}
+	for addr := range s.bans {
+		if !bans[addr] {
+			proxy.Unban(addr)
+		}
+	}
+	s.bans = bans
+
+	offenders := make(map[string]bool)
+	for _, e := range r.Offenders {
+		offenders[e.Addr] = true
+		if _, ok := proxy.blacklist.Peek(e.Addr); !ok && !s.offenders[e.Addr] {
+			proxy.blacklist.Add(e.Addr, &offender{first: e.FirstSeen, last: e.LastSeen, hits: e.Hits})
+		}
+	}
+	s.offenders = offenders
+	return nil
+}
+
+// serveSync handles the pushes of the peer
+func (proxy *ProxyUpstream) serveSync(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil || r.Method != "POST" || r.URL.Path != syncPath ||
+		!hmac.Equal([]byte(r.Header.Get(syncHeader)), []byte(proxy.sign(buf))) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	rep := &replica{}
+	if err := json.Unmarshal(proxy.unseal(buf), rep); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// a push captured and sent again would revert bans
+	if d := time.Since(time.Unix(0, rep.At)); d > proxy.skewTolerance()+syncInterval || d < -proxy.skewTolerance() {
+		logg.W("sync: push from ", r.RemoteAddr, " is ", d, " off, the clocks may be out of sync")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := proxy.apply(rep); err != nil {
+		w.WriteHeader(http.StatusConflict)
+	}
+}
+
+// push sends the state of this server to the peer
+func (proxy *ProxyUpstream) push(client *http.Client) error {
+	buf, err := json.Marshal(proxy.snapshot())
+	if err != nil {
+		return err
+	}
+	buf = proxy.seal(buf)
+
+	req, _ := http.NewRequest("POST", "http://"+proxy.SyncPeer+syncPath, bytes.NewReader(buf))
+	req.Header.Set(syncHeader, proxy.sign(buf))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return errors.New(resp.Status + ", check the password of the peer")
+	}
+	return nil
+}
+
+// StartSync listens on Sync for the pushes of SyncPeer and pushes to it in turn until Shutdown
+func (proxy *ProxyUpstream) StartSync() error {
+	ln, err := listenTCP(proxy.Sync)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		client := &http.Client{Timeout: syncInterval}
+		tick := time.NewTicker(syncInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+			case <-stop:
+				return
+			}
+
+			err := proxy.push(client)
+
+			s := &proxy.replica
+			s.mu.Lock()
+			if up := err == nil; up != s.up {
+				s.up = up
+				if up {
+					logg.L("sync: the peer ", proxy.SyncPeer, " is up")
+				} else {
+					logg.W("sync: the peer ", proxy.SyncPeer, " is down: ", err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}()
+
+	return proxy.serveWith(ln, &http.Server{Handler: http.HandlerFunc(proxy.serveSync)})
+}
+
+// traffic returns the bytes in and out of each user on this server
+func (proxy *ProxyUpstream) traffic() map[string][2]uint64 {
+	ret := make(map[string][2]uint64)
+	m := &proxy.serverMetrics
+	m.metersMu.Lock()
+	for user, tm := range m.meters {
+		ret[user] = [2]uint64{atomic.LoadUint64(&tm.in), atomic.LoadUint64(&tm.out)}
+	}
+	m.metersMu.Unlock()
+	return ret
+}
+
+// ClusterTraffic returns the bytes in and out of each user on this server and its peer
+func (proxy *ProxyUpstream) ClusterTraffic() map[string][2]uint64 {
+	ret := proxy.traffic()
+
+	proxy.replica.mu.Lock()
+	for user, t := range proxy.replica.traffic {
+		ret[user] = [2]uint64{ret[user][0] + t[0], ret[user][1] + t[1]}
+	}
+	proxy.replica.mu.Unlock()
+	return ret
+}
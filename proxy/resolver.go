@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the content type of DNS messages carried by DNS-over-HTTPS (RFC 8484)
+const dohContentType = "application/dns-message"
+
+// ParseResolver returns the resolver asking DNS servers like "8.8.8.8,1.1.1.1:53", tried in turn
+// when one fails, or a DNS-over-HTTPS endpoint like "https://1.1.1.1/dns-query" instead of those
+// of the system, which may be poisoned or rate limited. Names in /etc/hosts are still answered by it
+func ParseResolver(s string) (*net.Resolver, error) {
+	if strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+
+		client := &http.Client{Timeout: timeoutDial}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, url: u.String(), client: client}, nil
+			},
+		}, nil
+	}
+
+	var servers []string
+	for _, s := range strings.Split(s, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		addr := hostWithPort(s, "53")
+		if host, _, err := net.SplitHostPort(addr); err != nil || net.ParseIP(host) == nil {
+			return nil, errors.New("invalid DNS server, expect an IP: " + s)
+		}
+		servers = append(servers, addr)
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers")
+	}
+
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// each retry of the Go resolver goes to the next server
+			addr := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			return (&net.Dialer{Timeout: timeoutDial}).DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// dohConn exchanges the DNS messages of the Go resolver with a DNS-over-HTTPS endpoint, it isn't a
+// net.PacketConn, so the messages written and read are prefixed with their lengths like on TCP
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+	resp   bytes.Reader
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	if len(p) < 2 || int(binary.BigEndian.Uint16(p)) != len(p)-2 {
+		return 0, errors.New("doh: unexpected DNS message")
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(p[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("doh: " + resp.Status)
+	}
+
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	c.resp.Reset(buf)
+	return len(p), nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error) { return c.resp.Read(p) }
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "doh" }
+func (a dohAddr) String() string  { return string(a) }
+
+// lookup4 returns the first IPv4 of host by Resolver, and the least TTL of the records answered,
+// 0 if there are none like names in /etc/hosts
+func (proxy *ProxyUpstream) lookup4(host string) (net.IP, time.Duration, error) {
+	var ttl dnsTTL
+	ips, err := ttl.resolver(proxy.Resolver).LookupIP(context.Background(), "ip4", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips[0], ttl.get(), nil
+}
+
+// resolveUDP is net.ResolveUDPAddr by Resolver
+func (proxy *ProxyUpstream) resolveUDP(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := proxy.Resolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv4 first like net.ResolveUDPAddr
+	ip := ips[0]
+	for _, x := range ips {
+		if x.To4() != nil {
+			ip = x
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: p}, nil
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/coyove/tcpmux"
+)
+
+type surveys []tcpmux.Survey
+
+func (s surveys) Count() (conns int, streams int) {
+	for _, x := range s {
+		c, n := x.Count()
+		conns, streams = conns+c, streams+n
+	}
+	return
+}
+
+// startWorkers binds Workers listeners to each address with SO_REUSEPORT,
+// so the kernel spreads incoming connections among their accept loops
+func (proxy *ProxyUpstream) startWorkers(addrs []bindAddr) error {
+	var lns []net.Listener
+	for _, b := range addrs {
+		for i := 0; i < proxy.Workers; i++ {
+			ln, err := listenReusePort(b.network, b.addr)
+			if err != nil {
+				for _, ln := range lns {
+					ln.Close()
+				}
+				return err
+			}
+			lns = append(lns, ln)
+		}
+	}
+
+	return proxy.serveAll(lns)
+}
@@ -0,0 +1,7 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package proxy
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,4 @@
+package proxy
+
+// syscall doesn't define SO_REUSEPORT on linux
+const soReusePort = 0xf
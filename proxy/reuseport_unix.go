@@ -0,0 +1,25 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+func listenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	return lc.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/codec"
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Reverse tunnels let the upstream reach the network of the client:
+// the client parks idle tunnels whose host is reverseScheme+name on the upstream,
+// when the upstream needs to connect somewhere, it sends the target (encrypted, ends with '\n')
+// through a parked tunnel, the client then dials the target and bridges them.
+// Name is empty for the reverse SOCKS, or "<listen>/<target>" for remote port forwarding.
+// Tunnels are pooled by the user parking them, the reverse SOCKS only exits through those of the user
+// authenticated by it.
+const (
+	reverseScheme   = "reverse://"
+	reversePoolSize = 64
+	reverseRetry    = 5 * time.Second
+)
+
+var errNoReverseConn = errors.New("no reverse client is connected")
+
+type reverseConn struct {
+	net.Conn
+	gc       *codec.Codec // the key the client parked the tunnel by
+	key      []byte
+	partial  bool
+	pool     *reversePool
+	idle     chan struct{} // closed when watchIdle returns
+	released bool          // guarded by reverseMu
+}
+
+// reverseKey identifies the parked tunnels of a user, see parkReverse
+type reverseKey struct {
+	user, name string
+}
+
+// reversePool holds the parked tunnels of a key, the listener of a remote port forwarding is closed
+// when the last tunnel of the client, parked or bridged, ends
+type reversePool struct {
+	key   reverseKey
+	ch    chan *reverseConn
+	ln    net.Listener // nil for the reverse SOCKS
+	conns int          // guarded by reverseMu
+}
+
+// parkReverse keeps the tunnel of user until someone needs it
+func (proxy *ProxyUpstream) parkReverse(conn net.Conn, user, name string, gc *codec.Codec, key []byte, partial bool) {
+	if name == "" && proxy.ReverseSOCKS == "" || name != "" && !proxy.RemoteForward {
+		logg.W("client is trying to park a reverse tunnel but we disabled it")
+		conn.Close()
+		return
+	}
+
+	pool := proxy.reversePool(reverseKey{user, name})
+	if pool == nil {
+		conn.Close()
+		return
+	}
+
+	rc := &reverseConn{Conn: conn, gc: gc, key: key, partial: partial, pool: pool, idle: make(chan struct{})}
+	select {
+	case pool.ch <- rc:
+		go proxy.watchIdle(rc)
+	default:
+		logg.W("too many reverse tunnels parked")
+		proxy.releaseReverse(rc)
+	}
+}
+
+// watchIdle waits for a parked tunnel to break, the client sends nothing before it is given a target,
+// dialReverse stops the watch by a read deadline when it takes the tunnel
+func (proxy *ProxyUpstream) watchIdle(rc *reverseConn) {
+	defer close(rc.idle)
+
+	_, err := rc.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return
+	}
+
+	// broken, or the client is speaking out of turn
+	proxy.releaseReverse(rc)
+}
+
+// releaseReverse closes a tunnel which is no longer parked nor bridged, releasing it again does nothing
+func (proxy *ProxyUpstream) releaseReverse(rc *reverseConn) {
+	rc.Conn.Close()
+
+	proxy.reverseMu.Lock()
+	defer proxy.reverseMu.Unlock()
+
+	if rc.released {
+		return
+	}
+	rc.released = true
+
+	pool := rc.pool
+	if pool.conns--; pool.conns > 0 || pool.ln == nil {
+		return
+	}
+
+	if proxy.reverse[pool.key] == pool {
+		delete(proxy.reverse, pool.key)
+	}
+	pool.ln.Close()
+	logg.L("remote port forwarding ", pool.key.name, " is closed, no client is connected")
+}
+
+// allowBind tells whether clients may listen on addr for remote port forwarding:
+// loopback addresses and those in RemoteBinds
+func (proxy *ProxyUpstream) allowBind(addr string) bool {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return false
+	}
+
+	if isLoopback(addr) {
+		return true
+	}
+
+	for _, b := range proxy.RemoteBinds {
+		if b == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// reversePool returns the pool of key counting a new tunnel in, a new remote port forwarding
+// starts listening when its pool is created
+func (proxy *ProxyUpstream) reversePool(key reverseKey) *reversePool {
+	proxy.reverseMu.Lock()
+	defer proxy.reverseMu.Unlock()
+
+	if pool := proxy.reverse[key]; pool != nil {
+		pool.conns++
+		return pool
+	}
+
+	pool := &reversePool{key: key, ch: make(chan *reverseConn, reversePoolSize), conns: 1}
+	if name := key.name; name != "" {
+		idx := strings.Index(name, "/")
+		if idx == -1 {
+			logg.W("invalid remote port forwarding: ", name)
+			return nil
+		}
+
+		if !proxy.allowBind(name[:idx]) {
+			logg.W("remote port forwarding: listening on ", name[:idx], " is not allowed")
+			return nil
+		}
+
+		ln, err := net.Listen("tcp", name[:idx])
+		if err != nil {
+			logg.E("remote port forwarding: ", err)
+			return nil
+		}
+
+		logg.L("remote port forwarding ", name[:idx], " -> ", name[idx+1:])
+		pool.ln = ln
+		go proxy.serveRemoteForward(ln, key, name[idx+1:])
+	}
+
+	proxy.reverse[key] = pool
+	return pool
+}
+
+func (proxy *ProxyUpstream) serveRemoteForward(ln net.Listener, key reverseKey, target string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isClosedConnErr(err) {
+				return
+			}
+			logg.E("remote port forwarding: ", err)
+			continue
+		}
+
+		go func() {
+			rc, err := proxy.dialReverse(key, target)
+			if err != nil {
+				logg.E("remote port forwarding ", target, ": ", err)
+				conn.Close()
+				return
+			}
+
+			proxy.Cipher.IO.Bridge(rc.Conn, conn, rc.key, IOConfig{Partial: rc.partial, Block: rc.gc.Block})
+			proxy.releaseReverse(rc)
+		}()
+	}
+}
+
+// dialReverse takes a parked tunnel from the pool of key and asks the client to connect target
+func (proxy *ProxyUpstream) dialReverse(key reverseKey, target string) (*reverseConn, error) {
+	proxy.reverseMu.Lock()
+	pool := proxy.reverse[key]
+	proxy.reverseMu.Unlock()
+
+	if pool == nil {
+		return nil, errNoReverseConn
+	}
+
+	timeout := time.After(timeoutDial)
+	for {
+		select {
+		case rc := <-pool.ch:
+			rc.SetReadDeadline(time.Now())
+			select {
+			case <-rc.idle:
+			case <-time.After(time.Second):
+				// the conn ignores deadlines
+				proxy.releaseReverse(rc)
+				continue
+			}
+			rc.SetReadDeadline(time.Time{})
+
+			proxy.reverseMu.Lock()
+			released := rc.released
+			proxy.reverseMu.Unlock()
+			if released {
+				// broken while parked
+				continue
+			}
+
+			if _, err := rc.Write([]byte(rc.gc.EncryptCompress(target, rc.key...) + "\n")); err != nil {
+				// the parked tunnel is dead, try the next one
+				proxy.releaseReverse(rc)
+				continue
+			}
+			return rc, nil
+		case <-timeout:
+			return nil, errNoReverseConn
+		}
+	}
+}
+
+// StartReverseSOCKS serves SOCKS5 (CONNECT only) whose traffic exits through reverse clients,
+// SOCKS clients authenticate with username/password of Users and exit through the clients of that user
+func (proxy *ProxyUpstream) StartReverseSOCKS() error {
+	if !proxy.multiUser() {
+		return errors.New("reverse SOCKS needs users, anyone could exit through the reverse clients otherwise")
+	}
+
+	ln, err := listenTCP(proxy.ReverseSOCKS)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isClosedConnErr(err) {
+				return err
+			}
+			logg.E("reverse SOCKS: ", err)
+			continue
+		}
+
+		go proxy.handleReverseSocks(conn)
+	}
+}
+
+func (proxy *ProxyUpstream) handleReverseSocks(conn net.Conn) {
+	addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if proxy.banned(addr) {
+		conn.Close()
+		return
+	}
+
+	user, ok := proxy.socksAuth(conn, addr, true)
+	if !ok {
+		return
+	}
+
+	method, dst, err := parseUDPHeader(conn, nil, false)
+	if err != nil || method != 1 {
+		logg.E("reverse SOCKS: ", err)
+		conn.Close()
+		return
+	}
+
+	host := dst.String()
+	rc, err := proxy.dialReverse(reverseKey{user: user}, host)
+	if err != nil {
+		logg.E("reverse SOCKS ", host, ": ", err)
+		replyFailure(conn, okSOCKS, closeReasonOf(err))
+		return
+	}
+
+	logg.D("reverse SOCKS ", host, " through ", user)
+	conn.Write(okSOCKS)
+	go func() {
+		proxy.Cipher.IO.Bridge(rc.Conn, conn, rc.key, IOConfig{Partial: rc.partial, Block: rc.gc.Block})
+		proxy.releaseReverse(rc)
+	}()
+}
+
+// StartReverse parks n tunnels on the upstream and keeps replenishing them
+func (proxy *ProxyClient) StartReverse(n int) {
+	for i := 0; i < n; i++ {
+		go proxy.reverseWorker("")
+	}
+}
+
+// StartRemoteForward asks the upstream to listen on listen and forward connections to target,
+// which is dialed by the client, n tunnels are parked for it
+func (proxy *ProxyClient) StartRemoteForward(listen, target string, n int) {
+	for i := 0; i < n; i++ {
+		go proxy.reverseWorker(listen + "/" + target)
+	}
+}
+
+func (proxy *ProxyClient) reverseWorker(name string) {
+	for {
+		if err := proxy.waitReverse(name); err != nil {
+			logg.E("reverse tunnel: ", err)
+			time.Sleep(reverseRetry)
+		}
+	}
+}
+
+// waitReverse parks one tunnel and returns after it is used or broken
+func (proxy *ProxyClient) waitReverse(name string) error {
+	upstreamConn, rkeybuf, _, err := proxy.openTunnel(reverseScheme+name, 0)
+	if err != nil {
+		return err
+	}
+
+	buf, err := readUntil(upstreamConn, "\n")
+	if err != nil {
+		upstreamConn.Close()
+		return err
+	}
+
+	target := proxy.Cipher.DecryptDecompress(strings.TrimSpace(string(buf)), rkeybuf...)
+	if target == "" {
+		upstreamConn.Close()
+		return errors.New("invalid target from the upstream")
+	}
+
+	go func() {
+		targetConn, err := net.DialTimeout("tcp", target, timeoutDial)
+		if err != nil {
+			logg.E("reverse ", target, ": ", err)
+			upstreamConn.Close()
+			return
+		}
+
+		logg.D("reverse ", target)
+		proxy.Cipher.IO.Bridge(targetConn, upstreamConn, rkeybuf, IOConfig{Partial: proxy.Partial})
+	}()
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+const (
+	routeDirectFails = 3                  // direct timeouts before a host is always proxied
+	routeFailWindow  = time.Hour          // within this time since the first one, older timeouts are forgotten
+	routeMaxAge      = 7 * 24 * time.Hour // learned routes are forgotten after this
+)
+
+type routeVerdict struct {
+	r    byte
+	time int64
+}
+
+type routeFails struct {
+	n     int
+	since int64 // unix time of the first timeout counted
+}
+
+// RouteBook remembers routes learned for hosts without explicit rules: hosts whose direct connections
+// keep timing out will be proxied, and race winners are used directly. Routes are forgotten after MaxAge,
+// the book is saved to Path periodically so it survives restarts
+type RouteBook struct {
+	Path   string
+	MaxAge time.Duration
+
+	m     map[string]routeVerdict
+	fails map[string]routeFails
+	mu    sync.Mutex
+	dirty bool
+}
+
+// RaceBook is the book of race winners RouteBook grew out of.
+//
+// Deprecated: use RouteBook
+type RaceBook = RouteBook
+
+// LoadRaceBook is LoadRouteBook.
+//
+// Deprecated: use LoadRouteBook
+func LoadRaceBook(path string) (*RaceBook, error) {
+	return LoadRouteBook(path)
+}
+
+// LoadRouteBook reads the book saved at path, each line looks like: <domain> <pass|proxy> <unix time>,
+// a missing file is not an error
+func LoadRouteBook(path string) (*RouteBook, error) {
+	b := &RouteBook{
+		Path:   path,
+		MaxAge: routeMaxAge,
+		m:      make(map[string]routeVerdict),
+		fails:  make(map[string]routeFails),
+	}
+
+	if path == "" {
+		return b, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		v := routeVerdict{r: ruleProxy, time: now}
+		if fields[1] == "pass" {
+			v.r = rulePass
+		}
+
+		if len(fields) > 2 {
+			v.time, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+
+		b.m[fields[0]] = v
+	}
+
+	return b, nil
+}
+
+func (b *RouteBook) get(host string) (byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v, ok := b.m[host]
+	if ok && time.Now().Unix()-v.time > int64(b.MaxAge/time.Second) {
+		delete(b.m, host)
+		b.dirty = true
+		return 0, false
+	}
+
+	return v.r, ok
+}
+
+func (b *RouteBook) learn(host string, r byte) {
+	b.mu.Lock()
+	b.m[host], b.dirty = routeVerdict{r: r, time: time.Now().Unix()}, true
+	delete(b.fails, host)
+	b.mu.Unlock()
+}
+
+// fail records a direct connection to host which timed out, timeouts count within routeFailWindow
+func (b *RouteBook) fail(host string) {
+	now := time.Now().Unix()
+	b.mu.Lock()
+	f := b.fails[host]
+	if now-f.since > int64(routeFailWindow/time.Second) {
+		f = routeFails{since: now}
+	}
+	f.n++
+	b.fails[host] = f
+	n := f.n
+	b.mu.Unlock()
+
+	if n >= routeDirectFails {
+		logg.L(host, " timed out ", n, " times, it will be proxied from now on")
+		b.learn(host, ruleProxy)
+	}
+}
+
+// Save writes the book to Path if it has been changed since the last save
+func (b *RouteBook) Save() error {
+	b.mu.Lock()
+	if b.Path == "" || !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+
+	lines := make([]string, 0, len(b.m))
+	for host, v := range b.m {
+		ans := "proxy"
+		if v.r == rulePass {
+			ans = "pass"
+		}
+		lines = append(lines, host+" "+ans+" "+strconv.FormatInt(v.time, 10))
+	}
+	b.dirty = false
+	b.mu.Unlock()
+
+	sort.Strings(lines)
+	return ioutil.WriteFile(b.Path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// prune forgets timeouts out of the window and routes older than MaxAge, hosts never visited again stay otherwise
+func (b *RouteBook) prune(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for host, f := range b.fails {
+		if now.Unix()-f.since > int64(routeFailWindow/time.Second) {
+			delete(b.fails, host)
+		}
+	}
+
+	for host, v := range b.m {
+		if now.Unix()-v.time > int64(b.MaxAge/time.Second) {
+			delete(b.m, host)
+			b.dirty = true
+		}
+	}
+}
+
+func (b *RouteBook) startSaving() {
+	for range time.Tick(time.Minute) {
+		b.prune(time.Now())
+		if err := b.Save(); err != nil {
+			logg.E("save route book: ", err)
+		}
+	}
+}
+
+// guessed reports whether the rule of host was only a guess, explicit matches and rules changed by the user are trusted
+func (proxy *ProxyClient) guessed(host string) bool {
+	if proxy.RouteBook == nil || proxy.Policy.IsSet(PolicyGlobal) {
+		return false
+	}
+
+	c, ok := proxy.DNSCache.Peek(host)
+	if !ok || c.(*Rule) == nil {
+		return false
+	}
+
+	switch rule := c.(*Rule); rule.R {
+	case acr.RulePass, acr.RuleProxy, acr.RuleIPv6, acr.RuleUnknown:
+		return rule.Ans == rule.OldAns
+	}
+
+	return false
+}
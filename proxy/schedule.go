@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron-like schedule of 5 fields: minute, hour, day of month, month and day of week (0 is Sunday),
+// each field is *, a number, a range like 1-5, a step like */15 or 0-30/10, or a list of them separated by commas.
+// Unlike cron, a day must match both the day of month and the day of week
+type Schedule struct {
+	fields [5]uint64
+}
+
+var scheduleBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// ParseSchedule parses a schedule like "30 4 * * 1-5"
+func ParseSchedule(spec string) (*Schedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid schedule: %s, expect 5 fields", spec)
+	}
+
+	s := &Schedule{}
+	for i, part := range parts {
+		for _, r := range strings.Split(part, ",") {
+			bits, err := parseScheduleRange(r, scheduleBounds[i][0], scheduleBounds[i][1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule: %s, %v", spec, err)
+			}
+			s.fields[i] |= bits
+		}
+	}
+
+	return s, nil
+}
+
+func parseScheduleRange(r string, min, max int) (uint64, error) {
+	step := 1
+	if idx := strings.Index(r, "/"); idx > -1 {
+		var err error
+		if step, err = strconv.Atoi(r[idx+1:]); err != nil || step <= 0 {
+			return 0, fmt.Errorf("bad step: %s", r)
+		}
+		r = r[:idx]
+	}
+
+	lo, hi := min, max
+	if r != "*" {
+		var err error
+		bounds := strings.SplitN(r, "-", 2)
+		if lo, err = strconv.Atoi(bounds[0]); err != nil {
+			return 0, fmt.Errorf("bad number: %s", r)
+		}
+
+		if hi = lo; len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, fmt.Errorf("bad number: %s", r)
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%s out of range %d-%d", r, min, max)
+		}
+	}
+
+	var bits uint64
+	for i := lo; i <= hi; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+func (s *Schedule) match(field, v int) bool {
+	return s.fields[field]&(1<<uint(v)) > 0
+}
+
+// Next returns the first minute after t matching the schedule, or the zero time if there is none in 5 years
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		y, mon, d := t.Date()
+		switch {
+		case !s.match(3, int(mon)):
+			t = time.Date(y, mon+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.match(2, d) || !s.match(4, int(t.Weekday())):
+			t = time.Date(y, mon, d+1, 0, 0, 0, 0, t.Location())
+		case !s.match(1, t.Hour()):
+			t = time.Date(y, mon, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.match(0, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// Prev returns the last minute at or before t matching the schedule, or the zero time if there is none in 5 years
+func (s *Schedule) Prev(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	end := t.AddDate(-5, 0, 0)
+
+	for t.After(end) {
+		y, mon, d := t.Date()
+		switch {
+		case !s.match(3, int(mon)):
+			t = time.Date(y, mon, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !s.match(2, d) || !s.match(4, int(t.Weekday())):
+			t = time.Date(y, mon, d, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !s.match(1, t.Hour()):
+			t = time.Date(y, mon, d, t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !s.match(0, t.Minute()):
+			t = t.Add(-time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// Start calls fn at every time of the schedule, it never returns unless the schedule has no more times
+func (s *Schedule) Start(fn func()) {
+	for {
+		next := s.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+
+		time.Sleep(next.Sub(time.Now()))
+		fn()
+	}
+}
@@ -1,68 +1,181 @@
 package proxy
 
 import (
+	"github.com/coyove/goflyway/pkg/codec"
 	"github.com/coyove/goflyway/pkg/logg"
 	"github.com/coyove/goflyway/pkg/lru"
 	"github.com/coyove/tcpmux"
 
+	"crypto/cipher"
+	"crypto/tls"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ServerConfig struct {
-	Throttling    int64
-	ThrottlingMax int64
-	DisableUDP    bool
-	ProxyPassAddr string
-
-	Users map[string]UserConfig
+	Throttling      int64
+	ThrottlingMax   int64
+	ThrottlingScope ThrottlingScope
+	DisableUDP      bool
+	ProxyPassAddr   string
+	ReverseSOCKS    string   // listening address of the reverse SOCKS, empty means disabled
+	SOCKS           string   // listening address of the plain SOCKS5 inbound, empty means disabled
+	RemoteForward   bool     // allow clients to listen on loopback addresses of the server and forward connections back
+	RemoteBinds     []string // addresses like 0.0.0.0:8080 clients may listen on besides loopback ones
+	NAT64           *NAT64   // reach IPv4 destinations from an IPv6-only server, nil means disabled
+	Workers         int      // accept loops sharing the port with SO_REUSEPORT, 0 or 1 means a single one
+	Watchdog        *Watchdog
+	Classes         TrafficClasses // policies of streams grouped by destinations
+	AccessRules     AccessRules    // destinations blocked in time windows, for all or some users
+	HotOrigins      []string       // rules of origins kept warm in forward mode, like api.example.com or *.example.com
+	SkewTolerance   time.Duration  // clock skew against clients accepted, 0 means DefaultSkewTolerance
+	DNSCacheTTL     time.Duration  // answers of DNS lookups made for clients are cached for it, 0 means not cached
+	Resolver        *net.Resolver  // looks up destinations and names asked by clients, see ParseResolver, nil means the system's
+	WireGuard       *WireGuard     // destinations are dialed through the tunnel instead, see LoadWireGuard, nil means directly
+	SSHJumps        SSHJumps       // destinations matching them are dialed through SSH bastions instead, see LoadSSHJumps
+	Tracer          *Tracer        // spans of tunnels are exported, joining the traces of clients, nil means not traced
+	Audit           *Audit         // security events like users connecting from networks they aren't pinned to, nil means only logged
+	UDPMaxSessions  int            // UDP NAT sessions open at the same time, see udpNATHost, 0 means no limit
+	UDPTimeout      time.Duration  // NAT sessions and their destinations expire when idle for it, 0 means 30 sec
+	BlacklistSize   int            // offenders tracked in the blacklist, the least recent are forgotten beyond it, 0 means 128
+	BanThreshold    int            // offenders are rejected before their requests are decrypted after so many invalid ones, 0 means 10
+	BanDuration     time.Duration  // offenders stay rejected for it since their last invalid request, 0 means 10 min
+	BanPrefixV4     int            // offenders are tracked by networks of this length, like 24, 0 means by IP
+	BanPrefixV6     int            // like BanPrefixV4 of IPv6, like 64
+	State           SharedState    // offenders, replay IVs and connection rates shared with servers behind the load balancer, see NewRedisState, nil means local
+	IPConnRate      int            // new connections accepted per second from each source IP, 0 means no limit
+	IPMaxBridges    int            // streams bridged at the same time for each source IP, 0 means no limit
+	AntiReplay      bool           // reject replayed requests and those stamped out of the skew tolerance, requests of old clients carry no stamp
+	Transports      []Transport    // listening on the address besides TCP, like KCP on its UDP port, or taken over on the HTTP listener like ws
+	Tenants         []*Tenant      // sites hosted by name instead of ProxyPassAddr, see LoadTenants
+	TLS             *tls.Config    // the main listener terminates TLS with it, like NewACMEConfig, nil means plain TCP
+	TLSRoute        string         // SNI or ALPN protocol telling the tunnel from visitors of the site sharing the TLS port, see sniListener
+	KeyEpochs       *KeyEpochs     // clients encrypt by the key of the epoch instead of the password, nil means by the password
+
+	Users      map[string]UserConfig // keyed by username, nil means no authentication
+	UsersFile  string                // where Users are loaded from, re-read by Reload
+	Bans       []string              // IPs rejected from the start, like Ban
+	ConfigFile string                // re-read by Reload
+
+	BlacklistFile string // the blacklist is restored from it and written by SaveBlacklist, empty means not persisted
+
+	Sync     string // listening address of the pushes of SyncPeer, see StartSync
+	SyncPeer string // the sync address of the other server of the warm standby pair, sharing the password
 
 	*Cipher
 }
 
-// for multi-users server, not implemented yet
+// UserConfig is a user of a multi-user server, the user's streams are throttled
+// by its own limits instead of the server's ones if Throttling is set
 type UserConfig struct {
-	Auth          string
+	Auth          string // username:password presented by the client
 	Throttling    int64
-	ThrottlingMax int64
+	ThrottlingMax int64        // 0 means the server's ThrottlingMax
+	Sources       []*net.IPNet // the user can only connect from these networks, empty means anywhere
 }
 
 type ProxyUpstream struct {
 	tp            *http.Transport
+	hot           *hotOrigins
+	dnsCache      *lru.Cache // nil if DNSCacheTTL is 0
 	rp            http.Handler
 	blacklist     *lru.Cache
+	blacklistMu   sync.Mutex // of offend, so concurrent offenses of a key all count
 	trustedTokens map[string]bool
 	rkeyHeader    string
 
-	Localaddr string
+	bans      bans
+	reverse   map[reverseKey]*reversePool
+	reverseMu sync.Mutex
+	notices   noticeBoard
+	buckets   map[string]*TokenBucket
+	bucketsMu sync.Mutex
+	draining  int64 // the Retry-After hint while draining, 0 means not draining
+	replay    replayCache
+	dups      map[string]*dupStream // duplicated streams keyed by user, host and id
+	dupsMu    sync.Mutex
+	replica   replicaState
+	limiter   ipLimiter // of IPConnRate and IPMaxBridges
+	upgrades  []upgrade // of HTTPTransport in Transports, set by Start
+
+	servers   []*http.Server // stopped by Shutdown
+	serversMu sync.Mutex
+	stopped   bool
+
+	// Users, throttling and bans replaced by Reload
+	reloadMu   sync.RWMutex
+	fileUsers  map[string]bool
+	configBans []string
+
+	skewMeter
+	serverMetrics
+
+	Localaddr string // or addresses separated by commas, like 0.0.0.0:8100,[::]:8100
 
 	*ServerConfig
 }
 
-func (proxy *ProxyUpstream) auth(auth string) bool {
-	if _, existed := proxy.Users[auth]; existed {
-		// we don't have multi-user mode currently
-		return true
+func (proxy *ProxyUpstream) skewTolerance() time.Duration {
+	if proxy.SkewTolerance > 0 {
+		return proxy.SkewTolerance
 	}
+	return DefaultSkewTolerance
+}
 
-	return false
+// limits returns the throttling of user's streams
+func (proxy *ProxyUpstream) limits(user string) (speed, max int64, scope ThrottlingScope) {
+	proxy.reloadMu.RLock()
+	defer proxy.reloadMu.RUnlock()
+
+	speed, max, scope = proxy.Throttling, proxy.ThrottlingMax, proxy.ThrottlingScope
+	if u := proxy.Users[user]; scope != ThrottlingGlobal && u.Throttling > 0 {
+		speed = u.Throttling
+		if u.ThrottlingMax > 0 {
+			max = u.ThrottlingMax
+		}
+	}
+	return
 }
 
-func (proxy *ProxyUpstream) getIOConfig(auth string) IOConfig {
-	var ioc IOConfig
-	if proxy.Throttling > 0 {
-		ioc.Bucket = NewTokenBucket(proxy.Throttling, proxy.ThrottlingMax)
+func (proxy *ProxyUpstream) getIOConfig(user string) IOConfig {
+	ioc := IOConfig{Meter: proxy.meter(user), User: user}
+
+	speed, max, scope := proxy.limits(user)
+	if scope == ThrottlingGlobal {
+		user = ""
 	}
+
+	if speed <= 0 {
+		return ioc
+	}
+
+	if scope == ThrottlingPerConn {
+		ioc.Bucket = NewTokenBucket(speed, max)
+		return ioc
+	}
+
+	proxy.bucketsMu.Lock()
+	if ioc.Bucket = proxy.buckets[user]; ioc.Bucket == nil {
+		ioc.Bucket = NewTokenBucket(speed, max)
+		proxy.buckets[user] = ioc.Bucket
+	}
+	proxy.bucketsMu.Unlock()
+
 	return ioc
 }
 
 func (proxy *ProxyUpstream) Write(w http.ResponseWriter, key, p []byte, code int) (n int, err error) {
-	if ctr := proxy.Cipher.getCipherStream(key); ctr != nil {
+	return writeEncrypted(w, proxy.Cipher.Block, key, p, code)
+}
+
+// writeEncrypted responds p encrypted by b with the IV key
+func writeEncrypted(w http.ResponseWriter, b cipher.Block, key, p []byte, code int) (int, error) {
+	if ctr := newCipherStream(b, key); ctr != nil {
 		ctr.XorBuffer(p)
 	}
 
@@ -73,7 +186,6 @@ func (proxy *ProxyUpstream) Write(w http.ResponseWriter, key, p []byte, code int
 func (proxy *ProxyUpstream) hijack(w http.ResponseWriter) net.Conn {
 	hij, ok := w.(http.Hijacker)
 	if !ok {
-		logg.E("webserver doesn't support hijacking")
 		return nil
 	}
 
@@ -87,181 +199,502 @@ func (proxy *ProxyUpstream) hijack(w http.ResponseWriter) net.Conn {
 }
 
 func (proxy *ProxyUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	replySomething := func() {
-		if proxy.rp == nil {
-			w.WriteHeader(404)
-			w.Write([]byte(`<html>
-<head><title>404 Not Found</title></head>
-<body bgcolor="white">
-<center><h1>404 Not Found</h1></center>
-<hr><center>nginx</center>
-</body>
-</html>`))
-		} else {
-			proxy.rp.ServeHTTP(w, r)
-		}
-	}
+	start := time.Now()
 
 	addr, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		logg.W("unknown address: ", r.RemoteAddr)
-		replySomething()
+		proxy.decoy(w, r, start)
+		return
+	}
+
+	if proxy.banned(addr) {
+		logg.D("banned address: ", addr)
+		proxy.decoy(w, r, start)
 		return
 	}
 
-	rkey := r.Header.Get(proxy.rkeyHeader)
-	options, rkeybuf, authbuf := proxy.Cipher.ReverseIV(rkey)
+	if proxy.upgrade(w, r) {
+		return
+	}
 
+	if proxy.Watchdog.Shedding() {
+		decoyPage(w, http.StatusServiceUnavailable)
+		return
+	}
+
+	k := proxy.keyOf(r)
+	rkey := r.Header.Get(k.header)
+
+	// only requests shaped like the unlock token are decrypted for blocked addresses,
+	// and they are decoyed below unless the token is trusted
+	unlocking := unlockShaped(r, rkey)
+	if proxy.blocked(addr) {
+		if !unlocking {
+			logg.D("repeated access using invalid key from: ", addr)
+			proxy.decoy(w, r, start)
+			return
+		}
+	} else {
+		unlocking = false
+	}
+
+	options, rkeybuf, authbuf := k.ReverseIV(rkey)
 	if rkeybuf == nil {
 		logg.D("cannot find header, check your client's key, from: ", addr)
-		proxy.blacklist.Add(addr, nil)
-		replySomething()
+		proxy.offend(addr)
+		proxy.decoy(w, r, start)
 		return
 	}
 
-	var auth string
-	if proxy.Users != nil {
-		if authbuf == nil || string(authbuf) == "" || !proxy.auth(string(authbuf)) {
+	var user string
+	if proxy.multiUser() {
+		var ok bool
+		if user, ok = proxy.auth(string(authbuf)); !ok {
 			logg.W("user auth failed, from: ", addr)
+			proxy.decoy(w, r, start)
+			return
+		}
+
+		if !proxy.allows(user, addr) {
+			proxy.decoy(w, r, start)
 			return
 		}
+	}
 
-		auth = string(authbuf)
+	if date := r.Header.Get("Date"); date != "" {
+		proxy.observe(date, "client "+addr, proxy.skewTolerance())
 	}
 
 	if options == 0 {
-		r := isTrustedToken("unlock", rkeybuf)
+		trusted := isTrustedToken("unlock", rkeybuf, proxy.skewTolerance())
 
-		if r == -1 {
+		if trusted == -1 {
 			logg.W("someone is using an old token: ", addr)
-			proxy.blacklist.Add(addr, nil)
-			replySomething()
+			proxy.offend(addr)
+			proxy.decoy(w, r, start)
 			return
 		}
 
-		if r == 1 {
-			proxy.blacklist.Remove(addr)
+		if trusted == 1 {
+			proxy.forget(addr)
 			logg.L("unlock request accepted from: ", addr)
 			return
 		}
 	}
 
-	if h, _ := proxy.blacklist.GetHits(addr); h > invalidRequestRetry {
-		logg.D("repeated access using invalid key from: ", addr)
-		// replySomething()
-		// return
+	if unlocking {
+		logg.D("repeated access from: ", addr)
+		proxy.decoy(w, r, start)
+		return
+	}
+
+	if proxy.AntiReplay && (options&doDNS) == 0 && proxy.replayed(rkeybuf) {
+		logg.W("replayed or expired request from: ", addr)
+		proxy.offend(addr)
+		proxy.decoy(w, r, start)
+		return
 	}
 
 	if (options & doDNS) > 0 {
 		host := string(rkeybuf)
-		ip, err := net.ResolveIPAddr("ip4", host)
+		ip, err := proxy.resolve(host)
+		atomic.AddUint64(&proxy.dnsLookups, 1)
 		if err != nil {
+			atomic.AddUint64(&proxy.dnsFailures, 1)
 			logg.W(err)
-			ip = &net.IPAddr{IP: net.IP{127, 0, 0, 1}}
+			ip = net.IP{127, 0, 0, 1}
 		}
 
 		logg.D("DNS: ", host, " ", ip.String())
-		w.Header().Add(dnsRespHeader, base32Encode([]byte(ip.IP.To4()), true))
-		w.WriteHeader(200)
+		w.Header().Add(dnsRespHeader, codec.Base32Encode([]byte(ip.To4()), true))
+		if lane := proxy.IO.DNSLane; lane.enter(r.RemoteAddr) {
+			// bulk downloads of the carrier hold until the answer is written
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+			lane.leave(r.RemoteAddr)
+		} else {
+			w.WriteHeader(200)
+		}
 
 	} else if options.IsSet(doConnect) {
-		host := proxy.Cipher.DecryptDecompress(stripURI(r.RequestURI), rkeybuf...)
+		sid := streamID(rkeybuf)
+		uri := stripURI(r.RequestURI)
+		if options.IsSet(doLongURL) {
+			uri = proxy.longURL(r, k.header)
+		} else if h := r.Header.Get(k.header + wsHostSuffix); h != "" && options.IsSet(doWebSocket) {
+			uri = h
+		}
+
+		host := k.DecryptDecompress(uri, rkeybuf...)
 		if host == "" {
 			logg.W("we had a valid rkey, but invalid host, from: ", addr)
-			replySomething()
+			proxy.decoy(w, r, start)
 			return
 		}
 
-		logg.D("CONNECT ", host)
-		downstreamConn := proxy.hijack(w)
-		if downstreamConn == nil {
+		logg.D("[", sid, "] CONNECT ", host)
+		var downstreamConn net.Conn
+		if r.Body != http.NoBody && !options.IsSet(doWebSocket) {
+			// the client streams in the request body, see ClientConfig.StreamBody
+			http.NewResponseController(w).EnableFullDuplex()
+			sc := newStreamConn(w, r)
+			if sc == nil {
+				logg.E("webserver doesn't support flushing, streamed tunnels are unavailable")
+				return
+			}
+			downstreamConn = sc
+		} else if downstreamConn = proxy.hijack(w); downstreamConn == nil {
+			if options.IsSet(doWebSocket) {
+				logg.E("webserver doesn't support hijacking, websocket is unavailable")
+				return
+			}
+
+			// fall back to streaming over the request and response bodies
+			sc := newStreamConn(w, r)
+			if sc == nil {
+				logg.E("webserver doesn't support hijacking or flushing")
+				return
+			}
+
+			downstreamConn = sc
+		}
+
+		if _, ok := downstreamConn.(*streamConn); ok && strings.Contains(host, "://") {
+			logg.E("[", sid, "] webserver doesn't support hijacking, ", host, " is unavailable")
+			proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseUnsupported)
+			return
+		} else if strings.HasPrefix(host, reverseScheme) {
+			downstreamConn.Write(okHTTP)
+			proxy.parkReverse(downstreamConn, user, host[len(reverseScheme):], k.Codec, rkeybuf, options.IsSet(doPartial))
+			return
+		} else if host == noticeScheme {
+			downstreamConn.Write(okHTTP)
+			proxy.subscribeNotice(downstreamConn, k.Codec, rkeybuf)
 			return
 		}
 
-		ioc := proxy.getIOConfig(auth)
+		if _, ok := proxy.Draining(); ok {
+			logg.D("[", sid, "] draining, refuse ", host)
+			proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseDraining)
+			return
+		}
+
+		if proxy.AccessRules.blocked(user, host, time.Now()) != nil {
+			proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseDenied)
+			return
+		}
+
+		ioc := proxy.getIOConfig(user)
 		ioc.Partial = options.IsSet(doPartial)
+		ioc.Block = k.Block
+
+		if c := proxy.Classes.classify(host); c != nil {
+			logg.D("[", sid, "] ", host, " is in class ", c.Name)
+			c.apply(&ioc)
+		}
+
+		var ecdhPub string
+		if peer := r.Header.Get(k.header + ecdhSuffix); peer != "" {
+			var err error
+			if ecdhPub, ioc.Block, err = acceptECDH(k.Codec, peer, rkeybuf); err != nil {
+				logg.W("[", sid, "] ECDH: ", err, ", from: ", addr)
+				proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseUnknown)
+				return
+			}
+		}
+
+		var p, ecdhLine, dupLine, sumLine, natLine string
+		if ecdhPub != "" {
+			ecdhLine = k.header + ecdhSuffix + ": " + ecdhPub + "\r\n"
+		}
+
+		var d *dupStream
+		if id := r.Header.Get(k.header + dupSuffix); id != "" {
+			if _, ok := downstreamConn.(*streamConn); ok || options.IsSet(doUDPRelay) || options.IsSet(doWebSocket) {
+				logg.W("[", sid, "] ", host, " can't be a duplicated stream")
+				proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseUnsupported)
+				return
+			}
+
+			dupLine = k.header + dupSuffix + ": " + id + "\r\n"
+		}
+
+		if r.Header.Get(k.header+sumSuffix) != "" && options.IsSet(doPartial) && dupLine == "" && !options.IsSet(doUDPRelay) && !options.IsSet(doWebSocket) {
+			if _, ok := downstreamConn.(*streamConn); !ok {
+				sumLine = k.header + sumSuffix + ": 1\r\n"
+				ioc.Sum = sumTarget
+			}
+		}
+
+		if r.Header.Get(k.header+natSuffix) != "" && options.IsSet(doUDPRelay) && !options.IsSet(doWebSocket) && host == udpNATHost {
+			natLine = k.header + natSuffix + ": 1\r\n"
+		}
+
+		if options.IsSet(doWebSocket) {
+			ioc.WSCtrl = wsServer
+			p = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n" + ecdhLine + "Date: " + httpDate() + "\r\n\r\n"
+		} else {
+			p = "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n" + ecdhLine + dupLine + sumLine + natLine +
+				k.header + longURLSuffix + ": 1\r\nDate: " + httpDate() + "\r\n\r\n"
+		}
+
+		if dupLine != "" {
+			id := k.DecryptString(r.Header.Get(k.header+dupSuffix), rkeybuf...)
+			var created bool
+			if d, created = proxy.joinDup(user+"/"+host+"/"+id, ioc); !created {
+				// the target is dialed by the first tunnel
+				logg.D("[", sid, "] ", host, " joins duplicated stream ", id)
+				downstreamConn.Write([]byte(p))
+				d.attach(downstreamConn, rkeybuf, ioc.Block)
+				return
+			}
+		}
+
+		var span *Span
+		if proxy.Tracer != nil {
+			tp := k.DecryptString(r.Header.Get(k.header+traceSuffix), rkeybuf...)
+			span = proxy.Tracer.start("tunnel", spanServer, tp, start)
+			span.set("host", host)
+			span.set("user", user)
+			span.child("handshake", start).end(nil)
+		}
+
+		// duplicated streams are counted once, by the bridge of the first tunnel
+		held := d == nil
+		if held && !proxy.acquireBridge(addr) {
+			logg.W("[", sid, "] too many streams from ", addr, ", refuse ", host)
+			span.end(&CloseError{Reason: CloseIPBusy, Stream: sid})
+			proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseIPBusy)
+			return
+		}
+		defer func() {
+			if held {
+				proxy.releaseBridge(addr)
+			}
+		}()
 
 		var targetSiteConn net.Conn
 		var err error
 
 		if options.IsSet(doUDPRelay) {
 			if proxy.DisableUDP {
-				logg.W("client is trying to send UDP data but we disabled it")
-				downstreamConn.Close()
+				logg.W("[", sid, "] client is trying to send UDP data but we disabled it")
+				span.end(&CloseError{Reason: CloseUDPDisabled, Stream: sid})
+				proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseUDPDisabled)
 				return
 			}
 
-			uaddr, _ := net.ResolveUDPAddr("udp", host)
+			if proxy.WireGuard != nil {
+				logg.W("[", sid, "] UDP relays can't go through WireGuard")
+				span.end(&CloseError{Reason: CloseUDPDisabled, Stream: sid})
+				proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseUDPDisabled)
+				return
+			}
 
-			var rconn *net.UDPConn
-			rconn, err = net.DialUDP("udp", nil, uaddr)
-			targetSiteConn = &udpBridgeConn{
-				UDPConn: rconn,
-				udpSrc:  uaddr,
+			if natLine != "" {
+				var nat *udpBridgeConn
+				if nat, err = proxy.openNAT(user); err == errUDPBusy {
+					logg.W("[", sid, "] ", err, ", refuse the UDP NAT session")
+					span.end(err)
+					proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, CloseUDPBusy)
+					return
+				}
+				targetSiteConn = nat
+			} else {
+				uaddr, _ := proxy.resolveUDP(host)
+				uaddr = proxy.NAT64.UDPAddr(uaddr)
+
+				var rconn *net.UDPConn
+				rconn, err = net.DialUDP("udp", nil, uaddr)
+				targetSiteConn = &udpBridgeConn{
+					UDPConn: rconn,
+					udpSrc:  uaddr,
+				}
+				// rconn.Write([]byte{6, 7, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 98, 97, 105, 100, 117, 3, 99, 111, 109, 0, 0, 1, 0, 1})
 			}
-			// rconn.Write([]byte{6, 7, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 98, 97, 105, 100, 117, 3, 99, 111, 109, 0, 0, 1, 0, 1})
 		} else {
-			targetSiteConn, err = net.Dial("tcp", host)
+			targetSiteConn, err = proxy.dialTraced("tcp", host, span)
 		}
 
 		if err != nil {
-			logg.E(err)
-			downstreamConn.Close()
+			logg.E("[", sid, "] ", err)
+			if d != nil {
+				d.fail()
+			}
+			span.end(err)
+			proxy.refuse(w, downstreamConn, k.Codec, rkeybuf, dialCloseReason(err))
 			return
 		}
 
-		var p string
-		if options.IsSet(doWebSocket) {
-			ioc.WSCtrl = wsServer
-			p = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Accept: " + (rkey + rkey)[4:32] + "\r\n\r\n"
-		} else {
-			p = "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nDate: " + time.Now().UTC().Format(time.RFC1123) + "\r\n\r\n"
+		targetSiteConn = proxy.Cipher.IO.Dump.Wrap(targetSiteConn, host)
+		ioc.Span, ioc.Host = span, host
+
+		if d != nil {
+			// duplicated streams are bridged by themselves
+			downstreamConn.Write([]byte(p))
+			d.attach(downstreamConn, rkeybuf, ioc.Block)
+			go d.start(targetSiteConn, span)
+			return
+		}
+
+		if _, ok := downstreamConn.(*streamConn); ok {
+			// the response must stay alive until the bridge is done, its body starts with
+			// the response of a hijacked conn, see bodyConn
+			w.Header().Set("Content-Type", "application/octet-stream")
+			downstreamConn.Write([]byte(p))
+			proxy.Cipher.IO.Bridge(downstreamConn, targetSiteConn, rkeybuf, ioc)
+			return
 		}
 
 		downstreamConn.Write([]byte(p))
-		go proxy.Cipher.IO.Bridge(downstreamConn, targetSiteConn, rkeybuf, ioc)
+		held = false
+		go func() {
+			proxy.Cipher.IO.Bridge(downstreamConn, targetSiteConn, rkeybuf, ioc)
+			proxy.releaseBridge(addr)
+		}()
 	} else if options.IsSet(doForward) {
-		if !proxy.decryptRequest(r, rkeybuf) {
-			replySomething()
+		if !proxy.decryptRequest(r, k, options, rkeybuf) {
+			proxy.decoy(w, r, start)
+			return
+		}
+
+		sid := streamID(rkeybuf)
+		logg.D("[", sid, "] ", r.Method, " ", r.URL.String())
+
+		if proxy.AccessRules.blocked(user, r.URL.Host, time.Now()) != nil {
+			writeEncrypted(w, k.Block, rkeybuf, []byte("["+sid+"] "+CloseDenied.String()), http.StatusForbidden)
 			return
 		}
 
-		logg.D(r.Method, " ", r.URL.String())
+		var span *Span
+		if proxy.Tracer != nil {
+			tp := k.DecryptString(r.Header.Get(k.header+traceSuffix), rkeybuf...)
+			span = proxy.Tracer.start("forward", spanServer, tp, start)
+			span.set("host", r.URL.Host)
+			span.set("user", user)
+		}
+
+		gz := r.Header.Get(k.header+gzipSuffix) != ""
+		r.Header.Del(k.header)
+		r.Header.Del(k.header + gzipSuffix)
+		r.Header.Del(k.header + traceSuffix)
+		tp := proxy.tp
+		if hot := proxy.hot.transport(r.URL); hot != nil {
+			tp = hot
+		}
+
+		dump := proxy.Cipher.IO.Dump.wrapHTTP(r, r.URL.Host, dumpOut)
+		defer dump.end()
 
-		r.Header.Del(proxy.rkeyHeader)
-		resp, err := proxy.tp.RoundTrip(r)
+		rt := span.child("roundtrip", time.Now())
+		resp, err := tp.RoundTrip(r)
+		rt.end(err)
 		if err != nil {
-			logg.E("HTTP forward: ", r.URL, ", ", err)
-			proxy.Write(w, rkeybuf, []byte(err.Error()), http.StatusInternalServerError)
+			span.end(err)
+			logg.E("[", sid, "] HTTP forward: ", r.URL, ", ", err)
+			writeEncrypted(w, k.Block, rkeybuf, []byte("["+sid+"] "+err.Error()), http.StatusInternalServerError)
 			return
 		}
 
 		if resp.StatusCode >= 400 {
-			logg.D("[", resp.Status, "] - ", r.URL)
+			logg.D("[", sid, "] [", resp.Status, "] - ", r.URL)
 		}
 
-		copyHeaders(w.Header(), resp.Header, proxy.Cipher, true, rkeybuf)
+		dump.response(resp, resp.Header)
+		resp.Body = dump.body(resp.Body)
+		body := resp.Body
+		if gz && compressible(resp) {
+			body = gzipResponse(resp)
+		}
+
+		copyHeaders(w.Header(), resp.Header, k.Codec, true, rkeybuf)
+		w.Header().Set(k.header+longURLSuffix, "1")
 		w.WriteHeader(resp.StatusCode)
 
-		if nr, err := proxy.Cipher.IO.Copy(w, resp.Body, rkeybuf, proxy.getIOConfig(auth)); err != nil {
-			logg.E("copy ", nr, " bytes: ", err)
+		ioc := proxy.getIOConfig(user)
+		ioc.Block = k.Block
+		nr, err := proxy.Cipher.IO.Copy(w, body, rkeybuf, ioc)
+		if err != nil {
+			logg.E("[", sid, "] copy ", nr, " bytes: ", err)
 		}
 
-		tryClose(resp.Body)
+		tryClose(body)
+		span.set("status", resp.StatusCode)
+		span.set("bytes.source", nr)
+		span.end(err)
 	} else {
-		proxy.blacklist.Add(addr, nil)
-		replySomething()
+		proxy.offend(addr)
+		proxy.decoy(w, r, start)
+	}
+}
+
+// upgrade is a transport arriving at the HTTP listener, with the listener serving its conns
+type upgrade struct {
+	t  HTTPTransport
+	ln *connListener
+}
+
+// upgrade hands the request over to the HTTPTransport it's of, false if it's of none
+func (proxy *ProxyUpstream) upgrade(w http.ResponseWriter, r *http.Request) bool {
+	for _, u := range proxy.upgrades {
+		if conn, ok := u.t.Upgrade(w, r); ok {
+			if conn != nil && !u.ln.push(conn) {
+				conn.Close()
+			}
+			return true
+		}
 	}
+	return false
 }
 
 func (proxy *ProxyUpstream) Start() error {
-	ln, err := tcpmux.Listen(proxy.Localaddr, true)
+	addrs := bindAddrs(proxy.Localaddr)
+	for _, t := range proxy.Transports {
+		if ht, ok := t.(HTTPTransport); ok {
+			ln := newConnListener(&net.TCPAddr{})
+			proxy.upgrades = append(proxy.upgrades, upgrade{t: ht, ln: ln})
+			go func() {
+				if err := proxy.serve(tcpmux.Wrap(ln)); err != nil && err != http.ErrServerClosed {
+					logg.E("transport over HTTP: ", err)
+				}
+			}()
+			continue
+		}
+
+		for _, b := range addrs {
+			if b.network == "tcp4" {
+				// transports listen on [::] of the port dual-stack
+				continue
+			}
+
+			ln, err := t.Listen(b.addr)
+			if err != nil {
+				return err
+			}
+
+			go func() {
+				if err := proxy.serve(tcpmux.Wrap(proxy.limit(ln))); err != nil && err != http.ErrServerClosed {
+					logg.E("transport ", ln.Addr(), ": ", err)
+				}
+			}()
+		}
+	}
+
+	if proxy.Workers > 1 {
+		return proxy.startWorkers(addrs)
+	} else if len(addrs) > 1 {
+		return proxy.startAll(addrs)
+	}
+
+	l, err := listenTCP(proxy.Localaddr)
 	if err != nil {
 		return err
 	}
 
-	proxy.Cipher.IO.Ob = ln.(*tcpmux.ListenPool)
-	return http.Serve(ln, proxy)
+	ln := proxy.wrap(l)
+	proxy.Cipher.IO.Ob = ln
+	return proxy.serve(ln)
 }
 
 func NewServer(addr string, config *ServerConfig) *ProxyUpstream {
@@ -269,24 +702,75 @@ func NewServer(addr string, config *ServerConfig) *ProxyUpstream {
 		tp: &http.Transport{TLSClientConfig: tlsSkip},
 
 		ServerConfig:  config,
-		blacklist:     lru.NewCache(128),
+		blacklist:     lru.NewCache(blacklistSize),
 		trustedTokens: make(map[string]bool),
+		bans:          bans{m: make(map[string]time.Time)},
+		reverse:       make(map[reverseKey]*reversePool),
+		notices:       noticeBoard{subs: make(map[*noticeSubscriber]bool)},
+		buckets:       make(map[string]*TokenBucket),
 		rkeyHeader:    "X-" + config.Cipher.Alias,
 	}
 
-	tcpmux.Version = checksum1b([]byte(config.Cipher.Alias)) | 0x80
+	tcpmux.Version = codec.Checksum1b([]byte(config.Cipher.Alias)) | 0x80
 
-	if config.ProxyPassAddr != "" {
-		if strings.HasPrefix(config.ProxyPassAddr, "http") {
-			u, err := url.Parse(config.ProxyPassAddr)
-			if err != nil {
-				logg.F(err)
-				return nil
+	proxy.fileUsers = make(map[string]bool)
+	proxy.replica.usersAt = usersStamp(config.UsersFile)
+	if config.UsersFile != "" {
+		users, _ := LoadUsers(config.UsersFile)
+		for name := range users {
+			proxy.fileUsers[name] = true
+		}
+	}
+	if config.ConfigFile != "" {
+		// the auth of the config is replaced by Reload too
+		if c, err := openConfFile(config.ConfigFile, nil); err == nil {
+			if auth := c.str("auth", ""); auth != "" {
+				proxy.fileUsers[userName(auth)] = true
 			}
+		}
+	}
 
-			proxy.rp = httputil.NewSingleHostReverseProxy(u)
-		} else {
-			proxy.rp = http.FileServer(http.Dir(config.ProxyPassAddr))
+	if config.BlacklistSize > 0 {
+		proxy.blacklist.MaxEntries = config.BlacklistSize
+	}
+
+	proxy.configBans = config.Bans
+	for _, ip := range config.Bans {
+		proxy.Ban(ip)
+	}
+
+	if config.BlacklistFile != "" {
+		if err := proxy.loadBlacklist(); err != nil {
+			logg.E("load blacklist: ", err)
+		}
+	}
+
+	proxy.tp.Dial = proxy.dial
+
+	if config.DNSCacheTTL > 0 {
+		proxy.dnsCache = lru.NewCache(dnsCacheSize)
+	}
+
+	if len(config.HotOrigins) > 0 {
+		var err error
+		if proxy.hot, err = newHotOrigins(config.HotOrigins, proxy.tp); err != nil {
+			logg.F(err)
+			return nil
+		}
+	}
+
+	if config.ProxyPassAddr != "" {
+		var err error
+		if proxy.rp, err = newProxyPass(config.ProxyPassAddr, nil); err != nil {
+			logg.F(err)
+			return nil
+		}
+	}
+
+	for _, t := range config.Tenants {
+		if err := t.open(); err != nil {
+			logg.F("tenant ", t.Name, ": ", err)
+			return nil
 		}
 	}
 
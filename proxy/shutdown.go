@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+const shutdownPoll = 100 * time.Millisecond
+
+// serve runs an HTTP server on ln which Shutdown can stop
+func (proxy *ProxyUpstream) serve(ln net.Listener) error {
+	return proxy.serveWith(ln, &http.Server{Handler: proxy})
+}
+
+// serveWith runs srv on ln until Shutdown
+func (proxy *ProxyUpstream) serveWith(ln net.Listener, srv *http.Server) error {
+	proxy.serversMu.Lock()
+	if proxy.stopped {
+		proxy.serversMu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	proxy.servers = append(proxy.servers, srv)
+	proxy.serversMu.Unlock()
+
+	return srv.Serve(ln)
+}
+
+// stopAccepting closes all listeners, requests being served and bridged streams are not affected
+func (proxy *ProxyUpstream) stopAccepting() []*http.Server {
+	proxy.serversMu.Lock()
+	proxy.stopped = true
+	servers := proxy.servers
+	proxy.serversMu.Unlock()
+
+	for _, srv := range servers {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	return servers
+}
+
+// Ready reports whether the server takes new tunnels: it listens and is neither draining nor shutting down
+func (proxy *ProxyUpstream) Ready() bool {
+	if _, draining := proxy.Draining(); draining {
+		return false
+	}
+
+	proxy.serversMu.Lock()
+	defer proxy.serversMu.Unlock()
+	for _, srv := range proxy.servers {
+		// not the listener of StartSync
+		if srv.Handler == http.Handler(proxy) && !proxy.stopped {
+			return true
+		}
+	}
+	return false
+}
+
+// StartContext is Start which stops accepting new connections when ctx is done,
+// bridged streams continue until they finish or Shutdown is called
+func (proxy *ProxyUpstream) StartContext(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() { errs <- proxy.Start() }()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		for _, srv := range proxy.stopAccepting() {
+			srv.Close()
+		}
+		<-errs
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting new connections, waits for pending requests and bridged streams
+// to finish, and returns. If ctx is done first, the remaining streams are closed and ctx.Err()
+// is returned.
+func (proxy *ProxyUpstream) Shutdown(ctx context.Context) error {
+	servers := proxy.stopAccepting()
+
+	// Shutdown of each server closes its listener and waits for requests not hijacked
+	done := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) { done <- srv.Shutdown(ctx) }(srv)
+	}
+
+	var err error
+	for range servers {
+		if e := <-done; e != nil {
+			err = e
+		}
+	}
+
+	tick := time.NewTicker(shutdownPoll)
+	defer tick.Stop()
+
+	for err == nil {
+		n := len(proxy.IO.OpenBridges())
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			logg.W("shutdown: closing ", n, " bridges")
+			err = ctx.Err()
+		}
+	}
+
+	proxy.IO.br.closeAll()
+	return err
+}
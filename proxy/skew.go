@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Clients stamp tunnel requests with their local time in the Date header and the server does
+// the same on its responses, so both ends can tell how far the other's clock is off
+const (
+	DefaultSkewTolerance = 5 * time.Second // added to both sides of the token and replay windows, keep it small
+	skewWarnInterval     = 10 * time.Minute
+	skewSmooth           = 8 // weight of the current estimation against a new sample
+)
+
+type skewMeter struct {
+	mu      sync.Mutex
+	skew    time.Duration // peer's clock minus ours, smoothed
+	samples int64
+	warned  time.Time
+}
+
+func httpDate() string {
+	return time.Now().UTC().Format(time.RFC1123)
+}
+
+// observe records the peer's clock read from a Date header, it warns loudly
+// (at most once every skewWarnInterval) when the estimation exceeds tol
+func (m *skewMeter) observe(date, who string, tol time.Duration) {
+	t, err := time.Parse(time.RFC1123, date)
+	if err != nil {
+		return
+	}
+
+	// Date has a resolution of 1 second
+	d := t.Sub(time.Now().Truncate(time.Second))
+	if tol <= 0 {
+		tol = DefaultSkewTolerance
+	}
+
+	m.mu.Lock()
+	if m.samples++; m.samples == 1 {
+		m.skew = d
+	} else {
+		m.skew += (d - m.skew) / skewSmooth
+	}
+
+	skew, warn := m.skew, false
+	if (skew > tol || skew < -tol) && time.Since(m.warned) >= skewWarnInterval {
+		m.warned, warn = time.Now(), true
+	}
+	m.mu.Unlock()
+
+	if warn {
+		logg.W("!!! the clock of ", who, " is off by ", skew, " (tolerance: ", tol, "), time-based tokens will be rejected, please sync the clocks (e.g. with ntpd)")
+	}
+}
+
+// ClockSkew returns the estimated offset of the peers' clocks against the local one,
+// positive means peers are ahead, ok is false if no peer has reported its time yet
+func (m *skewMeter) ClockSkew() (skew time.Duration, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.skew, m.samples > 0
+}
+
+// headerValue finds the value of key in a raw HTTP response header
+func headerValue(resp []byte, key string) string {
+	for _, line := range bytes.Split(resp, []byte("\r\n")) {
+		idx := bytes.IndexByte(line, ':')
+		if idx > -1 && strings.EqualFold(string(line[:idx]), key) {
+			return strings.TrimSpace(string(line[idx+1:]))
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	sniffTimeout    = 2 * time.Second
+	sniffBufferSize = 16*1024 + 5 // a full TLS record
+)
+
+// sniffHost peeks at the first bytes sent by the client and tries to recover the hostname,
+// the returned conn must be used instead of conn because the peeked bytes are buffered in it
+func sniffHost(conn net.Conn, port string) (string, net.Conn) {
+	var sniff func(*bufio.Reader) string
+	switch port {
+	case "443":
+		sniff = sniffTLS
+	case "80":
+		sniff = sniffHTTP
+	default:
+		return "", conn
+	}
+
+	r := bufio.NewReaderSize(conn, sniffBufferSize)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	host := sniff(r)
+	conn.SetReadDeadline(time.Time{})
+
+	return host, &bufioConn{m: r, Conn: conn}
+}
+
+func sniffTLS(r *bufio.Reader) string {
+	return parseSNI(peekHello(r))
+}
+
+// peekHello peeks at the ClientHello handshake message in the first TLS record, nil if it isn't one
+func peekHello(r *bufio.Reader) []byte {
+	hdr, err := r.Peek(5)
+	if err != nil || hdr[0] != 0x16 {
+		// not a handshake record
+		return nil
+	}
+
+	buf, err := r.Peek(5 + int(binary.BigEndian.Uint16(hdr[3:])))
+	if err != nil {
+		return nil
+	}
+
+	return buf[5:]
+}
+
+// helloExtension returns the data of the extension typ in a ClientHello handshake message, nil if it's absent
+func helloExtension(buf []byte, typ uint16) []byte {
+	// handshake type (1) + length (3) + version (2) + random (32)
+	if len(buf) < 38 || buf[0] != 0x01 {
+		return nil
+	}
+
+	p := 38
+	skip := func(lenBytes int) bool {
+		if p+lenBytes > len(buf) {
+			return false
+		}
+
+		ln := 0
+		for i := 0; i < lenBytes; i++ {
+			ln = ln<<8 + int(buf[p+i])
+		}
+
+		p += lenBytes + ln
+		return p <= len(buf)
+	}
+
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) || p+2 > len(buf) {
+		return nil
+	}
+
+	end := p + 2 + int(binary.BigEndian.Uint16(buf[p:]))
+	if end > len(buf) {
+		return nil
+	}
+
+	for p += 2; p+4 <= end; {
+		t, ln := binary.BigEndian.Uint16(buf[p:]), int(binary.BigEndian.Uint16(buf[p+2:]))
+		p += 4
+		if p+ln > end {
+			return nil
+		}
+
+		if t == typ {
+			return buf[p : p+ln]
+		}
+		p += ln
+	}
+
+	return nil
+}
+
+// parseSNI extracts the server name from a ClientHello handshake message
+func parseSNI(buf []byte) string {
+	// server_name extension: list length (2) + name type (1) + name length (2) + name
+	ext := helloExtension(buf, 0)
+	if len(ext) < 5 || ext[2] != 0 {
+		return ""
+	}
+
+	nl := int(binary.BigEndian.Uint16(ext[3:]))
+	if 5+nl > len(ext) {
+		return ""
+	}
+
+	return string(ext[5 : 5+nl])
+}
+
+// parseALPN extracts the protocols offered by a ClientHello handshake message
+func parseALPN(buf []byte) []string {
+	// application_layer_protocol_negotiation extension: list length (2) + [name length (1) + name]...
+	ext := helloExtension(buf, 16)
+	if len(ext) < 2 {
+		return nil
+	}
+
+	protos := []string{}
+	for p := 2; p < len(ext); {
+		ln := int(ext[p])
+		if p+1+ln > len(ext) {
+			break
+		}
+
+		protos = append(protos, string(ext[p+1:p+1+ln]))
+		p += 1 + ln
+	}
+	return protos
+}
+
+// parseECH returns the id of the ECH config an outer ClientHello handshake message is encrypted by, false without ECH
+func parseECH(buf []byte) (byte, bool) {
+	// encrypted_client_hello extension: type (1, 0 for outer) + KDF (2) + AEAD (2) + config id (1) + ...
+	ext := helloExtension(buf, echVersion)
+	if len(ext) < 6 || ext[0] != 0 {
+		return 0, false
+	}
+	return ext[5], true
+}
+
+// sniffHTTP looks for the Host header in the plain HTTP request header
+func sniffHTTP(r *bufio.Reader) string {
+	buf, err := r.Peek(1)
+	for err == nil {
+		buf, _ = r.Peek(r.Buffered())
+		if bytes.Contains(buf, []byte("\r\n\r\n")) || len(buf) >= sniffBufferSize {
+			break
+		}
+
+		// we don't have the full header yet, wait for more
+		_, err = r.Peek(len(buf) + 1)
+	}
+
+	lines := strings.Split(string(buf), "\r\n")
+	if len(lines) < 2 || !strings.Contains(lines[0], " HTTP/1.") {
+		return ""
+	}
+
+	for _, line := range lines[1:] {
+		if len(line) > 5 && strings.EqualFold(line[:5], "host:") {
+			host, _ := splitHostPort(strings.TrimSpace(line[5:]))
+			return strings.Trim(host, "[]")
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+var errOpenSOCKS = errors.New("plain SOCKS5 without users must listen on a loopback address, or it is an open proxy")
+
+// StartSOCKS serves plain SOCKS5 (CONNECT only) besides the obfuscated protocol,
+// clients authenticate with username/password of Users, without Users it only listens on loopback addresses.
+// The traffic is not encrypted, it should only listen inside trusted networks.
+func (proxy *ProxyUpstream) StartSOCKS() error {
+	if !proxy.multiUser() && !isLoopback(proxy.SOCKS) {
+		return errOpenSOCKS
+	}
+
+	ln, err := listenTCP(proxy.SOCKS)
+	if err != nil {
+		return err
+	}
+	ln = proxy.limit(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isClosedConnErr(err) {
+				return err
+			}
+			logg.E("SOCKS: ", err)
+			continue
+		}
+
+		go proxy.handleSocks(conn)
+	}
+}
+
+func (proxy *ProxyUpstream) handleSocks(conn net.Conn) {
+	addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if proxy.banned(addr) || proxy.Watchdog.Shedding() {
+		conn.Close()
+		return
+	}
+
+	if !proxy.multiUser() && !isLoopback(conn.LocalAddr().String()) {
+		// the users are gone by Reload
+		logg.W("SOCKS: ", errOpenSOCKS)
+		conn.Close()
+		return
+	}
+
+	user, ok := proxy.socksAuth(conn, addr, proxy.multiUser())
+	if !ok {
+		return
+	}
+
+	method, dst, err := parseUDPHeader(conn, nil, false)
+	if err != nil {
+		logg.E("SOCKS: ", err)
+		conn.Close()
+		return
+	}
+
+	if method != 1 {
+		replyFailure(conn, okSOCKS, CloseUnsupported)
+		return
+	}
+
+	host := dst.String()
+	if proxy.AccessRules.blocked(user, host, time.Now()) != nil {
+		replyFailure(conn, okSOCKS, CloseDenied)
+		return
+	}
+
+	ioc := proxy.getIOConfig(user)
+	ioc.Host = host
+	if c := proxy.Classes.classify(host); c != nil {
+		c.apply(&ioc)
+	}
+
+	targetSiteConn, err := proxy.dial("tcp", host)
+	if err != nil {
+		logg.E("SOCKS ", host, ": ", err)
+		replyFailure(conn, okSOCKS, dialCloseReason(err))
+		return
+	}
+
+	logg.D("SOCKS ", host, " from ", addr)
+	conn.Write(okSOCKS)
+	targetSiteConn = proxy.Cipher.IO.Dump.Wrap(targetSiteConn, host)
+	go proxy.Cipher.IO.Bridge(conn, targetSiteConn, nil, ioc)
+}
+
+// socksAuth negotiates the method with a SOCKS5 client, which authenticates with username/password of Users
+// if required, the conn is closed if it fails
+func (proxy *ProxyUpstream) socksAuth(conn net.Conn, addr string, required bool) (user string, ok bool) {
+	buf := make([]byte, 2+255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != socksVersion5 {
+		conn.Close()
+		return "", false
+	}
+
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		conn.Close()
+		return "", false
+	}
+
+	if required {
+		if !hasMethod(methods, 0x02) {
+			conn.Write([]byte{socksVersion5, 0xff}) // no acceptable methods
+			conn.Close()
+			return "", false
+		}
+
+		conn.Write([]byte{socksVersion5, 0x02}) // username & password auth
+		var auth string
+		auth, ok = readSocksAuth(conn)
+		if ok {
+			user, ok = proxy.auth(auth)
+		}
+
+		if !ok {
+			logg.W("SOCKS user auth failed, from: ", addr)
+			conn.Write([]byte{1, 1})
+			conn.Close()
+			return "", false
+		}
+
+		if !proxy.allows(user, addr) {
+			conn.Write([]byte{1, 1})
+			conn.Close()
+			return "", false
+		}
+
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{socksVersion5, 0})
+	}
+
+	return user, true
+}
+
+func hasMethod(methods []byte, m byte) bool {
+	for _, b := range methods {
+		if b == m {
+			return true
+		}
+	}
+	return false
+}
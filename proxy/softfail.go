@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+const softFailWarnInterval = time.Minute
+
+// unreachableError means the upstream couldn't be dialed at all, as opposed to refusing a stream
+type unreachableError struct{ error }
+
+// unreachable tells whether err means the upstream couldn't be dialed, errors of forwarded requests
+// are those of http.Transport, which wraps the dialing ones of HTTP upstreams as proxyconnect
+func unreachable(err error) bool {
+	var ue unreachableError
+	var op *net.OpError
+	return errors.As(err, &ue) || errors.As(err, &op) && op.Op == "proxyconnect"
+}
+
+// softFail reports whether host may be connected directly because the upstream is unreachable,
+// a loud warning is logged because the traffic is no longer protected by the tunnel.
+// Hosts matching SoftFailDeny never leave the tunnel.
+func (proxy *ProxyClient) softFail(host string, err error) bool {
+	if !proxy.SoftFail || !unreachable(err) {
+		return false
+	}
+
+	name, _ := splitHostPort(host)
+	if proxy.SoftFailDeny != nil && proxy.SoftFailDeny.Match(strings.Trim(name, "[]")) {
+		logg.D("soft fail denied: ", host)
+		return false
+	}
+
+	now := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&proxy.softWarnAt); now-last > int64(softFailWarnInterval) &&
+		atomic.CompareAndSwapInt64(&proxy.softWarnAt, last, now) {
+		logg.W("!!! the upstream is unreachable (", err, "), connections are made DIRECTLY and NOT protected until it is back")
+	}
+
+	logg.D("soft fail: ", host)
+	return true
+}
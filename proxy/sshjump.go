@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+	"github.com/coyove/goflyway/pkg/logg"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHJump lets the server reach destinations through an SSH bastion, like networks of a company,
+// streams to them are forwarded by the bastion (ssh -J), which also resolves their names.
+// UDP relays can't go through it and are sent directly
+type SSHJump struct {
+	Name  string
+	Hosts *acr.HostMatcher // nil matches any host
+	Ports map[string]bool  // empty matches any port
+	Addr  string           // of the bastion
+
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client // shared by streams, dialed again when broken
+}
+
+// SSHJumps are sorted by name, the first matching one is used
+type SSHJumps []*SSHJump
+
+// LoadSSHJumps reads bastions from a config file, each section is a bastion:
+//
+//	[corp]
+//	hosts=*.corp.example.com,10.0.0.0/8
+//	ports=22,443                    # empty means any port
+//	jump=bastion.example.com:22
+//	user=alice
+//	key=/home/alice/.ssh/id_ed25519 # or password=...
+//	passphrase=...                  # of the key if encrypted
+//	knownhosts=/home/alice/.ssh/known_hosts # or hostkey=SHA256:... printed by ssh-keygen -lf
+//
+// The key of the bastion must be verified by one of knownhosts and hostkey
+func LoadSSHJumps(path string) (SSHJumps, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := config.ParseConf(string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	// numbers are parsed by the config, like passwords of digits
+	str := func(section, key string) string {
+		if n := cf.GetInt(section, key, -1); n > -1 {
+			return strconv.FormatInt(n, 10)
+		}
+		return cf.GetString(section, key, "")
+	}
+
+	list := func(section, key string) []string {
+		parts := []string{}
+		for _, p := range strings.Split(str(section, key), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		return parts
+	}
+
+	sj := SSHJumps{}
+	for name := range *cf {
+		if name == "default" {
+			continue
+		}
+
+		j := &SSHJump{
+			Name:  name,
+			Ports: make(map[string]bool),
+			Addr:  hostWithPort(str(name, "jump"), "22"),
+		}
+
+		if j.Addr == ":22" {
+			return nil, errors.New(name + ": jump is missing")
+		}
+
+		if hosts := list(name, "hosts"); len(hosts) > 0 {
+			if j.Hosts, err = acr.NewHostMatcher(hosts); err != nil {
+				return nil, errors.New(name + ": " + err.Error())
+			}
+		}
+
+		for _, p := range list(name, "ports") {
+			j.Ports[p] = true
+		}
+
+		if j.config, err = sshClientConfig(func(key string) string { return str(name, key) }); err != nil {
+			return nil, errors.New(name + ": " + err.Error())
+		}
+
+		sj = append(sj, j)
+	}
+
+	sort.Slice(sj, func(i, k int) bool { return sj[i].Name < sj[k].Name })
+	return sj, nil
+}
+
+// sshClientConfig returns the config of a bastion, whose keys are read by str
+func sshClientConfig(str func(key string) string) (*ssh.ClientConfig, error) {
+	c := &ssh.ClientConfig{User: str("user"), Timeout: timeoutDial}
+	if c.User == "" {
+		return nil, errors.New("user is missing")
+	}
+
+	if path := str("key"); path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		if pass := str("passphrase"); pass != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(pass))
+		} else {
+			signer, err = ssh.ParsePrivateKey(buf)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.Auth = append(c.Auth, ssh.PublicKeys(signer))
+	}
+
+	if pass := str("password"); pass != "" {
+		c.Auth = append(c.Auth, ssh.Password(pass))
+	}
+
+	if len(c.Auth) == 0 {
+		return nil, errors.New("key or password is missing")
+	}
+
+	if path := str("knownhosts"); path != "" {
+		cb, err := knownhosts.New(path)
+		if err != nil {
+			return nil, err
+		}
+		c.HostKeyCallback = cb
+	} else if fp := str("hostkey"); fp != "" {
+		c.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != fp {
+				return errors.New("ssh: host key of " + hostname + " is " + ssh.FingerprintSHA256(key) + ", not " + fp)
+			}
+			return nil
+		}
+	} else {
+		return nil, errors.New("knownhosts or hostkey is missing, the bastion must be verified")
+	}
+
+	return c, nil
+}
+
+// match returns the bastion of host, nil if none
+func (sj SSHJumps) match(host string) *SSHJump {
+	name, port := splitHostPort(host)
+	name = strings.Trim(name, "[]")
+	port = strings.TrimPrefix(port, ":")
+
+	for _, j := range sj {
+		if len(j.Ports) > 0 && !j.Ports[port] {
+			continue
+		}
+
+		if j.Hosts != nil && !j.Hosts.Match(name) {
+			continue
+		}
+
+		return j
+	}
+
+	return nil
+}
+
+// dial opens a stream to addr forwarded by the bastion, the connection to which is shared
+// and dialed again if it has been broken
+func (j *SSHJump) dial(network, addr string) (net.Conn, error) {
+	for retry := 0; ; retry++ {
+		client, err := j.connect()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := client.Dial(network, addr)
+		if _, refused := err.(*ssh.OpenChannelError); err == nil || refused || retry > 0 {
+			// a refusal of the bastion means the connection is fine
+			return conn, err
+		}
+
+		logg.W("SSH jump ", j.Name, ": ", err, ", reconnect")
+		j.mu.Lock()
+		if j.client == client {
+			j.client = nil
+		}
+		j.mu.Unlock()
+		client.Close()
+	}
+}
+
+func (j *SSHJump) connect() (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.client != nil {
+		return j.client, nil
+	}
+
+	client, err := ssh.Dial("tcp", j.Addr, j.config)
+	if err != nil {
+		return nil, err
+	}
+
+	logg.D("SSH jump ", j.Name, ": connected to ", j.Addr)
+	j.client = client
+	go func() {
+		client.Wait()
+		j.mu.Lock()
+		if j.client == client {
+			j.client = nil
+		}
+		j.mu.Unlock()
+	}()
+	return client, nil
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SharedState is a key-value store shared by servers behind a TCP load balancer, so their blacklist,
+// replay IVs and connection rates of IPs are enforced together and scaling out doesn't weaken them.
+// Manual bans are spread by the config, the admin API or sync instead, and bridges are counted locally
+type SharedState interface {
+	// Incr increments the counter of key and returns its value, the key expires ttl after the last increment
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Get returns the counter of key, 0 if it is missing
+	Get(key string) (int64, error)
+	// Add sets key expiring after ttl and reports true, or false if it exists
+	Add(key string, ttl time.Duration) (bool, error)
+	// Del deletes key
+	Del(key string) error
+}
+
+// keys of the shared state, keys of servers of different passwords should be kept apart by the Redis database
+const (
+	stateOffense = "goflyway:offense:"
+	stateIV      = "goflyway:iv:"
+	stateRate    = "goflyway:rate:"
+)
+
+const (
+	redisPool       = 8
+	redisTimeout    = time.Second
+	redisMaxBackoff = 30 * time.Second
+)
+
+var errRedisDown = errors.New("redis: unreachable, retry later")
+
+// RedisState is the SharedState in Redis, spoken by RESP over a few pooled connections.
+// After a failed dial, calls fail at once for a backoff doubling up to redisMaxBackoff,
+// so requests don't wait for Redis being down before failing open
+type RedisState struct {
+	Addr     string
+	Password string
+	DB       int
+
+	idle    chan net.Conn
+	mu      sync.Mutex
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// NewRedisState returns the state in the Redis of rawurl, like redis://:password@localhost:6379/0
+func NewRedisState(rawurl string) (*RedisState, error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "redis://" + rawurl
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, errors.New("shared state should be like redis://:password@host:6379/0")
+	}
+
+	r := &RedisState{Addr: hostWithPort(u.Host, "6379")}
+	if p, ok := u.User.Password(); ok {
+		r.Password = p
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.New("invalid database: " + db)
+		}
+	}
+
+	r.idle = make(chan net.Conn, redisPool)
+	return r, nil
+}
+
+func (r *RedisState) Incr(key string, ttl time.Duration) (int64, error) {
+	v, err := r.do([]string{"INCR", key}, []string{"PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10)})
+	if err != nil {
+		return 0, err
+	}
+	return v[0].(int64), nil
+}
+
+func (r *RedisState) Get(key string) (int64, error) {
+	v, err := r.do([]string{"GET", key})
+	if err != nil || v[0] == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v[0].(string), 10, 64)
+}
+
+func (r *RedisState) Add(key string, ttl time.Duration) (bool, error) {
+	v, err := r.do([]string{"SET", key, "1", "NX", "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10)})
+	if err != nil {
+		return false, err
+	}
+	return v[0] != nil, nil
+}
+
+func (r *RedisState) Del(key string) error {
+	_, err := r.do([]string{"DEL", key})
+	return err
+}
+
+// Ping checks whether Redis is reachable and the password is accepted
+func (r *RedisState) Ping() error {
+	_, err := r.do([]string{"PING"})
+	return err
+}
+
+// do sends cmds in a pipeline and returns their replies, integers are int64, strings are string
+// and nil replies are nil, a reply of error fails the whole call
+func (r *RedisState) do(cmds ...[]string) ([]interface{}, error) {
+	conn, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for _, cmd := range cmds {
+		writeRESP(rw.Writer, cmd)
+	}
+
+	replies := make([]interface{}, len(cmds))
+	broken := rw.Flush()
+	for i := 0; i < len(cmds) && broken == nil; i++ {
+		var e error
+		if replies[i], e = readRESP(rw.Reader); e == nil {
+			continue
+		} else if _, ok := e.(redisError); !ok {
+			broken = e
+		} else if err == nil {
+			// the connection is fine after an error reply
+			err = e
+		}
+	}
+
+	if broken != nil {
+		conn.Close()
+		return nil, broken
+	}
+
+	select {
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return replies, err
+}
+
+// conn returns an idle connection, or dials a new one which is authenticated and selects the database
+func (r *RedisState) conn() (net.Conn, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, nil
+	default:
+	}
+
+	r.mu.Lock()
+	down := time.Now().Before(r.retryAt)
+	r.mu.Unlock()
+	if down {
+		return nil, errRedisDown
+	}
+
+	conn, err := net.DialTimeout("tcp", r.Addr, redisTimeout)
+	r.dialed(err)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds [][]string
+	if r.Password != "" {
+		cmds = append(cmds, []string{"AUTH", r.Password})
+	}
+	if r.DB != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(r.DB)})
+	}
+
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for _, cmd := range cmds {
+		writeRESP(rw.Writer, cmd)
+	}
+	if err = rw.Flush(); err == nil {
+		for range cmds {
+			if _, err = readRESP(rw.Reader); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialed backs off after a failed dial, or resets the backoff after a successful one
+func (r *RedisState) dialed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil {
+		r.backoff, r.retryAt = 0, time.Time{}
+		return
+	}
+
+	if r.backoff *= 2; r.backoff == 0 {
+		r.backoff = redisTimeout
+	} else if r.backoff > redisMaxBackoff {
+		r.backoff = redisMaxBackoff
+	}
+	r.retryAt = time.Now().Add(r.backoff)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func writeRESP(w *bufio.Writer, cmd []string) {
+	w.WriteString("*" + strconv.Itoa(len(cmd)) + "\r\n")
+	for _, arg := range cmd {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+}
+
+// readRESP reads a reply of simple strings, errors, integers or bulk strings
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if line = strings.TrimSuffix(line, "\r\n"); len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	}
+	return nil, errors.New("redis: unexpected reply " + line)
+}
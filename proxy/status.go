@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var startedAt = time.Now()
+
+// Status is a snapshot of a running client or server, served as JSON by the web console and the admin API
+type Status struct {
+	Version    string  `json:"version"`
+	Role       string  `json:"role"`
+	Upstream   string  `json:"upstream,omitempty"` // the upstream in use, may be an alternate one
+	Uptime     float64 `json:"uptime_seconds"`
+	Bridges    int     `json:"bridges"`              // streams being bridged
+	Latency    float64 `json:"latency_ms,omitempty"` // smoothed latency of dialing the upstream
+	LatencyMin float64 `json:"latency_min_ms,omitempty"`
+	LatencyMax float64 `json:"latency_max_ms,omitempty"`
+	Sent       uint64  `json:"sent_bytes"`
+	Received   uint64  `json:"received_bytes"`
+	ClockSkew  float64 `json:"clock_skew_seconds"`
+	DNSEntries int     `json:"dns_entries,omitempty"`
+	Draining   bool    `json:"draining,omitempty"`
+	Corrupted  uint64  `json:"corrupted_streams,omitempty"` // partial streams whose checksum trailers mismatched
+
+	Bandwidth   map[string]LinkSpeed   `json:"bandwidth,omitempty"`    // estimated throughput keyed by upstream
+	DialLatency map[string]Percentiles `json:"dial_latency,omitempty"` // of destinations keyed by network, see dialNetworks
+}
+
+func (iot *io_t) status(role string) Status {
+	s := Status{
+		Role:      role,
+		Uptime:    time.Since(startedAt).Seconds(),
+		Bridges:   len(iot.OpenBridges()),
+		Latency:   float64(iot.Tr.Latency()) / 1e6,
+		Sent:      atomic.LoadUint64(&iot.Tr.totalSent),
+		Received:  atomic.LoadUint64(&iot.Tr.totalRecved),
+		Corrupted: atomic.LoadUint64(&iot.sumFailures),
+	}
+
+	if min := atomic.LoadInt64(&iot.Tr.latencyMin); min > 0 {
+		s.LatencyMin = float64(min) / 1e6
+	}
+	s.LatencyMax = float64(atomic.LoadInt64(&iot.Tr.latencyMax)) / 1e6
+	return s
+}
+
+// Status returns the state of the client, Version is left empty
+func (proxy *ProxyClient) Status() Status {
+	s := proxy.IO.status("client")
+
+	proxy.activeMu.Lock()
+	_, s.Upstream = proxy.poolAt(proxy.active)
+	proxy.activeMu.Unlock()
+
+	skew, _ := proxy.ClockSkew()
+	s.ClockSkew = skew.Seconds()
+	s.DNSEntries = proxy.DNSCache.Len()
+	s.Bandwidth = proxy.bandwidth.Bandwidth()
+	return s
+}
+
+// Status returns the state of the server, Version is left empty
+func (proxy *ProxyUpstream) Status() Status {
+	s := proxy.IO.status("server")
+
+	skew, _ := proxy.ClockSkew()
+	s.ClockSkew = skew.Seconds()
+	_, s.Draining = proxy.Draining()
+	s.DialLatency = proxy.DialLatency()
+	return s
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamConn joins the request body and a flushed response into a full-duplex conn,
+// it is used when the ResponseWriter can't be hijacked, e.g. the server is behind an HTTP/2 frontend
+type streamConn struct {
+	r      io.ReadCloser
+	w      io.Writer
+	f      http.Flusher
+	remote net.Addr
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "http" }
+
+func (a streamAddr) String() string { return string(a) }
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+
+	return &streamConn{r: r.Body, w: w, f: f, remote: streamAddr(r.RemoteAddr)}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errors.New("write to closed stream")
+	}
+
+	n, err := c.w.Write(b)
+	c.f.Flush()
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.r.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr { return streamAddr("") }
+
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error { return nil }
+
+func (c *streamConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// bodyConn is the client end of streamConn: writes are sent as chunks of the request body, reads come from
+// the body of the response, the response is what the upstream writes to the streamConn, except that a
+// response without a body, e.g. of refuse, is read as its header
+type bodyConn struct {
+	net.Conn
+	r    io.Reader
+	resp *bufio.Reader
+}
+
+func newBodyConn(conn net.Conn) *bodyConn {
+	return &bodyConn{Conn: conn, resp: bufio.NewReader(conn)}
+}
+
+func (c *bodyConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		resp, err := http.ReadResponse(c.resp, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			c.r = resp.Body
+		} else {
+			resp.Body.Close()
+			hdr, _ := httputil.DumpResponse(resp, false)
+			c.r = bytes.NewReader(hdr)
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *bodyConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		// an empty chunk would end the body
+		return 0, nil
+	}
+
+	buf := make([]byte, 0, len(b)+16)
+	buf = strconv.AppendInt(buf, int64(len(b)), 16)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, b...)
+	buf = append(buf, "\r\n"...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// streamIDHeader carries the stream ID in error responses sent to the local application
+const streamIDHeader = "X-Goflyway-Stream"
+
+// streamID derives a short ID from the IV of a stream, both the client and the upstream know the IV,
+// so their log lines of the same stream can be correlated without sending anything extra
+func streamID(rkeybuf []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(rkeybuf))
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	acr "github.com/coyove/goflyway/pkg/aclrouter"
+	"github.com/coyove/goflyway/pkg/config"
+)
+
+// Tenant is a group sharing the server to host its own site behind the proxy, visitors are served
+// by the tenant's backend instead of ProxyPassAddr when the Host of their requests matches:
+// each tenant has its own backend connections, throttle, byte quota and access log, and its own admin token
+// which only reveals the tenant's stats
+type Tenant struct {
+	Name      string
+	Hosts     *acr.HostMatcher
+	ProxyPass string // a URL of the reverse proxy or a directory of the file server, like ProxyPassAddr
+	Throttle  int64  // bytes per second shared by the tenant's visitors, 0 means unlimited
+	Quota     int64  // bytes served before the site is refused until the server restarts, 0 means unlimited
+	Log       string // the access log, empty means no log
+	Token     string // presented by the tenant to the admin API, empty means the tenant has no access
+
+	handler  http.Handler
+	bucket   *TokenBucket
+	log      *os.File
+	logMu    sync.Mutex
+	requests int64
+	bytes    int64
+}
+
+// TenantStat is what a tenant sees of itself in the admin API
+type TenantStat struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Quota    int64  `json:"quota,omitempty"`
+}
+
+var errTenantQuota = errors.New("tenant quota used up")
+
+// LoadTenants reads tenants from a config file, each section is a tenant:
+//
+//	[shop]
+//	hosts=shop.example.com,*.shop.example.com
+//	proxypass=http://127.0.0.1:8080
+//	throttle=1024   # KB/s shared by the tenant's visitors
+//	quota=10240     # MB served in all, then visitors get 429
+//	log=/var/log/goflyway/shop.log
+//	token=a-long-random-string
+func LoadTenants(path string) ([]*Tenant, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := config.ParseConf(string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string)
+	tenants := []*Tenant{}
+	for name := range *cf {
+		if name == "default" {
+			continue
+		}
+
+		t := &Tenant{
+			Name:      name,
+			ProxyPass: cf.GetString(name, "proxypass", ""),
+			Throttle:  cf.GetInt(name, "throttle", 0) * 1024,
+			Quota:     cf.GetInt(name, "quota", 0) * 1024 * 1024,
+			Log:       cf.GetString(name, "log", ""),
+			Token:     cf.GetString(name, "token", ""),
+		}
+
+		hosts := []string{}
+		for _, h := range strings.Split(cf.GetString(name, "hosts", ""), ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+
+		if len(hosts) == 0 || t.ProxyPass == "" {
+			return nil, fmt.Errorf("%s: expect hosts and proxypass", name)
+		}
+
+		if t.Hosts, err = acr.NewHostMatcher(hosts); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if t.Token != "" {
+			if other, dup := tokens[t.Token]; dup {
+				return nil, fmt.Errorf("%s: token shared with %s", name, other)
+			}
+			tokens[t.Token] = name
+		}
+
+		tenants = append(tenants, t)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants, nil
+}
+
+// newProxyPass returns the reverse proxy of a URL or the file server of a directory,
+// tr is the transport of the reverse proxy, nil means the default one
+func newProxyPass(addr string, tr http.RoundTripper) (http.Handler, error) {
+	if !strings.HasPrefix(addr, "http") {
+		return http.FileServer(http.Dir(addr)), nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.Transport = tr
+	return rp, nil
+}
+
+// open prepares the backend, throttle and access log of the tenant
+func (t *Tenant) open() error {
+	// idle connections to a backend are never handed to another tenant
+	tr := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	var err error
+	if t.handler, err = newProxyPass(t.ProxyPass, tr); err != nil {
+		return err
+	}
+
+	if t.Throttle > 0 {
+		t.bucket = NewTokenBucket(t.Throttle, t.Throttle)
+	}
+
+	if t.Log != "" {
+		if t.log, err = os.OpenFile(t.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type tenantWriter struct {
+	http.ResponseWriter
+	t      *Tenant
+	status int
+	n      int64
+}
+
+func (w *tenantWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *tenantWriter) Write(p []byte) (int, error) {
+	if w.t.exhausted() {
+		return 0, errTenantQuota
+	}
+
+	if w.t.bucket != nil {
+		w.t.bucket.Consume(int64(len(p)))
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	atomic.AddInt64(&w.t.bytes, int64(n))
+	return n, err
+}
+
+func (w *tenantWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// exhausted tells whether the tenant has been served its quota, responses being written are cut there
+func (t *Tenant) exhausted() bool {
+	return t.Quota > 0 && atomic.LoadInt64(&t.bytes) >= t.Quota
+}
+
+func (t *Tenant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tw := &tenantWriter{ResponseWriter: w, t: t, status: http.StatusOK}
+	if t.exhausted() {
+		tw.WriteHeader(http.StatusTooManyRequests)
+	} else {
+		t.handler.ServeHTTP(tw, r)
+	}
+
+	atomic.AddInt64(&t.requests, 1)
+
+	if t.log != nil {
+		addr, _, _ := net.SplitHostPort(r.RemoteAddr)
+		t.logMu.Lock()
+		fmt.Fprintf(t.log, "%s %s %s %q %d %d\n",
+			time.Now().Format(time.RFC3339), addr, r.Host, r.Method+" "+r.RequestURI, tw.status, tw.n)
+		t.logMu.Unlock()
+	}
+}
+
+// tenantOf returns the tenant serving host, nil if none
+func (proxy *ProxyUpstream) tenantOf(host string) *Tenant {
+	name, _ := splitHostPort(host)
+	name = strings.ToLower(strings.Trim(name, "[]"))
+
+	for _, t := range proxy.Tenants {
+		if t.Hosts.Match(name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// TenantStat returns the stats of the tenant presenting token
+func (proxy *ProxyUpstream) TenantStat(token string) (TenantStat, error) {
+	for _, t := range proxy.Tenants {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return TenantStat{
+				Name:     t.Name,
+				Requests: atomic.LoadInt64(&t.requests),
+				Bytes:    atomic.LoadInt64(&t.bytes),
+				Quota:    t.Quota,
+			}, nil
+		}
+	}
+	return TenantStat{}, errors.New("invalid token")
+}
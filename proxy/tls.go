@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+	"github.com/coyove/tcpmux"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func init() {
+	RegisterTransport("tls", &TLSTransport{})
+}
+
+// TLSTransport carries the connections to the upstream by real TLS, so they look like visits to an HTTPS site,
+// the certificate of the upstream is verified against the host of its address unless Config says otherwise
+type TLSTransport struct {
+	Config      *tls.Config // nil means the default config of the client, the server needs certificates
+	Fingerprint string      // the browser whose ClientHello the client mimics, see Fingerprints, empty means Go's own
+	SNI         string      // presented instead of the name verified, see WithSNI
+	ECH         []byte      // the ECH config list the ClientHello is encrypted by, see WithECH
+}
+
+// fingerprints are the ClientHellos uTLS mimics, Go's own one is easily told apart by DPI
+var fingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"ios":     utls.HelloIOS_Auto,
+	"random":  utls.HelloRandomized,
+}
+
+// Fingerprints returns the sorted names of the ClientHellos TLSTransport can mimic
+func Fingerprints() []string {
+	names := make([]string, 0, len(fingerprints))
+	for name := range fingerprints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dial dials the upstream and handshakes
+func (t *TLSTransport) Dial(address string) (net.Conn, error) {
+	c := &tls.Config{}
+	if t.Config != nil {
+		c = t.Config.Clone()
+	}
+
+	if c.ServerName == "" {
+		c.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	if t.SNI != "" && t.SNI != c.ServerName {
+		// the certificate is of the site, not of the secret name presented
+		if !c.InsecureSkipVerify {
+			c.InsecureSkipVerify = true
+			c.VerifyPeerCertificate = verifyPeer(c.ServerName, c.RootCAs)
+		}
+		c.ServerName = t.SNI
+	}
+
+	if len(t.ECH) > 0 {
+		if t.Fingerprint != "" {
+			return nil, errors.New("tls: ECH can't encrypt a mimicked ClientHello")
+		}
+
+		// the outer ClientHello presents the public name of the config, the name above is encrypted
+		c.EncryptedClientHelloConfigList = t.ECH
+		c.MinVersion = tls.VersionTLS13
+	}
+
+	if t.Fingerprint == "" {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeoutDial}, "tcp", address, c)
+	}
+
+	id, ok := fingerprints[t.Fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("tls: unknown fingerprint %q", t.Fingerprint)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeoutDial)
+	if err != nil {
+		return nil, err
+	}
+
+	// the extensions and ALPN offered are those of the browser, the server still negotiates http/1.1
+	uc := utls.UClient(conn, &utls.Config{
+		ServerName:         c.ServerName,
+		RootCAs:            c.RootCAs,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+
+		VerifyPeerCertificate: c.VerifyPeerCertificate,
+	}, id)
+
+	conn.SetDeadline(time.Now().Add(timeoutDial))
+	if err := uc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return uc, nil
+}
+
+// verifyPeer verifies the certificate chain against name
+func verifyPeer(name string, roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		if len(certs) == 0 {
+			return errors.New("tls: no certificates from the server")
+		}
+
+		opts := x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// WithSNI returns a copy of t presenting sni instead of the host of the upstream address (or Config.ServerName),
+// which the certificate of the site is still verified against, see ServerConfig.TLSRoute
+func (t *TLSTransport) WithSNI(sni string) *TLSTransport {
+	return &TLSTransport{Config: t.Config, Fingerprint: t.Fingerprint, SNI: sni, ECH: t.ECH}
+}
+
+// WithFingerprint returns a copy of t mimicking the ClientHello of a browser, see Fingerprints
+func (t *TLSTransport) WithFingerprint(name string) (*TLSTransport, error) {
+	if _, ok := fingerprints[name]; !ok {
+		return nil, fmt.Errorf("unknown fingerprint %q, expect one of: %s", name, strings.Join(Fingerprints(), ", "))
+	}
+	return &TLSTransport{Config: t.Config, Fingerprint: name, SNI: t.SNI, ECH: t.ECH}, nil
+}
+
+// WithECH returns a copy of t encrypting the ClientHello by the ECH config list printed by the server,
+// so the SNI isn't visible on the wire, the server must accept ECH then, see ECHConfigList
+func (t *TLSTransport) WithECH(list []byte) *TLSTransport {
+	return &TLSTransport{Config: t.Config, Fingerprint: t.Fingerprint, SNI: t.SNI, ECH: list}
+}
+
+// Tune returns a copy of t presenting opts.SNI, encrypting the ClientHello by opts.ECH and mimicking opts.Fingerprint,
+// see WithSNI, WithECH and WithFingerprint
+func (t *TLSTransport) Tune(opts TransportOptions) (Transport, error) {
+	if opts.Params != "" {
+		return nil, errors.New("tls: no parameters, see -sni, -ech and -fingerprint")
+	}
+
+	if opts.Fingerprint != "" && len(opts.ECH) > 0 {
+		return nil, errors.New("tls: ECH can't encrypt a mimicked ClientHello")
+	}
+
+	if opts.SNI != "" {
+		t = t.WithSNI(opts.SNI)
+	}
+
+	if len(opts.ECH) > 0 {
+		t = t.WithECH(opts.ECH)
+	}
+
+	if opts.Fingerprint != "" {
+		ft, err := t.WithFingerprint(opts.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		return ft, nil
+	}
+	return t, nil
+}
+
+// Network tells the transport needs the TCP port, the server should terminate TLS by ServerConfig.TLS
+func (t *TLSTransport) Network() string { return "tcp" }
+
+// Listen listens on the TCP port of address, the server should rather use ServerConfig.TLS
+// which terminates TLS on the main listener
+func (t *TLSTransport) Listen(address string) (net.Listener, error) {
+	if t.Config == nil || (len(t.Config.Certificates) == 0 && t.Config.GetCertificate == nil) {
+		return nil, errors.New("tls: no certificates to listen with")
+	}
+
+	ln, err := listenTCP(address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, t.Config), nil
+}
+
+// NewACMEConfig returns the server TLS config whose certificates of domains are obtained and renewed
+// automatically from Let's Encrypt, accounts and certificates are kept in cacheDir.
+// Certificates are validated by the TLS-ALPN challenge, so the listener must be reachable on port 443.
+// Other names, like the secret SNI of ServerConfig.TLSRoute, get the certificate of the first domain
+func NewACMEConfig(domains []string, cacheDir, email string) *tls.Config {
+	policy := autocert.HostWhitelist(domains...)
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: policy,
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+
+	c := m.TLSConfig()
+	c.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if len(domains) > 0 && !acmeChallenge(hello.SupportedProtos) && policy(context.Background(), hello.ServerName) != nil {
+			h := *hello
+			h.ServerName = domains[0]
+			hello = &h
+		}
+		return m.GetCertificate(hello)
+	}
+	// the listener is wrapped by tcpmux, http.Server can't tell the negotiated protocol then
+	c.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	return c
+}
+
+// acmeChallenge tells whether the ALPN protocols are of a TLS-ALPN challenge of Let's Encrypt
+func acmeChallenge(protos []string) bool {
+	return len(protos) == 1 && protos[0] == acme.ALPNProto
+}
+
+// wrap limits the connections of ln, terminates TLS on it if the server is configured with it, and wraps it for tcpmux
+func (proxy *ProxyUpstream) wrap(ln net.Listener) *tcpmux.ListenPool {
+	ln = proxy.limit(ln)
+	if proxy.TLS != nil && proxy.TLSRoute != "" {
+		ln = proxy.newSNIListener(ln)
+	} else if proxy.TLS != nil {
+		ln = tls.NewListener(ln, proxy.TLS)
+	}
+	return tcpmux.Wrap(ln)
+}
+
+// sniListener shares the port with a real HTTPS site: connections presenting TLSRoute by SNI or ALPN
+// are terminated for the tunnel, others are passed untouched to the site of an https:// ProxyPassAddr,
+// or terminated too and served by ProxyPassAddr like invalid requests if it isn't one
+type sniListener struct {
+	net.Listener
+	proxy   *ProxyUpstream
+	backend string
+	tunnel  *tls.Config // proxy.TLS negotiating TLSRoute as the ALPN protocol
+	conns   chan net.Conn
+	err     chan error
+}
+
+func (proxy *ProxyUpstream) newSNIListener(ln net.Listener) *sniListener {
+	l := &sniListener{
+		Listener: ln,
+		proxy:    proxy,
+		tunnel:   proxy.TLS.Clone(),
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+	}
+
+	if len(l.tunnel.NextProtos) > 0 {
+		l.tunnel.NextProtos = append(l.tunnel.NextProtos, proxy.TLSRoute)
+	}
+
+	if u, err := url.Parse(proxy.ProxyPassAddr); err == nil && u.Scheme == "https" {
+		l.backend = hostWithPort(u.Host, "443")
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				l.err <- err
+				return
+			}
+			go l.route(conn)
+		}
+	}()
+
+	return l
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// later calls fail the same way
+		l.err <- err
+		return nil, err
+	}
+}
+
+// routed tells whether a ClientHello is of the tunnel, those encrypted by ECH keys of the server are,
+// the SNI and ALPN inside aren't visible, and the site can't decrypt them anyway
+func (l *sniListener) routed(hello []byte) bool {
+	if parseSNI(hello) == l.proxy.TLSRoute {
+		return true
+	}
+
+	if id, ok := parseECH(hello); ok {
+		for _, k := range l.proxy.TLS.EncryptedClientHelloKeys {
+			if kid, _ := echConfigID(k.Config); kid == id {
+				return true
+			}
+		}
+	}
+
+	for _, p := range parseALPN(hello) {
+		if p == l.proxy.TLSRoute {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *sniListener) route(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, sniffBufferSize)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	hello := peekHello(r)
+	conn.SetReadDeadline(time.Time{})
+	conn = &bufioConn{m: r, Conn: conn}
+
+	// challenges of Let's Encrypt are answered by proxy.TLS, not the site
+	tunnel := hello != nil && l.routed(hello)
+	if hello != nil && !tunnel && !acmeChallenge(parseALPN(hello)) && l.backend != "" {
+		site, err := net.DialTimeout("tcp", l.backend, timeoutDial)
+		if err != nil {
+			logg.E("pass to ", l.backend, ": ", err)
+			conn.Close()
+			return
+		}
+
+		l.proxy.Cipher.IO.Bridge(conn, site, nil, IOConfig{})
+		return
+	}
+
+	c := l.proxy.TLS
+	if tunnel {
+		c = l.tunnel
+	}
+
+	select {
+	case l.conns <- tls.Server(conn, c):
+	case err := <-l.err:
+		l.err <- err
+		conn.Close()
+	}
+}
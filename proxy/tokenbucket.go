@@ -17,6 +17,29 @@ import (
  * TODO: bugs all around
  */
 
+// ThrottlingScope decides which streams share the same token bucket
+type ThrottlingScope byte
+
+const (
+	ThrottlingPerConn ThrottlingScope = iota // every stream has its own bucket
+	ThrottlingPerUser                        // streams of the same user share a bucket
+	ThrottlingGlobal                         // all streams share a bucket
+)
+
+// ParseThrottlingScope accepts "per-conn" (or empty), "per-user" and "global"
+func ParseThrottlingScope(s string) (ThrottlingScope, error) {
+	switch s {
+	case "", "per-conn":
+		return ThrottlingPerConn, nil
+	case "per-user":
+		return ThrottlingPerUser, nil
+	case "global":
+		return ThrottlingGlobal, nil
+	}
+
+	return 0, fmt.Errorf("invalid throttling scope: %s", s)
+}
+
 type TokenBucket struct {
 	Speed int64 // bytes per second
 
@@ -35,7 +58,15 @@ func NewTokenBucket(speed, max int64) *TokenBucket {
 	}
 }
 
-func (tb *TokenBucket) Consume(n int64) {
+// SetSpeed changes the limits of the bucket, streams consuming it get them at once
+func (tb *TokenBucket) SetSpeed(speed, max int64) {
+	tb.mu.Lock()
+	tb.Speed, tb.maxCapacity = speed, max
+	tb.mu.Unlock()
+}
+
+// Consume takes n bytes from the bucket, it sleeps until there are enough and returns how long it slept
+func (tb *TokenBucket) Consume(n int64) time.Duration {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
@@ -43,7 +74,7 @@ func (tb *TokenBucket) Consume(n int64) {
 
 	if tb.Speed == 0 {
 		tb.lastConsume = now
-		return
+		return 0
 	}
 
 	ms := (now - tb.lastConsume) / 1e6
@@ -56,14 +87,16 @@ func (tb *TokenBucket) Consume(n int64) {
 	if n <= tb.capacity {
 		tb.lastConsume = now
 		tb.capacity -= n
-		return
+		return 0
 	}
 
 	sec := float64(n-tb.capacity) / float64(tb.Speed)
-	time.Sleep(time.Duration(sec*1000) * time.Millisecond)
+	d := time.Duration(sec*1000) * time.Millisecond
+	time.Sleep(d)
 
 	tb.capacity = 0
 	tb.lastConsume = time.Now().UnixNano()
+	return d
 }
 
 type trafficData struct {
@@ -127,25 +160,36 @@ func (s *trafficSurvey) Init(ln int) {
 
 func (s *trafficSurvey) AddLatency(nsec int64) {
 	const N = 2
+	p := (*uint64)(unsafe.Pointer(&s.latency))
 	for {
-		o := s.latency
+		oi := atomic.LoadUint64(p)
+		o := *(*float64)(unsafe.Pointer(&oi))
 		n := o - o/N + float64(nsec)/N
 
-		oi, ni := *(*uint64)(unsafe.Pointer(&o)), *(*uint64)(unsafe.Pointer(&n))
-		if atomic.CompareAndSwapUint64((*uint64)(unsafe.Pointer(&s.latency)), oi, ni) {
+		if atomic.CompareAndSwapUint64(p, oi, *(*uint64)(unsafe.Pointer(&n))) {
 			break
 		}
 	}
 
-	if nsec > s.latencyMax {
-		s.latencyMax = nsec
+	for max := atomic.LoadInt64(&s.latencyMax); nsec > max; max = atomic.LoadInt64(&s.latencyMax) {
+		if atomic.CompareAndSwapInt64(&s.latencyMax, max, nsec) {
+			break
+		}
 	}
 
-	if nsec < s.latencyMin || s.latencyMin == -1 {
-		s.latencyMin = nsec
+	for min := atomic.LoadInt64(&s.latencyMin); nsec < min || min == -1; min = atomic.LoadInt64(&s.latencyMin) {
+		if atomic.CompareAndSwapInt64(&s.latencyMin, min, nsec) {
+			break
+		}
 	}
 }
 
+// Latency returns the smoothed latency of dialing the upstream, 0 if not measured (e.g. on the server)
+func (s *trafficSurvey) Latency() time.Duration {
+	bits := atomic.LoadUint64((*uint64)(unsafe.Pointer(&s.latency)))
+	return time.Duration(*(*float64)(unsafe.Pointer(&bits)))
+}
+
 func (s *trafficSurvey) SVG(w, h int, logarithm bool) *bytes.Buffer {
 	ret := &bytes.Buffer{}
 	ret.WriteString(fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" version=\"1.1\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" viewBox=\"0 0 %d %d\">", w, h))
@@ -248,7 +292,7 @@ func (s *trafficSurvey) SVG(w, h int, logarithm bool) *bytes.Buffer {
 		rText = "<tspan y=\"50%%\" style=\"visibility:hidden\">a</tspan>" + rText
 	}
 
-	ret.WriteString(fmt.Sprintf(sText, s.latencyMin/1e6, int(s.latency/1e6), s.latencyMax/1e6,
+	ret.WriteString(fmt.Sprintf(sText, atomic.LoadInt64(&s.latencyMin)/1e6, int(s.Latency()/1e6), atomic.LoadInt64(&s.latencyMax)/1e6,
 		format(s.sent.data[0]/1024), format(savg/1024), format(smax/1024), float64(s.totalSent)/1024/1024))
 
 	ret.WriteString(fmt.Sprintf(rText, format(s.recved.data[0]/1024), format(ravg/1024), format(rmax/1024), float64(s.totalRecved)/1024/1024))
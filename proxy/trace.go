@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Tunnels are traced end to end: the client sends the W3C traceparent of its span to the upstream in
+// the traceSuffix header encrypted like dupSuffix, so spans of the server join the trace of the client
+const (
+	traceSuffix = "-T"
+
+	traceFlush      = 5 * time.Second // spans are exported in batches at least this often
+	traceBatch      = 512             // or when this many are pending
+	traceMaxPending = 8192            // spans are dropped beyond it if the collector can't keep up
+)
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// Tracer exports spans of tunnels to an OpenTelemetry collector by OTLP/HTTP in JSON: the DNS lookups,
+// the dial, the handshake with the upstream or client and the bridge, so slow requests can be told apart
+type Tracer struct {
+	Endpoint string // like http://localhost:4318/v1/traces
+	Service  string // service.name of the spans
+
+	once    sync.Once
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+	kick    chan struct{}
+}
+
+var traceClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewTracer returns the tracer exporting to endpoint, a collector address like localhost:4318 means its traces path
+func NewTracer(endpoint, service string) (*Tracer, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("OTLP endpoint must be an http or https URL: " + endpoint)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	return &Tracer{Endpoint: u.String(), Service: service}, nil
+}
+
+// Span is a timed phase of a traced tunnel, methods of a nil span do nothing,
+// so the code being traced needn't check whether tracing is on
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte // zero means a root span
+	name    string
+	kind    int
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	ended bool
+	stop  time.Time
+	err   error
+}
+
+// start starts a span of a tunnel at, traceparent of the other end joins its trace if valid,
+// nil is returned if t is nil
+func (t *Tracer) start(name string, kind int, traceparent string, at time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{tracer: t, name: name, kind: kind, start: at}
+	if p := strings.Split(traceparent, "-"); len(p) == 4 && p[0] == "00" {
+		trace, err1 := hex.DecodeString(p[1])
+		parent, err2 := hex.DecodeString(p[2])
+		if err1 == nil && err2 == nil && len(trace) == 16 && len(parent) == 8 {
+			copy(s.traceID[:], trace)
+			copy(s.parent[:], parent)
+		}
+	}
+
+	if s.traceID == ([16]byte{}) || s.parent == ([8]byte{}) {
+		rand.Read(s.traceID[:])
+		s.parent = [8]byte{}
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child starts a span of a phase of s at
+func (s *Span) child(name string, at time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, name: name, kind: spanInternal, start: at}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// traceparent returns the W3C traceparent of s, empty if s is nil
+func (s *Span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// set sets an attribute, value is a string, an int, an int64 or a bool
+func (s *Span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// end ends s with err as its status, spans end once, later calls do nothing
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.stop, s.err = true, time.Now(), err
+	s.mu.Unlock()
+
+	s.tracer.add(s)
+}
+
+// dnsTrace returns the context of dialing in s, lookups of names made by the dialer are traced as its dns spans
+func (s *Span) dnsTrace() context.Context {
+	ctx := context.Background()
+	if s == nil {
+		return ctx
+	}
+
+	var dns *Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dns = s.child("dns", time.Now())
+			dns.set("dns.name", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			dns.set("dns.addrs", len(info.Addrs))
+			dns.end(info.Err)
+		},
+	})
+}
+
+func (t *Tracer) add(s *Span) {
+	t.once.Do(func() {
+		t.kick = make(chan struct{}, 1)
+		go t.loop()
+	})
+
+	t.mu.Lock()
+	if len(t.pending) >= traceMaxPending {
+		if t.dropped++; t.dropped == 1 {
+			logg.W("OTLP: the collector can't keep up, spans are dropped")
+		}
+	} else {
+		t.pending = append(t.pending, s)
+	}
+	n := len(t.pending)
+	t.mu.Unlock()
+
+	if n >= traceBatch {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	tick := time.NewTicker(traceFlush)
+	for {
+		select {
+		case <-tick.C:
+		case <-t.kick:
+		}
+
+		if err := t.Flush(); err != nil {
+			logg.W("OTLP: ", err)
+		}
+	}
+}
+
+// Flush exports the pending spans now
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	buf, _ := json.Marshal(t.export(spans))
+	resp, err := traceClient.Post(t.Endpoint, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector responded " + resp.Status)
+	}
+	return nil
+}
+
+// export returns the ExportTraceServiceRequest of spans in the JSON encoding of OTLP
+func (t *Tracer) export(spans []*Span) map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		x := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.stop.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.parent != ([8]byte{}) {
+			x["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			x["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		s.mu.Unlock()
+		list = append(list, x)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]interface{}{"service.name": t.Service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "goflyway"},
+				"spans": list,
+			}},
+		}},
+	}
+}
+
+func otlpAttrs(attrs map[string]interface{}) []interface{} {
+	list := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]interface{}{"stringValue": v}
+		}
+		list = append(list, map[string]interface{}{"key": k, "value": value})
+	}
+	return list
+}
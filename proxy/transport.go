@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transport carries the connections between clients and the upstream instead of plain TCP, like KCP,
+// the obfuscated protocol and tcpmux run on top of it. Third parties add their own by registering them
+// in an init function and importing the package into the command
+type Transport interface {
+	// Dial dials the upstream, the returned conn should be ready for writing
+	Dial(address string) (net.Conn, error)
+
+	// Listen listens on address on the server, besides TCP
+	Listen(address string) (net.Listener, error)
+}
+
+// TransportOptions are the options of the command line for transports, each takes those meant for it
+type TransportOptions struct {
+	Params      string // of the transport, given by -transport name:params
+	SNI         string // presented in the TLS ClientHello instead of the host of the upstream
+	Fingerprint string // the browser whose TLS ClientHello is mimicked, see Fingerprints
+	ECH         []byte // the ECH config list the TLS ClientHello is encrypted by, see ECHConfigList
+}
+
+// Tunable is implemented by transports taking options, Tune returns a copy tuned by them,
+// or an error if some option is invalid or not meant for the transport. SNI is ignored if unused
+type Tunable interface {
+	Tune(opts TransportOptions) (Transport, error)
+}
+
+// Networked is implemented by transports telling where the server listens by them: "udp" is the UDP port
+// of the address, "tcp" means they need the TCP port for themselves, so the server can't listen by them
+// besides TCP
+type Networked interface {
+	Network() string
+}
+
+// HTTPTransport is implemented by transports arriving at the server's HTTP listener instead of listening
+// on their own, like ws. Upgrade takes over the request if it's of the transport and returns the conn
+// to be served like an accepted one, nil if the request has been answered otherwise
+type HTTPTransport interface {
+	Transport
+	Upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, bool)
+}
+
+// TransportNetwork returns where the server listens by t, "http" for HTTPTransport, empty if unknown
+func TransportNetwork(t Transport) string {
+	switch t := t.(type) {
+	case HTTPTransport:
+		return "http"
+	case Networked:
+		return t.Network()
+	}
+	return ""
+}
+
+var transports = struct {
+	sync.Mutex
+	m map[string]Transport
+}{m: make(map[string]Transport)}
+
+// RegisterTransport registers a transport by name, a later one of the same name replaces it
+func RegisterTransport(name string, t Transport) {
+	transports.Lock()
+	transports.m[name] = t
+	transports.Unlock()
+}
+
+// GetTransport returns the transport of name, nil if it's not registered
+func GetTransport(name string) Transport {
+	transports.Lock()
+	defer transports.Unlock()
+	return transports.m[name]
+}
+
+// Transports returns the names of registered transports, sorted
+func Transports() []string {
+	transports.Lock()
+	defer transports.Unlock()
+
+	names := make([]string, 0, len(transports.m))
+	for name := range transports.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseTransport returns the transport of name, or KCP tuned by kcp if it's not empty (see ParseKCPConfig),
+// nil means plain TCP
+func ParseTransport(name, kcp string) (Transport, error) {
+	if kcp != "" {
+		if name != "" && name != "kcp" {
+			return nil, errors.New("kcp parameters are for the kcp transport, not " + name)
+		}
+		name = "kcp:" + kcp
+	}
+	return NewTransport(name, TransportOptions{})
+}
+
+// NewTransport returns the transport of spec, "name" or "name:params" like "kcp:fast", tuned by opts,
+// nil means plain TCP
+func NewTransport(spec string, opts TransportOptions) (Transport, error) {
+	name := spec
+	if idx := strings.Index(spec, ":"); idx > -1 {
+		name, opts.Params = spec[:idx], spec[idx+1:]
+	}
+
+	if name == "" || name == "tcp" {
+		if opts.Params != "" || opts.Fingerprint != "" || len(opts.ECH) > 0 {
+			return nil, errors.New("plain TCP takes no parameters and has no TLS ClientHello to mimic or encrypt")
+		}
+		return nil, nil
+	}
+
+	t := GetTransport(name)
+	if t == nil {
+		return nil, errors.New("unknown transport " + name)
+	}
+
+	if tt, ok := t.(Tunable); ok {
+		return tt.Tune(opts)
+	} else if opts.Params != "" || opts.Fingerprint != "" || len(opts.ECH) > 0 {
+		return nil, errors.New("transport " + name + " takes no options")
+	}
+	return t, nil
+}
+
+// connListener accepts conns pushed to it, like those of HTTPTransport taken over from requests
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+	closer func() error // closes what pushes the conns, if any
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// push hands conn over to Accept, false if the listener is closed
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() (err error) {
+	l.once.Do(func() {
+		close(l.done)
+		if l.closer != nil {
+			err = l.closer()
+		}
+	})
+	return
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
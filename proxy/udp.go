@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/goflyway/pkg/logg"
@@ -26,7 +27,7 @@ func (a *uAddr) String() string {
 
 func (a *uAddr) HostString() string {
 	if a.ip != nil {
-		if len(a.ip) == net.IPv4len {
+		if a.ip.To4() != nil {
 			return a.ip.String()
 		}
 		return "[" + a.ip.String() + "]"
@@ -118,6 +119,8 @@ func parseUDPHeader(conn net.Conn, buf []byte, omitCheck bool) (method byte, add
 }
 
 type udpBridgeConn struct {
+	last int64 // unix nano of the last datagram written, of NAT sessions, note 64bit align
+
 	*net.UDPConn
 	udpSrc net.Addr
 
@@ -133,15 +136,57 @@ type udpBridgeConn struct {
 	socks bool
 	dst   *uAddr
 
+	// DNS responses written back to apps are rewritten with it, nil means disabled
+	rewrite Hosts
+
+	// DNS queries of apps are answered by it instead of being relayed, nil means disabled
+	fake *FakeIP
+
+	// for UDP port forwarding, packets of udpSrc are demuxed from the shared listener into "in"
+	in      chan []byte
+	onClose func()
+	done    chan struct{} // closed by Close if not nil, so the wait for "in" ends
+
+	// datagrams carry SOCKS5 UDP headers of their destinations and sources, see udpNATHost,
+	// on the upstream the table of the session is set
+	nat   bool
+	table *udpNAT
+
 	closed bool
 }
 
+type udpTimeoutErr struct{}
+
+func (e udpTimeoutErr) Error() string { return "UDP session timed out" }
+
+func (e udpTimeoutErr) Timeout() bool { return true }
+
+func (e udpTimeoutErr) Temporary() bool { return true }
+
 func (c *udpBridgeConn) Read(b []byte) (n int, err error) {
+	for {
+		if n, err = c.read(b); err != nil || c.fake == nil || c.nat {
+			return
+		}
+
+		reply := c.fake.answer(b[2:n], c.rewrite)
+		if reply == nil {
+			return
+		}
+		c.write(reply)
+	}
+}
+
+func (c *udpBridgeConn) read(b []byte) (n int, err error) {
 	const expectedMaxPacketSize = 2050
 	if len(b) < expectedMaxPacketSize {
 		panic(fmt.Sprintf("goflyway expects that all UDP packet must be smaller than %d bytes", expectedMaxPacketSize-2))
 	}
 
+	if c.table != nil {
+		return c.table.recv(c.UDPConn, b)
+	}
+
 	if c.initBuf != nil {
 		n = len(c.initBuf)
 		copy(b[2:], c.initBuf)
@@ -149,6 +194,24 @@ func (c *udpBridgeConn) Read(b []byte) (n int, err error) {
 		goto PUT_HEADER
 	}
 
+	if c.in != nil {
+		for {
+			select {
+			case p := <-c.in:
+				n = copy(b[2:], p)
+				goto PUT_HEADER
+			case <-c.done:
+				return 0, io.EOF
+			case <-time.After(timeoutUDP):
+				// NAT sessions are kept while replies come
+				if c.nat && !c.closed && time.Since(time.Unix(0, atomic.LoadInt64(&c.last))) < timeoutUDP {
+					continue
+				}
+				return 0, udpTimeoutErr{}
+			}
+		}
+	}
+
 	n, c.udpSrc, err = c.UDPConn.ReadFrom(b) // We assume that src never change
 	if err != nil {
 		return
@@ -173,8 +236,23 @@ PUT_HEADER:
 }
 
 func (c *udpBridgeConn) write(b []byte) (n int, err error) {
+	if c.table != nil {
+		return 0, c.table.send(c.UDPConn, b)
+	}
+
+	if c.nat {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+		b = c.natReply(b)
+	} else if c.rewrite != nil {
+		b = c.rewrite.rewriteDNS(b)
+	}
+
 	if !c.socks {
-		n, err = c.UDPConn.Write(b)
+		if c.in != nil {
+			n, err = c.WriteTo(b, c.udpSrc)
+		} else {
+			n, err = c.UDPConn.Write(b)
+		}
 		if err == nil {
 			n += 2
 		}
@@ -309,6 +387,22 @@ TEST:
 }
 
 func (c *udpBridgeConn) Close() error {
+	if c.table != nil {
+		c.table.close()
+	}
+
+	if c.in != nil {
+		// the listener is shared by all sessions
+		if !c.closed && c.onClose != nil {
+			c.onClose()
+		}
+		if !c.closed && c.done != nil {
+			close(c.done)
+		}
+		c.closed = true
+		return nil
+	}
+
 	c.closed = true
 	return c.UDPConn.Close()
 }
@@ -339,6 +433,22 @@ func (proxy *ProxyClient) handleUDPtoTCP(relay *net.UDPConn, client net.Conn) {
 
 	logg.D("UDP relay listening port: ", port, ", destination: ", dst.String())
 
+	if proxy.VLESS == nil && !proxy.Policy.IsSet(PolicyWebSocket) && atomic.LoadUint32(&proxy.noUDPNAT) == 0 {
+		err := proxy.relayNAT(relay, client, src, buf[:n])
+		if err != errNoNAT {
+			if err != nil {
+				logg.E("UDP relay: ", err)
+			}
+			return
+		}
+
+		logg.W(err, ", relay each destination in its own tunnels")
+		atomic.StoreUint32(&proxy.noUDPNAT, 1)
+	}
+
+	// replies still carry the fake IP the app sent to
+	target, _ := proxy.FakeIP.lookup(dst.String())
+
 	maxConns := proxy.UDPRelayCoconn
 	srcs := make([]*udpBridgeConn, maxConns)
 	conns := make([]net.Conn, maxConns)
@@ -351,15 +461,20 @@ func (proxy *ProxyClient) handleUDPtoTCP(relay *net.UDPConn, client net.Conn) {
 			dst:     dst,
 		}
 
+		if dst.port == 53 {
+			srcs[i].rewrite = proxy.DNSRewrite
+			srcs[i].fake = proxy.FakeIP
+		}
+
 		if i == 0 {
 			// The first connection will be responsible for sending the initial buffer
 			srcs[0].initBuf = buf[dst.size:n]
 		}
 
 		if proxy.Policy.IsSet(PolicyWebSocket) {
-			conns[i] = proxy.dialUpstreamAndBridgeWS(srcs[i], dst.String(), nil, doUDPRelay)
+			conns[i] = proxy.dialUpstreamAndBridgeWS(srcs[i], target, nil, doUDPRelay, nil)
 		} else {
-			conns[i] = proxy.dialUpstreamAndBridge(srcs[i], dst.String(), nil, doUDPRelay)
+			conns[i] = proxy.dialUpstreamAndBridge(srcs[i], target, nil, doUDPRelay, nil)
 		}
 	}
 
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// NAT sessions relay a whole UDP association in one tunnel: datagrams both ways carry the SOCKS5 UDP
+// headers of their destinations and sources, so an app can talk to any number of peers, and the
+// upstream sends to all of them from one socket. Tunnels of them are to udpNATHost and carry the
+// natSuffix header, which must be acknowledged, old upstreams would relay them to udpNATHost itself
+const (
+	udpNATHost = "0.0.0.0:0"
+	natSuffix  = "-N"
+
+	udpNATEntries   = 512                 // destinations a session keeps, the idlest is evicted for new ones
+	udpNATMaxHeader = 3 + 1 + 1 + 255 + 2 // the longest SOCKS5 UDP header, of a 255-byte name
+)
+
+var (
+	errNoNAT   = errors.New("upstream doesn't support UDP NAT sessions")
+	errUDPBusy = errors.New("too many UDP sessions")
+)
+
+// udpNAT is the table of destinations of a NAT session on the upstream, sharing the socket means the
+// session keeps its port towards all of them like a full cone NAT, as QUIC and game servers expect.
+// Replies are stamped with the header the client sent to their sources, the name instead of the IP
+type udpNAT struct {
+	last int64 // unix nano of the last datagram either way, note 64bit align
+
+	proxy   *ProxyUpstream
+	user    string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	byHdr  map[string]*natEntry
+	byAddr map[string]*natEntry
+	closed bool
+}
+
+type natEntry struct {
+	hdr  []byte
+	addr *net.UDPAddr
+	last time.Time
+}
+
+// openNAT opens a NAT session of user, at most UDPMaxSessions are open at the same time
+func (proxy *ProxyUpstream) openNAT(user string) (*udpBridgeConn, error) {
+	if n := atomic.AddInt64(&proxy.udpSessions, 1); proxy.UDPMaxSessions > 0 && n > int64(proxy.UDPMaxSessions) {
+		atomic.AddInt64(&proxy.udpSessions, -1)
+		return nil, errUDPBusy
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		atomic.AddInt64(&proxy.udpSessions, -1)
+		return nil, err
+	}
+
+	timeout := proxy.UDPTimeout
+	if timeout <= 0 {
+		timeout = timeoutUDP
+	}
+
+	return &udpBridgeConn{UDPConn: conn, nat: true, table: &udpNAT{
+		last:    time.Now().UnixNano(),
+		proxy:   proxy,
+		user:    user,
+		timeout: timeout,
+		byHdr:   make(map[string]*natEntry),
+		byAddr:  make(map[string]*natEntry),
+	}}, nil
+}
+
+func (t *udpNAT) touch() { atomic.StoreInt64(&t.last, time.Now().UnixNano()) }
+
+func (t *udpNAT) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.last))) >= t.timeout
+}
+
+func (t *udpNAT) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		atomic.AddInt64(&t.proxy.udpSessions, -1)
+	}
+}
+
+// entry returns the destination of hdr, which is resolved again when the entry has gone idle,
+// nil means it is blocked or can't be resolved
+func (t *udpNAT) entry(hdr []byte, dst *uAddr) *natEntry {
+	now := time.Now()
+
+	t.mu.Lock()
+	if e := t.byHdr[string(hdr)]; e != nil && now.Sub(e.last) < t.timeout {
+		e.last = now
+		t.mu.Unlock()
+		return e
+	}
+	t.mu.Unlock()
+
+	host := dst.String()
+	if t.proxy.AccessRules.blocked(t.user, host, now) != nil {
+		logg.D("UDP NAT: ", host, " is denied")
+		return nil
+	}
+
+	addr, err := t.proxy.resolveUDP(host)
+	if err != nil {
+		logg.D("UDP NAT: ", err)
+		return nil
+	}
+
+	e := &natEntry{hdr: dup(hdr), addr: t.proxy.NAT64.UDPAddr(addr), last: now}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old := t.byHdr[string(hdr)]; old != nil {
+		delete(t.byAddr, old.addr.String())
+	} else if len(t.byHdr) >= udpNATEntries {
+		t.evict(now)
+	}
+
+	t.byHdr[string(hdr)], t.byAddr[e.addr.String()] = e, e
+	logg.D("UDP NAT ", t.user, " -> ", host)
+	return e
+}
+
+// evict drops idle entries, or the idlest one if none is
+func (t *udpNAT) evict(now time.Time) {
+	var idlest string
+	for k, e := range t.byHdr {
+		if now.Sub(e.last) >= t.timeout {
+			delete(t.byHdr, k)
+			delete(t.byAddr, e.addr.String())
+		} else if idlest == "" || e.last.Before(t.byHdr[idlest].last) {
+			idlest = k
+		}
+	}
+
+	if len(t.byHdr) >= udpNATEntries {
+		delete(t.byAddr, t.byHdr[idlest].addr.String())
+		delete(t.byHdr, idlest)
+	}
+}
+
+// send sends a datagram of the client to its destination, datagrams which can't be sent are dropped
+// like on the internet rather than failing the session
+func (t *udpNAT) send(conn *net.UDPConn, pkt []byte) error {
+	t.touch()
+	if len(pkt) < 5 {
+		return nil
+	}
+
+	_, dst, err := parseUDPHeader(nil, pkt, true)
+	if err != nil {
+		logg.D("UDP NAT: ", err)
+		return nil
+	}
+
+	if e := t.entry(pkt[:dst.size], dst); e != nil {
+		if _, err := conn.WriteToUDP(pkt[dst.size:], e.addr); err != nil {
+			logg.D("UDP NAT: ", err)
+		}
+	}
+	return nil
+}
+
+// recv reads a datagram from any peer into b with its header and length like udpBridgeConn.read,
+// the session ends when no datagram is sent or received for the timeout
+func (t *udpNAT) recv(conn *net.UDPConn, b []byte) (int, error) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(t.timeout))
+		n, src, err := conn.ReadFromUDP(b[2+udpNATMaxHeader:])
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if t.idle() {
+				return 0, udpTimeoutErr{}
+			}
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		t.touch()
+		t.mu.Lock()
+		var hdr []byte
+		if e := t.byAddr[src.String()]; e != nil {
+			e.last, hdr = time.Now(), e.hdr
+		}
+		t.mu.Unlock()
+
+		if hdr == nil {
+			// a peer not sent to, still relayed like a full cone NAT does
+			hdr = udpAddrHeader(src.IP.String(), src.Port)
+		}
+
+		copy(b[2:], hdr)
+		copy(b[2+len(hdr):], b[2+udpNATMaxHeader:2+udpNATMaxHeader+n])
+		n += len(hdr)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return n + 2, nil
+	}
+}
+
+// udpAddrHeader returns the SOCKS5 UDP header of host:port, host is an IP or a name
+func udpAddrHeader(host string, port int) []byte {
+	var hdr []byte
+	if ip := net.ParseIP(host); ip == nil {
+		hdr = append(append([]byte{0, 0, 0, socksAddrDomain, byte(len(host))}, host...), 0, 0)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		hdr = append(dup(udpHeaderIPv4[:4]), append(ip4, 0, 0)...)
+	} else {
+		hdr = append(dup(udpHeaderIPv6[:4]), append(ip.To16(), 0, 0)...)
+	}
+
+	binary.BigEndian.PutUint16(hdr[len(hdr)-2:], uint16(port))
+	return hdr
+}
+
+// natReply maps the source of a datagram from the upstream back to the address the app sent to
+func (c *udpBridgeConn) natReply(b []byte) []byte {
+	if len(b) < 5 {
+		return b
+	}
+
+	_, src, err := parseUDPHeader(nil, b, true)
+	if err != nil {
+		return b
+	}
+
+	payload := b[src.size:]
+	if src.port == 53 && c.rewrite != nil {
+		payload = c.rewrite.rewriteDNS(payload)
+	}
+
+	if ip := c.fake.reverse(src.host); ip != nil {
+		return append(udpAddrHeader(ip.String(), src.port), payload...)
+	}
+	return append(b[:src.size:src.size], payload...)
+}
+
+// natRequest prepares a datagram of the app for the upstream, fake IPs are mapped to their names,
+// nil means the datagram is answered locally or dropped
+func (proxy *ProxyClient) natRequest(relay *net.UDPConn, src net.Addr, pkt []byte) []byte {
+	if len(pkt) < 5 || pkt[2] != 0 {
+		logg.D("UDP relay: drop a malformed or fragmented datagram")
+		return nil
+	}
+
+	_, dst, err := parseUDPHeader(nil, pkt, true)
+	if err != nil {
+		logg.D("UDP relay: ", err)
+		return nil
+	}
+
+	if dst.port == 53 {
+		if reply := proxy.FakeIP.answer(pkt[dst.size:], proxy.DNSRewrite); reply != nil {
+			relay.WriteTo(append(dup(pkt[:dst.size]), reply...), src)
+			return nil
+		}
+	}
+
+	if name, ok := proxy.FakeIP.lookup(dst.String()); ok {
+		host, _, _ := net.SplitHostPort(name)
+		return append(udpAddrHeader(host, dst.port), pkt[dst.size:]...)
+	}
+	return dup(pkt)
+}
+
+// relayNAT relays the UDP association of the app in a NAT session, the tunnel of which is opened again
+// by the next datagram after it goes idle. The association ends with the control connection of the app
+// like RFC 1928 says. errNoNAT is returned if the upstream is too old, before anything is relayed
+func (proxy *ProxyClient) relayNAT(relay *net.UDPConn, client net.Conn, src net.Addr, first []byte) error {
+	var s *udpBridgeConn
+	var upstreamConn net.Conn
+	open := func() error {
+		conn, rkeybuf, ioc, err := proxy.openTunnel(udpNATHost, doUDPRelay)
+		if err != nil {
+			return err
+		}
+
+		s, upstreamConn = &udpBridgeConn{
+			UDPConn: relay,
+			udpSrc:  src,
+			in:      make(chan []byte, 64),
+			done:    make(chan struct{}),
+			nat:     true,
+			rewrite: proxy.DNSRewrite,
+			fake:    proxy.FakeIP,
+		}, conn
+		go proxy.Cipher.IO.Bridge(s, conn, rkeybuf, ioc)
+		return nil
+	}
+
+	if err := open(); err != nil {
+		return err
+	}
+	defer func() { upstreamConn.Close() }()
+
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		relay.Close()
+	}()
+
+	buf := make([]byte, 2048)
+	for pkt := first; ; {
+		if p := proxy.natRequest(relay, src, pkt); p != nil {
+			if s.closed {
+				if err := open(); err != nil {
+					return err
+				}
+			}
+
+			select {
+			case s.in <- p:
+			default:
+				logg.D("UDP relay: drop a datagram of ", src)
+			}
+		}
+
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return nil
+			}
+
+			if from.String() == src.String() {
+				pkt = buf[:n]
+				break
+			}
+			logg.D("UDP relay: drop a datagram of ", from, ", the association is of ", src)
+		}
+	}
+}
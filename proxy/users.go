@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// LoadUsers reads users of a multi-user server, one per line:
+//
+//	username:password [throttling [throttling max]] [from=CIDR,IP...]
+//
+// throttling is in bytes per second like -throt, users without it share the server's limits,
+// users with from= can only connect from these sources
+func LoadUsers(path string) (map[string]UserConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]UserConfig)
+	for i, line := range strings.Split(string(buf), "\n") {
+		if idx := strings.Index(line, "#"); idx > -1 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := userName(fields[0])
+		if name == fields[0] || name == "" {
+			return nil, fmt.Errorf("line %d: expect username:password [throttling [throttling max]] [from=CIDR,IP...]", i+1)
+		}
+
+		u, nums := UserConfig{Auth: fields[0]}, 0
+		for _, v := range fields[1:] {
+			if strings.HasPrefix(v, "from=") {
+				if u.Sources, err = ParseSources(v[5:]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				continue
+			}
+
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 || nums == 2 {
+				return nil, fmt.Errorf("line %d: invalid throttling: %s", i+1, v)
+			}
+
+			if nums++; nums == 1 {
+				u.Throttling = n
+			} else {
+				u.ThrottlingMax = n
+			}
+		}
+
+		if _, dup := users[name]; dup {
+			return nil, fmt.Errorf("line %d: duplicated user: %s", i+1, name)
+		}
+		users[name] = u
+	}
+
+	return users, nil
+}
+
+// ParseSources parses comma separated CIDRs and IPs
+func ParseSources(s string) ([]*net.IPNet, error) {
+	sources := []*net.IPNet{}
+	for _, src := range strings.Split(s, ",") {
+		if src = strings.TrimSpace(src); src == "" {
+			continue
+		}
+
+		if !strings.Contains(src, "/") {
+			ip := net.ParseIP(src)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source: %s", src)
+			}
+
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			sources = append(sources, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(src)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, n)
+	}
+	return sources, nil
+}
+
+// allows reports whether the user can connect from addr
+func (u UserConfig) allows(addr string) bool {
+	if len(u.Sources) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	for _, n := range u.Sources {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func userName(auth string) string {
+	if idx := strings.Index(auth, ":"); idx > -1 {
+		return auth[:idx]
+	}
+	return auth
+}
+
+// multiUser reports whether clients must authenticate
+func (proxy *ProxyUpstream) multiUser() bool {
+	proxy.reloadMu.RLock()
+	defer proxy.reloadMu.RUnlock()
+	return proxy.Users != nil
+}
+
+// auth returns the name of the user presenting auth, the whole auth string must match
+func (proxy *ProxyUpstream) auth(auth string) (string, bool) {
+	proxy.reloadMu.RLock()
+	defer proxy.reloadMu.RUnlock()
+
+	name := userName(auth)
+	u, existed := proxy.Users[name]
+	if !existed || subtle.ConstantTimeCompare([]byte(u.Auth), []byte(auth)) != 1 {
+		return "", false
+	}
+
+	return name, true
+}
+
+// allows reports whether user can connect from addr, violations are logged and audited
+func (proxy *ProxyUpstream) allows(user, addr string) bool {
+	proxy.reloadMu.RLock()
+	ok := proxy.Users[user].allows(addr)
+	proxy.reloadMu.RUnlock()
+
+	if !ok {
+		logg.W("!!! user ", user, " is not allowed to connect from ", addr, ", the credential may have leaked")
+		proxy.Audit.record("source-denied", user, addr)
+	}
+	return ok
+}
+
+// UserInfo describes a user of a multi-user server with the traffic of its streams
+type UserInfo struct {
+	Name          string   `json:"name"`
+	Throttling    int64    `json:"throttling"`
+	ThrottlingMax int64    `json:"throttling_max"`
+	Sources       []string `json:"sources,omitempty"`
+	FromFile      bool     `json:"from_file"` // replaced by the users file on Reload
+	In            uint64   `json:"in"`
+	Out           uint64   `json:"out"`
+}
+
+// ListUsers lists the users by name
+func (proxy *ProxyUpstream) ListUsers() []UserInfo {
+	traffic := proxy.traffic()
+
+	proxy.reloadMu.RLock()
+	list := make([]UserInfo, 0, len(proxy.Users))
+	for name, u := range proxy.Users {
+		ui := UserInfo{
+			Name:          name,
+			Throttling:    u.Throttling,
+			ThrottlingMax: u.ThrottlingMax,
+			FromFile:      proxy.fileUsers[name],
+			In:            traffic[name][0],
+			Out:           traffic[name][1],
+		}
+		for _, n := range u.Sources {
+			ui.Sources = append(ui.Sources, n.String())
+		}
+		list = append(list, ui)
+	}
+	proxy.reloadMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// AddUser adds the user presenting auth (username:password), the server requires authentication from now on.
+// Users added are kept on Reload, unlike the ones of the users file
+func (proxy *ProxyUpstream) AddUser(auth string, u UserConfig) error {
+	name := userName(auth)
+	if name == auth || name == "" {
+		return errors.New("auth should be username:password")
+	}
+
+	proxy.reloadMu.Lock()
+	defer proxy.reloadMu.Unlock()
+
+	if _, existed := proxy.Users[name]; existed {
+		return errors.New("user exists: " + name)
+	}
+
+	if proxy.Users == nil {
+		proxy.Users = make(map[string]UserConfig)
+	}
+	u.Auth = auth
+	proxy.Users[name] = u
+	logg.L("user ", name, " added")
+	return nil
+}
+
+// RemoveUser removes the user and kills its sessions, false if there is no such user
+func (proxy *ProxyUpstream) RemoveUser(name string) bool {
+	proxy.reloadMu.Lock()
+	_, existed := proxy.Users[name]
+	delete(proxy.Users, name)
+	delete(proxy.fileUsers, name)
+	proxy.reloadMu.Unlock()
+
+	if !existed {
+		return false
+	}
+
+	proxy.bucketsMu.Lock()
+	delete(proxy.buckets, name)
+	proxy.bucketsMu.Unlock()
+
+	for _, bi := range proxy.IO.OpenBridges() {
+		if bi.User == name {
+			proxy.KillSession(bi.ID)
+		}
+	}
+	logg.L("user ", name, " removed")
+	return true
+}
+
+// KillSession closes both ends of the bridge listed by OpenBridges, false if it has closed
+func (proxy *ProxyUpstream) KillSession(id uint64) bool {
+	if !proxy.IO.br.kill(id) {
+		return false
+	}
+	logg.L("session #", id, " killed")
+	return true
+}
+
+// SetThrottling changes the throttling of the user in bytes per second, 0 means the server's limits.
+// Streams being bridged get it at once unless they weren't throttled before, or the scope is global
+func (proxy *ProxyUpstream) SetThrottling(name string, speed, max int64) error {
+	if speed < 0 || max < 0 {
+		return errors.New("invalid throttling")
+	}
+
+	proxy.reloadMu.Lock()
+	u, existed := proxy.Users[name]
+	if existed {
+		u.Throttling, u.ThrottlingMax = speed, max
+		proxy.Users[name] = u
+	}
+	proxy.reloadMu.Unlock()
+
+	if !existed {
+		return errors.New("no such user: " + name)
+	}
+
+	speed, max, scope := proxy.limits(name)
+	if scope == ThrottlingGlobal {
+		return nil
+	}
+
+	var buckets []*TokenBucket
+	proxy.IO.br.mu.Lock()
+	for _, s := range proxy.IO.br.m {
+		if s.user == name && s.bucket != nil {
+			buckets = append(buckets, s.bucket)
+		}
+	}
+	proxy.IO.br.mu.Unlock()
+
+	proxy.bucketsMu.Lock()
+	if b := proxy.buckets[name]; b != nil {
+		buckets = append(buckets, b)
+	}
+	proxy.bucketsMu.Unlock()
+
+	// a bucket may be sleeping for tokens, so it is set without holding other locks
+	for _, b := range buckets {
+		b.SetSpeed(speed, max)
+	}
+	return nil
+}
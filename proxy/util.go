@@ -5,17 +5,19 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/coyove/goflyway/pkg/codec"
 	"github.com/coyove/goflyway/pkg/logg"
 
 	"crypto/tls"
-	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
 	"io"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -31,14 +33,13 @@ const (
 )
 
 const (
-	doConnect   = 1 << iota // Establish TCP tunnel
-	doForward               // Forward plain HTTP request
-	doWebSocket             // Use WebSocket protocol
-	doDNS                   // DNS query request
-	doPartial               // Partial encryption
-	doUDPRelay              // UDP relay request
-	doRSV1                  // Reserved
-	doRSV2                  // Reserved
+	doConnect   = codec.DoConnect
+	doForward   = codec.DoForward
+	doWebSocket = codec.DoWebSocket
+	doDNS       = codec.DoDNS
+	doPartial   = codec.DoPartial
+	doUDPRelay  = codec.DoUDPRelay
+	doLongURL   = codec.DoLongURL
 )
 
 const (
@@ -46,6 +47,9 @@ const (
 	PolicyGlobal
 	PolicyVPN
 	PolicyWebSocket
+	PolicySniff
+	PolicyCompress
+	PolicyTunnelLAN
 )
 
 const (
@@ -55,32 +59,27 @@ const (
 	timeoutOp           = time.Duration(20) * time.Second
 	invalidRequestRetry = 10
 	dnsRespHeader       = "ETag"
+	maxRequestLine      = 2048 // default ClientConfig.MaxRequestLine
+	minRequestLine      = 128
+	longURLChunk        = 1024
+	longURLSuffix       = "-L" // the header of responses of upstreams collecting long URLs, see longURL
+	keepAliveStreams    = 16   // idle streams to the upstream kept for the next requests in forward mode
 	errConnClosedMsg    = "use of closed network connection"
 )
 
 var (
-	okHTTP          = []byte{'H', 'T', 'T', 'P', '/', '1', '.', '1', ' ', '2', '0', '0', ' ', 'O', 'K', '\r', '\n', '\r', '\n'}
-	okSOCKS         = []byte{socksVersion5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-	udpHeaderIPv4   = []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-	udpHeaderIPv6   = []byte{0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-	socksHandshake  = []byte{socksVersion5, 1, 0}
-	dummyHeaders    = []string{"Accept-Language", "User-Agent", "Referer", "Cache-Control", "Accept-Encoding", "Connection", "ph"}
-	tlsSkip         = &tls.Config{InsecureSkipVerify: true}
-	hasPort         = regexp.MustCompile(`:\d+$`)
-	isHTTPSSchema   = regexp.MustCompile(`^https:\/\/`)
-	base32Encoding  = base32.NewEncoding("0123456789abcdefghiklmnoprstuwxy")
-	base32Encoding2 = base32.NewEncoding("abcd&fghijklmnopqrstuvwxyz+-_./e")
+	okHTTP         = []byte{'H', 'T', 'T', 'P', '/', '1', '.', '1', ' ', '2', '0', '0', ' ', 'O', 'K', '\r', '\n', '\r', '\n'}
+	okSOCKS        = []byte{socksVersion5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	okSOCKS4       = []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+	udpHeaderIPv4  = []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	udpHeaderIPv6  = []byte{0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	socksHandshake = []byte{socksVersion5, 1, 0}
+	dummyHeaders   = []string{"Accept-Language", "User-Agent", "Referer", "Cache-Control", "Accept-Encoding", "Connection", "ph"}
+	tlsSkip        = &tls.Config{InsecureSkipVerify: true}
+	isHTTPSSchema  = regexp.MustCompile(`^https:\/\/`)
 )
 
-type Options byte
-
-func (o *Options) IsSet(option byte) bool { return (byte(*o) & option) != 0 }
-
-func (o *Options) Set(option byte) { *o = Options(byte(*o) | option) }
-
-func (o *Options) UnSet(option byte) { *o = Options((byte(*o) | option) - option) }
-
-func (o *Options) Val() byte { return byte(*o) }
+type Options = codec.Options
 
 func (proxy *ProxyClient) addToDummies(req *http.Request) {
 	for _, field := range dummyHeaders {
@@ -96,25 +95,51 @@ func (proxy *ProxyClient) genHost() string {
 	const tlds = ".com.net.org"
 	if proxy.DummyDomain == "" {
 		i := proxy.Rand.Intn(3) * 4
-		return proxy.Cipher.genWord(true) + tlds[i:i+4]
+		return proxy.Cipher.GenWord(true) + tlds[i:i+4]
 	}
 
 	return proxy.DummyDomain
 }
 
-func (proxy *ProxyClient) encryptAndTransport(req *http.Request) (*http.Response, []byte, error) {
-	rkey, rkeybuf := proxy.Cipher.NewIV(doForward, nil, proxy.UserAuth)
+// encryptAndTransport forwards req through the upstream, which joins the trace of span if it's not nil
+func (proxy *ProxyClient) encryptAndTransport(req *http.Request, span *Span) (*http.Response, []byte, error) {
+	opt := Options(doForward)
+	tp := proxy.transportFor(req.URL.Hostname())
+	rkey, rkeybuf := proxy.newIV(opt)
 	req.Header.Add(proxy.rkeyHeader, rkey)
 
+	if span != nil {
+		req.Header.Set(proxy.rkeyHeader+traceSuffix, proxy.Cipher.EncryptString(span.traceparent(), rkeybuf...))
+	}
+
+	if proxy.Policy.IsSet(PolicyCompress) && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		// the browser will decompress it for us
+		req.Header.Set(proxy.rkeyHeader+gzipSuffix, "1")
+	}
+
 	proxy.addToDummies(req)
 
 	if proxy.URLHeader != "" {
 		req.Header.Add(proxy.URLHeader, "http://"+proxy.genHost()+"/"+proxy.Cipher.EncryptCompress(req.URL.String(), rkeybuf...))
 		req.Host = proxy.Upstream
 		req.URL, _ = url.Parse("http://" + proxy.Upstream)
+	} else if enc := proxy.Cipher.EncryptCompress(req.URL.String(), rkeybuf...); !proxy.fitsURI(req.Method, enc) && proxy.collectsLongURLs() {
+		// re-generate the header with the same iv, telling the upstream where to find the URL
+		rkey, _ = proxy.Cipher.NewIV(opt|doLongURL, rkeybuf, proxy.UserAuth)
+		req.Header.Set(proxy.rkeyHeader, rkey)
+		proxy.splitURI(enc, req.Header.Set)
+
+		req.Host = proxy.genHost()
+		req.URL, _ = url.Parse("http://" + req.Host + "/" + proxy.Cipher.GenWord(true))
 	} else {
 		req.Host = proxy.genHost()
-		req.URL, _ = url.Parse("http://" + req.Host + "/" + proxy.Cipher.EncryptCompress(req.URL.String(), rkeybuf...))
+		req.URL, _ = url.Parse("http://" + req.Host + "/" + enc)
+	}
+
+	if tp.Dial != nil {
+		// tp dials the upstream itself, so the URL doesn't go on the wire but keys the idle streams,
+		// a random host would leave every stream idle for good after one request
+		req.URL.Host = proxy.Upstream
 	}
 
 	if proxy.Policy.IsSet(PolicyManInTheMiddle) && proxy.Connect2Auth != "" {
@@ -140,10 +165,66 @@ func (proxy *ProxyClient) encryptAndTransport(req *http.Request) (*http.Response
 
 	req.Body = proxy.Cipher.IO.NewReadCloser(req.Body, rkeybuf)
 	// logg.D(req.Header)
-	resp, err := proxy.tp.RoundTrip(req)
+	resp, err := tp.RoundTrip(req)
+	if resp != nil && resp.Header.Get(proxy.rkeyHeader+longURLSuffix) != "" {
+		atomic.StoreUint32(&proxy.longURLs, 1)
+		resp.Header.Del(proxy.rkeyHeader + longURLSuffix)
+	}
 	return resp, rkeybuf, err
 }
 
+// collectsLongURLs tells whether the upstream has advertised collecting long URLs from headers, until then
+// URLs go in the request line however long they are, upstreams too old would take the headers for garbage
+func (proxy *ProxyClient) collectsLongURLs() bool {
+	return atomic.LoadUint32(&proxy.longURLs) == 1
+}
+
+// fitsURI tells whether enc can go in the request line of method: the line must be within MaxRequestLine
+// and the URI must be left alone by intermediaries normalizing paths, see validURI
+func (proxy *ProxyClient) fitsURI(method, enc string) bool {
+	max := proxy.MaxRequestLine
+	if max <= 0 {
+		max = maxRequestLine
+	} else if max < minRequestLine {
+		max = minRequestLine
+	}
+
+	// GET /enc HTTP/1.1
+	return len(method)+len(" /")+len(enc)+len(" HTTP/1.1") <= max && validURI(enc)
+}
+
+// validURI tells whether "/"+enc is a path no intermediary would rewrite or reject, the alphabet of
+// EncryptCompress has '.' and '/', which may form empty or dot segments like "//" and "/../"
+func validURI(enc string) bool {
+	segs := strings.Split(enc, "/")
+	for i, seg := range segs {
+		if seg == "." || seg == ".." || (seg == "" && i < len(segs)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitURI carries enc in the headers collected by longURL instead of the URI
+func (proxy *ProxyClient) splitURI(enc string, set func(k, v string)) {
+	for i := 0; len(enc) > 0; i++ {
+		n := longURLChunk
+		if n > len(enc) {
+			n = len(enc)
+		}
+
+		set(proxy.rkeyHeader+"-"+strconv.Itoa(i), enc[:n])
+		enc = enc[n:]
+	}
+}
+
+// isLoopback tells whether the host of addr is a loopback address or localhost
+func isLoopback(addr string) bool {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() || host == "localhost"
+}
+
 func stripURI(uri string) string {
 	if len(uri) < 1 {
 		return uri
@@ -163,9 +244,31 @@ func stripURI(uri string) string {
 	return uri
 }
 
-func (proxy *ProxyUpstream) decryptRequest(req *http.Request, rkeybuf []byte) bool {
+// longURL collects the encrypted URL split by the client into headers named after the rkey header
+func (proxy *ProxyUpstream) longURL(req *http.Request, header string) string {
+	parts := []string{}
+	for i := 0; ; i++ {
+		k := header + "-" + strconv.Itoa(i)
+		p := req.Header.Get(k)
+		if p == "" {
+			break
+		}
+
+		parts = append(parts, p)
+		req.Header.Del(k)
+	}
+
+	return strings.Join(parts, "")
+}
+
+func (proxy *ProxyUpstream) decryptRequest(req *http.Request, k wireKey, options Options, rkeybuf []byte) bool {
+	uri := stripURI(req.RequestURI)
+	if options.IsSet(doLongURL) {
+		uri = proxy.longURL(req, k.header)
+	}
+
 	var err error
-	req.URL, err = url.Parse(proxy.Cipher.DecryptDecompress(stripURI(req.RequestURI), rkeybuf...))
+	req.URL, err = url.Parse(k.DecryptDecompress(uri, rkeybuf...))
 	if err != nil {
 		logg.E(err)
 		return false
@@ -175,17 +278,17 @@ func (proxy *ProxyUpstream) decryptRequest(req *http.Request, rkeybuf []byte) bo
 
 	cookies := make([]string, 0, len(req.Cookies()))
 	for _, c := range req.Cookies() {
-		c.Value = proxy.Cipher.DecryptString(c.Value, rkeybuf...)
+		c.Value = k.DecryptString(c.Value, rkeybuf...)
 		cookies = append(cookies, c.String())
 	}
 	req.Header.Set("Cookie", strings.Join(cookies, ";"))
 
 	if origin := req.Header.Get("Origin"); len(origin) > 4 {
-		req.Header.Set("Origin", proxy.DecryptString(origin[:len(origin)-4], rkeybuf...))
+		req.Header.Set("Origin", k.DecryptString(origin[:len(origin)-4], rkeybuf...))
 	}
 
 	if referer := req.Header.Get("Referer"); referer != "" {
-		req.Header.Set("Referer", proxy.DecryptString(referer, rkeybuf...))
+		req.Header.Set("Referer", k.DecryptString(referer, rkeybuf...))
 	}
 
 	for k := range req.Header {
@@ -200,11 +303,11 @@ func (proxy *ProxyUpstream) decryptRequest(req *http.Request, rkeybuf []byte) bo
 		}
 	}
 
-	req.Body = proxy.Cipher.IO.NewReadCloser(req.Body, rkeybuf)
+	req.Body = &IOReadCloserCipher{src: req.Body, key: rkeybuf, ctr: newCipherStream(k.Block, rkeybuf)}
 	return true
 }
 
-func copyHeaders(dst, src http.Header, gc *Cipher, enc bool, rkeybuf []byte) {
+func copyHeaders(dst, src http.Header, gc *codec.Codec, enc bool, rkeybuf []byte) {
 	for k := range dst {
 		dst.Del(k)
 	}
@@ -255,8 +358,8 @@ func copyHeaders(dst, src http.Header, gc *Cipher, enc bool, rkeybuf []byte) {
 		// some http proxies or middlewares will combine multiple Set-Cookie headers into one
 		// but some browsers do not support this behavior
 		// here we just do the combination in advance and split them when decrypting
-		dst.Add("Set-Cookie", gc.genWord(true)+"="+
-			gc.EncryptCompress(strings.Join(setcookies, "\n"), rkeybuf...)+"; Domain="+gc.genWord(true)+".com; HttpOnly")
+		dst.Add("Set-Cookie", gc.GenWord(true)+"="+
+			gc.EncryptCompress(strings.Join(setcookies, "\n"), rkeybuf...)+"; Domain="+gc.GenWord(true)+".com; HttpOnly")
 	}
 }
 
@@ -287,17 +390,39 @@ func tryClose(b io.ReadCloser) {
 func splitHostPort(host string) (string, string) {
 	if idx := strings.LastIndex(host, ":"); idx > 0 {
 		idx2 := strings.LastIndex(host, "]")
-		if idx2 < idx {
+		if idx2 < idx && (idx2 > -1 || strings.Count(host, ":") == 1) {
 			return strings.ToLower(host[:idx]), host[idx:]
 		}
 
+		if idx2 == -1 {
+			// bare ipv6 literal without port, bracket it so it looks the same as the others
+			return "[" + strings.ToLower(host) + "]", ""
+		}
+
 		// ipv6 without port
 	}
 
 	return strings.ToLower(host), ""
 }
 
-func isTrustedToken(mark string, rkeybuf []byte) int {
+// hostWithPort appends defaultPort to host if it has none, IPv6 literals will be bracketed
+func hostWithPort(host string, defaultPort string) string {
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(h, p)
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// unlockShaped reports whether r may carry an unlock token: a bare GET of / with the key header,
+// so other requests from blocked addresses can be rejected without decrypting anything
+func unlockShaped(r *http.Request, rkey string) bool {
+	return rkey != "" && r.Method == "GET" && r.URL.Path == "/" && r.URL.RawQuery == "" && r.ContentLength <= 0
+}
+
+// isTrustedToken accepts tokens generated less than 10 seconds ago, tol widens the window on both sides
+// so tokens from clients whose clocks are slightly off won't be rejected
+func isTrustedToken(mark string, rkeybuf []byte, tol time.Duration) int {
 	logg.D("test token: ", rkeybuf)
 
 	if string(rkeybuf[:len(mark)]) != mark {
@@ -305,7 +430,7 @@ func isTrustedToken(mark string, rkeybuf []byte) int {
 	}
 
 	sent := int64(binary.BigEndian.Uint32(rkeybuf[12:]))
-	if time.Now().Unix()-sent >= 10 {
+	if d, t := time.Now().Unix()-sent, int64(tol/time.Second); d >= 10+t || d < -t {
 		// token becomes invalid after 10 seconds
 		return -1
 	}
@@ -323,36 +448,6 @@ func genTrustedToken(mark, auth string, gc *Cipher) string {
 	return k
 }
 
-func base32Encode(buf []byte, alpha bool) string {
-	var str string
-	if alpha {
-		str = base32Encoding.EncodeToString(buf)
-	} else {
-		str = base32Encoding2.EncodeToString(buf)
-	}
-	idx := strings.Index(str, "=")
-
-	if idx == -1 {
-		return str
-	}
-
-	return str[:idx]
-}
-
-func base32Decode(text string, alpha bool) ([]byte, error) {
-	const paddings = "======"
-
-	if m := len(text) % 8; m > 1 {
-		text = text + paddings[:8-m]
-	}
-
-	if alpha {
-		return base32Encoding.DecodeString(text)
-	}
-
-	return base32Encoding2.DecodeString(text)
-}
-
 func readUntil(r io.Reader, eoh string) ([]byte, error) {
 	buf, respbuf := make([]byte, 1), &bytes.Buffer{}
 	eidx, found := 0, false
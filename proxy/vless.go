@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// VLESS lets the client use a V2Ray/Xray VLESS inbound as its upstream instead of a goflyway server,
+// the local features like rules, PAC and SOCKS are kept. VLESS doesn't encrypt, the upstream should
+// be reached by the tls transport. Streams the goflyway protocol is needed for, like UDP relays,
+// reverse tunnels and DNS lookups through the upstream, are unavailable
+type VLESS struct {
+	ID          [16]byte // the UUID of the user
+	TLS         bool     // security=tls of the share link, the upstream is reached by the tls transport
+	SNI         string   // sni of the share link
+	Fingerprint string   // fp of the share link, see Fingerprints
+}
+
+const (
+	vlessVersion = 0
+	vlessTCP     = 1
+	vlessIPv4    = 1
+	vlessDomain  = 2
+	vlessIPv6    = 3
+)
+
+var errVLESSDNS = errors.New("VLESS upstreams don't resolve names")
+
+var errVLESSUDP = errors.New("UDP relays are unavailable through VLESS")
+
+// vlessParams are the values of share link parameters VLESS supports, empty means any value
+var vlessParams = map[string][]string{
+	"security":   {"none", "tls"},
+	"type":       {"tcp"},
+	"encryption": {"none"},
+	"headerType": {"none"},
+	"flow":       {""},
+	"sni":        nil,
+	"fp":         nil,
+}
+
+// ParseVLESS parses vless://uuid@host:port?params#name, unsupported params like security=reality,
+// type=ws or flow are rejected instead of silently connecting without them
+func ParseVLESS(s string) (string, *VLESS, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if u.Scheme != "vless" || u.User == nil || u.Port() == "" {
+		return "", nil, errors.New("expect vless://uuid@host:port")
+	}
+
+	id, err := hex.DecodeString(strings.Replace(u.User.Username(), "-", "", -1))
+	if err != nil || len(id) != 16 {
+		return "", nil, errors.New("invalid UUID: " + u.User.Username())
+	}
+
+	q := u.Query()
+	for key := range q {
+		values, ok := vlessParams[key]
+		if !ok {
+			return "", nil, errors.New("unsupported parameter: " + key)
+		}
+
+		if value := q.Get(key); values != nil && !oneOf(value, values) {
+			return "", nil, errors.New("unsupported " + key + "=" + value + ", expect one of: " + strings.Join(values, ", "))
+		}
+	}
+
+	v := &VLESS{TLS: q.Get("security") == "tls", SNI: q.Get("sni"), Fingerprint: q.Get("fp")}
+	if !v.TLS && (v.SNI != "" || v.Fingerprint != "") {
+		return "", nil, errors.New("sni and fp need security=tls")
+	}
+
+	copy(v.ID[:], id)
+	return u.Host, v, nil
+}
+
+func oneOf(s string, l []string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// header is the request header of a TCP stream to host
+func (v *VLESS) header(host string) ([]byte, error) {
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := append([]byte{vlessVersion}, v.ID[:]...)
+	buf = append(buf, 0, vlessTCP, byte(port>>8), byte(port))
+
+	if ip := net.ParseIP(h); ip == nil {
+		if len(h) > 255 {
+			return nil, errors.New("host name too long: " + h)
+		}
+		buf = append(append(buf, vlessDomain, byte(len(h))), h...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(append(buf, vlessIPv4), ip4...)
+	} else {
+		buf = append(append(buf, vlessIPv6), ip...)
+	}
+	return buf, nil
+}
+
+// vlessConn strips the response header, which comes with the first bytes of the destination
+type vlessConn struct {
+	net.Conn
+	read bool
+}
+
+func (c *vlessConn) Read(p []byte) (int, error) {
+	if !c.read {
+		c.read = true
+
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, hdr); err != nil {
+			return 0, err
+		}
+
+		if hdr[0] != vlessVersion {
+			return 0, errors.New("vless: unexpected response version " + strconv.Itoa(int(hdr[0])))
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, c.Conn, int64(hdr[1])); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+// dialVLESS opens a stream to host through the VLESS upstream, which is returned too
+func (proxy *ProxyClient) dialVLESS(host string) (net.Conn, string, error) {
+	hdr, err := proxy.VLESS.header(host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, up, err := proxy.dialFor(host)
+	if err != nil {
+		return nil, up, unreachableError{err}
+	}
+
+	if _, err := conn.Write(hdr); err != nil {
+		conn.Close()
+		return nil, up, unreachableError{err}
+	}
+	return &vlessConn{Conn: conn}, up, nil
+}
+
+// bridgeVLESS is dialUpstreamAndBridge through the VLESS upstream
+func (proxy *ProxyClient) bridgeVLESS(downstreamConn net.Conn, host string, resp []byte, extra byte, span *Span) net.Conn {
+	if extra&doUDPRelay != 0 {
+		logg.E(host, ": ", errVLESSUDP)
+		span.end(errVLESSUDP)
+		replyFailure(downstreamConn, resp, CloseUnsupported)
+		return nil
+	}
+
+	// VLESS has no handshake to wait for, the header is written by the dial
+	ds := span.child("dial", time.Now())
+	upstreamConn, up, err := proxy.dialVLESS(host)
+	ds.set("upstream", up)
+	ds.end(err)
+	if err != nil {
+		if proxy.softFail(host, err) {
+			proxy.dialHostAndBridge(downstreamConn, host, resp, span)
+			return nil
+		}
+
+		logg.E(host, ": ", err)
+		span.end(err)
+		replyFailure(downstreamConn, resp, CloseUnknown)
+		return nil
+	}
+
+	if resp != nil {
+		downstreamConn.Write(resp)
+	}
+
+	downstreamConn = proxy.Cipher.IO.Dump.Wrap(downstreamConn, host)
+	go proxy.Cipher.IO.Bridge(downstreamConn, upstreamConn, nil, IOConfig{Meter: proxy.bandwidth.meter(up), Span: span})
+	return upstreamConn
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+// Watchdog samples goroutines, heap and fds of the process, when any of them exceeds its limit,
+// new connections are shed and profiles are dumped into ProfileDir until usage drops below 90% of the limits
+type Watchdog struct {
+	MaxGoroutines int
+	MaxHeap       uint64 // bytes
+	MaxFDs        int
+	ProfileDir    string // empty means no dumps
+
+	goroutines int64
+	heap       uint64
+	fds        int64
+	shedding   int32
+}
+
+func (wd *Watchdog) Start(interval time.Duration) {
+	for range time.Tick(interval) {
+		wd.check()
+	}
+}
+
+func (wd *Watchdog) check() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	g, fds := runtime.NumGoroutine(), countFDs()
+	atomic.StoreInt64(&wd.goroutines, int64(g))
+	atomic.StoreUint64(&wd.heap, ms.HeapAlloc)
+	atomic.StoreInt64(&wd.fds, int64(fds))
+
+	over := func(v, max uint64) bool { return max > 0 && v > max }
+	under := func(v, max uint64) bool { return max == 0 || v < max*9/10 }
+
+	fdv := uint64(0)
+	if fds > 0 {
+		fdv = uint64(fds)
+	}
+
+	if over(uint64(g), uint64(wd.MaxGoroutines)) || over(ms.HeapAlloc, wd.MaxHeap) || over(fdv, uint64(wd.MaxFDs)) {
+		if atomic.CompareAndSwapInt32(&wd.shedding, 0, 1) {
+			logg.W("watchdog: ", g, " goroutines, ", ms.HeapAlloc>>20, "M heap, ", fds, " fds, start shedding new connections")
+			wd.dump()
+		}
+	} else if under(uint64(g), uint64(wd.MaxGoroutines)) && under(ms.HeapAlloc, wd.MaxHeap) && under(fdv, uint64(wd.MaxFDs)) {
+		if atomic.CompareAndSwapInt32(&wd.shedding, 1, 0) {
+			logg.L("watchdog: back to normal, ", g, " goroutines, ", ms.HeapAlloc>>20, "M heap, ", fds, " fds")
+		}
+	}
+}
+
+func (wd *Watchdog) dump() {
+	if wd.ProfileDir == "" {
+		return
+	}
+
+	ts := time.Now().Format("20060102-150405")
+	for _, name := range []string{"goroutine", "heap"} {
+		f, err := os.Create(filepath.Join(wd.ProfileDir, name+"-"+ts+".pprof"))
+		if err != nil {
+			logg.E("watchdog: ", err)
+			return
+		}
+
+		pprof.Lookup(name).WriteTo(f, 0)
+		f.Close()
+	}
+}
+
+// Shedding reports whether new connections should be refused, it is always false for a nil Watchdog
+func (wd *Watchdog) Shedding() bool {
+	return wd != nil && atomic.LoadInt32(&wd.shedding) == 1
+}
+
+// Expose writes the last samples in the Prometheus text format
+func (wd *Watchdog) Expose(w io.Writer) {
+	if wd == nil {
+		return
+	}
+
+	gauge := func(name, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, v)
+	}
+
+	gauge("goflyway_goroutines", "Number of goroutines.", atomic.LoadInt64(&wd.goroutines))
+	gauge("goflyway_heap_bytes", "Bytes of allocated heap objects.", atomic.LoadUint64(&wd.heap))
+	gauge("goflyway_open_fds", "Number of open file descriptors, -1 if unknown.", atomic.LoadInt64(&wd.fds))
+	gauge("goflyway_shedding", "Whether new connections are being shed.", atomic.LoadInt32(&wd.shedding))
+}
+
+// countFDs returns -1 on platforms without /proc
+func countFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/pkg/logg"
+)
+
+const (
+	// the header carrying the destination when the handshake goes to ClientConfig.WSPath, encrypted like the URI
+	wsHostSuffix = "-H"
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxPayload = 4 * 1024 * 1024
+)
+
+var errWSAccept = errors.New("invalid Sec-WebSocket-Accept, the upstream or the CDN doesn't speak WebSocket")
+
+// newWSKey returns a Sec-WebSocket-Key, the base64 of 16 random bytes
+func newWSKey() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// wsAccept returns the Sec-WebSocket-Accept of key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsWrite and wsRead implement the framing of RFC6455, so the tunnel survives CDNs and proxies
+// terminating WebSocket connections, which may split, merge or ping them along the way:
+// data frames are sent as single binary ones, read frames of any data opcode are concatenated,
+// pings are answered, and a close frame ends the stream like the TCP connection closing
+//
+//	0                   1                   2                   3
+//	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-------+-+-------------+-------------------------------+
+//	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+//	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+//	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+//	| |1|2|3|       |K|             |                               |
+//	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+//	|     Extended payload length continued, if payload len == 127  |
+//	+ - - - - - - - - - - - - - - - +-------------------------------+
+//	|                               |Masking-key, if MASK set to 1  |
+//	+-------------------------------+-------------------------------+
+//	| Masking-key (continued)       |          Payload Data         |
+//	+-------------------------------- - - - - - - - - - - - - - - - +
+//	:                     Payload Data continued ...                :
+//	+ - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
+//	|                     Payload Data continued ...                |
+//	+---------------------------------------------------------------+
+func wsWrite(dst io.Writer, payload []byte, mask bool) (n int, err error) {
+	return wsFrame(dst, 2, payload, mask)
+}
+
+// wsFrame writes a final frame in a single Write, so pongs written by the reading side won't interleave with it,
+// clients must mask their frames with a random key
+func wsFrame(dst io.Writer, opcode byte, payload []byte, mask bool) (n int, err error) {
+	buf := make([]byte, 2, 14+len(payload))
+	buf[0] = 0x80 | opcode
+
+	switch ln := len(payload); {
+	case ln < 126:
+		buf[1] = byte(ln)
+	case ln <= 65535:
+		buf[1] = 126
+		buf = append(buf, 0, 0)
+		binary.BigEndian.PutUint16(buf[2:], uint16(ln))
+	default:
+		buf[1] = 127
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[2:], uint64(ln))
+	}
+
+	if mask {
+		buf[1] |= 0x80
+		key := make([]byte, 4)
+		rand.Read(key)
+		buf = append(buf, key...)
+	}
+
+	hdr := len(buf)
+	buf = append(buf, payload...)
+	if mask {
+		// the payload of the caller is left as is
+		key := buf[hdr-4 : hdr]
+		for i := range buf[hdr:] {
+			buf[hdr+i] ^= key[i%4]
+		}
+	}
+
+	if n, err = dst.Write(buf); n > hdr {
+		n -= hdr
+	} else {
+		n = 0
+	}
+	return
+}
+
+// wsRead reads the payload of the next data frame, pongs will be masked if mask is set
+func wsRead(src io.Reader, mask bool) (payload []byte, n int, err error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(src, buf[:2]); err != nil {
+			return nil, 0, err
+		}
+
+		opcode, masked, ln := buf[0]&0x0f, buf[1]&0x80 > 0, uint64(buf[1]&0x7f)
+		switch ln {
+		case 126:
+			if _, err = io.ReadFull(src, buf[:2]); err != nil {
+				return nil, 0, err
+			}
+			ln = uint64(binary.BigEndian.Uint16(buf))
+		case 127:
+			if _, err = io.ReadFull(src, buf); err != nil {
+				return nil, 0, err
+			}
+			ln = binary.BigEndian.Uint64(buf)
+		}
+
+		if ln > wsMaxPayload {
+			return nil, 0, errors.New("websocket frame too large")
+		}
+
+		if masked {
+			if _, err = io.ReadFull(src, buf[:4]); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		payload = make([]byte, ln)
+		if _, err = io.ReadFull(src, payload); err != nil {
+			return nil, 0, err
+		}
+
+		if masked {
+			for i := range payload {
+				payload[i] ^= buf[i%4]
+			}
+		}
+
+		switch opcode {
+		case 0, 1, 2: // continuation, text and binary
+			return payload, len(payload), nil
+		case 8:
+			return nil, 0, io.EOF
+		case 9:
+			if w, ok := src.(io.Writer); ok {
+				if _, err = wsFrame(w, 10, payload, mask); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+		// pongs and unknown opcodes are ignored
+	}
+}
+
+func init() {
+	RegisterTransport("ws", &WSTransport{Path: "/ws"})
+}
+
+// WSTransport carries the connections to the upstream in WebSocket binary frames, so CDNs passing
+// only WebSocket can front the upstream. Unlike the tunnels of PolicyWebSocket, the whole tcpmux
+// carrier goes in one WebSocket connection, and the server takes it over on its HTTP listener
+type WSTransport struct {
+	Path string // of the handshakes, it should differ from the ClientConfig.WSPath of clients
+}
+
+// Tune returns a copy of t whose handshakes go to opts.Params if any
+func (t *WSTransport) Tune(opts TransportOptions) (Transport, error) {
+	if opts.Fingerprint != "" || len(opts.ECH) > 0 {
+		return nil, errors.New("ws: no TLS ClientHello to mimic or encrypt")
+	}
+
+	if opts.Params == "" {
+		return t, nil
+	}
+	return &WSTransport{Path: "/" + strings.TrimPrefix(opts.Params, "/")}, nil
+}
+
+// Dial dials the upstream and handshakes
+func (t *WSTransport) Dial(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeoutDial)
+	if err != nil {
+		return nil, err
+	}
+
+	key := newWSKey()
+	conn.SetDeadline(time.Now().Add(timeoutOp))
+	if _, err := conn.Write([]byte("GET " + t.Path + " HTTP/1.1\r\nHost: " + address + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errWSAccept
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, r: r, mask: true}, nil
+}
+
+// Upgrade takes over WebSocket handshakes to t.Path
+func (t *WSTransport) Upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, bool) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.URL.Path != t.Path || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		return nil, false
+	}
+
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking unsupported", http.StatusInternalServerError)
+		return nil, true
+	}
+
+	conn, rw, err := hij.Hijack()
+	if err != nil {
+		logg.E("hijacking: ", err)
+		return nil, true
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, true
+	}
+	return &wsConn{Conn: conn, r: rw.Reader}, true
+}
+
+// Listen listens on the TCP port of address on its own, the server rather takes ws over on its HTTP listener
+func (t *WSTransport) Listen(address string) (net.Listener, error) {
+	ln, err := listenTCP(address)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := newConnListener(ln.Addr())
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := t.Upgrade(w, r); !ok {
+			http.NotFound(w, r)
+		} else if conn != nil && !cl.push(conn) {
+			conn.Close()
+		}
+	})}
+	cl.closer = srv.Close
+
+	go func() {
+		srv.Serve(ln)
+		cl.Close()
+	}()
+	return cl, nil
+}
+
+// wsConn is a connection of the ws transport, clients mask their frames
+type wsConn struct {
+	net.Conn
+	r    *bufio.Reader
+	mask bool
+	left []byte // of the last frame read
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.left) == 0 {
+		payload, _, err := wsRead(struct {
+			io.Reader
+			io.Writer
+		}{c.r, c.Conn}, c.mask)
+		if err != nil {
+			return 0, err
+		}
+		c.left = payload
+	}
+
+	n := copy(p, c.left)
+	c.left = c.left[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		frame := p
+		if len(frame) > wsMaxPayload {
+			frame = frame[:wsMaxPayload]
+		}
+
+		n, err := wsWrite(c.Conn, frame, c.mask)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(frame):]
+	}
+	return written, nil
+}
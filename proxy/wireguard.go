@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coyove/goflyway/pkg/logg"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const wgDefaultMTU = 1420
+
+// WireGuard is a WireGuard tunnel in the process with its own TCP/IP stack, the server dials destinations
+// through it so they see the exit IP of the peer instead of the server's, without routing set up on the OS.
+// UDP relays can't go through it and are refused
+type WireGuard struct {
+	Address []netip.Addr // of the interface
+	DNS     []netip.Addr // names are looked up through the tunnel by them, or by the resolver of the server if empty
+	MTU     int
+
+	privateKey string // hex, like the keys and peers of the IPC config of wireguard-go
+	listenPort int
+	peers      []wgPeer
+
+	once sync.Once
+	dev  *device.Device
+	tnet *netstack.Net
+	err  error
+}
+
+type wgPeer struct {
+	publicKey    string
+	presharedKey string
+	endpoint     string // host:port, resolved when the tunnel goes up
+	allowedIPs   []string
+	keepalive    int
+}
+
+// LoadWireGuard reads a config file of wg-quick, the tunnel goes up on Up or the first dial.
+// Of [Interface] PrivateKey, Address, DNS, MTU and ListenPort are used, of each [Peer] PublicKey,
+// PresharedKey, Endpoint, AllowedIPs and PersistentKeepalive
+func LoadWireGuard(path string) (*WireGuard, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w, section := &WireGuard{MTU: wgDefaultMTU}, ""
+	var peer *wgPeer
+	for i, line := range strings.Split(string(buf), "\n") {
+		if idx := strings.Index(line, "#"); idx > -1 {
+			line = line[:idx]
+		}
+
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if section = strings.ToLower(line[1 : len(line)-1]); section == "peer" {
+				w.peers = append(w.peers, wgPeer{})
+				peer = &w.peers[len(w.peers)-1]
+			}
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("line %d: expect key = value", i+1)
+		}
+
+		key, value := strings.ToLower(strings.TrimSpace(line[:idx])), strings.TrimSpace(line[idx+1:])
+		if err := w.set(section, peer, key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", i+1, key, err)
+		}
+	}
+
+	if w.privateKey == "" || len(w.Address) == 0 {
+		return nil, errors.New("[Interface] needs PrivateKey and Address")
+	}
+
+	if len(w.peers) == 0 {
+		return nil, errors.New("no [Peer]")
+	}
+
+	for _, p := range w.peers {
+		if p.publicKey == "" || p.endpoint == "" {
+			return nil, errors.New("[Peer] needs PublicKey and Endpoint")
+		}
+	}
+	return w, nil
+}
+
+func (w *WireGuard) set(section string, peer *wgPeer, key, value string) (err error) {
+	list := func() []string {
+		var ret []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				ret = append(ret, v)
+			}
+		}
+		return ret
+	}
+
+	switch section + "." + key {
+	case "interface.privatekey":
+		w.privateKey, err = wgKey(value)
+	case "interface.address":
+		for _, a := range list() {
+			if idx := strings.Index(a, "/"); idx > -1 {
+				a = a[:idx] // the tunnel has no routes, only the address matters
+			}
+			ip, err := netip.ParseAddr(a)
+			if err != nil {
+				return err
+			}
+			w.Address = append(w.Address, ip)
+		}
+	case "interface.dns":
+		for _, a := range list() {
+			ip, err := netip.ParseAddr(a)
+			if err != nil {
+				return errors.New("only IPs are supported: " + a)
+			}
+			w.DNS = append(w.DNS, ip)
+		}
+	case "interface.mtu":
+		w.MTU, err = strconv.Atoi(value)
+	case "interface.listenport":
+		w.listenPort, err = strconv.Atoi(value)
+	case "peer.publickey":
+		peer.publicKey, err = wgKey(value)
+	case "peer.presharedkey":
+		peer.presharedKey, err = wgKey(value)
+	case "peer.endpoint":
+		_, _, err = net.SplitHostPort(value)
+		peer.endpoint = value
+	case "peer.allowedips":
+		for _, a := range list() {
+			if _, err := netip.ParsePrefix(a); err != nil {
+				return err
+			}
+		}
+		peer.allowedIPs = list()
+	case "peer.persistentkeepalive":
+		peer.keepalive, err = strconv.Atoi(value)
+	default:
+		// like Table and PostUp of wg-quick, which are about the OS
+		logg.D("wireguard: ", section, ".", key, " ignored")
+	}
+	return
+}
+
+// wgKey converts a base64 key of the config file into the hex of the IPC config
+func wgKey(s string) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(buf) != 32 {
+		return "", errors.New("invalid key")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ipc returns the IPC config of wireguard-go, peer endpoints are resolved by resolve
+func (w *WireGuard) ipc(resolve func(string) (string, error)) (string, error) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "private_key=%s\n", w.privateKey)
+	if w.listenPort > 0 {
+		fmt.Fprintf(b, "listen_port=%d\n", w.listenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+
+	for _, p := range w.peers {
+		endpoint, err := resolve(p.endpoint)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(b, "public_key=%s\nendpoint=%s\n", p.publicKey, endpoint)
+		if p.presharedKey != "" {
+			fmt.Fprintf(b, "preshared_key=%s\n", p.presharedKey)
+		}
+		if p.keepalive > 0 {
+			fmt.Fprintf(b, "persistent_keepalive_interval=%d\n", p.keepalive)
+		}
+
+		allowed := p.allowedIPs
+		if len(allowed) == 0 {
+			allowed = []string{"0.0.0.0/0", "::/0"}
+		}
+		for _, a := range allowed {
+			fmt.Fprintf(b, "allowed_ip=%s\n", a)
+		}
+	}
+	return b.String(), nil
+}
+
+// Up brings the tunnel up, later calls return the error of the first one
+func (w *WireGuard) Up() error {
+	w.once.Do(func() {
+		cfg, err := w.ipc(func(endpoint string) (string, error) {
+			addr, err := net.ResolveUDPAddr("udp", endpoint)
+			if err != nil {
+				return "", err
+			}
+			return addr.String(), nil
+		})
+		if err != nil {
+			w.err = err
+			return
+		}
+
+		tun, tnet, err := netstack.CreateNetTUN(w.Address, w.DNS, w.MTU)
+		if err != nil {
+			w.err = err
+			return
+		}
+
+		dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "wireguard: "))
+		if err := dev.IpcSet(cfg); err != nil {
+			dev.Close()
+			w.err = err
+			return
+		}
+
+		if err := dev.Up(); err != nil {
+			dev.Close()
+			w.err = err
+			return
+		}
+
+		w.dev, w.tnet = dev, tnet
+	})
+	return w.err
+}
+
+// dial dials addr through the tunnel in ctx, names are looked up by resolver if the tunnel has no DNS
+func (w *WireGuard) dial(ctx context.Context, network, addr string, resolver *net.Resolver) (net.Conn, error) {
+	if err := w.Up(); err != nil {
+		return nil, err
+	}
+
+	if len(w.DNS) == 0 {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) == nil {
+			ips, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+
+			ip := w.pick(ips)
+			if ip == nil {
+				return nil, errors.New("wireguard: the interface has no address of the family of " + host)
+			}
+			addr = net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	return w.tnet.DialContext(ctx, familyNetwork(network, addr), addr)
+}
+
+// pick returns the first of ips of a family the interface has an address of, nil if there is none
+func (w *WireGuard) pick(ips []net.IPAddr) net.IP {
+	var v4, v6 bool
+	for _, a := range w.Address {
+		v4, v6 = v4 || a.Unmap().Is4(), v6 || !a.Unmap().Is4()
+	}
+
+	for _, ip := range ips {
+		if is4 := ip.IP.To4() != nil; (is4 && v4) || (!is4 && v6) {
+			return ip.IP
+		}
+	}
+	return nil
+}